@@ -1,7 +1,9 @@
 package beaconChain
 
 import (
+	"context"
 	"go-w3chain/core"
+	"go-w3chain/eth_chain"
 	"go-w3chain/log"
 	"sync"
 	"time"
@@ -24,18 +26,29 @@ type BeaconChain struct {
 	shardNum   int
 	messageHub core.MessageHub
 
-	/* key是分片ID，value是该分片每个高度区块的信标 */
-	tbs  map[int][]*ConfirmedTB
+	/* key是分片ID，value是该分片每个高度区块的信标，与合约中的 tbs 相同 */
+	tbs  map[int]map[uint64]*ConfirmedTB
 	lock sync.Mutex
-	/* 已提交到信标链但还未被信标链打包 */
-	tbs_new  map[int][]*core.SignedTB
+	/* 已提交到模拟信标链但还未被打包的交易，按提交顺序执行 */
+	txs_new  []*simulationTx
 	lock_new sync.Mutex
-	height   uint64
-	stopCh   chan struct{}
-	wg       sync.WaitGroup
+	/* 批量模式下等待合并为一笔 addTBs 交易的信标，batch_nodeID 是最近提交信标的节点，用它的账户发送交易 */
+	batch        []*core.SignedTB
+	batch_nodeID uint32
+	lock_batch   sync.Mutex
+	height       uint64
+	ctx          context.Context // 取消时停止出块和事件订阅
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
 
-	// geth 私链最新高度的区块打包的信标
-	geth_tbs_new map[uint64]map[uint32][]*core.TimeBeacon
+	// geth 私链上还未达到确认数的 addTB 日志
+	geth_pending map[ethLogKey]*eth_chain.Event
+	// 已推送的 addTB 日志，用于撤回被回滚的信标
+	geth_released map[ethLogKey]*eth_chain.Event
+	geth_reorged  int
+	// 本进程提交的信标，信标被回滚时据此重新提交，信标再次确认并超出回滚窗口后删除
+	geth_submitted map[tbKey]*gethSubmission
+	lock_submitted sync.Mutex
 
 	contract *Contract
 	addrs    [][]common.Address
@@ -43,25 +56,35 @@ type BeaconChain struct {
 	contractAddr common.Address
 	contractAbi  *abi.ABI
 
-	tbBlocks map[uint64]*TBBlock
+	tbBlocks   map[uint64]*TBBlock
+	headHeight uint64 // tbBlocks 中最高的区块高度
+
+	store *tbStore // 以太坊模式下持久化的信标链视图，未设置 DataDir 时为空
+
+	// 以太坊模式下合约日志的订阅，收到合约地址后创建
+	events *eth_chain.Subscription
 }
 
 /** 新建一条信标链
  * required 表示一个信标需要收到的多签名最小数量
+ * ctx 取消或调用 Close 时信标链停止出块
  */
-func NewTBChain(cfg *core.BeaconChainConfig, shardNum int) *BeaconChain {
+func NewTBChain(ctx context.Context, cfg *core.BeaconChainConfig, shardNum int) *BeaconChain {
+	ctx, cancel := context.WithCancel(ctx)
 	tbChain := &BeaconChain{
-		cfg:          cfg,
-		mode:         cfg.Mode,
-		shardNum:     shardNum,
-		tbs:          make(map[int][]*ConfirmedTB),
-		tbs_new:      make(map[int][]*core.SignedTB),
-		geth_tbs_new: make(map[uint64]map[uint32][]*core.TimeBeacon),
-		height:       0,
-		stopCh:       make(chan struct{}),
-		contract:     NewContract(shardNum, cfg.MultiSignRequiredNum),
-		addrs:        make([][]common.Address, shardNum),
-		tbBlocks:     make(map[uint64]*TBBlock),
+		cfg:            cfg,
+		mode:           cfg.Mode,
+		shardNum:       shardNum,
+		tbs:            make(map[int]map[uint64]*ConfirmedTB),
+		geth_pending:   make(map[ethLogKey]*eth_chain.Event),
+		geth_released:  make(map[ethLogKey]*eth_chain.Event),
+		geth_submitted: make(map[tbKey]*gethSubmission),
+		height:         0,
+		ctx:            ctx,
+		cancel:         cancel,
+		contract:       NewContract(shardNum, cfg.MultiSignRequiredNum),
+		addrs:          make([][]common.Address, shardNum),
+		tbBlocks:       make(map[uint64]*TBBlock),
 	}
 	log.Info("NewTBChain")
 	tbChain.wg.Add(1)
@@ -69,17 +92,41 @@ func NewTBChain(cfg *core.BeaconChainConfig, shardNum int) *BeaconChain {
 	return tbChain
 }
 
+/* 停止出块和事件订阅，等待正在生成的区块推送完成 */
 func (tbChain *BeaconChain) Close() {
-	close(tbChain.stopCh)
+	tbChain.cancel()
 	tbChain.wg.Wait()
+	if tbChain.store != nil {
+		if err := tbChain.store.close(); err != nil {
+			log.Warn("close tbchain store fail", "err", err)
+		}
+	}
 	log.Info("tbchain close")
 }
 
+/* 最近生成的信标链区块的高度，geth 模式下为 geth 私链的区块高度 */
+func (tbChain *BeaconChain) Height() uint64 {
+	tbChain.lock.Lock()
+	defer tbChain.lock.Unlock()
+	return tbChain.headHeight
+}
+
 func (tbChain *BeaconChain) SetMessageHub(hub core.MessageHub) {
 	tbChain.messageHub = hub
 }
 
 func (tbChain *BeaconChain) AddTimeBeacon(tb *core.SignedTB, nodeID uint32) {
+	if tbChain.mode != 0 && tb.Height > 0 {
+		tbChain.recordSubmission(tb.ShardID, tb.Height, &gethSubmission{tb: tb, nodeID: nodeID})
+	}
+	tbChain.submitTimeBeacon(tb, nodeID)
+}
+
+func (tbChain *BeaconChain) submitTimeBeacon(tb *core.SignedTB, nodeID uint32) {
+	if tbChain.cfg.TBSubmit == core.TBSubmitBatch && tb.Height > 0 {
+		tbChain.addTimeBeacon2Batch(tb, nodeID)
+		return
+	}
 	if tbChain.mode == 0 {
 		tbChain.AddTimeBeacon2SimulationChain(tb)
 	} else if tbChain.mode == 1 || tbChain.mode == 2 {
@@ -89,8 +136,84 @@ func (tbChain *BeaconChain) AddTimeBeacon(tb *core.SignedTB, nodeID uint32) {
 	}
 }
 
+/** 批量模式下先缓存信标，缓存达到 TBBatchSize 个或到了出块时间时合并为一笔 addTBs 交易
+ * 同一个出块间隔内不同分片、同一分片不同高度的信标都会被合并
+ */
+func (tbChain *BeaconChain) addTimeBeacon2Batch(tb *core.SignedTB, nodeID uint32) {
+	tbChain.lock_batch.Lock()
+	tbChain.batch = append(tbChain.batch, tb)
+	tbChain.batch_nodeID = nodeID
+	full := len(tbChain.batch) >= tbChain.batchSize()
+	tbChain.lock_batch.Unlock()
+	log.Debug("AddTimeBeacon2Batch", "shardID", tb.ShardID, "height", tb.Height)
+	if full {
+		tbChain.flushBatch()
+	}
+}
+
+func (tbChain *BeaconChain) batchSize() int {
+	if tbChain.cfg.TBBatchSize > 0 {
+		return tbChain.cfg.TBBatchSize
+	}
+	return core.DefaultTBBatchSize
+}
+
+/* 把缓存的信标作为一笔 addTBs 交易提交，缓存为空时不提交 */
+func (tbChain *BeaconChain) flushBatch() {
+	tbChain.lock_batch.Lock()
+	batch, nodeID := tbChain.batch, tbChain.batch_nodeID
+	tbChain.batch = nil
+	tbChain.lock_batch.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	if tbChain.mode == 0 {
+		tbChain.lock_new.Lock()
+		tbChain.txs_new = append(tbChain.txs_new, &simulationTx{batch: batch})
+		tbChain.lock_new.Unlock()
+		log.Debug("AddTimeBeacons", "count", len(batch))
+	} else if tbChain.mode == 1 || tbChain.mode == 2 {
+		tbChain.AddTimeBeacons2EthChain(batch, nodeID)
+	}
+}
+
+/** 累加器模式下委员会提交的默克尔根，合约验证根的多签名，模拟信标链还验证信标与根一致
+ * 验证通过后根覆盖的每个信标都被确认
+ */
+func (tbChain *BeaconChain) AddTimeBeaconRoot(root *core.SignedTBRoot, nodeID uint32) {
+	if tbChain.mode == 0 {
+		tbChain.lock_new.Lock()
+		defer tbChain.lock_new.Unlock()
+		tbChain.txs_new = append(tbChain.txs_new, &simulationTx{root: root})
+		log.Debug("AddTimeBeaconRoot", "shardID", root.ShardID, "start", root.StartHeight, "count", root.Count)
+	} else if tbChain.mode == 1 || tbChain.mode == 2 {
+		submission := &gethSubmission{root: root, nodeID: nodeID}
+		for height := root.StartHeight; height < root.StartHeight+root.Count; height++ {
+			tbChain.recordSubmission(root.ShardID, height, submission)
+		}
+		tbChain.AddTimeBeaconRoot2EthChain(root, nodeID)
+	} else {
+		log.Error("unknown beaconChain mode!", "mode", tbChain.mode)
+	}
+}
+
+/** 记录委员会的地址，booter 在创世时调用（vrfs 为空），委员会 leader 在重组后调用
+ * 模拟信标链在创世时直接记录地址，重组后的调整与信标一样在打包时执行
+ */
 func (tbChain *BeaconChain) SetAddrs(addrs []common.Address, vrfs [][]byte, seedHeight uint64, comID uint32, nodeID uint32) {
-	if tbChain.mode == 1 || tbChain.mode == 2 {
+	if tbChain.mode == 0 {
+		if vrfs == nil {
+			tbChain.lock.Lock()
+			tbChain.contract.recordGenesisAddrs(comID, addrs)
+			tbChain.lock.Unlock()
+			return
+		}
+		tbChain.lock_new.Lock()
+		defer tbChain.lock_new.Unlock()
+		adjust := &core.AdjustAddrs{ComID: comID, Addrs: addrs, Vrfs: vrfs, SeedHeight: seedHeight}
+		tbChain.txs_new = append(tbChain.txs_new, &simulationTx{adjust: adjust})
+		log.Debug("AdjustRecordedAddrs", "comID", comID, "addrs", len(addrs), "seedHeight", seedHeight)
+	} else if tbChain.mode == 1 || tbChain.mode == 2 {
 		tbChain.addrs[comID] = addrs
 		if seedHeight > 0 {
 			tbChain.AdjustEthChainRecordedAddrs(addrs, vrfs, seedHeight, comID, nodeID)
@@ -98,6 +221,14 @@ func (tbChain *BeaconChain) SetAddrs(addrs []common.Address, vrfs [][]byte, seed
 	}
 }
 
+/* 模拟信标链上的一笔交易，tb、batch、root 和 adjust 中只有一个不为空 */
+type simulationTx struct {
+	tb     *core.SignedTB
+	batch  []*core.SignedTB
+	root   *core.SignedTBRoot
+	adjust *core.AdjustAddrs
+}
+
 /** 调用这个函数，相当于在信标链上发起一笔交易
  * tb会被暂时存下，等待信标链打包时处理
  * 信标链打包时，会调用合约验证tb的多签名合法性，验证通过才会打包该交易，即确认该信标
@@ -109,12 +240,7 @@ func (tbChain *BeaconChain) AddTimeBeacon2SimulationChain(tb *core.SignedTB) {
 	}
 	tbChain.lock_new.Lock()
 	defer tbChain.lock_new.Unlock()
-	tbs_shard := tbChain.tbs[int(tb.ShardID)]
-	tbs_shard_new := tbChain.tbs_new[int(tb.ShardID)]
-	if tb.Height != uint64(len(tbs_shard)+len(tbs_shard_new)) {
-		log.Warn("Could not add time beacon because the height didn't match!", "expected", len(tbs_shard)+len(tbs_shard_new), "got", tb.Height)
-	}
-	tbChain.tbs_new[int(tb.ShardID)] = append(tbChain.tbs_new[int(tb.ShardID)], tb)
+	tbChain.txs_new = append(tbChain.txs_new, &simulationTx{tb: tb})
 	log.Debug("AddTimeBeacon", "info", tb)
 }
 
@@ -122,25 +248,89 @@ func (tbChain *BeaconChain) AddGenesisTB(signedTb *core.SignedTB) {
 	tbChain.lock.Lock()
 	defer tbChain.lock.Unlock()
 	tb := signedTb.TimeBeacon
-	tbs_shard := tbChain.tbs[int(tb.ShardID)]
-	if tb.Height != uint64(len(tbs_shard)) {
-		log.Warn("Could not add time beacon because the height didn't match!", "expected", len(tbs_shard), "got", tb.Height)
+	if _, ok := tbChain.tbs[int(tb.ShardID)][0]; ok {
+		log.Warn("genesis time beacon already exists, overwrite it", "shardID", tb.ShardID)
 	}
 	confirmedTb := &ConfirmedTB{
 		TimeBeacon:    tb,
 		ConfirmTime:   uint64(time.Now().Unix()),
 		ConfirmHeight: 0,
 	}
-	tbChain.tbs[int(tb.ShardID)] = append(tbChain.tbs[int(tb.ShardID)], confirmedTb)
+	tbChain.confirmTB(confirmedTb)
 	log.Debug("AddGenesisTimeBeacon", "info", tb)
 
 }
 
+/* 记录一个已确认的信标，同一分片同一高度的信标会被覆盖，调用者需持有 tbChain.lock */
+func (tbChain *BeaconChain) confirmTB(tb *ConfirmedTB) {
+	shardID := int(tb.ShardID)
+	if _, ok := tbChain.tbs[shardID]; !ok {
+		tbChain.tbs[shardID] = make(map[uint64]*ConfirmedTB)
+	}
+	tbChain.tbs[shardID][tb.Height] = tb
+}
+
 func (tbChain *BeaconChain) GetTimeBeacon(shardID int, height uint64) *ConfirmedTB {
-	tbs_shard := tbChain.tbs[shardID]
-	if height >= uint64(len(tbs_shard)) {
-		log.Warn("Could not get the time beacon because the requested height was larger than existing confirmed height!", "requested", height, "max height", len(tbs_shard))
+	tbChain.lock.Lock()
+	defer tbChain.lock.Unlock()
+	tb, ok := tbChain.tbs[shardID][height]
+	if !ok {
+		log.Warn("Could not get the time beacon because it was not confirmed!", "shardID", shardID, "requested", height)
 		return nil
 	}
-	return tbs_shard[height]
+	return tb
+}
+
+/** 模拟信标链合约最近产生的事件和每种事件的总次数
+ * 以太坊模式下事件由合约产生，这里为空
+ */
+func (tbChain *BeaconChain) ContractEvents() ([]ContractEvent, map[string]int) {
+	tbChain.lock.Lock()
+	defer tbChain.lock.Unlock()
+	events := make([]ContractEvent, len(tbChain.contract.events))
+	for i, e := range tbChain.contract.events {
+		events[i] = *e
+	}
+	counts := make(map[string]int, len(tbChain.contract.eventCounts))
+	for msg, n := range tbChain.contract.eventCounts {
+		counts[msg] = n
+	}
+	return events, counts
+}
+
+/** 模拟信标链不需要部署合约，booter 直接把各分片的创世信标写入链中
+ * 所有分片的创世信标都写入后返回 true
+ */
+func (tbChain *BeaconChain) AddSimulationChainGenesisTB(tb *core.TimeBeacon) bool {
+	tbChain.AddGenesisTB(&core.SignedTB{TimeBeacon: *tb})
+	tbChain.lock.Lock()
+	defer tbChain.lock.Unlock()
+	return len(tbChain.tbs) == tbChain.shardNum
+}
+
+func (tbChain *BeaconChain) IsSimulationChain() bool {
+	return tbChain.mode == 0
+}
+
+/** 模拟信标链上指定高度区块的哈希和高度，超过当前高度时返回最新区块
+ * 高度0（尚未出块）时返回空哈希
+ */
+func (tbChain *BeaconChain) getSimulationChainBlockHash(height uint64) (common.Hash, uint64) {
+	tbChain.lock.Lock()
+	defer tbChain.lock.Unlock()
+	return tbChain.blockHash(height)
+}
+
+/** 不加锁的 getSimulationChainBlockHash，调用者需持有 tbChain.lock
+ * 以已推送的最高区块为准，正在生成的区块还没有哈希，不能作为种子
+ */
+func (tbChain *BeaconChain) blockHash(height uint64) (common.Hash, uint64) {
+	if height > tbChain.headHeight {
+		height = tbChain.headHeight
+	}
+	block, ok := tbChain.tbBlocks[height]
+	if !ok {
+		return common.Hash{}, height
+	}
+	return block.Hash(), height
 }
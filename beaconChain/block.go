@@ -5,17 +5,42 @@ import (
 	"go-w3chain/core"
 	"go-w3chain/log"
 	"time"
+
+	"github.com/ethereum/go-ethereum/common"
 )
 
 type TBBlock struct {
 	/* 时间戳 */
 	Time   uint64
 	Height uint64
+	/* 模拟信标链上一个区块的哈希，以太坊模式下为空 */
+	ParentHash common.Hash
 	/** key是分片ID，value是该分片未在信标链上链的区块的信标
 	 * 一个分片可能对应多个信标，取决于分片出块速度 */
 	Tbs [][]*ConfirmedTB
 }
 
+/** 区块的rlp哈希，模拟信标链用它代替以太坊区块哈希作为重组和出块的随机种子
+ * 只包含父区块哈希、高度和确认的信标，不包含时间戳，相同的信标序列得到相同的哈希
+ */
+func (block *TBBlock) Hash() common.Hash {
+	tbs := make([][]core.TimeBeacon, len(block.Tbs))
+	for shardID, shardTbs := range block.Tbs {
+		for _, tb := range shardTbs {
+			tbs[shardID] = append(tbs[shardID], tb.TimeBeacon)
+		}
+	}
+	hash, err := core.RlpHash(struct {
+		ParentHash common.Hash
+		Height     uint64
+		Tbs        [][]core.TimeBeacon
+	}{block.ParentHash, block.Height, tbs})
+	if err != nil {
+		log.Warn("hash tbchain block fail", "height", block.Height, "err", err)
+	}
+	return hash
+}
+
 func (tbChain *BeaconChain) loop() {
 	defer tbChain.wg.Done()
 	log.Info("TBChain work loop start.")
@@ -26,6 +51,8 @@ func (tbChain *BeaconChain) loop() {
 		select {
 		case <-timer.C:
 			if tbChain.mode == 0 || tbChain.mode == 1 || tbChain.mode == 2 {
+				// 批量模式下本出块间隔内收到的信标合并为一笔交易
+				tbChain.flushBatch()
 				block := tbChain.GenerateBlock()
 				if block != nil {
 					tbChain.toPushBlock(block)
@@ -36,7 +63,7 @@ func (tbChain *BeaconChain) loop() {
 				log.Error("err occurs", "err", err)
 			}
 
-		case <-tbChain.stopCh:
+		case <-tbChain.ctx.Done():
 			log.Info("TBChain work loop stop.")
 			return
 		}
@@ -63,34 +90,53 @@ func (tbChain *BeaconChain) generateSimulationChainBlock() *TBBlock {
 	now := time.Now().Unix()
 	tbChain.height += 1
 
-	// confirmTBs := make(map[uint32][]*ConfirmedTB, 0)
+	// 按提交顺序执行交易，合约验证通过的信标才被确认
 	confirmTBs := make([][]*ConfirmedTB, tbChain.shardNum)
-	for shardID, tbs := range tbChain.tbs_new {
-		shardContract := tbChain.contract.contracts[shardID]
-		for _, signedTb := range tbs {
-			// todo: 验证多签名
-			if !shardContract.VerifyTimeBeacon(signedTb) {
-				log.Error("TBchain verify time beacon fail. this time beacon has no enough valid signatures!!")
-			} else {
-				log.Trace("TBchain verify time beacon success.")
+	confirm := func(tb core.TimeBeacon) {
+		confirmedTB := &ConfirmedTB{
+			TimeBeacon:    tb,
+			ConfirmTime:   uint64(now),
+			ConfirmHeight: tbChain.height,
+		}
+		confirmTBs[tb.ShardID] = append(confirmTBs[tb.ShardID], confirmedTB)
+		tbChain.confirmTB(confirmedTB)
+	}
+	seedOf := func(seedHeight uint64) common.Hash {
+		seed, _ := tbChain.blockHash(seedHeight)
+		return seed
+	}
+	for _, tx := range tbChain.txs_new {
+		switch {
+		case tx.adjust != nil:
+			tbChain.contract.adjustRecordedAddrs(tx.adjust.Addrs, tx.adjust.Vrfs, seedOf(tx.adjust.SeedHeight), tbChain.height)
+		case tx.batch != nil:
+			for i, ok := range tbChain.contract.addTBs(tx.batch, seedOf, tbChain.height) {
+				if ok {
+					confirm(tx.batch[i].TimeBeacon)
+				}
 			}
-			confirmedTB := &ConfirmedTB{
-				TimeBeacon:    signedTb.TimeBeacon,
-				ConfirmTime:   uint64(now),
-				ConfirmHeight: tbChain.height,
+		case tx.root != nil:
+			if tbChain.contract.addTBRoot(tx.root, seedOf(tx.root.SeedHeight), tbChain.height) {
+				for _, tb := range tx.root.Tbs {
+					confirm(tb)
+				}
+			}
+		default:
+			if tbChain.contract.addTB(tx.tb, seedOf(tx.tb.SeedHeight), tbChain.height) {
+				confirm(tx.tb.TimeBeacon)
 			}
-			confirmTBs[uint32(shardID)] = append(confirmTBs[uint32(shardID)], confirmedTB)
 		}
-		tbChain.tbs[shardID] = append(tbChain.tbs[shardID], confirmTBs[uint32(shardID)]...)
 	}
 
+	parentHash, _ := tbChain.blockHash(tbChain.height - 1)
 	block := &TBBlock{
-		Tbs:    confirmTBs,
-		Time:   uint64(now),
-		Height: tbChain.height,
+		Tbs:        confirmTBs,
+		Time:       uint64(now),
+		Height:     tbChain.height,
+		ParentHash: parentHash,
 	}
 
-	tbChain.tbs_new = make(map[int][]*core.SignedTB)
+	tbChain.txs_new = nil
 
 	log.Debug("tbchain generate block", "info", block)
 	return block
@@ -102,14 +148,29 @@ func (tbChain *BeaconChain) generateSimulationChainBlock() *TBBlock {
 * 订阅者包括客户端、委员会等需要获取信标辅助验证的角色
 */
 func (tbChain *BeaconChain) toPushBlock(block *TBBlock) {
+	tbChain.lock.Lock()
 	if _, ok := tbChain.tbBlocks[block.Height]; ok {
 		log.Error(fmt.Sprintf("contradictory tbchain block have same height. old block: %v, new block: %v",
 			tbChain.tbBlocks[block.Height], block))
 	}
 	tbChain.tbBlocks[block.Height] = block
+	if block.Height > tbChain.headHeight {
+		tbChain.headHeight = block.Height
+	}
+	if tbChain.store != nil {
+		if err := tbChain.store.writeBlock(block); err != nil {
+			log.Warn("persist tbchain block fail", "height", block.Height, "err", err)
+		}
+	}
 
-	confirmHeight := block.Height - tbChain.cfg.Height2Confirm
-	if confirmBlock, ok := tbChain.tbBlocks[confirmHeight]; ok && confirmBlock != nil {
+	// 模拟信标链推送 Height2Confirm 个区块之前的区块，以太坊模式下生成区块时信标已达到确认数
+	confirmHeight := block.Height
+	if tbChain.mode == 0 {
+		confirmHeight = block.Height - tbChain.cfg.Height2Confirm
+	}
+	confirmBlock, ok := tbChain.tbBlocks[confirmHeight]
+	tbChain.lock.Unlock()
+	if ok && confirmBlock != nil {
 		tbChain.PushBlock2Client(confirmBlock)
 		tbChain.PushBlock2Coms(confirmBlock)
 	}
@@ -126,3 +187,10 @@ func (tbChain *BeaconChain) PushBlock2Client(block *TBBlock) {
 func (tbChain *BeaconChain) PushBlock2Coms(block *TBBlock) {
 	tbChain.messageHub.Send(core.MsgTypeTBChainPushTB2Coms, 0, block, nil)
 }
+
+/** 以太坊模式下已推送的信标被回滚时，通知客户端撤回该信标
+ * 委员会只关心信标链高度，不需要撤回
+ */
+func (tbChain *BeaconChain) PushRetraction2Client(tb *ConfirmedTB) {
+	tbChain.messageHub.Send(core.MsgTypeTBChainRetractTB2Client, 0, tb, nil)
+}
@@ -1,11 +1,16 @@
 package beaconChain
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"go-w3chain/core"
+	"go-w3chain/eth_chain"
+	"go-w3chain/log"
+	"path/filepath"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
@@ -85,3 +90,206 @@ func TestHashBlock(t *testing.T) {
 	}
 	fmt.Printf("hash = %v", hash)
 }
+
+func TestSimulationChainBlockHash(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testSimulationChain.log"))
+	tbChain := NewTBChain(context.Background(), &core.BeaconChainConfig{Mode: 0, BlockInterval: 100, MultiSignRequiredNum: 1}, 2)
+	defer tbChain.Close()
+
+	// 收集齐所有分片的创世信标
+	if tbChain.AddSimulationChainGenesisTB(&core.TimeBeacon{ShardID: 0}) {
+		t.Fatal("genesis done with one of two shards")
+	}
+	if !tbChain.AddSimulationChainGenesisTB(&core.TimeBeacon{ShardID: 1}) {
+		t.Fatal("genesis not done with all shards")
+	}
+	if tb := tbChain.GetTimeBeacon(1, 0); tb == nil || tb.ShardID != 1 {
+		t.Fatalf("unexpected genesis tb: %v", tb)
+	}
+
+	// 尚未出块时返回空哈希
+	if hash, height := tbChain.GetEthChainLatestBlockHash(); hash != (common.Hash{}) || height != 0 {
+		t.Fatalf("unexpected hash %x at height %d", hash, height)
+	}
+
+	tbChain.SetMessageHub(&nopHub{})
+	block := tbChain.GenerateBlock()
+	tbChain.toPushBlock(block)
+	hash, height := tbChain.GetEthChainBlockHash(5)
+	if height != 1 || hash != block.Hash() || hash == (common.Hash{}) {
+		t.Fatalf("unexpected hash %x at height %d", hash, height)
+	}
+}
+
+func TestEthChainConfirmAndReorg(t *testing.T) {
+	t.Cleanup(log.SwapRootHandler(log.DiscardHandler()))
+	tbChain := NewTBChain(context.Background(), &core.BeaconChainConfig{Mode: 2, BlockInterval: 100, Height2Confirm: 2, TBSubmit: core.TBSubmitBatch}, 2)
+	defer tbChain.Close()
+	hub := &recordHub{}
+	tbChain.SetMessageHub(hub)
+	// 本进程提交的信标，批量模式下先进入缓存，这里直接清空缓存代替发送交易
+	signed := &core.SignedTB{TimeBeacon: core.TimeBeacon{ShardID: 0, Height: 1}}
+	tbChain.AddTimeBeacon(signed, 0)
+	tbChain.batch = nil
+	release := func(head uint64) *TBBlock {
+		block := tbChain.releaseEthChainTBs(head)
+		if block != nil {
+			tbChain.toPushBlock(block)
+		}
+		return block
+	}
+
+	a := &eth_chain.Event{Msg: "addTB", ShardID: 0, Height: 1, Eth_height: 10, BlockHash: "0xa"}
+	b := &eth_chain.Event{Msg: "addTB", ShardID: 1, Height: 1, Eth_height: 11, BlockHash: "0xb"}
+	tbChain.handleEthChainEvent(a)
+	tbChain.handleEthChainEvent(b)
+	if block := release(11); block != nil {
+		t.Fatalf("released before Height2Confirm confirmations: %v", block)
+	}
+	block := release(12)
+	if block == nil || block.Height != 10 || len(block.Tbs[0]) != 1 || len(block.Tbs[1]) != 0 {
+		t.Fatalf("unexpected block: %v", block)
+	}
+
+	// 未确认的日志被回滚后丢弃，重新打包的日志在新高度确认
+	removed := *b
+	removed.Removed = true
+	tbChain.handleEthChainEvent(&removed)
+	tbChain.handleEthChainEvent(&eth_chain.Event{Msg: "addTB", ShardID: 1, Height: 1, Eth_height: 12, BlockHash: "0xc"})
+	if block := release(12); block != nil {
+		t.Fatalf("block released without head moving: %v", block)
+	}
+	block = release(14)
+	if block == nil || block.Height != 12 || len(block.Tbs[1]) != 1 || block.Tbs[1][0].ConfirmHeight != 12 {
+		t.Fatalf("unexpected block: %v", block)
+	}
+
+	// 已推送的信标被回滚后从信标链视图中撤回
+	removed = *a
+	removed.Removed = true
+	tbChain.handleEthChainEvent(&removed)
+	if tb := tbChain.GetTimeBeacon(0, 1); tb != nil {
+		t.Fatalf("reorged tb not retracted: %v", tb)
+	}
+	if tb := tbChain.GetTimeBeacon(1, 1); tb == nil {
+		t.Fatal("tb retracted by an unrelated reorg")
+	}
+	// 客户端收到撤回通知，本进程提交的信标被重新提交，同一回滚只重新提交一次
+	if len(hub.retracted) != 1 || hub.retracted[0].ShardID != 0 || hub.retracted[0].ConfirmHeight != 10 {
+		t.Fatalf("unexpected retractions: %v", hub.retracted)
+	}
+	if len(tbChain.batch) != 1 || tbChain.batch[0] != signed {
+		t.Fatalf("reorged tb not resubmitted: %v", tbChain.batch)
+	}
+	tbChain.handleEthChainEvent(&removed)
+	if len(tbChain.batch) != 1 || len(hub.retracted) != 1 {
+		t.Fatalf("tb resubmitted twice for one reorg: %v", tbChain.batch)
+	}
+}
+
+func TestEthChainViewRestore(t *testing.T) {
+	t.Cleanup(log.SwapRootHandler(log.DiscardHandler()))
+	dir := t.TempDir()
+	contract := common.HexToAddress("0x1234")
+	newChain := func(contractAddr common.Address, hub core.MessageHub) (*BeaconChain, uint64) {
+		tbChain := NewTBChain(context.Background(), &core.BeaconChainConfig{Mode: 2, BlockInterval: 100, Height2Confirm: 1, DataDir: dir}, 2)
+		tbChain.SetMessageHub(hub)
+		tbChain.contractAddr = contractAddr
+		return tbChain, tbChain.restore()
+	}
+
+	tbChain, from := newChain(contract, &nopHub{})
+	if from != 0 {
+		t.Fatalf("catch up from %d with an empty store", from)
+	}
+	tbChain.handleEthChainEvent(&eth_chain.Event{Msg: "addTB", ShardID: 0, Height: 1, Eth_height: 5, BlockHash: "0xa"})
+	tbChain.handleEthChainEvent(&eth_chain.Event{Msg: "addTB", ShardID: 1, Height: 1, Eth_height: 6, BlockHash: "0xb"})
+	tbChain.toPushBlock(tbChain.releaseEthChainTBs(7))
+	tbChain.Close()
+
+	// 重启后恢复信标和区块，从下一个以太坊高度开始补齐日志，并把恢复的信标推送给客户端和委员会
+	hub := &recordHub{}
+	tbChain, from = newChain(contract, hub)
+	if from != 7 || tbChain.Height() != 6 {
+		t.Fatalf("unexpected restore: from %d height %d", from, tbChain.Height())
+	}
+	if tb := tbChain.GetTimeBeacon(1, 1); tb == nil || tb.ConfirmHeight != 6 {
+		t.Fatalf("tb not restored: %v", tb)
+	}
+	if len(hub.blocks) != 2 || hub.blocks[0].Height != 6 || len(hub.blocks[0].Tbs[0]) != 1 || len(hub.blocks[0].Tbs[1]) != 1 {
+		t.Fatalf("unexpected replay: %v", hub.blocks)
+	}
+	tbChain.Close()
+
+	// 其他合约（新的实验）不读取上次的信标
+	tbChain, from = newChain(common.HexToAddress("0x5678"), &nopHub{})
+	defer tbChain.Close()
+	if from != 0 || tbChain.GetTimeBeacon(0, 1) != nil {
+		t.Fatal("tbs of another contract restored")
+	}
+}
+
+func TestEthChainRetractRestore(t *testing.T) {
+	t.Cleanup(log.SwapRootHandler(log.DiscardHandler()))
+	dir := t.TempDir()
+	newChain := func(hub core.MessageHub) *BeaconChain {
+		tbChain := NewTBChain(context.Background(), &core.BeaconChainConfig{Mode: 2, BlockInterval: 100, Height2Confirm: 1, DataDir: dir}, 2)
+		tbChain.SetMessageHub(hub)
+		tbChain.contractAddr = common.HexToAddress("0x1234")
+		tbChain.restore()
+		return tbChain
+	}
+
+	tbChain := newChain(&nopHub{})
+	a := &eth_chain.Event{Msg: "addTB", ShardID: 0, Height: 1, Eth_height: 5, BlockHash: "0xa"}
+	tbChain.handleEthChainEvent(a)
+	tbChain.handleEthChainEvent(&eth_chain.Event{Msg: "addTB", ShardID: 1, Height: 1, Eth_height: 5, BlockHash: "0xa", LogIndex: 1})
+	pushed := tbChain.releaseEthChainTBs(6)
+	tbChain.toPushBlock(pushed)
+	removed := *a
+	removed.Removed = true
+	tbChain.handleEthChainEvent(&removed)
+	// 撤回的信标从区块中移除，已推送的原区块不变
+	if block := tbChain.tbBlocks[5]; len(block.Tbs[0]) != 0 || len(block.Tbs[1]) != 1 {
+		t.Fatalf("retracted tb still in block: %v", block)
+	}
+	if len(pushed.Tbs[0]) != 1 {
+		t.Fatalf("pushed block modified: %v", pushed)
+	}
+	tbChain.Close()
+
+	// 重启后既不恢复撤回的信标，也不在区块中恢复
+	hub := &recordHub{}
+	tbChain = newChain(hub)
+	defer tbChain.Close()
+	if tb := tbChain.GetTimeBeacon(0, 1); tb != nil {
+		t.Fatalf("retracted tb restored: %v", tb)
+	}
+	if tb := tbChain.GetTimeBeacon(1, 1); tb == nil {
+		t.Fatal("tb of another shard not restored")
+	}
+	if block := tbChain.tbBlocks[5]; block == nil || len(block.Tbs[0]) != 0 || len(block.Tbs[1]) != 1 {
+		t.Fatalf("unexpected restored block: %v", block)
+	}
+	if len(hub.blocks) != 2 || len(hub.blocks[0].Tbs[0]) != 0 {
+		t.Fatalf("retracted tb replayed: %v", hub.blocks)
+	}
+}
+
+type recordHub struct {
+	blocks    []*TBBlock
+	retracted []*ConfirmedTB
+}
+
+func (hub *recordHub) Send(msgType uint32, id uint32, msg interface{}, callback func(res ...interface{})) {
+	switch data := msg.(type) {
+	case *TBBlock:
+		hub.blocks = append(hub.blocks, data)
+	case *ConfirmedTB:
+		hub.retracted = append(hub.retracted, data)
+	}
+}
+
+type nopHub struct{}
+
+func (*nopHub) Send(msgType uint32, id uint32, msg interface{}, callback func(res ...interface{})) {}
@@ -1,17 +1,231 @@
 package beaconChain
 
-/* 信标链上验证多签名的合约 */
+import (
+	"go-w3chain/core"
+	"go-w3chain/log"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+/* 合约事件的消息，与 eth_chain/timebeacon.sol 中 LogMessage 的 message 相同 */
+const (
+	EventAddTB                  = "addTB"
+	EventAddrNotRecorded        = "addTB... address not recorded"
+	EventSignerNotInShard       = "addTB... signer not in this shard"
+	EventVrfNotPassed           = "addTB... vrf verification not passed"
+	EventVrfNotQualified        = "addTB... vrf not qualified"
+	EventSigNotPassed           = "addTB... signature verification not passed"
+	EventInsufficientSigs       = "addTB... insufficient valid signatures"
+	EventAdjustAddrNotRecorded  = "adjustAddr... address not recorded"
+	EventAdjustAddrVrfNotPassed = "adjustAddr... vrf verification not passed"
+	EventTBRootMismatch         = "addTBRoot... time beacons do not match the root"
+	maxContractEvents           = 1024
+)
+
+/* 合约的 LogMessage 事件，BlockHeight 是产生事件的模拟信标链区块高度 */
+type ContractEvent struct {
+	Msg         string
+	ShardID     uint32
+	Height      uint64
+	Addr        common.Address
+	BlockHeight uint64
+}
+
+/** 模拟信标链上的 TBStorage 合约，验证规则与 eth_chain/timebeacon.sol 相同：
+ * 创世时记录各分片的初始地址，信标的每个签名者必须已记录、属于该分片、vrf 和签名都验证通过，
+ * 有效签名达到 minSigCnt 的信标才被确认；重组后按 vrf 调整地址所属的分片
+ * 合约的状态由 tbChain.lock 保护
+ */
 type Contract struct {
-	contracts []*ShardContract
+	minSigCnt int
+	shardNum  uint32
+	/* 已记录的地址及其所属的分片 */
+	addr2Shard map[common.Address]uint32
+
+	/* 最近的事件和每种事件的次数 */
+	events      []*ContractEvent
+	eventCounts map[string]int
 }
 
-func NewContract(shardNum int, required int) *Contract {
-	contracts := make([]*ShardContract, shardNum)
-	for i := 0; i < shardNum; i++ {
-		contracts[i] = NewShardContract(i, required)
+func NewContract(shardNum int, minSigCnt int) *Contract {
+	return &Contract{
+		minSigCnt:   minSigCnt,
+		shardNum:    uint32(shardNum),
+		addr2Shard:  make(map[common.Address]uint32),
+		eventCounts: make(map[string]int),
 	}
+}
 
-	return &Contract{
-		contracts: contracts,
+func (contract *Contract) emit(msg string, shardID uint32, height uint64, addr common.Address, blockHeight uint64) {
+	event := &ContractEvent{Msg: msg, ShardID: shardID, Height: height, Addr: addr, BlockHeight: blockHeight}
+	if len(contract.events) == maxContractEvents {
+		contract.events = contract.events[1:]
+	}
+	contract.events = append(contract.events, event)
+	contract.eventCounts[msg] += 1
+	// 以太坊模式下拒绝事件会结束进程，模拟信标链只记录警告，实验可以继续观察被拒绝的信标
+	if msg == EventAddTB {
+		log.Trace("tbchain contract event", "msg", msg, "shardID", shardID, "height", height, "blockHeight", blockHeight)
+	} else {
+		log.Warn("tbchain contract event", "msg", msg, "shardID", shardID, "height", height, "addr", addr, "blockHeight", blockHeight)
+	}
+}
+
+/* 对应合约的构造函数，记录一个分片的初始地址 */
+func (contract *Contract) recordGenesisAddrs(shardID uint32, addrs []common.Address) {
+	for _, addr := range addrs {
+		contract.addr2Shard[addr] = shardID
+	}
+}
+
+/** 对应合约的 addTB，seed 是 SeedHeight 高度区块的哈希
+ * 签名数量不足时返回 false，信标不会被确认
+ */
+func (contract *Contract) addTB(tb *core.SignedTB, seed common.Hash, blockHeight uint64) bool {
+	if len(tb.Vrfs) < len(tb.Sigs) || len(tb.Signers) < len(tb.Sigs) {
+		// 合约中数组越界会使交易回滚，不产生事件
+		log.Warn("tbchain contract addTB reverted. sigs, vrfs and signers mismatch", "shardID", tb.ShardID, "height", tb.Height,
+			"sigs", len(tb.Sigs), "vrfs", len(tb.Vrfs), "signers", len(tb.Signers))
+		return false
+	}
+	validSigCnt := contract.countValidSigs(tb.TimeBeacon.Hash(), tb.ShardID, tb.Height, tb.Sigs, tb.Vrfs, tb.Signers, seed, blockHeight)
+	if validSigCnt < contract.minSigCnt {
+		contract.emit(EventInsufficientSigs, tb.ShardID, tb.Height, common.Address{}, blockHeight)
+		return false
+	}
+	contract.emit(EventAddTB, tb.ShardID, tb.Height, common.Address{}, blockHeight)
+	return true
+}
+
+/** 对应合约的 addTBs，逐个执行 addTB，返回每个信标是否被确认
+ * 任一信标的数组长度不匹配时整笔交易回滚，所有信标都不被确认
+ */
+func (contract *Contract) addTBs(tbs []*core.SignedTB, seedOf func(uint64) common.Hash, blockHeight uint64) []bool {
+	ok := make([]bool, len(tbs))
+	for _, tb := range tbs {
+		if len(tb.Vrfs) < len(tb.Sigs) || len(tb.Signers) < len(tb.Sigs) {
+			log.Warn("tbchain contract addTBs reverted. sigs, vrfs and signers mismatch", "shardID", tb.ShardID, "height", tb.Height,
+				"sigs", len(tb.Sigs), "vrfs", len(tb.Vrfs), "signers", len(tb.Signers))
+			return ok
+		}
+	}
+	for i, tb := range tbs {
+		ok[i] = contract.addTB(tb, seedOf(tb.SeedHeight), blockHeight)
+	}
+	return ok
+}
+
+/** 对应合约的 addTBRoot，分片、起始高度和数量取自随根提交的信标 Tbs，多签名针对根的哈希
+ * 通过后检查 Tbs 是连续的信标且默克尔根与 Root 相同，再为每个高度产生一个 addTB 事件
+ */
+func (contract *Contract) addTBRoot(root *core.SignedTBRoot, seed common.Hash, blockHeight uint64) bool {
+	if len(root.Tbs) == 0 || len(root.Vrfs) < len(root.Sigs) || len(root.Signers) < len(root.Sigs) {
+		log.Warn("tbchain contract addTBRoot reverted. no time beacons or sigs, vrfs and signers mismatch", "shardID", root.ShardID,
+			"start", root.StartHeight, "tbs", len(root.Tbs), "sigs", len(root.Sigs), "vrfs", len(root.Vrfs), "signers", len(root.Signers))
+		return false
+	}
+	signed := core.TBRoot{ShardID: root.Tbs[0].ShardID, StartHeight: root.Tbs[0].Height, Count: uint64(len(root.Tbs)), Root: root.Root}
+	endHeight := signed.StartHeight + signed.Count - 1
+	validSigCnt := contract.countValidSigs(signed.Hash(), signed.ShardID, endHeight, root.Sigs, root.Vrfs, root.Signers, seed, blockHeight)
+	if validSigCnt < contract.minSigCnt {
+		contract.emit(EventInsufficientSigs, signed.ShardID, endHeight, common.Address{}, blockHeight)
+		return false
+	}
+	if !tbsMatchRoot(root.Tbs, root.Root) {
+		contract.emit(EventTBRootMismatch, signed.ShardID, endHeight, common.Address{}, blockHeight)
+		return false
+	}
+	for h := signed.StartHeight; h <= endHeight; h++ {
+		contract.emit(EventAddTB, signed.ShardID, h, common.Address{}, blockHeight)
+	}
+	return true
+}
+
+/* 验证签名直到有效签名数达到 minSigCnt，与合约的 countValidSigs 相同，返回有效签名数 */
+func (contract *Contract) countValidSigs(msgHash []byte, shardID uint32, height uint64,
+	sigs [][]byte, vrfs [][]byte, signers []common.Address, seed common.Hash, blockHeight uint64) int {
+	validSigCnt := 0
+	for i := 0; i < len(sigs); i++ {
+		signer := signers[i]
+		signerShard, ok := contract.addr2Shard[signer]
+		if !ok {
+			contract.emit(EventAddrNotRecorded, shardID, height, signer, blockHeight)
+			continue
+		}
+		if signerShard != shardID {
+			contract.emit(EventSignerNotInShard, shardID, height, signer, blockHeight)
+			continue
+		}
+		if !verifySigner(seed[:], vrfs[i], signer) {
+			contract.emit(EventVrfNotPassed, shardID, height, signer, blockHeight)
+			continue
+		}
+		if !vrfIsQualified(vrfs[i]) {
+			contract.emit(EventVrfNotQualified, shardID, height, signer, blockHeight)
+			continue
+		}
+		if verifySigner(msgHash, sigs[i], signer) {
+			validSigCnt += 1
+			if validSigCnt >= contract.minSigCnt {
+				break
+			}
+		} else {
+			contract.emit(EventSigNotPassed, shardID, height, signer, blockHeight)
+		}
+	}
+	return validSigCnt
+}
+
+/* 对应合约的 adjustRecordedAddrs，重组后把地址调整到 vrf 对应的分片 */
+func (contract *Contract) adjustRecordedAddrs(addrs []common.Address, vrfs [][]byte, seed common.Hash, blockHeight uint64) {
+	for j, addr := range addrs {
+		if _, ok := contract.addr2Shard[addr]; !ok {
+			contract.emit(EventAdjustAddrNotRecorded, 0, 0, addr, blockHeight)
+			continue
+		}
+		if j >= len(vrfs) || !verifySigner(seed[:], vrfs[j], addr) {
+			contract.emit(EventAdjustAddrVrfNotPassed, 0, 0, addr, blockHeight)
+			continue
+		}
+		// 与合约一致，最多支持256个分片
+		contract.addr2Shard[addr] = uint32(vrfs[j][0]) % contract.shardNum
+	}
+}
+
+/* 与合约的 tbsMatchRoot 相同：tbs 是同一分片高度连续的信标，且默克尔根与 root 相同 */
+func tbsMatchRoot(tbs []core.TimeBeacon, root common.Hash) bool {
+	for i, tb := range tbs {
+		if tb.ShardID != tbs[0].ShardID || tb.Height != tbs[0].Height+uint64(i) {
+			return false
+		}
+	}
+	return core.TBMerkleRoot(tbs) == root
+}
+
+/* 与合约相同，vrf 的第一个字节作为 uint8 总是不小于0，即所有 vrf 都合格 */
+func vrfIsQualified(vrf []byte) bool {
+	return len(vrf) > 0 && uint8(vrf[0]) >= 0
+}
+
+/** 验证 sig 是 signer 对 hash 的签名，vrf 也用这种方式验证
+ * 与合约中的 decomposeSig 相同，v 可以是 0/1 或 27/28
+ */
+func verifySigner(hash []byte, sig []byte, signer common.Address) bool {
+	if len(sig) != crypto.SignatureLength {
+		return false
+	}
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig = append([]byte{}, sig...)
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	pubKeyBytes, err := crypto.Ecrecover(hash, sig)
+	if err != nil {
+		return false
+	}
+	pubkey, err := crypto.UnmarshalPubkey(pubKeyBytes)
+	if err != nil {
+		return false
 	}
+	return crypto.PubkeyToAddress(*pubkey) == signer
 }
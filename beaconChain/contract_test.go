@@ -0,0 +1,252 @@
+package beaconChain
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+type testSigner struct {
+	key  *ecdsa.PrivateKey
+	addr common.Address
+}
+
+func newTestSigners(t *testing.T, n int) []testSigner {
+	signers := make([]testSigner, n)
+	for i := range signers {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[i] = testSigner{key: key, addr: crypto.PubkeyToAddress(key.PublicKey)}
+	}
+	return signers
+}
+
+func (s testSigner) sign(t *testing.T, hash []byte) []byte {
+	sig, err := crypto.Sign(hash, s.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+/* 与委员会多签名相同：签名者对信标哈希签名，对种子签名作为 vrf */
+func signTB(t *testing.T, tb core.TimeBeacon, seed common.Hash, seedHeight uint64, signers ...testSigner) *core.SignedTB {
+	signed := &core.SignedTB{TimeBeacon: tb, SeedHeight: seedHeight}
+	for _, s := range signers {
+		signed.Signers = append(signed.Signers, s.addr)
+		signed.Sigs = append(signed.Sigs, s.sign(t, tb.Hash()))
+		signed.Vrfs = append(signed.Vrfs, s.sign(t, seed[:]))
+	}
+	return signed
+}
+
+func newTestChain(t *testing.T, shards [][]testSigner) *BeaconChain {
+	tbChain := NewTBChain(context.Background(), &core.BeaconChainConfig{Mode: 0, BlockInterval: 100, MultiSignRequiredNum: 2}, len(shards))
+	t.Cleanup(tbChain.Close)
+	tbChain.SetMessageHub(&nopHub{})
+	for shardID, signers := range shards {
+		addrs := make([]common.Address, len(signers))
+		for i, s := range signers {
+			addrs[i] = s.addr
+		}
+		tbChain.SetAddrs(addrs, nil, 0, uint32(shardID), 0)
+		tbChain.AddSimulationChainGenesisTB(&core.TimeBeacon{ShardID: uint32(shardID)})
+	}
+	return tbChain
+}
+
+func (tbChain *BeaconChain) nextBlock() *TBBlock {
+	block := tbChain.GenerateBlock()
+	tbChain.toPushBlock(block)
+	return block
+}
+
+func TestSimulationChainContract(t *testing.T) {
+	t.Cleanup(log.SwapRootHandler(log.DiscardHandler()))
+
+	keys := newTestSigners(t, 5)
+	shard0, shard1, unknown := keys[0:3], keys[3:4], keys[4]
+	tbChain := newTestChain(t, [][]testSigner{shard0, shard1})
+	tbChain.nextBlock()
+	seed, seedHeight := tbChain.GetEthChainLatestBlockHash()
+	if seedHeight != 1 || seed == (common.Hash{}) {
+		t.Fatalf("unexpected seed %x at height %d", seed, seedHeight)
+	}
+
+	tb1 := core.TimeBeacon{ShardID: 0, Height: 1, BlockHash: "0x01"}
+	tb2 := core.TimeBeacon{ShardID: 0, Height: 2, BlockHash: "0x02"}
+	// 只有 shard0[0] 是有效签名者：其他签名者未记录、不属于该分片、vrf 的种子错误
+	bad := signTB(t, tb2, seed, seedHeight, unknown, shard1[0], shard0[0])
+	wrongVrf := signTB(t, tb2, common.Hash{1}, seedHeight, shard0[1])
+	bad.Signers, bad.Sigs, bad.Vrfs = append(bad.Signers, wrongVrf.Signers...), append(bad.Sigs, wrongVrf.Sigs...), append(bad.Vrfs, wrongVrf.Vrfs...)
+	tbChain.AddTimeBeacon(signTB(t, tb1, seed, seedHeight, shard0[0], shard0[1]), 0)
+	tbChain.AddTimeBeacon(bad, 0)
+	block := tbChain.nextBlock()
+
+	if len(block.Tbs[0]) != 1 || block.Tbs[0][0].Height != 1 {
+		t.Fatalf("unexpected confirmed tbs: %v", block.Tbs)
+	}
+	if tb := tbChain.GetTimeBeacon(0, 1); tb == nil || tb.ConfirmHeight != 2 {
+		t.Fatalf("tb not confirmed: %v", tb)
+	}
+	if tb := tbChain.GetTimeBeacon(0, 2); tb != nil {
+		t.Fatalf("tb with insufficient signatures confirmed: %v", tb)
+	}
+	_, counts := tbChain.ContractEvents()
+	for msg, n := range map[string]int{EventAddTB: 1, EventAddrNotRecorded: 1, EventSignerNotInShard: 1, EventVrfNotPassed: 1, EventInsufficientSigs: 1} {
+		if counts[msg] != n {
+			t.Errorf("event %q: got %d, want %d", msg, counts[msg], n)
+		}
+	}
+
+	// 重组后按 vrf 调整签名者所属的分片，vrf 不正确的地址保持不变
+	seed, seedHeight = tbChain.GetEthChainLatestBlockHash()
+	vrf0, vrf1 := shard0[0].sign(t, seed[:]), shard0[1].sign(t, common.Hash{}.Bytes())
+	tbChain.SetAddrs([]common.Address{shard0[0].addr, shard0[1].addr, unknown.addr}, [][]byte{vrf0, vrf1, vrf1}, seedHeight, 0, 0)
+	tbChain.nextBlock()
+	tbChain.lock.Lock()
+	moved, kept := tbChain.contract.addr2Shard[shard0[0].addr], tbChain.contract.addr2Shard[shard0[1].addr]
+	tbChain.lock.Unlock()
+	if moved != uint32(vrf0[0])%2 || kept != 0 {
+		t.Fatalf("unexpected shards after adjust: %d %d", moved, kept)
+	}
+	events, counts := tbChain.ContractEvents()
+	if counts[EventAdjustAddrVrfNotPassed] != 1 || counts[EventAdjustAddrNotRecorded] != 1 {
+		t.Fatalf("unexpected adjust events: %v", counts)
+	}
+	if last := events[len(events)-1]; last.BlockHeight != 3 || last.Addr != unknown.addr {
+		t.Fatalf("unexpected last event: %+v", last)
+	}
+}
+
+func TestSimulationChainDeterministicHash(t *testing.T) {
+	t.Cleanup(log.SwapRootHandler(log.DiscardHandler()))
+
+	keys := newTestSigners(t, 2)
+	// 两条链执行相同的交易，出块时间不同，区块哈希相同
+	var hashes [2][]common.Hash
+	for i := range hashes {
+		tbChain := newTestChain(t, [][]testSigner{keys})
+		for h := uint64(1); h <= 3; h++ {
+			seed, seedHeight := tbChain.GetEthChainLatestBlockHash()
+			tbChain.AddTimeBeacon(signTB(t, core.TimeBeacon{Height: h}, seed, seedHeight, keys...), 0)
+			block := tbChain.nextBlock()
+			block.Time += uint64(i)
+			hashes[i] = append(hashes[i], block.Hash())
+			if parent, _ := tbChain.GetEthChainBlockHash(h - 1); block.ParentHash != parent {
+				t.Fatalf("block %d: parent hash %x, want %x", h, block.ParentHash, parent)
+			}
+		}
+	}
+	for h := range hashes[0] {
+		if hashes[0][h] != hashes[1][h] {
+			t.Fatalf("block %d hash differs: %x %x", h+1, hashes[0][h], hashes[1][h])
+		}
+	}
+	if hashes[0][0] == hashes[0][1] {
+		t.Fatal("different blocks have the same hash")
+	}
+}
+
+func TestSimulationChainBatch(t *testing.T) {
+	t.Cleanup(log.SwapRootHandler(log.DiscardHandler()))
+
+	keys := newTestSigners(t, 4)
+	shard0, shard1 := keys[0:2], keys[2:4]
+	tbChain := newTestChain(t, [][]testSigner{shard0, shard1})
+	tbChain.cfg.TBSubmit, tbChain.cfg.TBBatchSize = core.TBSubmitBatch, 3
+	tbChain.nextBlock()
+	seed, seedHeight := tbChain.GetEthChainLatestBlockHash()
+
+	// 不同分片、不同高度的信标合并为一笔交易，签名不足的信标不影响其他信标
+	tbChain.AddTimeBeacon(signTB(t, core.TimeBeacon{ShardID: 0, Height: 1}, seed, seedHeight, shard0...), 0)
+	tbChain.AddTimeBeacon(signTB(t, core.TimeBeacon{ShardID: 1, Height: 1}, seed, seedHeight, shard1...), 0)
+	if len(tbChain.txs_new) != 0 {
+		t.Fatalf("batch flushed before it is full: %d txs", len(tbChain.txs_new))
+	}
+	tbChain.AddTimeBeacon(signTB(t, core.TimeBeacon{ShardID: 0, Height: 2}, seed, seedHeight, shard0[0]), 0)
+	if len(tbChain.txs_new) != 1 || len(tbChain.txs_new[0].batch) != 3 {
+		t.Fatalf("full batch not submitted as one tx: %d txs", len(tbChain.txs_new))
+	}
+	block := tbChain.nextBlock()
+	if len(block.Tbs[0]) != 1 || len(block.Tbs[1]) != 1 || tbChain.GetTimeBeacon(0, 2) != nil {
+		t.Fatalf("unexpected confirmed tbs: %v", block.Tbs)
+	}
+
+	// 任一信标的数组长度不匹配时整笔交易回滚
+	mismatch := signTB(t, core.TimeBeacon{ShardID: 0, Height: 3}, seed, seedHeight, shard0...)
+	mismatch.Vrfs = mismatch.Vrfs[:1]
+	tbChain.AddTimeBeacon(signTB(t, core.TimeBeacon{ShardID: 1, Height: 2}, seed, seedHeight, shard1...), 0)
+	tbChain.AddTimeBeacon(mismatch, 0)
+	tbChain.flushBatch()
+	tbChain.nextBlock()
+	if tbChain.GetTimeBeacon(1, 2) != nil || tbChain.GetTimeBeacon(0, 3) != nil {
+		t.Fatal("tbs of a reverted batch confirmed")
+	}
+	if _, counts := tbChain.ContractEvents(); counts[EventAddTB] != 2 || counts[EventInsufficientSigs] != 1 {
+		t.Fatalf("unexpected events: %v", counts)
+	}
+}
+
+/* 与委员会对默克尔根的多签名相同 */
+func signTBRoot(t *testing.T, tbs []core.TimeBeacon, seed common.Hash, seedHeight uint64, signers ...testSigner) *core.SignedTBRoot {
+	root := &core.SignedTBRoot{
+		TBRoot:     core.TBRoot{ShardID: tbs[0].ShardID, StartHeight: tbs[0].Height, Count: uint64(len(tbs)), Root: core.TBMerkleRoot(tbs)},
+		Tbs:        tbs,
+		SeedHeight: seedHeight,
+	}
+	for _, s := range signers {
+		root.Signers = append(root.Signers, s.addr)
+		root.Sigs = append(root.Sigs, s.sign(t, root.TBRoot.Hash()))
+		root.Vrfs = append(root.Vrfs, s.sign(t, seed[:]))
+	}
+	return root
+}
+
+func TestSimulationChainTBRoot(t *testing.T) {
+	t.Cleanup(log.SwapRootHandler(log.DiscardHandler()))
+
+	keys := newTestSigners(t, 2)
+	tbChain := newTestChain(t, [][]testSigner{keys})
+	tbChain.nextBlock()
+	seed, seedHeight := tbChain.GetEthChainLatestBlockHash()
+	window := func(start, count uint64) []core.TimeBeacon {
+		tbs := make([]core.TimeBeacon, count)
+		for i := range tbs {
+			tbs[i] = core.TimeBeacon{Height: start + uint64(i), BlockHash: fmt.Sprintf("0x%02x", start+uint64(i))}
+		}
+		return tbs
+	}
+
+	// 根的多签名通过后，根覆盖的每个信标都被确认
+	tbChain.AddTimeBeaconRoot(signTBRoot(t, window(1, 3), seed, seedHeight, keys...), 0)
+	// 信标与根不一致、签名不足的根都被拒绝
+	tampered := signTBRoot(t, window(4, 2), seed, seedHeight, keys...)
+	tampered.Tbs[1].BlockHash = "0xff"
+	tbChain.AddTimeBeaconRoot(tampered, 0)
+	tbChain.AddTimeBeaconRoot(signTBRoot(t, window(6, 2), seed, seedHeight, keys[0]), 0)
+	block := tbChain.nextBlock()
+
+	if len(block.Tbs[0]) != 3 {
+		t.Fatalf("unexpected confirmed tbs: %v", block.Tbs)
+	}
+	for h := uint64(1); h <= 7; h++ {
+		if confirmed := tbChain.GetTimeBeacon(0, h) != nil; confirmed != (h <= 3) {
+			t.Errorf("height %d: confirmed %v", h, confirmed)
+		}
+	}
+	_, counts := tbChain.ContractEvents()
+	for msg, n := range map[string]int{EventAddTB: 3, EventTBRootMismatch: 1, EventInsufficientSigs: 1} {
+		if counts[msg] != n {
+			t.Errorf("event %q: got %d, want %d", msg, counts[msg], n)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package beaconChain
+
+import (
+	"fmt"
+	"go-w3chain/core"
+	"go-w3chain/eth_chain"
+	"go-w3chain/log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+/* 报告中交易的类型 */
+const (
+	TxTypeDeploy              = "deploy"
+	TxTypeAddTB               = "addTB"
+	TxTypeAddTBs              = "addTBs"
+	TxTypeAddTBRoot           = "addTBRoot"
+	TxTypeAdjustRecordedAddrs = "adjustRecordedAddrs"
+)
+
+/** 交易开销报告，发给客户端0汇总到运行结果中，格式与 node/reconfig.go 中的报告相同，如
+ * "shardID: 1 msgType: gas txType: addTB shard tbs: 1=1 gas used: 52000 gas price(wei): 1000000000 latency: 1250 status: 1"
+ * shard tbs 是交易提交的每个分片的信标数，没有提交信标的交易为 "-"；部署交易的 shardID 为 -1
+ */
+func gasReport(shardID int, txType string, shardTBs map[uint32]int, cost *eth_chain.TxCost) string {
+	parts := make([]string, 0, len(shardTBs))
+	for s, n := range shardTBs {
+		parts = append(parts, fmt.Sprintf("%d=%d", s, n))
+	}
+	sort.Strings(parts)
+	tbs := "-"
+	if len(parts) > 0 {
+		tbs = strings.Join(parts, ",")
+	}
+	return fmt.Sprintf("shardID: %d msgType: gas txType: %s shard tbs: %s gas used: %d gas price(wei): %s latency: %d status: %d",
+		shardID, txType, tbs, cost.GasUsed, cost.GasPrice, cost.Latency.Milliseconds(), cost.Status)
+}
+
+func (tbChain *BeaconChain) sendGasReport(shardID int, txType string, shardTBs map[uint32]int, cost *eth_chain.TxCost) {
+	log.Info("tbchain tx cost", "txType", txType, "shardID", shardID, "gasUsed", cost.GasUsed,
+		"gasPrice", cost.GasPrice, "latency", cost.Latency, "status", cost.Status)
+	if tbChain.messageHub == nil {
+		return
+	}
+	tbChain.messageHub.Send(core.MsgTypeReportAny, 0, gasReport(shardID, txType, shardTBs, cost), nil)
+}
+
+/** 在后台等待 sentAt 时刻发送的交易被打包，然后报告它的开销
+ * 信标链关闭时停止等待，此时还未被打包的交易不计入开销
+ */
+func (tbChain *BeaconChain) trackTxCost(tx *types.Transaction, sentAt time.Time, shardID int, txType string, shardTBs map[uint32]int) {
+	if tx == nil {
+		return
+	}
+	tbChain.wg.Add(1)
+	go func() {
+		defer tbChain.wg.Done()
+		cost, err := eth_chain.WaitTxCost(tbChain.ctx, tbChain.getEthClient(), tx, sentAt)
+		if err != nil {
+			if tbChain.ctx.Err() == nil {
+				log.Warn("get tbchain tx receipt fail", "txType", txType, "tx", tx.Hash(), "err", err)
+			}
+			return
+		}
+		tbChain.sendGasReport(shardID, txType, shardTBs, cost)
+	}()
+}
@@ -0,0 +1,39 @@
+package beaconChain
+
+import (
+	"go-w3chain/eth_chain"
+	"go-w3chain/result"
+	"math/big"
+	"testing"
+	"time"
+)
+
+/* 开销报告经客户端解析后按交易类型和分片汇总，批量交易按信标数分摊到各分片 */
+func TestGasReport(t *testing.T) {
+	gwei := big.NewInt(1e9)
+	result.AddReport(gasReport(-1, TxTypeDeploy, nil, &eth_chain.TxCost{GasUsed: 1000000, GasPrice: gwei, Latency: 2 * time.Second, Status: 1}))
+	result.AddReport(gasReport(0, TxTypeAddTB, map[uint32]int{0: 1}, &eth_chain.TxCost{GasUsed: 60000, GasPrice: gwei, Latency: time.Second, Status: 1}))
+	result.AddReport(gasReport(1, TxTypeAddTBs, map[uint32]int{0: 1, 1: 3}, &eth_chain.TxCost{GasUsed: 200000, GasPrice: gwei, Latency: 3 * time.Second, Status: 1}))
+	result.AddReport(gasReport(1, TxTypeAdjustRecordedAddrs, nil, &eth_chain.TxCost{GasUsed: 40000, GasPrice: gwei, Latency: 2 * time.Second, Status: 0}))
+
+	s := result.GetGasSummary()
+	if s.Total.Txs != 4 || s.Total.TBs != 5 || s.Total.GasUsed != 1300000 || s.Total.Failed != 1 || s.Total.AvgLatencyMs != 2000 {
+		t.Fatalf("unexpected total: %+v", s.Total)
+	}
+	if s.Total.FeeGwei != 1300000 || s.GasPerShardBlock != 260000 {
+		t.Fatalf("unexpected fee: %v %v", s.Total.FeeGwei, s.GasPerShardBlock)
+	}
+	if len(s.ByType) != 4 || s.ByType[TxTypeAddTBs].TBs != 4 || s.ByType[TxTypeDeploy].GasUsed != 1000000 {
+		t.Fatalf("unexpected by type: %+v", s.ByType)
+	}
+	// 分片0：addTB 全部和 addTBs 的 1/4；分片1：addTBs 的 3/4 和调整地址
+	if s.ByShard[0].GasUsed != 110000 || s.ByShard[0].Txs != 2 || s.ByShard[0].TBs != 2 {
+		t.Fatalf("unexpected shard 0: %+v", s.ByShard[0])
+	}
+	if s.ByShard[1].GasUsed != 190000 || s.ByShard[1].TBs != 3 || s.ByShard[1].Failed != 1 {
+		t.Fatalf("unexpected shard 1: %+v", s.ByShard[1])
+	}
+	if len(s.ByShard) != 2 {
+		t.Fatalf("deploy attributed to a shard: %+v", s.ByShard)
+	}
+}
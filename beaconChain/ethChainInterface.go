@@ -4,6 +4,8 @@ import (
 	"go-w3chain/core"
 	"go-w3chain/eth_chain"
 	"go-w3chain/log"
+	"math"
+	"sort"
 	"strings"
 	"time"
 
@@ -20,6 +22,9 @@ var (
 	eventChannel chan *eth_chain.Event = make(chan *eth_chain.Event, 100)
 )
 
+/* 已推送的信标日志保留的区块数，更深的回滚不再撤回 */
+const gethReorgWindow = 64
+
 func (tbChain *BeaconChain) HandleBooterSendContract(data *core.BooterSendContract) {
 	tbChain.contractAddr = data.Addr
 	contractABI, err := abi.JSON(strings.NewReader(eth_chain.MyContractABI()))
@@ -28,15 +33,98 @@ func (tbChain *BeaconChain) HandleBooterSendContract(data *core.BooterSendContra
 	}
 	tbChain.contractAbi = &contractABI
 
-	go eth_chain.SubscribeEvents(tbChain.cfg.Port, tbChain.contractAddr, eventChannel)
+	if tbChain.mode == 0 {
+		// 模拟信标链没有合约事件需要订阅
+		return
+	}
+	// 从上次运行推送的最高高度之后补齐日志，之后断开重连时从已读到的高度补齐
+	from := tbChain.restore()
+	events := eth_chain.NewSubscription(tbChain.ctx, tbChain.getEthClient(), tbChain.cfg.Port,
+		tbChain.contractAddr, tbChain.cfg.EventSource, from, eventChannel)
+	tbChain.lock.Lock()
+	tbChain.events = events
+	tbChain.lock.Unlock()
+	tbChain.wg.Add(2)
+	go func() {
+		defer tbChain.wg.Done()
+		events.Run()
+	}()
+	// 重发被丢弃或长时间未上链的信标交易
+	go func() {
+		defer tbChain.wg.Done()
+		eth_chain.MonitorPending(tbChain.ctx, tbChain.getEthClient())
+	}()
+}
+
+/* 合约日志订阅的健康状态，模拟信标链或还未收到合约地址时返回 false */
+func (tbChain *BeaconChain) EventHealth() (eth_chain.SubscriptionHealth, bool) {
+	tbChain.lock.Lock()
+	events := tbChain.events
+	tbChain.lock.Unlock()
+	if events == nil {
+		return eth_chain.SubscriptionHealth{}, false
+	}
+	return events.Health(), true
+}
+
+/** 打开本合约的持久化存储，恢复上次运行已推送的信标和区块，并推送给本进程的客户端和委员会
+ * 返回需要从哪个以太坊高度开始补齐日志，没有持久化的区块时返回0，即不补齐
+ */
+func (tbChain *BeaconChain) restore() uint64 {
+	if tbChain.cfg.DataDir == "" {
+		return 0
+	}
+	store, err := openTBStore(tbChain.cfg.DataDir, tbChain.contractAddr)
+	if err != nil {
+		log.Warn("open tbchain store fail, time beacons will not be persisted", "dir", tbChain.cfg.DataDir, "err", err)
+		return 0
+	}
+	tbs, blocks, err := store.load()
+	if err != nil {
+		log.Warn("load tbchain store fail", "err", err)
+	}
+	tbChain.lock.Lock()
+	tbChain.store = store
+	for _, tb := range tbs {
+		tbChain.confirmTB(tb)
+	}
+	for _, block := range blocks {
+		tbChain.tbBlocks[block.Height] = block
+	}
+	head, ok := store.head()
+	if ok && head > tbChain.headHeight {
+		tbChain.headHeight = head
+	}
+	tbChain.lock.Unlock()
+	if !ok {
+		return 0
+	}
+
+	// 合并为一个区块推送：客户端得到全部信标，委员会只关心最新高度
+	replay := &TBBlock{Height: head, Time: uint64(time.Now().Unix()), Tbs: make([][]*ConfirmedTB, tbChain.shardNum)}
+	for _, tb := range tbs {
+		if int(tb.ShardID) < tbChain.shardNum {
+			replay.Tbs[tb.ShardID] = append(replay.Tbs[tb.ShardID], tb)
+		}
+	}
+	log.Info("tbchain view restored", "tbs", len(tbs), "blocks", len(blocks), "head", head)
+	tbChain.PushBlock2Client(replay)
+	tbChain.PushBlock2Coms(replay)
+	return head + 1
 }
 
 func (tbChain *BeaconChain) GetEthChainLatestBlockHash() (common.Hash, uint64) {
+	if tbChain.mode == 0 {
+		return tbChain.getSimulationChainBlockHash(math.MaxUint64)
+	}
 	client := tbChain.getEthClient()
 	return eth_chain.GetLatestBlockHash(client)
 }
 
 func (tbChain *BeaconChain) GetEthChainBlockHash(height uint64) (common.Hash, uint64) {
+	if tbChain.mode == 0 {
+		return tbChain.getSimulationChainBlockHash(height)
+	}
 	client := tbChain.getEthClient()
 	return eth_chain.GetBlockHash(client, height)
 }
@@ -60,99 +148,292 @@ func (tbChain *BeaconChain) AddTimeBeacon2EthChain(signedtb *core.SignedTB, node
 		tbChain.AddEthChainGenesisTB(contractTB)
 	} else {
 		client := tbChain.getEthClient()
-		err := eth_chain.AddTB(client, tbChain.contractAddr,
+		sentAt := time.Now()
+		tx, err := eth_chain.AddTB(client, tbChain.contractAddr,
 			tbChain.contractAbi, tbChain.mode, contractTB, signedtb.Sigs, signedtb.Vrfs,
 			signedtb.SeedHeight, signedtb.Signers, tbChain.cfg.ChainId, nodeID)
 		if err != nil {
 			log.Error("eth_chain.AddTB err", "err", err)
 		}
+		tbChain.trackTxCost(tx, sentAt, int(tb.ShardID), TxTypeAddTB, map[uint32]int{tb.ShardID: 1})
 	}
 	log.Debug("AddTbTXSent", "info", signedtb)
 }
 
+/* 一笔 addTBs 交易提交多个信标，使用最后一个信标所在委员会 nodeID 节点的账户，即最近提交信标的节点 */
+func (tbChain *BeaconChain) AddTimeBeacons2EthChain(signedtbs []*core.SignedTB, nodeID uint32) {
+	n := len(signedtbs)
+	tbs := make([]eth_chain.ContractTB, n)
+	sigs := make([][][]byte, n)
+	vrfs := make([][][]byte, n)
+	seedHeights := make([]uint64, n)
+	signers := make([][]common.Address, n)
+	shardTBs := make(map[uint32]int)
+	for i, signedtb := range signedtbs {
+		tb := signedtb.TimeBeacon
+		shardTBs[tb.ShardID] += 1
+		tbs[i] = eth_chain.ContractTB{
+			ShardID:    tb.ShardID,
+			Height:     tb.Height,
+			BlockHash:  tb.BlockHash,
+			TxHash:     tb.TxHash,
+			StatusHash: tb.StatusHash,
+		}
+		sigs[i], vrfs[i], seedHeights[i], signers[i] = signedtb.Sigs, signedtb.Vrfs, signedtb.SeedHeight, signedtb.Signers
+	}
+	client := tbChain.getEthClient()
+	sentAt := time.Now()
+	tx, err := eth_chain.AddTBs(client, tbChain.contractAddr, tbChain.contractAbi, tbChain.mode,
+		tbs, sigs, vrfs, seedHeights, signers, tbChain.cfg.ChainId, tbs[n-1].ShardID, nodeID)
+	if err != nil {
+		log.Error("eth_chain.AddTBs err", "err", err)
+	}
+	tbChain.trackTxCost(tx, sentAt, int(tbs[n-1].ShardID), TxTypeAddTBs, shardTBs)
+	log.Debug("AddTbsTXSent", "count", n)
+}
+
+func (tbChain *BeaconChain) AddTimeBeaconRoot2EthChain(root *core.SignedTBRoot, nodeID uint32) {
+	tbs := make([]eth_chain.ContractTB, len(root.Tbs))
+	for i, tb := range root.Tbs {
+		tbs[i] = eth_chain.ContractTB{
+			ShardID:    tb.ShardID,
+			Height:     tb.Height,
+			BlockHash:  tb.BlockHash,
+			TxHash:     tb.TxHash,
+			StatusHash: tb.StatusHash,
+		}
+	}
+	client := tbChain.getEthClient()
+	sentAt := time.Now()
+	tx, err := eth_chain.AddTBRoot(client, tbChain.contractAddr, tbChain.contractAbi, tbChain.mode,
+		tbs, root.Root, root.Sigs, root.Vrfs, root.SeedHeight, root.Signers, tbChain.cfg.ChainId, nodeID)
+	if err != nil {
+		log.Error("eth_chain.AddTBRoot err", "err", err)
+	}
+	tbChain.trackTxCost(tx, sentAt, int(root.ShardID), TxTypeAddTBRoot, map[uint32]int{root.ShardID: int(root.Count)})
+	log.Debug("AddTbRootTXSent", "shardID", root.ShardID, "start", root.StartHeight, "count", root.Count)
+}
+
 func (tbChain *BeaconChain) AdjustEthChainRecordedAddrs(addrs []common.Address, vrfs [][]byte, seedHeight uint64, comID uint32, nodeID uint32) {
 	client := tbChain.getEthClient()
-	err := eth_chain.AdjustRecordedAddrs(client, tbChain.contractAddr,
+	sentAt := time.Now()
+	tx, err := eth_chain.AdjustRecordedAddrs(client, tbChain.contractAddr,
 		tbChain.contractAbi, tbChain.mode, comID, addrs, vrfs, seedHeight, tbChain.cfg.ChainId, nodeID)
 	if err != nil {
 		log.Error("eth_chain.AdjustRecordedAddrs err", "err", err)
 	}
+	tbChain.trackTxCost(tx, sentAt, int(comID), TxTypeAdjustRecordedAddrs, nil)
 	log.Debug("AdjustAddrsTXSent", "shardID", comID, "seedHeight", seedHeight)
 }
 
+/* 一条合约日志，日志被回滚时以相同的区块哈希和日志序号推送 removed */
+type ethLogKey struct {
+	blockHash string
+	logIndex  uint64
+}
+
+/* 一个分片一个高度的信标 */
+type tbKey struct {
+	shardID uint32
+	height  uint64
+}
+
+/** 本进程提交的一个信标或一个默克尔根，tb 和 root 中只有一个不为空
+ * resentFor 是上次因回滚重新提交时被回滚的区块哈希，同一笔交易的多条日志只重新提交一次
+ */
+type gethSubmission struct {
+	tb        *core.SignedTB
+	root      *core.SignedTBRoot
+	nodeID    uint32
+	resentFor string
+}
+
+func (tbChain *BeaconChain) recordSubmission(shardID uint32, height uint64, submission *gethSubmission) {
+	tbChain.lock_submitted.Lock()
+	defer tbChain.lock_submitted.Unlock()
+	tbChain.geth_submitted[tbKey{shardID: shardID, height: height}] = submission
+}
+
+/** 重新提交被回滚的信标，只有提交该信标的进程记录了它的多签名
+ * geth 也可能把原交易重新打包，合约允许重复提交同一信标，先上链的日志确认该信标
+ */
+func (tbChain *BeaconChain) resubmit(event *eth_chain.Event) {
+	tbChain.lock_submitted.Lock()
+	submission, ok := tbChain.geth_submitted[tbKey{shardID: event.ShardID, height: event.Height}]
+	if !ok || submission.resentFor == event.BlockHash {
+		tbChain.lock_submitted.Unlock()
+		return
+	}
+	submission.resentFor = event.BlockHash
+	tbChain.lock_submitted.Unlock()
+
+	log.Info("resubmit reorged time beacon", "shardID", event.ShardID, "height", event.Height, "ethHeight", event.Eth_height)
+	if submission.root != nil {
+		tbChain.AddTimeBeaconRoot2EthChain(submission.root, submission.nodeID)
+	} else {
+		tbChain.submitTimeBeacon(submission.tb, submission.nodeID)
+	}
+}
+
+
+/** 取出订阅到的 addTB 事件，把达到 Height2Confirm 个确认的信标打包成一个区块
+ * 没有信标达到确认数时返回 nil
+ */
 func (tbChain *BeaconChain) generateEthChainBlock() *TBBlock {
-	to_pack := false
-	start_eth_height := uint64(0)
-	if len(tbChain.geth_tbs_new) != 0 {
-		for h, _ := range tbChain.geth_tbs_new {
-			if start_eth_height == 0 {
-				start_eth_height = h
-			} else if h < start_eth_height {
-				start_eth_height = h
-			}
-		}
+	for len(eventChannel) > 0 {
+		tbChain.handleEthChainEvent(<-eventChannel)
 	}
-	for {
-		if len(eventChannel) == 0 {
-			break
-		}
+	if len(tbChain.geth_pending) == 0 {
+		return nil
+	}
+	_, head := eth_chain.GetLatestBlockHash(tbChain.getEthClient())
+	return tbChain.releaseEthChainTBs(head)
+}
 
-		event := <-eventChannel
-		// tbChain.height = uint64(utils.Max(int(tbChain.height), ))
-		if start_eth_height == 0 {
-			start_eth_height = event.Eth_height
+/** 记录一条 addTB 日志；被回滚（removed）的日志如果还未达到确认数则直接丢弃，
+ * 已推送的则从信标链视图中撤回并通知客户端。两种情况下本进程提交的信标都会被重新提交，
+ * 新的日志会再次确认该信标
+ */
+func (tbChain *BeaconChain) handleEthChainEvent(event *eth_chain.Event) {
+	key := ethLogKey{blockHash: event.BlockHash, logIndex: event.LogIndex}
+	if !event.Removed {
+		if _, ok := tbChain.geth_released[key]; !ok {
+			tbChain.geth_pending[key] = event
 		}
-		tb := &core.TimeBeacon{
-			ShardID: event.ShardID,
-			Height:  event.Height,
+		return
+	}
+	if _, ok := tbChain.geth_pending[key]; ok {
+		delete(tbChain.geth_pending, key)
+		log.Info("time beacon log removed by reorg before confirmation", "shardID", event.ShardID, "height", event.Height, "ethHeight", event.Eth_height)
+		tbChain.resubmit(event)
+		return
+	}
+	released, ok := tbChain.geth_released[key]
+	if !ok {
+		log.Debug("removed time beacon log not found", "shardID", event.ShardID, "height", event.Height, "ethHeight", event.Eth_height)
+		return
+	}
+	delete(tbChain.geth_released, key)
+	tbChain.lock.Lock()
+	tb, ok := tbChain.tbs[int(released.ShardID)][released.Height]
+	retracted := ok && tb.ConfirmHeight == released.Eth_height
+	if retracted {
+		delete(tbChain.tbs[int(released.ShardID)], released.Height)
+		block := tbChain.blockWithout(tb)
+		if block != nil {
+			tbChain.tbBlocks[block.Height] = block
 		}
-		if _, ok := tbChain.geth_tbs_new[event.Eth_height]; !ok {
-			tbChain.geth_tbs_new[event.Eth_height] = make(map[uint32][]*core.TimeBeacon)
+		if tbChain.store != nil {
+			if err := tbChain.store.retractTB(released.ShardID, released.Height, block); err != nil {
+				log.Warn("delete reorged tb from store fail", "err", err)
+			}
 		}
-		tbChain.geth_tbs_new[event.Eth_height][tb.ShardID] = append(tbChain.geth_tbs_new[event.Eth_height][tb.ShardID], tb)
+	}
+	tbChain.geth_reorged += 1
+	reorged := tbChain.geth_reorged
+	tbChain.lock.Unlock()
+	// 回滚深度超过了确认数，需要调大 Height2Confirm
+	log.Warn("confirmed time beacon reorged out, retracted until included again. consider a larger Height2Confirm",
+		"shardID", released.ShardID, "height", released.Height, "ethHeight", released.Eth_height,
+		"Height2Confirm", tbChain.cfg.Height2Confirm, "reorged", reorged)
+	if retracted {
+		tbChain.PushRetraction2Client(tb)
+	}
+	tbChain.resubmit(event)
+}
 
-		if event.Eth_height > start_eth_height {
-			to_pack = true
+/** 返回把信标 tb 从包含它的已推送区块中移除后的区块，没有找到时返回 nil
+ * 原区块已推送给订阅者，因此复制区块而不修改原区块。调用者需持有 tbChain.lock
+ */
+func (tbChain *BeaconChain) blockWithout(tb *ConfirmedTB) *TBBlock {
+	// 信标在不低于其确认高度的区块中推送
+	for height := tb.ConfirmHeight; height <= tbChain.headHeight; height++ {
+		block, ok := tbChain.tbBlocks[height]
+		if !ok || int(tb.ShardID) >= len(block.Tbs) {
+			continue
+		}
+		tbs := block.Tbs[tb.ShardID]
+		for i, t := range tbs {
+			if t.Height != tb.Height || t.ConfirmHeight != tb.ConfirmHeight {
+				continue
+			}
+			rebuilt := *block
+			rebuilt.Tbs = make([][]*ConfirmedTB, len(block.Tbs))
+			copy(rebuilt.Tbs, block.Tbs)
+			rebuilt.Tbs[tb.ShardID] = append(append(make([]*ConfirmedTB, 0, len(tbs)-1), tbs[:i]...), tbs[i+1:]...)
+			return &rebuilt
 		}
 	}
+	return nil
+}
 
-	// // 在当前设置中，当客户端注入交易完成时，会发送消息停止所有节点。
-	// // 节点退出时，交易未被全部处理，因而一定有未被打包的信标。
-	// // 因此，如果在运行时遇到len(tbChain.geth_tbs_new) == 0 的情况，可以肯定是因为没来得及获取到新确认的信标，直接返回nil即可
-	// // 结合以上代码，每个节点最多落后其他节点一个信标链高度，仍可以通过信标链与其他节点保持“同步”
-	// // 但这会导致该节点交易池对交易是否超时的判断有误吗？—— 不会，因为交易池判断依据是本分片的高度而非信标链的高度
-	// if len(tbChain.geth_tbs_new) == 0 {
-	// 	return nil
-	// }
-	if !to_pack { // 还没遇到下一个区块的信标，不能确定本区块信标全部接收到，暂不出块
+/** 把 head-Height2Confirm 及以下高度的日志中的信标打包成一个区块，区块高度为 head-Height2Confirm
+ * 同一以太坊区块的日志可能还未全部收到，因此至少需要1个确认
+ * 区块高度必须递增，head 没有前进时暂不出块
+ */
+func (tbChain *BeaconChain) releaseEthChainTBs(head uint64) *TBBlock {
+	depth := tbChain.cfg.Height2Confirm
+	if depth == 0 {
+		depth = 1
+	}
+	if head < depth {
+		return nil
+	}
+	confirmed := head - depth
+	tbChain.lock.Lock()
+	lastHeight := tbChain.headHeight
+	tbChain.lock.Unlock()
+	if confirmed <= lastHeight {
 		return nil
 	}
 
-	tbs_new := tbChain.geth_tbs_new[start_eth_height]
+	events := make([]*eth_chain.Event, 0)
+	for key, event := range tbChain.geth_pending {
+		if event.Eth_height <= confirmed {
+			events = append(events, event)
+			tbChain.geth_released[key] = event
+			delete(tbChain.geth_pending, key)
+		}
+	}
+	// 回滚通知最多追溯到最近 gethReorgWindow 个区块
+	tbChain.lock_submitted.Lock()
+	for key, event := range tbChain.geth_released {
+		if event.Eth_height+gethReorgWindow < confirmed {
+			delete(tbChain.geth_released, key)
+			delete(tbChain.geth_submitted, tbKey{shardID: event.ShardID, height: event.Height})
+		}
+	}
+	tbChain.lock_submitted.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Eth_height != events[j].Eth_height {
+			return events[i].Eth_height < events[j].Eth_height
+		}
+		return events[i].LogIndex < events[j].LogIndex
+	})
 
 	now := time.Now().Unix()
-
 	confirmTBs := make([][]*ConfirmedTB, tbChain.shardNum)
-	for shardID, tbs := range tbs_new {
-		for _, tb := range tbs {
-			confirmedTB := &ConfirmedTB{
-				TimeBeacon:    *tb,
-				ConfirmTime:   uint64(now),
-				ConfirmHeight: tbChain.height,
-			}
-			confirmTBs[shardID] = append(confirmTBs[shardID], confirmedTB)
+	tbChain.lock.Lock()
+	for _, event := range events {
+		confirmedTB := &ConfirmedTB{
+			TimeBeacon:    core.TimeBeacon{ShardID: event.ShardID, Height: event.Height},
+			ConfirmTime:   uint64(now),
+			ConfirmHeight: event.Eth_height,
 		}
-		tbChain.tbs[int(shardID)] = append(tbChain.tbs[int(shardID)], confirmTBs[shardID]...)
+		confirmTBs[event.ShardID] = append(confirmTBs[event.ShardID], confirmedTB)
+		tbChain.confirmTB(confirmedTB)
 	}
+	tbChain.lock.Unlock()
 
 	block := &TBBlock{
 		Tbs:    confirmTBs,
 		Time:   uint64(now),
-		Height: start_eth_height,
+		Height: confirmed,
 	}
 
-	delete(tbChain.geth_tbs_new, start_eth_height)
-
 	log.Debug("TBchainGenerateBlock", "info", block)
 	return block
 }
@@ -178,12 +459,17 @@ func (tbChain *BeaconChain) deployContract(genesisTBs []eth_chain.ContractTB) {
 	// 创建合约，各分片创世区块作为构造函数的参数
 	client := tbChain.getEthClient()
 
-	tbChain.contractAddr, tbChain.contractAbi, _, _ = eth_chain.DeployContract(client,
+	var cost *eth_chain.TxCost
+	tbChain.contractAddr, tbChain.contractAbi, cost, _ = eth_chain.DeployContract(client,
 		tbChain.mode, genesisTBs,
 		uint32(tbChain.cfg.MultiSignRequiredNum),
 		uint32(tbChain.shardNum),
 		tbChain.addrs,
 		tbChain.cfg.ChainId)
+	if cost != nil {
+		// 创世信标随部署交易上链，部署开销不归属于任何分片
+		tbChain.sendGasReport(-1, TxTypeDeploy, nil, cost)
+	}
 }
 
 func (tbChain *BeaconChain) getEthClient() *ethclient.Client {
@@ -0,0 +1,131 @@
+package beaconChain
+
+import (
+	"encoding/binary"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+/* 信标链视图在本地数据库中的存储格式 */
+var (
+	storeTBPrefix    = []byte("t")    // storeTBPrefix + shardID (uint32 big endian) + height (uint64 big endian) -> ConfirmedTB
+	storeBlockPrefix = []byte("b")    // storeBlockPrefix + height (uint64 big endian) -> TBBlock
+	storeHeadKey     = []byte("head") // 已持久化的最高区块高度 (uint64 big endian)
+)
+
+func storeTBKey(shardID uint32, height uint64) []byte {
+	key := make([]byte, len(storeTBPrefix)+12)
+	copy(key, storeTBPrefix)
+	binary.BigEndian.PutUint32(key[len(storeTBPrefix):], shardID)
+	binary.BigEndian.PutUint64(key[len(storeTBPrefix)+4:], height)
+	return key
+}
+
+func storeBlockKey(height uint64) []byte {
+	key := make([]byte, len(storeBlockPrefix)+8)
+	copy(key, storeBlockPrefix)
+	binary.BigEndian.PutUint64(key[len(storeBlockPrefix):], height)
+	return key
+}
+
+/** 持久化已推送的信标和信标链区块，客户端或节点重启后据此恢复信标链视图
+ * 每个合约一个数据库，重新部署合约（新的实验）不会读到上次实验的信标
+ */
+type tbStore struct {
+	db ethdb.Database
+}
+
+func openTBStore(dataDir string, contractAddr common.Address) (*tbStore, error) {
+	path := filepath.Join(dataDir, "tbchain", contractAddr.Hex())
+	db, err := rawdb.NewLevelDBDatabase(path, 0, 0, "", false)
+	if err != nil {
+		return nil, err
+	}
+	return &tbStore{db: db}, nil
+}
+
+func (store *tbStore) close() error {
+	return store.db.Close()
+}
+
+/* 写入一个已推送的区块及其中的信标，区块高度递增时更新 head */
+func (store *tbStore) writeBlock(block *TBBlock) error {
+	batch := store.db.NewBatch()
+	for _, tbs := range block.Tbs {
+		for _, tb := range tbs {
+			data, err := rlp.EncodeToBytes(tb)
+			if err != nil {
+				return err
+			}
+			batch.Put(storeTBKey(tb.ShardID, tb.Height), data)
+		}
+	}
+	data, err := rlp.EncodeToBytes(block)
+	if err != nil {
+		return err
+	}
+	batch.Put(storeBlockKey(block.Height), data)
+	if head, ok := store.head(); !ok || block.Height > head {
+		batch.Put(storeHeadKey, encodeHeight(block.Height))
+	}
+	return batch.Write()
+}
+
+/* 删除被回滚的信标，block 不为 nil 时同时写入移除了该信标的区块 */
+func (store *tbStore) retractTB(shardID uint32, height uint64, block *TBBlock) error {
+	batch := store.db.NewBatch()
+	batch.Delete(storeTBKey(shardID, height))
+	if block != nil {
+		data, err := rlp.EncodeToBytes(block)
+		if err != nil {
+			return err
+		}
+		batch.Put(storeBlockKey(block.Height), data)
+	}
+	return batch.Write()
+}
+
+func (store *tbStore) head() (uint64, bool) {
+	data, err := store.db.Get(storeHeadKey)
+	if err != nil || len(data) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(data), true
+}
+
+/* 读出所有信标和区块 */
+func (store *tbStore) load() ([]*ConfirmedTB, []*TBBlock, error) {
+	tbs := make([]*ConfirmedTB, 0)
+	it := store.db.NewIterator(storeTBPrefix, nil)
+	for it.Next() {
+		tb := new(ConfirmedTB)
+		if err := rlp.DecodeBytes(it.Value(), tb); err != nil {
+			it.Release()
+			return nil, nil, err
+		}
+		tbs = append(tbs, tb)
+	}
+	it.Release()
+
+	blocks := make([]*TBBlock, 0)
+	it = store.db.NewIterator(storeBlockPrefix, nil)
+	defer it.Release()
+	for it.Next() {
+		block := new(TBBlock)
+		if err := rlp.DecodeBytes(it.Value(), block); err != nil {
+			return nil, nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return tbs, blocks, it.Error()
+}
+
+func encodeHeight(height uint64) []byte {
+	enc := make([]byte, 8)
+	binary.BigEndian.PutUint64(enc, height)
+	return enc
+}
@@ -14,6 +14,8 @@ type Cfg struct {
 	IsProgressBar       bool   `json:"IsProgressBar"`
 	IsLogProgress       bool   `json:"IsLogProgress"`
 	LogProgressInterval int    `json:"LogProgressInterval"`
+	// 各节点、客户端和booter的数据目录（链数据、私钥、身份表）所在的目录，为空时使用 $HOME/.lessChain
+	DataDir string `json:"DataDir"`
 
 	Role string `json:"Role"`
 
@@ -21,6 +23,8 @@ type Cfg struct {
 	ClientId  int `json:"ClientId"`
 
 	ShardNum             int `json:"ShardNum"`
+	MachineNum           int `json:"MachineNum"`      // 仅由启动脚本使用：运行分片节点的机器数
+	ShardStartIndex      int `json:"ShardStartIndex"` // 仅由启动脚本使用：本机运行的第一个分片
 	ShardId              int `json:"ShardId"`
 	ShardSize            int `json:"ShardSize"`
 	ComAllNodeNum        int `json:"ComAllNodeNum"`
@@ -43,6 +47,35 @@ type Cfg struct {
 	BeaconChainPort int `json:"BeaconChainPort"`
 	ExitMode        int `json:"ExitMode"`
 	ReconfigTime    int `json:"ReconfigTime"`
+
+	TBSubmit    string `json:"TBSubmit"`    // 信标的提交方式：single、batch 或 accumulator，为空时等同 single，见 core.TBSubmitSingle
+	TBBatchSize int    `json:"TBBatchSize"` // 一笔 addTBs 交易最多包含的信标数，或累加器一个默克尔根包含的信标数；0表示使用默认值8
+
+	TBEventSource string `json:"TBEventSource"` // 读取合约日志的方式：websocket（默认，断开后重新订阅）或 polling（只用 http 接口轮询）
+
+	Seed int64 `json:"Seed"` // 全局随机数种子，0表示使用默认种子1
+
+	EnableTLS      bool         `json:"EnableTLS"`      // 节点、客户端和booter之间使用tls加密通信
+	VerifyEnvelope bool         `json:"VerifyEnvelope"` // 验证收到的消息的签名者、接收方和序号，需能确定所有发送方的账户，见 messageHub/envelope.go
+	Faults         *FaultConfig `json:"Faults"`         // 网络故障注入，见 fault.go
+
+	Compression       string `json:"Compression"`       // 节点间消息的压缩算法，为空不压缩，目前支持 snappy
+	CompressThreshold int    `json:"CompressThreshold"` // 小于该字节数的消息不压缩，0表示使用默认值
+
+	Broadcast       string `json:"Broadcast"`       // 委员会内广播的分发策略：direct、tree 或 gossip，为空时等同 direct
+	BroadcastFanout int    `json:"BroadcastFanout"` // 树的分叉数或 gossip 每次转发的节点数，0表示使用默认值
+
+	InboundQueue *InboundQueueConfig `json:"InboundQueue"` // 接收队列，为nil时不开启
+
+	Topology   string `json:"Topology"`   // 集群地址配置文件(json或yaml)，见 topology.go；为空时使用 node.go 中的地址表
+	Discovery  bool   `json:"Discovery"`  // 节点和客户端启动时向booter注册地址并获取地址表，不使用 cfg/node.go 中固定的地址表
+	ListenAddr string `json:"ListenAddr"` // 本进程的监听地址(ip:port)，为空时使用 cfg/node.go 中本进程的地址
+	BooterAddr string `json:"BooterAddr"` // booter的地址，为空时使用 cfg/node.go 中的地址
+	// 集群口令，非空时booter只接受带有该口令hmac的注册，节点和客户端也据此验证booter下发的地址表
+	ClusterToken string `json:"ClusterToken"`
+
+	AdminAddr  string `json:"AdminAddr"`  // 本地管理接口(http/json)的监听地址，为空时不开启，端口为0时自动选择，见 controller/admin.go
+	AdminToken string `json:"AdminToken"` // 管理接口的口令，非空时请求需带有 Authorization: Bearer <口令>；不是回环地址的 AdminAddr 必须设置
 }
 
 var (
@@ -69,7 +102,10 @@ func ReadCfg(filename string) *Cfg {
 		os.Exit(1)
 	}
 	var cfg Cfg
-	json.Unmarshal(jsonData, &cfg)
+	if err := json.Unmarshal(jsonData, &cfg); err != nil {
+		fmt.Println("error parsing json file", filename, err)
+		os.Exit(1)
+	}
 	// log.Info(fmt.Sprintf("%#v", cfg)) // 此处还未初始化
 	return &cfg
 }
@@ -78,12 +114,43 @@ const (
 	datadir = ".lessChain"
 )
 
-/** 返回所有节点存储数据的默认父路径
- * $Home/.lessChain/
+// 配置中指定的数据目录，为空时使用 $HOME/.lessChain
+var dataDirOverride string
+
+/** 返回所有节点存储数据的父路径
+ * 配置了 DataDir 时为该目录，否则为 $Home/.lessChain/
  */
 func DefaultDataDir() string {
+	if dataDirOverride != "" {
+		return dataDirOverride
+	}
 	// Try to place the data folder in the user's home dir
 	home := os.Getenv("HOME")
 	return filepath.Join(home, datadir)
 
 }
+
+/* 使用配置中的 DataDir 作为数据目录，相对路径相对于当前目录，需在任何角色启动之前调用 */
+func (c *Cfg) ApplyDataDir() error {
+	if c.DataDir == "" {
+		return nil
+	}
+	dir, err := filepath.Abs(c.DataDir)
+	if err != nil {
+		return err
+	}
+	dataDirOverride = dir
+	return nil
+}
+
+/** 每条被动连接上共识类和交易类消息各有一个有界队列
+ * Size 为0或 Policy 为空时使用默认值（共识1024、交易4096，都为 block）。
+ * Policy 为 block 时队列满后停止读取该连接，为 drop 时丢弃新消息（区块、回执和注入完成消息仍等待空位）；
+ * 交易队列设为 drop 时，交易过多时共识消息仍能继续被读取，但被丢弃的交易不会被执行
+ */
+type InboundQueueConfig struct {
+	ConsensusSize   int    `json:"ConsensusSize"`
+	ConsensusPolicy string `json:"ConsensusPolicy"`
+	TxSize          int    `json:"TxSize"`
+	TxPolicy        string `json:"TxPolicy"`
+}
@@ -0,0 +1,42 @@
+package cfg
+
+/** 网络故障注入的配置，为nil时所有消息立即投递
+ * 节点的名字为 S<分片ID>N<节点ID>（按 NodeTable 中的位置），客户端为 C<客户端ID>，booter 为 B，信标链为 TB。
+ * 名字可以使用 path.Match 的通配符，如 S0N* 表示分片0的所有节点，C* 表示所有客户端。
+ * 相同的 Seed 和配置下，各进程的随机决策序列相同，实验结果可复现
+ */
+type FaultConfig struct {
+	Seed       int64               `json:"Seed"`
+	Groups     map[string][]string `json:"Groups"` // 组名 -> 成员名列表
+	Links      []LinkFault         `json:"Links"`
+	Partitions []Partition         `json:"Partitions"`
+}
+
+/** 一条链路上的故障规则，From 和 To 可以是组名或成员名
+ * 一条消息对每个目标只使用第一条匹配的规则
+ */
+type LinkFault struct {
+	From string `json:"From"`
+	To   string `json:"To"`
+
+	Latency        LatencyDist `json:"Latency"`
+	BandwidthKBps  float64     `json:"BandwidthKBps"` // 0表示不限速
+	DropRate       float64     `json:"DropRate"`
+	DupRate        float64     `json:"DupRate"`
+	ReorderRate    float64     `json:"ReorderRate"`
+	ReorderDelayMs float64     `json:"ReorderDelayMs"` // 被乱序的消息额外延迟的时间
+}
+
+/* 链路延迟的分布 */
+type LatencyDist struct {
+	Dist   string  `json:"Dist"` // const、uniform、normal 或 exp，为空时等同 const
+	MeanMs float64 `json:"MeanMs"`
+	StdMs  float64 `json:"StdMs"` // normal 的标准差；uniform 时取值范围为 [MeanMs-StdMs, MeanMs+StdMs]
+}
+
+/* 定时的网络分区，期间 Groups 中任意两个不同组之间的消息被丢弃 */
+type Partition struct {
+	Groups    []string `json:"Groups"`
+	StartSecs float64  `json:"StartSecs"` // 相对于消息中心启动的时间
+	EndSecs   float64  `json:"EndSecs"`   // 0表示一直持续
+}
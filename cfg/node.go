@@ -8,6 +8,8 @@ var (
 	ClientTable  map[uint32]string
 	NodeTable    map[uint32]map[uint32]string // 分片->节点
 	ComNodeTable map[uint32]map[uint32]string // 委员会->节点
+	// 角色名(S<分片>N<节点>、C<客户端>、B) -> 该角色应使用的账户地址，由地址配置文件给出
+	AccountTable map[string]string
 )
 
 // 包被引用时自动执行init函数
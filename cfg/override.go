@@ -0,0 +1,110 @@
+package cfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* 覆写配置字段的环境变量前缀，如 LESSCHAIN_SHARDNUM=4 */
+const EnvPrefix = "LESSCHAIN_"
+
+/* 按 json 字段名（不区分大小写）找到 Cfg 中的字段 */
+func (c *Cfg) field(key string) (reflect.Value, string, bool) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if strings.EqualFold(name, key) {
+			return v.Field(i), name, true
+		}
+	}
+	return reflect.Value{}, "", false
+}
+
+/* 所有配置字段的 json 名，按字母序排列 */
+func FieldNames() []string {
+	t := reflect.TypeOf(Cfg{})
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, strings.Split(t.Field(i).Tag.Get("json"), ",")[0])
+	}
+	sort.Strings(names)
+	return names
+}
+
+/** 覆写一个配置字段，key 为字段的 json 名（不区分大小写）
+ * value 按字段的类型解析：整数、布尔值和字符串直接给出，Faults、InboundQueue 等结构体字段给出 json
+ */
+func (c *Cfg) Set(key, value string) error {
+	f, name, ok := c.field(key)
+	if !ok {
+		return fmt.Errorf("unknown config field %q", key)
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, f.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%s=%s: expected an integer", name, value)
+		}
+		f.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s=%s: expected true or false", name, value)
+		}
+		f.SetBool(b)
+	default:
+		p := reflect.New(f.Type())
+		if err := json.Unmarshal([]byte(value), p.Interface()); err != nil {
+			return fmt.Errorf("%s=%s: expected json for %s: %v", name, value, f.Type(), err)
+		}
+		f.Set(p.Elem())
+	}
+	return nil
+}
+
+/* 解析 Key=Value 形式的覆写并应用 */
+func (c *Cfg) SetKeyValue(kv string) error {
+	i := strings.Index(kv, "=")
+	if i <= 0 {
+		return fmt.Errorf("invalid override %q, expected Key=Value", kv)
+	}
+	return c.Set(kv[:i], kv[i+1:])
+}
+
+/** 用 LESSCHAIN_<字段名> 环境变量覆写配置，字段名不区分大小写
+ * 前缀匹配但字段不存在的变量视为错误，避免拼写错误被忽略；返回应用的变量
+ */
+func (c *Cfg) ApplyEnv(environ []string) ([]string, error) {
+	var applied []string
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		kv = strings.TrimPrefix(kv, EnvPrefix)
+		if err := c.SetKeyValue(kv); err != nil {
+			return applied, fmt.Errorf("environment %s%s: %v", EnvPrefix, kv, err)
+		}
+		applied = append(applied, EnvPrefix+kv)
+	}
+	return applied, nil
+}
+
+/* 字段的当前值，字符串原样返回，其他类型为 json */
+func (c *Cfg) Get(key string) (string, error) {
+	f, _, ok := c.field(key)
+	if !ok {
+		return "", fmt.Errorf("unknown config field %q", key)
+	}
+	if f.Kind() == reflect.String {
+		return f.String(), nil
+	}
+	data, err := json.Marshal(f.Interface())
+	return string(data), err
+}
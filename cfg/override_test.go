@@ -0,0 +1,41 @@
+package cfg
+
+import (
+	"testing"
+)
+
+func TestOverride(t *testing.T) {
+	c := ReadCfg("debug.json")
+
+	// 字段名不区分大小写，值按字段类型解析
+	for _, kv := range []string{"shardnum=3", "ReconfigMode=fastsync", "EnableTLS=true", "Seed=-7", `InboundQueue={"TxSize": 10, "TxPolicy": "drop"}`, "BooterAddr=10.0.0.1:18000"} {
+		if err := c.SetKeyValue(kv); err != nil {
+			t.Fatalf("%s: %v", kv, err)
+		}
+	}
+	if c.ShardNum != 3 || c.ReconfigMode != "fastsync" || !c.EnableTLS || c.Seed != -7 || c.InboundQueue.TxSize != 10 || c.BooterAddr != "10.0.0.1:18000" {
+		t.Fatalf("overrides not applied: %+v", c)
+	}
+	if v, err := c.Get("InboundQueue"); err != nil || v != `{"ConsensusSize":0,"ConsensusPolicy":"","TxSize":10,"TxPolicy":"drop"}` {
+		t.Fatalf("unexpected InboundQueue: %s %v", v, err)
+	}
+
+	// 类型不符、不存在的字段和格式错误都被拒绝，且不改变原值
+	for _, kv := range []string{"ShardNum=four", "ShardNum=", "EnableTLS=yes", "Faults=[1]", "ShardCount=4", "ShardNum"} {
+		if err := c.SetKeyValue(kv); err == nil {
+			t.Errorf("%s accepted", kv)
+		}
+	}
+	if c.ShardNum != 3 {
+		t.Fatalf("ShardNum changed by rejected override: %d", c.ShardNum)
+	}
+
+	// 只处理带前缀的环境变量
+	applied, err := c.ApplyEnv([]string{"HOME=/root", "LESSCHAIN_INJECTSPEED=500", "LESSCHAIN_ClientNum=2"})
+	if err != nil || len(applied) != 2 || c.InjectSpeed != 500 || c.ClientNum != 2 {
+		t.Fatalf("env not applied: %v %v", applied, err)
+	}
+	if _, err := c.ApplyEnv([]string{"LESSCHAIN_INJECTSPEEDS=500"}); err == nil {
+		t.Fatalf("unknown env field accepted")
+	}
+}
@@ -0,0 +1,159 @@
+package cfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+/** 参数扫描实验的配置，由 lessChain sweep 读入，json 或 yaml 格式
+ * Grid 中每个参数的取值做笛卡尔积，每个组合在 Base 配置的基础上覆写这些参数，运行 Repetitions 次
+ * 第 r 次运行(从0开始)使用随机数种子 Seed+r，不同组合的同一次运行种子相同
+ */
+type Sweep struct {
+	Name        string                   `json:"Name" yaml:"Name"`
+	Base        string                   `json:"Base" yaml:"Base"` // 基础配置文件，为空时使用 -m 选择的配置文件
+	Grid        map[string][]interface{} `json:"Grid" yaml:"Grid"` // Cfg 的 json 字段名 -> 取值列表
+	Repetitions int                      `json:"Repetitions" yaml:"Repetitions"`
+	Seed        int64                    `json:"Seed" yaml:"Seed"`
+	TimeoutSecs int                      `json:"TimeoutSecs" yaml:"TimeoutSecs"` // 单次运行的最长时间，0表示不限制
+	OutDir      string                   `json:"OutDir" yaml:"OutDir"`           // 为空时使用 experiments/sweep-<Name>
+}
+
+/* 参数网格中的一个组合，Values 与 Sweep.Params() 一一对应 */
+type SweepPoint struct {
+	Index  int
+	Values []interface{}
+}
+
+/* 按扩展名读取 json 或 yaml 格式的扫描配置 */
+func ReadSweep(filename string) (*Sweep, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var s Sweep
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, &s)
+	default:
+		err = json.Unmarshal(data, &s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse sweep file %s: %v", filename, err)
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	}
+	if s.Repetitions < 1 {
+		s.Repetitions = 1
+	}
+	if s.OutDir == "" {
+		s.OutDir = filepath.Join("experiments", "sweep-"+s.Name)
+	}
+	return &s, nil
+}
+
+/* 网格中的参数名，按字母序排列 */
+func (s *Sweep) Params() []string {
+	params := make([]string, 0, len(s.Grid))
+	for p := range s.Grid {
+		params = append(params, p)
+	}
+	sort.Strings(params)
+	return params
+}
+
+/* 参数网格的所有组合，最后一个参数变化最快 */
+func (s *Sweep) Points() []SweepPoint {
+	params := s.Params()
+	points := []SweepPoint{{Values: []interface{}{}}}
+	for _, p := range params {
+		var next []SweepPoint
+		for _, point := range points {
+			for _, v := range s.Grid[p] {
+				values := append(append([]interface{}{}, point.Values...), v)
+				next = append(next, SweepPoint{Values: values})
+			}
+		}
+		points = next
+	}
+	for i := range points {
+		points[i].Index = i
+	}
+	return points
+}
+
+/** 在 base 的副本上覆写一个组合中的参数
+ * 参数名必须是 Cfg 的 json 字段名，取值的类型必须与字段一致
+ */
+func (s *Sweep) Apply(base *Cfg, point SweepPoint) (*Cfg, error) {
+	data, err := json.Marshal(base)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for i, p := range s.Params() {
+		if _, ok := fields[p]; !ok {
+			return nil, fmt.Errorf("sweep parameter %q is not a config field", p)
+		}
+		v, err := json.Marshal(normalizeYAML(point.Values[i]))
+		if err != nil {
+			return nil, fmt.Errorf("sweep parameter %s: %v", p, err)
+		}
+		fields[p] = v
+	}
+	if data, err = json.Marshal(fields); err != nil {
+		return nil, err
+	}
+	c := new(Cfg)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("sweep point %d: %v", point.Index, err)
+	}
+	return c, nil
+}
+
+/* 检查所有参数名和取值，在运行任何组合之前调用 */
+func (s *Sweep) Check(base *Cfg) error {
+	if len(s.Grid) == 0 {
+		return fmt.Errorf("sweep %s: empty Grid", s.Name)
+	}
+	for _, p := range s.Params() {
+		if len(s.Grid[p]) == 0 {
+			return fmt.Errorf("sweep parameter %s has no values", p)
+		}
+	}
+	for _, point := range s.Points() {
+		if _, err := s.Apply(base, point); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* yaml 解析出的 map 的键是 interface{}，转换为 json 可以编码的类型 */
+func normalizeYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalizeYAML(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalizeYAML(e)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,56 @@
+package cfg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSweep(t *testing.T) {
+	// 示例扫描配置中的参数都是合法的配置字段
+	s, err := ReadSweep("../experiments/sweep.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := ReadCfg("debug.json")
+	if err := s.Check(base); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Points()); n != 3*2*2*1*2 {
+		t.Fatalf("got %d points", n)
+	}
+
+	file := filepath.Join(t.TempDir(), "sweep.json")
+	err = os.WriteFile(file, []byte(`{"Grid": {"ShardNum": [2, 4], "ReconfigMode": ["lesssync", "fastsync"]}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = ReadSweep(file); err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "sweep" || s.Repetitions != 1 || s.OutDir != filepath.Join("experiments", "sweep-sweep") {
+		t.Fatalf("unexpected defaults: %+v", s)
+	}
+	// 参数按字母序排列，最后一个参数变化最快
+	points := s.Points()
+	c, err := s.Apply(base, points[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ReconfigMode != "lesssync" || c.ShardNum != 4 || c.InjectSpeed != base.InjectSpeed {
+		t.Fatalf("unexpected config for point 1: %+v", c)
+	}
+	if base.ShardNum == 4 {
+		t.Fatalf("base config modified")
+	}
+
+	// 类型不符和不存在的字段在运行前被发现
+	s.Grid = map[string][]interface{}{"ShardNum": {"four"}}
+	if err := s.Check(base); err == nil {
+		t.Fatalf("wrong type accepted")
+	}
+	s.Grid = map[string][]interface{}{"ShardCount": {4}}
+	if err := s.Check(base); err == nil {
+		t.Fatalf("unknown field accepted")
+	}
+}
@@ -0,0 +1,215 @@
+package cfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"gopkg.in/yaml.v2"
+)
+
+/** 集群的地址配置，由 Cfg.Topology 指定的 json 或 yaml 文件读入，代替 node.go 中固定的地址表
+ * 分片节点的地址按以下顺序确定：
+ * 1. Shards 中单独列出的分片，Addrs 给出每个节点的地址，或 Hosts 与 StartPort 按节点ID依次分配；
+ * 2. 其余分片按机器分组：分片 i 运行在 Machines[i%len(Machines)] 上，同一台机器上第 k 轮的分片
+ *    使用端口 StartPort+k*PortsPerShard 起的 PortsPerShard 个端口，与 start_lessChain_for_linux.sh
+ *    中 MachineNum、ShardStartIndex 的分配方式一致
+ */
+type Topology struct {
+	GethAddr string   `json:"GethAddr" yaml:"GethAddr"` // geth私链的ip
+	Booter   string   `json:"Booter" yaml:"Booter"`     // ip:port
+	Clients  []string `json:"Clients" yaml:"Clients"`   // 第i个为客户端i的地址
+
+	Machines      []string `json:"Machines" yaml:"Machines"`
+	StartPort     int      `json:"StartPort" yaml:"StartPort"`
+	PortsPerShard int      `json:"PortsPerShard" yaml:"PortsPerShard"` // 0表示20
+
+	Shards map[uint32]*ShardTopology `json:"Shards" yaml:"Shards"`
+
+	// 角色名(S<分片>N<节点>、C<客户端>、B) -> 账户地址，各进程据此验证消息和连接的来源
+	// 未列出的角色使用数据目录下公开身份表中的账户，只在共享数据目录时可用
+	Accounts map[string]string `json:"Accounts" yaml:"Accounts"`
+}
+
+/* 单独指定地址的分片，Addrs 不为空时忽略 Hosts */
+type ShardTopology struct {
+	Addrs     []string `json:"Addrs" yaml:"Addrs"`         // 第j个为节点j的地址
+	Hosts     []string `json:"Hosts" yaml:"Hosts"`         // 节点j运行在 Hosts[j%len(Hosts)] 上
+	StartPort int      `json:"StartPort" yaml:"StartPort"` // 节点j使用端口 StartPort+j
+}
+
+const defaultPortsPerShard = 20
+
+/* 按扩展名读取 json 或 yaml 格式的地址配置 */
+func ReadTopology(filename string) (*Topology, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var t Topology
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, &t)
+	default:
+		err = json.Unmarshal(data, &t)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse topology file %s: %v", filename, err)
+	}
+	return &t, nil
+}
+
+func (t *Topology) shardAddr(shardID, nodeID uint32) (string, error) {
+	if s, ok := t.Shards[shardID]; ok {
+		switch {
+		case len(s.Addrs) > 0:
+			if int(nodeID) >= len(s.Addrs) {
+				return "", fmt.Errorf("shard %d lists %d addresses, no address for node %d", shardID, len(s.Addrs), nodeID)
+			}
+			return s.Addrs[nodeID], nil
+		case len(s.Hosts) > 0:
+			return net.JoinHostPort(s.Hosts[int(nodeID)%len(s.Hosts)], strconv.Itoa(s.StartPort+int(nodeID))), nil
+		default:
+			return "", fmt.Errorf("shard %d has neither Addrs nor Hosts", shardID)
+		}
+	}
+	if len(t.Machines) == 0 {
+		return "", fmt.Errorf("no address for shard %d: not listed in Shards and no Machines", shardID)
+	}
+	portsPerShard := t.PortsPerShard
+	if portsPerShard <= 0 {
+		portsPerShard = defaultPortsPerShard
+	}
+	if int(nodeID) >= portsPerShard {
+		return "", fmt.Errorf("node %d of shard %d exceeds the %d ports per shard", nodeID, shardID, portsPerShard)
+	}
+	host := t.Machines[int(shardID)%len(t.Machines)]
+	round := int(shardID) / len(t.Machines)
+	return net.JoinHostPort(host, strconv.Itoa(t.StartPort+round*portsPerShard+int(nodeID))), nil
+}
+
+/** 按本次运行的分片数、每个委员会的节点数和客户端数生成地址表
+ * 所有需要的分片节点、客户端以及 booter 都必须有合法且互不相同的地址，否则返回列出所有问题的错误
+ */
+func (t *Topology) Tables(shardNum, comAllNodeNum, clientNum int) (map[uint32]map[uint32]string, map[uint32]string, error) {
+	var problems []string
+	owners := make(map[string]string)
+	check := func(owner, addr string) bool {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || host == "" {
+			problems = append(problems, fmt.Sprintf("%s: invalid address %q", owner, addr))
+			return false
+		}
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			problems = append(problems, fmt.Sprintf("%s: invalid port in %q", owner, addr))
+			return false
+		}
+		if o, ok := owners[addr]; ok {
+			problems = append(problems, fmt.Sprintf("%s: address %s already used by %s", owner, addr, o))
+			return false
+		}
+		owners[addr] = owner
+		return true
+	}
+
+	if t.Booter == "" {
+		problems = append(problems, "Booter: missing")
+	} else {
+		check("booter", t.Booter)
+	}
+
+	nodeTable := make(map[uint32]map[uint32]string)
+	for i := 0; i < shardNum; i++ {
+		nodeTable[uint32(i)] = make(map[uint32]string)
+		for j := 0; j < comAllNodeNum; j++ {
+			addr, err := t.shardAddr(uint32(i), uint32(j))
+			if err != nil {
+				problems = append(problems, err.Error())
+				break
+			}
+			if check(fmt.Sprintf("S%dN%d", i, j), addr) {
+				nodeTable[uint32(i)][uint32(j)] = addr
+			}
+		}
+	}
+	for shardID := range t.Shards {
+		if int(shardID) >= shardNum {
+			problems = append(problems, fmt.Sprintf("shard %d listed in Shards but ShardNum is %d", shardID, shardNum))
+		}
+	}
+
+	clientTable := make(map[uint32]string)
+	if len(t.Clients) < clientNum {
+		problems = append(problems, fmt.Sprintf("Clients: %d addresses for %d clients", len(t.Clients), clientNum))
+	}
+	for i := 0; i < clientNum && i < len(t.Clients); i++ {
+		if check(fmt.Sprintf("C%d", i), t.Clients[i]) {
+			clientTable[uint32(i)] = t.Clients[i]
+		}
+	}
+
+	for slot, account := range t.Accounts {
+		if !isSlotName(slot, shardNum, comAllNodeNum, clientNum) {
+			problems = append(problems, fmt.Sprintf("Accounts: unknown role %q", slot))
+		} else if !common.IsHexAddress(account) {
+			problems = append(problems, fmt.Sprintf("Accounts: invalid account %q of %s", account, slot))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, nil, fmt.Errorf("invalid topology:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nodeTable, clientTable, nil
+}
+
+/* slot 是否为本次运行中某个角色的名字 */
+func isSlotName(slot string, shardNum, comAllNodeNum, clientNum int) bool {
+	if slot == "B" {
+		return true
+	}
+	var i, j int
+	if n, err := fmt.Sscanf(slot, "S%dN%d", &i, &j); err == nil && n == 2 && fmt.Sprintf("S%dN%d", i, j) == slot {
+		return i >= 0 && i < shardNum && j >= 0 && j < comAllNodeNum
+	}
+	if n, err := fmt.Sscanf(slot, "C%d", &i); err == nil && n == 1 && fmt.Sprintf("C%d", i) == slot {
+		return i >= 0 && i < clientNum
+	}
+	return false
+}
+
+/** 读取地址配置，校验后替换 node.go 中的地址表
+ * 出错时保留原来的地址表
+ */
+func LoadTopology(filename string, shardNum, comAllNodeNum, clientNum int) error {
+	t, err := ReadTopology(filename)
+	if err != nil {
+		return err
+	}
+	return t.Apply(shardNum, comAllNodeNum, clientNum)
+}
+
+/* 校验地址配置并替换 node.go 中的地址表，出错时保留原来的地址表 */
+func (t *Topology) Apply(shardNum, comAllNodeNum, clientNum int) error {
+	nodeTable, clientTable, err := t.Tables(shardNum, comAllNodeNum, clientNum)
+	if err != nil {
+		return err
+	}
+	NodeTable = nodeTable
+	// 初始时ComNodeTable与NodeTable相等，重组时会发现变化
+	ComNodeTable = NodeTable
+	ClientTable = clientTable
+	BooterAddr = t.Booter
+	AccountTable = t.Accounts
+	if t.GethAddr != "" {
+		GethIPAddr = t.GethAddr
+	}
+	gethChainPriKeys = nil
+	return nil
+}
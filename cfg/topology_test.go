@@ -0,0 +1,85 @@
+package cfg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTopology(t *testing.T) {
+	// 示例文件按机器分组生成的地址表与 node.go 中的相同
+	topo, err := ReadTopology("topology.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeTable, clientTable, err := topo.Tables(len(NodeTable), 20, len(ClientTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for shardID, list := range NodeTable {
+		for nodeID, addr := range list {
+			if nodeTable[shardID][nodeID] != addr {
+				t.Fatalf("S%dN%d: got %s, want %s", shardID, nodeID, nodeTable[shardID][nodeID], addr)
+			}
+		}
+	}
+	if clientTable[0] != ClientTable[0] || topo.Booter != BooterAddr || topo.GethAddr != GethIPAddr {
+		t.Fatalf("unexpected client, booter or geth address")
+	}
+
+	yamlFile := filepath.Join(t.TempDir(), "topology.yaml")
+	err = os.WriteFile(yamlFile, []byte(`
+Booter: 10.0.0.1:18000
+Clients: [10.0.0.1:19000]
+Machines: [10.0.0.2]
+StartPort: 20000
+Shards:
+  1:
+    Hosts: [10.0.0.3, 10.0.0.4]
+    StartPort: 30000
+  2:
+    Addrs: [10.0.0.5:1, 10.0.0.5:2]
+Accounts:
+  S0N1: "0x00000000000000000000000000000000000000a1"
+  B: "0x00000000000000000000000000000000000000b0"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo, err = ReadTopology(yamlFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeTable, _, err = topo.Tables(3, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeTable[0][1] != "10.0.0.2:20001" || nodeTable[1][1] != "10.0.0.4:30001" || nodeTable[2][1] != "10.0.0.5:2" {
+		t.Fatalf("unexpected node table: %v", nodeTable)
+	}
+
+	// 缺少地址的节点和客户端都被列出
+	_, _, err = topo.Tables(4, 3, 2)
+	if err == nil {
+		t.Fatalf("incomplete topology accepted")
+	}
+	for _, want := range []string{"no address for node 2", "Clients: 1 addresses for 2 clients"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q does not mention %q", err, want)
+		}
+	}
+
+	// 账户只能给出本次运行中的角色，且必须是合法的地址
+	topo.Accounts["S9N0"] = "0x00000000000000000000000000000000000000a2"
+	topo.Accounts["C0"] = "not an address"
+	_, _, err = topo.Tables(3, 2, 1)
+	if err == nil {
+		t.Fatalf("invalid accounts accepted")
+	}
+	for _, want := range []string{`unknown role "S9N0"`, `invalid account "not an address" of C0`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q does not mention %q", err, want)
+		}
+	}
+}
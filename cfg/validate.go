@@ -0,0 +1,190 @@
+package cfg
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	// 与 committee/worker.go 中的 minRecommitInterval 一致
+	minRecommitIntervalSecs = 3
+	// pbft 至少需要 3f+1 个节点，f 至少为1
+	minShardSize = 4
+)
+
+var reconfigModes = []string{"lesssync", "fastsync", "fullsync", "tMPTsync"}
+
+var tbSubmitModes = []string{"single", "batch", "accumulator"}
+
+var tbEventSources = []string{"websocket", "polling"}
+
+/* host 是否为回环地址或 localhost，为空（监听所有地址）时不是 */
+func IsLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+/* 配置不合法时返回的错误，列出所有违反的约束 */
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%d config problem(s):\n  %s", len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+/** 检查各参数及其组合是否合法，在任何角色启动之前调用
+ * 一次检查所有约束，返回的错误中列出每一条问题及修改建议
+ */
+func (c *Cfg) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch c.Role {
+	case "booter", "client", "node", "cluster":
+	default:
+		add("Role %q: must be booter, node, client or cluster", c.Role)
+	}
+	if c.ShardNum < 1 {
+		add("ShardNum %d: must be at least 1", c.ShardNum)
+	}
+	if c.ClientNum < 1 {
+		add("ClientNum %d: must be at least 1", c.ClientNum)
+	}
+	if c.Role == "client" && (c.ClientId < 0 || c.ClientId >= c.ClientNum) {
+		add("ClientId %d: must be in [0, ClientNum=%d)", c.ClientId, c.ClientNum)
+	}
+	if c.Role == "node" {
+		if c.ShardId < 0 || c.ShardId >= c.ShardNum {
+			add("ShardId %d: must be in [0, ShardNum=%d)", c.ShardId, c.ShardNum)
+		}
+		if c.NodeId < 0 || c.NodeId >= c.ComAllNodeNum {
+			add("NodeId %d: must be in [0, ComAllNodeNum=%d)", c.NodeId, c.ComAllNodeNum)
+		}
+	}
+
+	// pbft
+	if c.ShardSize < minShardSize {
+		add("ShardSize %d: pbft needs at least 3f+1=%d consensus nodes", c.ShardSize, minShardSize)
+	}
+	if c.ComAllNodeNum < c.ShardSize {
+		add("ComAllNodeNum %d: must not be smaller than ShardSize %d", c.ComAllNodeNum, c.ShardSize)
+	}
+	if c.RecommitIntervalSecs < minRecommitIntervalSecs {
+		add("RecommitInterval %d: must be at least %d seconds", c.RecommitIntervalSecs, minRecommitIntervalSecs)
+	}
+	if c.MaxBlockTXSize < 1 {
+		add("MaxBlockTXSize %d: must be at least 1", c.MaxBlockTXSize)
+	}
+
+	// 多签
+	if c.MultiSignRequiredNum < 1 || c.MultiSignRequiredNum > c.ComAllNodeNum {
+		add("MultiSignRequiredNum %d: must be in [1, ComAllNodeNum=%d]", c.MultiSignRequiredNum, c.ComAllNodeNum)
+	}
+
+	// 重组
+	if c.Height2Reconfig < 1 {
+		add("Height2Reconfig %d: must be at least 1", c.Height2Reconfig)
+	}
+	validMode := false
+	for _, mode := range reconfigModes {
+		validMode = validMode || c.ReconfigMode == mode
+	}
+	if !validMode {
+		add("ReconfigMode %q: must be one of %s", c.ReconfigMode, strings.Join(reconfigModes, ", "))
+	}
+	if c.ReconfigMode == "fastsync" && c.FastsyncBlockNum < 1 {
+		add("FastsyncBlockNum %d: fastsync needs at least 1 block", c.FastsyncBlockNum)
+	}
+
+	// 信标链
+	switch c.BeaconChainMode {
+	case 0, 2:
+	case 1:
+		if c.ShardNum > len(GanacheChainAccounts) {
+			add("ShardNum %d: ganache mode (BeaconChainMode 1) has accounts for %d shards only", c.ShardNum, len(GanacheChainAccounts))
+		}
+	default:
+		add("BeaconChainMode %d: must be 0 (simulated), 1 (ganache) or 2 (geth)", c.BeaconChainMode)
+	}
+	if c.BeaconChainMode != 0 && (c.BeaconChainPort <= 0 || c.BeaconChainPort > 65535) {
+		add("BeaconChainPort %d: invalid port", c.BeaconChainPort)
+	}
+	if c.Height2Confirm < 0 {
+		add("Height2Confirm %d: must not be negative", c.Height2Confirm)
+	}
+	validSubmit := c.TBSubmit == ""
+	for _, mode := range tbSubmitModes {
+		validSubmit = validSubmit || c.TBSubmit == mode
+	}
+	if !validSubmit {
+		add("TBSubmit %q: must be one of %s", c.TBSubmit, strings.Join(tbSubmitModes, ", "))
+	}
+	if c.TBBatchSize < 0 {
+		add("TBBatchSize %d: must not be negative", c.TBBatchSize)
+	}
+	validSource := c.TBEventSource == ""
+	for _, source := range tbEventSources {
+		validSource = validSource || c.TBEventSource == source
+	}
+	if !validSource {
+		add("TBEventSource %q: must be one of %s", c.TBEventSource, strings.Join(tbEventSources, ", "))
+	}
+
+	// 地址表
+	switch {
+	case c.Role == "cluster":
+		// cluster 在回环地址上自动生成地址表
+	case c.Topology != "":
+		if t, err := ReadTopology(c.Topology); err != nil {
+			add("Topology: %v", err)
+		} else if _, _, err := t.Tables(c.ShardNum, c.ComAllNodeNum, c.ClientNum); err != nil {
+			add("Topology %s: %v", c.Topology, err)
+		}
+	case !c.Discovery:
+		if c.ShardNum > len(NodeTable) {
+			add("ShardNum %d: cfg/node.go has addresses for %d shards, set Topology or Discovery", c.ShardNum, len(NodeTable))
+		}
+		for i := 0; i < c.ShardNum && i < len(NodeTable); i++ {
+			if n := len(NodeTable[uint32(i)]); c.ComAllNodeNum > n {
+				add("ComAllNodeNum %d: cfg/node.go has %d ports for shard %d, set Topology or Discovery", c.ComAllNodeNum, n, i)
+				break
+			}
+		}
+		if c.ClientNum > len(ClientTable) {
+			add("ClientNum %d: cfg/node.go has addresses for %d clients, set Topology or Discovery", c.ClientNum, len(ClientTable))
+		}
+	}
+
+	if c.AdminAddr != "" {
+		if host, _, err := net.SplitHostPort(c.AdminAddr); err != nil {
+			add("AdminAddr %q: %v", c.AdminAddr, err)
+		} else if !IsLoopbackHost(host) && c.AdminToken == "" {
+			add("AdminAddr %q: not a loopback address, use 127.0.0.1 or set AdminToken", c.AdminAddr)
+		}
+	}
+
+	// 数据集，由客户端和各分片leader读取
+	if c.Role == "client" || c.Role == "cluster" || (c.Role == "node" && c.NodeId == 0) {
+		if info, err := os.Stat(c.DatasetDir); err != nil {
+			add("DatasetDir %q: %v", c.DatasetDir, err)
+		} else if info.IsDir() {
+			add("DatasetDir %q: is a directory, expected a csv file", c.DatasetDir)
+		}
+		if c.MaxTxNum < 1 {
+			add("MaxTxNum %d: must be at least 1", c.MaxTxNum)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
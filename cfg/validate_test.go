@@ -0,0 +1,63 @@
+package cfg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	c := ReadCfg("debug.json")
+	c.Role = "booter"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("debug.json rejected: %v", err)
+	}
+
+	c.ShardSize = 3
+	c.ComAllNodeNum = 21
+	c.MultiSignRequiredNum = 22
+	c.RecommitIntervalSecs = 2
+	c.ReconfigMode = "slowsync"
+	c.BeaconChainMode = 5
+	c.TBSubmit = "batched"
+	c.TBEventSource = "ipc"
+	c.Role = "node"
+	c.DatasetDir = "no-such-dataset.csv"
+	err := c.Validate()
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// 每条违反的约束都被列出
+	for _, field := range []string{"ShardSize", "ComAllNodeNum", "MultiSignRequiredNum", "RecommitInterval", "ReconfigMode", "BeaconChainMode", "TBSubmit", "TBEventSource", "DatasetDir"} {
+		found := false
+		for _, p := range verr.Problems {
+			found = found || strings.HasPrefix(p, field+" ")
+		}
+		if !found {
+			t.Errorf("no problem reported for %s: %v", field, err)
+		}
+	}
+	// 合约包含 addTBs 和 addTBRoot，Ganache、geth 和模拟链上都可以批量或按默克尔根提交信标
+	c = ReadCfg("debug.json")
+	c.Role = "booter"
+	for _, mode := range []string{"batch", "accumulator"} {
+		for _, chainMode := range []int{0, 1, 2} {
+			c.TBSubmit, c.BeaconChainMode = mode, chainMode
+			if err := c.Validate(); err != nil {
+				t.Errorf("TBSubmit %s rejected on BeaconChainMode %d: %v", mode, chainMode, err)
+			}
+		}
+	}
+
+	// 管理接口没有口令时只能监听回环地址
+	for addr, ok := range map[string]bool{"127.0.0.1:9000": true, "[::1]:0": true, "localhost:9000": true, ":9000": false, "0.0.0.0:9000": false, "10.0.0.5:9000": false} {
+		c.AdminAddr, c.AdminToken = addr, ""
+		if err := c.Validate(); (err == nil) != ok {
+			t.Errorf("AdminAddr %s: %v", addr, err)
+		}
+		c.AdminToken = "secret"
+		if err := c.Validate(); err != nil {
+			t.Errorf("AdminAddr %s with AdminToken rejected: %v", addr, err)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"go-w3chain/result"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi"
@@ -39,6 +40,8 @@ type Client struct {
 	/* 已注入到分片的交易数量 */
 	injectCnt         int
 	InjectDoneMsgSent bool
+	/* 注入协程修改以上两个字段时持有，其他协程通过 InjectCount 和 InjectDone 读取 */
+	injectLock sync.Mutex
 
 	/* 委员会发送给客户端的待处理的交易收据 */
 	tx_reply *list.List
@@ -58,6 +61,10 @@ type Client struct {
 	cross2_txs []*core.Transaction
 	/* cross2_txs的锁 */
 	c2_lock sync.Mutex
+	/* 前半部分所在区块的信标被撤回的后半部分交易，信标再次确认后放回 cross2_txs。与 cross2_txs 共用锁 */
+	cross2_held []*core.Transaction
+	/* cross2_txs 和 cross2_held 中交易的前半部分收据 */
+	cross2_receipts map[uint64]*result.TXReceipt
 
 	/* 跨片交易超时队列，客户端将向源分片发送回滚交易。使用记得加锁 */
 	cross_tx_expired []uint64
@@ -69,11 +76,14 @@ type Client struct {
 	shard_cur_heights map[uint32]uint64
 
 	tbchain_height uint64
+	/* 管理接口读取 shard_cur_heights 和 tbchain_height 时使用，只有 AddTBs 修改二者 */
+	heightLock sync.RWMutex
 
 	contractAddr common.Address
 	contractAbi  *abi.ABI
 
-	injectSpeed int
+	/* 每秒注入的交易数，可通过管理接口在运行时修改，原子读写 */
+	injectSpeed int64
 
 	wg sync.WaitGroup
 }
@@ -95,6 +105,7 @@ func NewClient(addr string, id, rollbackHeight, shardNum int, exitMode int) *Cli
 		tx_reply:                  list.New(),
 		shard_num:                 shardNum,
 		cross1_confirm_height_map: make(map[uint64]uint64),
+		cross2_receipts:           make(map[uint64]*result.TXReceipt),
 		tbs:                       make(map[uint32]map[uint64]*beaconChain.ConfirmedTB),
 		shard_cur_heights:         make(map[uint32]uint64),
 	}
@@ -107,12 +118,21 @@ func NewClient(addr string, id, rollbackHeight, shardNum int, exitMode int) *Cli
 }
 
 func (c *Client) Start(injectSpeed int) {
-	c.injectSpeed = injectSpeed
+	c.SetInjectSpeed(injectSpeed)
 }
 
 func (c *Client) StartInjectTxs() {
 	c.wg.Add(1)
-	go c.SendTXs(c.injectSpeed)
+	go c.SendTXs()
+}
+
+/* 修改注入速度，从下一秒开始生效 */
+func (c *Client) SetInjectSpeed(injectSpeed int) {
+	atomic.StoreInt64(&c.injectSpeed, int64(injectSpeed))
+}
+
+func (c *Client) GetInjectSpeed() int {
+	return int(atomic.LoadInt64(&c.injectSpeed))
 }
 
 func (c *Client) SetMessageHub(hub core.MessageHub) {
@@ -163,6 +183,10 @@ func (c *Client) getTBFromTBChain(shardID uint32, height uint64) *beaconChain.Co
 	var tb *beaconChain.ConfirmedTB
 	callback := func(res ...interface{}) {
 		tb = res[0].(*beaconChain.ConfirmedTB)
+		if err := core.RPCErr(res); err != nil {
+			log.Warn("get time beacon failed", "shardID", shardID, "height", height, "err", err)
+			tb = nil
+		}
 	}
 	c.messageHub.Send(core.MsgTypeGetTB, shardID, height, callback)
 	return tb
@@ -181,21 +205,84 @@ func VerifyTxMKproof(proof []byte, tb *core.TimeBeacon) bool {
 
 /* 所有交易执行完成则结束 */
 func (c *Client) CanStopV1() bool {
-	return len(c.txs) == c.injectCnt && c.tx_reply.Len() == 0 && len(c.cross_tx_expired) == 0 &&
-		len(c.cross2_txs) == 0 && len(c.cross1_confirm_height_map) == 0
+	return len(c.txs) == c.InjectCount() && c.tx_reply.Len() == 0 && len(c.cross_tx_expired) == 0 &&
+		len(c.cross2_txs) == 0 && len(c.cross2_held) == 0 && len(c.cross1_confirm_height_map) == 0
 }
 
 func (c *Client) LogQueues() {
 	log.Debug("client queue length", "tx_reply", c.tx_reply.Len(), "cross1_confirm_height_map", len(c.cross1_confirm_height_map),
-		"cross2_txs", len(c.cross2_txs), "cross_tx_expired", len(c.cross_tx_expired),
-		"c.injectCnt", c.injectCnt, "len(c.txs)", len(c.txs))
+		"cross2_txs", len(c.cross2_txs), "cross2_held", len(c.cross2_held), "cross_tx_expired", len(c.cross_tx_expired),
+		"c.injectCnt", c.InjectCount(), "len(c.txs)", len(c.txs))
 }
 
 /* 客户端初始交易注入完成则结束 */
 func (c *Client) CanStopV2() bool {
-	return c.injectCnt == len(c.txs)
+	return c.InjectCount() == len(c.txs)
+}
+
+/* 已注入到分片的交易数量 */
+func (c *Client) InjectCount() int {
+	c.injectLock.Lock()
+	defer c.injectLock.Unlock()
+	return c.injectCnt
+}
+
+/* 是否已通知各节点交易注入完成 */
+func (c *Client) InjectDone() bool {
+	c.injectLock.Lock()
+	defer c.injectLock.Unlock()
+	return c.InjectDoneMsgSent
 }
 
 func (c *Client) GetCid() int {
 	return c.cid
 }
+
+/* 客户端的运行状态，由管理接口返回 */
+type ClientStatus struct {
+	ClientID        int
+	Addr            string
+	InjectSpeed     int
+	TxNum           int // 待注入的交易总数
+	InjectCnt       int // 已注入的交易数
+	InjectDone      bool
+	TxReply         int // 等待信标确认的交易收据
+	Cross1Confirmed int // 等待接收分片出块的跨片交易
+	Cross2Pending   int // 待发送的跨片交易后半部分
+	Cross2Held      int // 前半部分的信标被撤回、暂缓发送的后半部分
+	Expired         int // 待发送回滚交易的超时跨片交易
+	TBChainHeight   uint64
+	ShardConfirmed  map[uint32]uint64 // 各分片已在信标链确认的最新高度
+}
+
+func (c *Client) Status() *ClientStatus {
+	s := &ClientStatus{
+		ClientID:       c.cid,
+		Addr:           c.GetAddr(),
+		InjectSpeed:    c.GetInjectSpeed(),
+		TxNum:          len(c.txs),
+		InjectCnt:      c.InjectCount(),
+		InjectDone:     c.InjectDone(),
+		ShardConfirmed: make(map[uint32]uint64),
+	}
+	c.r_lock.Lock()
+	s.TxReply = c.tx_reply.Len()
+	c.r_lock.Unlock()
+	c.c1_c_lock.RLock()
+	s.Cross1Confirmed = len(c.cross1_confirm_height_map)
+	c.c1_c_lock.RUnlock()
+	c.c2_lock.Lock()
+	s.Cross2Pending = len(c.cross2_txs)
+	s.Cross2Held = len(c.cross2_held)
+	c.c2_lock.Unlock()
+	c.e_lock.Lock()
+	s.Expired = len(c.cross_tx_expired)
+	c.e_lock.Unlock()
+	c.heightLock.RLock()
+	s.TBChainHeight = c.tbchain_height
+	for shardID, height := range c.shard_cur_heights {
+		s.ShardConfirmed[shardID] = height
+	}
+	c.heightLock.RUnlock()
+	return s
+}
@@ -60,6 +60,7 @@ func (c *Client) GetTB(shardID uint32, height uint64) *beaconChain.ConfirmedTB {
  */
 func (c *Client) AddTBs(tbblock *beaconChain.TBBlock) {
 	log.Debug(fmt.Sprintf("client get tbchain confirm block... %v", tbblock))
+	c.heightLock.Lock()
 	for shardID, tbs := range tbblock.Tbs {
 		for _, tb := range tbs {
 			// log.Debug("addTB to c.tbs", "shardID", shardID, "blockHeight", tb.Height)
@@ -68,11 +69,38 @@ func (c *Client) AddTBs(tbblock *beaconChain.TBBlock) {
 		}
 	}
 	c.tbchain_height = tbblock.Height
+	c.heightLock.Unlock()
 	c.processTXReceipts()
 	c.checkExpiredTXs()
 
 }
 
+/** 信标链撤回被以太坊回滚的信标时调用此函数
+ * 删除本地的信标，还未发送的跨片交易后半部分暂缓发送，等信标再次被确认后再发送；
+ * 已经发送的后半部分无法撤回
+ */
+func (c *Client) RetractTB(tb *beaconChain.ConfirmedTB) {
+	c.heightLock.Lock()
+	if cur, ok := c.tbs[tb.ShardID][tb.Height]; ok && cur.ConfirmHeight == tb.ConfirmHeight {
+		delete(c.tbs[tb.ShardID], tb.Height)
+	}
+	c.heightLock.Unlock()
+
+	c.c2_lock.Lock()
+	defer c.c2_lock.Unlock()
+	held := len(c.cross2_held)
+	cross2_txs := c.cross2_txs[:0]
+	for _, tx := range c.cross2_txs {
+		if r := c.cross2_receipts[tx.ID]; r != nil && r.ShardID == int(tb.ShardID) && r.BlockHeight == tb.Height {
+			c.cross2_held = append(c.cross2_held, tx)
+			continue
+		}
+		cross2_txs = append(cross2_txs, tx)
+	}
+	c.cross2_txs = cross2_txs
+	log.Warn("time beacon retracted by tbchain", "shardID", tb.ShardID, "height", tb.Height, "cross2Held", len(c.cross2_held)-held)
+}
+
 /**
 * 遍历 tx_reply，如果某个交易的区块信标已确认，则对该交易进行后续处理：
 如果交易已完成，则记录确认时间；如果交易未完成，则加入到新队列中等待被发送
@@ -112,6 +140,7 @@ func (c *Client) processTXReceipts() {
 			tx.ConfirmHeight = c.tbchain_height
 			tx.Cross1ConfirmHeight = c.shard_cur_heights[uint32(tx.Recipient_sid)]
 			c.cross2_txs = append(c.cross2_txs, &tx)
+			c.cross2_receipts[txid] = r
 			log.Trace("tracing transaction", "txid", r.TxID, "status", result.GetStatusString(r.TxStatus), "time", r.ConfirmTimeStamp)
 			log.Trace("tracing transaction", "txid", r.TxID, "status", "client add tx to cross2_txs (list)", "time", r.ConfirmTimeStamp)
 			// 2. 记录到 cross1_confirm_height_map 中
@@ -136,6 +165,17 @@ func (c *Client) processTXReceipts() {
 		l.Remove(e)
 		e = n
 	}
+	// 信标再次确认后，暂缓的后半部分重新加入cross2队列
+	cross2_held := c.cross2_held[:0]
+	for _, tx := range c.cross2_held {
+		r := c.cross2_receipts[tx.ID]
+		if _, ok := c.tbs[uint32(r.ShardID)][r.BlockHeight]; ok {
+			c.cross2_txs = append(c.cross2_txs, tx)
+			continue
+		}
+		cross2_held = append(cross2_held, tx)
+	}
+	c.cross2_held = cross2_held
 	c.recordTXReceipts(to_record)
 
 }
@@ -12,32 +12,47 @@ import (
  * 按一定速率发送交易到分片
  * 目前的实现未通过网络传输
  */
-func (c *Client) SendTXs(inject_speed int) {
+func (c *Client) SendTXs() {
 	defer c.wg.Done()
-	c.InjectTXs(c.cid, inject_speed)
+	c.InjectTXs(c.cid)
 }
 
 /**
  * 按一定速率将客户端的交易注入到分片
+ * 每秒读取一次注入速度，运行时的修改从下一秒开始生效
  */
-func (c *Client) InjectTXs(cid int, inject_speed int) {
+func (c *Client) InjectTXs(cid int) {
+	c.injectLock.Lock()
 	c.injectCnt = 0
+	c.InjectDoneMsgSent = false
+	c.injectLock.Unlock()
 	resBroadcastMap := make(map[uint64]uint64)
 
-	c.InjectDoneMsgSent = false
-	// 按秒注入
+	// 按秒注入，客户端关闭时停止注入
+loop:
 	for {
-		time.Sleep(1000 * time.Millisecond) //fixme 应该记录下面的运行时间
+		select {
+		case <-time.After(1000 * time.Millisecond): //fixme 应该记录下面的运行时间
+		case <-c.stopCh:
+			log.Info("client stop injecting txs", "clientID", cid, "injectCnt", c.injectCnt)
+			break loop
+		}
 		// start := time.Now().UnixMilli()
+		inject_speed := c.GetInjectSpeed()
 		rollbackTxSentCnt := c.sendRollbackTxs(inject_speed)
 
 		cross2TxSentCnt := c.sendCross2Txs(inject_speed - rollbackTxSentCnt)
 
-		c.injectCnt = c.sendPendingTxs(c.injectCnt, inject_speed-rollbackTxSentCnt-cross2TxSentCnt, resBroadcastMap)
+		injectCnt := c.sendPendingTxs(c.injectCnt, inject_speed-rollbackTxSentCnt-cross2TxSentCnt, resBroadcastMap)
+		c.injectLock.Lock()
+		c.injectCnt = injectCnt
+		c.injectLock.Unlock()
 		if c.CanStopV2() && !c.InjectDoneMsgSent {
 			/* 通知各节点交易注入完成 */
 			c.messageHub.Send(core.MsgTypeSetInjectDone2Nodes, uint32(c.cid), struct{}{}, nil)
+			c.injectLock.Lock()
 			c.InjectDoneMsgSent = true
+			c.injectLock.Unlock()
 			if c.exitMode == 1 {
 				break
 			}
@@ -104,6 +119,7 @@ func (c *Client) sendCross2Txs(maxTxNum2Pack int) int {
 		tx := c.cross2_txs[i]
 		log.Trace("tracing transaction, ", "txid", tx.ID, "status", "client send cross2 to committee", "time", now)
 		shardtxs[tx.Recipient_sid] = append(shardtxs[tx.Recipient_sid], tx)
+		delete(c.cross2_receipts, tx.ID)
 	}
 	/* 注入到各分片 */
 	for i := 0; i < c.shard_num; i++ {
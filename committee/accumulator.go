@@ -0,0 +1,59 @@
+package committee
+
+import (
+	"go-w3chain/core"
+	"go-w3chain/log"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/** 累加器模式（TBSubmit=accumulator）下，leader 不再为每个区块多签名并提交信标，
+ * 而是积累连续k个信标，委员会只对它们的默克尔根多签名，由信标链锚定该根
+ * flush 为 true 时不等窗口填满，立即锚定已积累的信标：
+ * 重组后可能换了leader，窗口不能跨越重组；交易池为空时也提前锚定，避免负载低时信标迟迟不被确认
+ */
+func (com *Committee) accumulateTB(tb *core.TimeBeacon, seed common.Hash, height uint64, flush bool) {
+	if n := len(com.tbWindow); n > 0 && com.tbWindow[n-1].Height+1 != tb.Height {
+		// 正常情况下leader的区块高度连续，否则先锚定之前的窗口
+		log.Warn("time beacon window not consecutive, anchor it first", "comID", com.Node.NodeInfo.ComID,
+			"last", com.tbWindow[n-1].Height, "height", tb.Height)
+		com.anchorTBWindow(seed, height)
+	}
+	com.tbWindow = append(com.tbWindow, *tb)
+
+	k := com.config.TBBatchSize
+	if k <= 0 {
+		k = core.DefaultTBBatchSize
+	}
+	if flush || len(com.tbWindow) >= k {
+		com.anchorTBWindow(seed, height)
+	}
+}
+
+/* worker 停止出块时调用，以最新的信标链区块为种子锚定未满的窗口 */
+func (com *Committee) flushTBWindow() {
+	if len(com.tbWindow) == 0 {
+		return
+	}
+	seed, height := com.GetEthChainBlockHash(com.TbChainHeight())
+	com.anchorTBWindow(seed, height)
+}
+
+/* 对窗口中信标的默克尔根多签名并提交到信标链，然后清空窗口 */
+func (com *Committee) anchorTBWindow(seed common.Hash, height uint64) {
+	if len(com.tbWindow) == 0 {
+		return
+	}
+	tbs := com.tbWindow
+	com.tbWindow = nil
+	root := &core.TBRoot{
+		ShardID:     tbs[0].ShardID,
+		StartHeight: tbs[0].Height,
+		Count:       uint64(len(tbs)),
+		Root:        core.TBMerkleRoot(tbs),
+	}
+	signedRoot := com.initRootMultiSign(root, tbs, seed, height)
+	log.Debug("anchor time beacon root", "comID", com.Node.NodeInfo.ComID, "start", root.StartHeight, "count", root.Count)
+
+	com.SendTBRoot(signedRoot)
+}
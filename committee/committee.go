@@ -2,6 +2,7 @@ package committee
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"go-w3chain/beaconChain"
 	"go-w3chain/core"
@@ -25,6 +26,7 @@ type MultiSignData struct {
 }
 
 type Committee struct {
+	ctx        context.Context
 	config     *core.CommitteeConfig
 	worker     *Worker
 	messageHub core.MessageHub
@@ -40,18 +42,21 @@ type Committee struct {
 	tbchain_height       uint64
 	to_reconfig          bool   // 收到特定高度的信标链区块后设为true，准备重组
 	reconfig_seed_height uint64 // 用于重组的种子，所有委员会必须统一
-
-	shardSendStateChan chan *core.ShardSendState
+	/* 保护以上三个字段，信标链推送的协程写入，worker 和管理接口读取 */
+	heightLock sync.Mutex
+	/* 累加器模式下leader已出块但还未锚定的连续信标 */
+	tbWindow []core.TimeBeacon
 }
 
-func NewCommittee(comID uint32, clientCnt int, _node *node.Node, config *core.CommitteeConfig) *Committee {
+/* ctx 取消后 worker 打包完当前区块即停止出块 */
+func NewCommittee(ctx context.Context, comID uint32, clientCnt int, _node *node.Node, config *core.CommitteeConfig) *Committee {
 	com := &Committee{
-		config:             config,
-		multiSignData:      &MultiSignData{},
-		Node:               _node,
-		injectNotDone:      int32(clientCnt),
-		to_reconfig:        false,
-		shardSendStateChan: make(chan *core.ShardSendState, 0),
+		ctx:           ctx,
+		config:        config,
+		multiSignData: &MultiSignData{},
+		Node:          _node,
+		injectNotDone: int32(clientCnt),
+		to_reconfig:   false,
 	}
 	log.Info("NewCommittee", "comID", comID, "nodeID", _node.NodeInfo.NodeID)
 
@@ -59,14 +64,17 @@ func NewCommittee(comID uint32, clientCnt int, _node *node.Node, config *core.Co
 }
 
 func (com *Committee) Start(nodeId uint32) {
+	com.heightLock.Lock()
 	com.to_reconfig = false // 防止重组后该值一直为true
+	com.heightLock.Unlock()
+	com.tbWindow = nil // 旧leader在重组前已锚定了自己的窗口
 
 	pool := NewTxPool(com.Node.NodeInfo.ComID) // 其它线程可能正在使用 pool.lock，直接new会导致问题，比如unlock of unlocked mutex
 	com.txPool = pool
 	pool.setCommittee(com)
 
 	if utils.IsComLeader(nodeId) { // 只有委员会的leader节点会运行worker，即出块
-		worker := newWorker(com.config)
+		worker := newWorker(com.ctx, com.config)
 		com.worker = worker
 		worker.setCommittee(com)
 	}
@@ -102,18 +110,23 @@ func (com *Committee) CanStopV2() bool {
  * 当committee触发重组时，会在该方法会被阻塞，直到重组完成
  */
 func (com *Committee) NewBlockGenerated(block *core.Block) {
-	if com.to_reconfig {
+	com.heightLock.Lock()
+	toReconfig, seedHeight := com.to_reconfig, com.reconfig_seed_height
+	com.heightLock.Unlock()
+	if toReconfig {
 		// 关闭worker
 		com.worker.exitCh <- struct{}{}
 
-		seed, height := com.GetEthChainBlockHash(com.reconfig_seed_height)
+		seed, height := com.GetEthChainBlockHash(seedHeight)
 		msg := &core.InitReconfig{
 			Seed:       seed,
 			SeedHeight: height,
 			ComID:      com.Node.NodeInfo.ComID,
 		}
 		com.Node.InitReconfig(msg)
+		com.heightLock.Lock()
 		com.to_reconfig = false
+		com.heightLock.Unlock()
 	}
 
 }
@@ -148,6 +161,8 @@ func (com *Committee) AddTBs(tbblock *beaconChain.TBBlock) {
 	// 	}
 	// }
 	log.Debug(fmt.Sprintf("committee get tbchain confirm block... %v", tbblock))
+	com.heightLock.Lock()
+	defer com.heightLock.Unlock()
 	if tbblock.Height <= com.tbchain_height {
 		return
 	}
@@ -202,10 +217,13 @@ func (com *Committee) send2Client(receipts map[uint64]*result.TXReceipt, txs []*
 	}
 }
 
-func (com *Committee) getBlockHeight() *big.Int {
+/* 从对应分片获取最新区块高度，分片无响应时返回错误 */
+func (com *Committee) getBlockHeight() (*big.Int, error) {
 	var blockHeight *big.Int
+	var err error
 	callback := func(res ...interface{}) {
 		blockHeight = res[0].(*big.Int)
+		err = core.RPCErr(res)
 	}
 
 	data := &core.ComGetHeight{
@@ -213,21 +231,34 @@ func (com *Committee) getBlockHeight() *big.Int {
 		Target_shardID: com.Node.NodeInfo.ComID,
 	}
 	com.messageHub.Send(core.MsgTypeComGetHeightFromShard, com.Node.NodeInfo.ComID, data, callback)
+	if err == nil && blockHeight == nil {
+		err = core.ErrRPCUnreachable
+	}
 
-	return blockHeight
+	return blockHeight, err
 }
 
 /* 从对应的分片获取账户状态和证明
  */
-func (com *Committee) getStatusFromShard(addrList []common.Address) *core.ShardSendState {
+func (com *Committee) getStatusFromShard(addrList []common.Address) (*core.ShardSendState, error) {
 	request := &core.ComGetState{
 		From_comID:     com.Node.NodeInfo.ComID,
 		Target_shardID: com.Node.NodeInfo.ComID,
 		AddrList:       addrList, // TODO: implement it
 	}
-	com.messageHub.Send(core.MsgTypeComGetStateFromShard, com.Node.NodeInfo.ComID, request, nil)
-
-	response := <-com.shardSendStateChan
+	var response *core.ShardSendState
+	var err error
+	callback := func(res ...interface{}) {
+		response = res[0].(*core.ShardSendState)
+		err = core.RPCErr(res)
+	}
+	com.messageHub.Send(core.MsgTypeComGetStateFromShard, com.Node.NodeInfo.ComID, request, callback)
+	if err == nil && response == nil {
+		err = core.ErrRPCUnreachable
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	// Validate Merkle proofs for each address
 	rootHash := response.StatusTrieHash
@@ -238,21 +269,17 @@ func (com *Committee) getStatusFromShard(addrList []common.Address) *core.ShardS
 		computedValue, err := trie.VerifyProof(rootHash, utils.GetHash(address.Bytes()), proofDB)
 		if err != nil {
 			log.Error("Failed to verify Merkle proof", "err", err, "address", address)
-			return nil
+			return nil, err
 		}
 		if !bytes.Equal(computedValue, accountData) {
 			log.Error("Merkle proof verification failed for address", "address", address)
-			return nil
+			return nil, fmt.Errorf("merkle proof verification failed for address %x", address)
 		}
 	}
 
 	log.Info("getStatusFromShard and verify merkle proof succeed.")
 
-	return response
-}
-
-func (com *Committee) HandleShardSendState(response *core.ShardSendState) {
-	com.shardSendStateChan <- response
+	return response, nil
 }
 
 /**
@@ -272,6 +299,10 @@ func (com *Committee) SendTB(tb *core.SignedTB) {
 	com.messageHub.Send(core.MsgTypeComAddTb2TBChain, com.Node.NodeInfo.NodeID, tb, nil)
 }
 
+func (com *Committee) SendTBRoot(root *core.SignedTBRoot) {
+	com.messageHub.Send(core.MsgTypeComAddTbRoot2TBChain, com.Node.NodeInfo.NodeID, root, nil)
+}
+
 func (com *Committee) GetEthChainBlockHash(height uint64) (common.Hash, uint64) {
 	channel := make(chan struct{}, 1)
 	var blockHash common.Hash
@@ -338,7 +369,23 @@ func (com *Committee) SetOldTxPool() {
 }
 
 func (com *Committee) UpdateTbChainHeight(height uint64) {
+	com.heightLock.Lock()
+	defer com.heightLock.Unlock()
 	if height > com.tbchain_height {
 		com.tbchain_height = height
 	}
 }
+
+/* 委员会已知的最新信标链高度 */
+func (com *Committee) TbChainHeight() uint64 {
+	com.heightLock.Lock()
+	defer com.heightLock.Unlock()
+	return com.tbchain_height
+}
+
+/* 是否已收到触发重组的信标链区块，等待出完当前区块后开始重组 */
+func (com *Committee) ToReconfig() bool {
+	com.heightLock.Lock()
+	defer com.heightLock.Unlock()
+	return com.to_reconfig
+}
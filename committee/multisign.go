@@ -13,13 +13,43 @@ import (
 由委员会的leader发起
 */
 func (com *Committee) initMultiSign(tb *core.TimeBeacon, seed common.Hash, height uint64) *core.SignedTB {
-	// 发送消息
 	r := &core.ComLeaderInitMultiSign{
 		Seed:       seed,
 		SeedHeight: height,
 		Tb:         tb,
 	}
+	com.multiSign(r)
 
+	return &core.SignedTB{
+		TimeBeacon: *tb,
+		Signers:    com.multiSignData.Signers,
+		Sigs:       com.multiSignData.Sigs,
+		Vrfs:       com.multiSignData.Vrfs,
+		SeedHeight: height,
+	}
+}
+
+/* 累加器模式下，委员会对连续信标的默克尔根进行多签名 */
+func (com *Committee) initRootMultiSign(root *core.TBRoot, tbs []core.TimeBeacon, seed common.Hash, height uint64) *core.SignedTBRoot {
+	r := &core.ComLeaderInitMultiSign{
+		Seed:       seed,
+		SeedHeight: height,
+		Root:       root,
+	}
+	com.multiSign(r)
+
+	return &core.SignedTBRoot{
+		TBRoot:     *root,
+		Tbs:        tbs,
+		Signers:    com.multiSignData.Signers,
+		Sigs:       com.multiSignData.Sigs,
+		Vrfs:       com.multiSignData.Vrfs,
+		SeedHeight: height,
+	}
+}
+
+/* 发送多签名请求，等待收到足够的签名或worker退出 */
+func (com *Committee) multiSign(r *core.ComLeaderInitMultiSign) {
 	com.multiSignData.Signers = make([]common.Address, 0)
 	com.multiSignData.Sigs = make([][]byte, 0)
 	com.multiSignData.Vrfs = make([][]byte, 0)
@@ -32,20 +62,13 @@ func (com *Committee) initMultiSign(tb *core.TimeBeacon, seed common.Hash, heigh
 	case <-com.worker.exitCh:
 		com.worker.exitCh <- struct{}{}
 		break
-	}
-
-	return &core.SignedTB{
-		TimeBeacon: *tb,
-		Signers:    com.multiSignData.Signers,
-		Sigs:       com.multiSignData.Sigs,
-		Vrfs:       com.multiSignData.Vrfs,
-		SeedHeight: height,
+	case <-com.ctx.Done():
+		break
 	}
 }
 
 func (com *Committee) HandleMultiSignRequest(request *core.ComLeaderInitMultiSign) {
 	seed := request.Seed
-	tb := request.Tb
 
 	account := com.Node.GetAccount()
 
@@ -57,7 +80,7 @@ func (com *Committee) HandleMultiSignRequest(request *core.ComLeaderInitMultiSig
 	reply := &core.MultiSignReply{
 		Request:    request,
 		PubAddress: *account.GetAccountAddress(),
-		Sig:        account.SignHash(tb.Hash()),
+		Sig:        account.SignHash(request.SignHash()),
 		VrfValue:   vrf.RandomValue,
 		NodeInfo:   com.Node.GetPbftNode().NodeInfo,
 	}
@@ -81,7 +104,7 @@ func (com *Committee) HandleMultiSignReply(reply *core.MultiSignReply) {
 		log.Debug(fmt.Sprintf("vrf not good.. nodeID: %d", reply.NodeInfo.NodeID))
 		return
 	}
-	tbHash := reply.Request.Tb.Hash()
+	tbHash := reply.Request.SignHash()
 	if !node.VerifySignature(tbHash, reply.Sig, reply.PubAddress) {
 		log.Debug(fmt.Sprintf("signature verification not pass.. nodeID: %d", reply.NodeInfo.NodeID))
 		return
@@ -100,6 +100,25 @@ func (pool *TxPool) AddTxs(txs []*core.Transaction) {
 	log.Debug("TxPoolAddTXs", "comID", pool.com.Node.NodeInfo.ComID, "txPoolPendingLen", pool.PendingLen(), "txPoolPendingRollbackLen", pool.PendingRollbackLen())
 }
 
+/* 出块失败时，将 Pending 取出的交易按原顺序放回队列头部 */
+func (pool *TxPool) Requeue(txs []*core.Transaction) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.r_lock.Lock()
+	defer pool.r_lock.Unlock()
+	rollbackTxs := make([]*core.Transaction, 0)
+	otherTxs := make([]*core.Transaction, 0)
+	for _, tx := range txs {
+		if tx.TXtype == core.RollbackTXType {
+			rollbackTxs = append(rollbackTxs, tx)
+		} else {
+			otherTxs = append(otherTxs, tx)
+		}
+	}
+	pool.pendingRollback = append(rollbackTxs, pool.pendingRollback...)
+	pool.pending = append(otherTxs, pool.pending...)
+}
+
 /* worker.commitTransaction 从队列取出交易 */
 func (pool *TxPool) Pending(maxBlockSize int, parentBlockHeight *big.Int) ([]*core.Transaction, []common.Address) {
 	/* 需要对lock和r_lock都加锁的场景，都按照先lock再r_lock的顺序，避免死锁 */
@@ -194,3 +213,12 @@ func (pool *TxPool) PendingLen() int {
 func (pool *TxPool) PendingRollbackLen() int {
 	return len(pool.pendingRollback)
 }
+
+/* 加锁读取两个队列的长度，供其他协程查看状态 */
+func (pool *TxPool) Sizes() (pending, pendingRollback int) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.r_lock.Lock()
+	defer pool.r_lock.Unlock()
+	return len(pool.pending), len(pool.pendingRollback)
+}
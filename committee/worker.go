@@ -1,6 +1,7 @@
 package committee
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"go-w3chain/core"
@@ -23,10 +24,13 @@ import (
 
 const (
 	minRecommitInterval = 3 * time.Second
+	// 收到退出信号后，等待正在打包的区块完成的最长时间
+	inflightBlockTimeout = 30 * time.Second
 )
 
 type Worker struct {
 	config *core.CommitteeConfig
+	ctx    context.Context // 取消后打包完当前区块即退出
 
 	// Channels
 	startCh chan struct{}
@@ -43,9 +47,10 @@ type Worker struct {
 	com *Committee
 }
 
-func newWorker(config *core.CommitteeConfig) *Worker {
+func newWorker(ctx context.Context, config *core.CommitteeConfig) *Worker {
 	worker := &Worker{
 		config:  config,
+		ctx:     ctx,
 		startCh: make(chan struct{}, 1), // at most 1 element
 		exitCh:  make(chan struct{}, 1),
 	}
@@ -92,7 +97,24 @@ func (w *Worker) isRunning() bool {
 func (w *Worker) close() {
 	log.Debug("closing worker of this committee..", "comID", w.com.Node.NodeInfo.ComID)
 	w.stop()
-	w.exitCh <- struct{}{}
+	if w.ctx.Err() != nil {
+		// 收到退出信号时，先等待正在打包的区块完成，超时后再中断
+		done := make(chan struct{})
+		go func() {
+			w.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(inflightBlockTimeout):
+			log.Warn("in-flight block not finished, abort it", "comID", w.com.Node.NodeInfo.ComID)
+		}
+	}
+	// 通道中已有退出信号时不必重复发送
+	select {
+	case w.exitCh <- struct{}{}:
+	default:
+	}
 	w.wg.Wait()
 	log.Debug("worker of this committee has been close!", "comID", w.com.Node.NodeInfo.ComID)
 }
@@ -112,11 +134,14 @@ func (w *Worker) newWorkLoop(recommit time.Duration) {
 	commit := func() {
 		block, err := w.commit(timestamp)
 		if err != nil {
-			log.Error("worker commit block failed", "err", err)
+			// 分片无响应等情况下本轮不出块，等待下一轮重试
+			log.Warn("worker commit block failed", "err", err)
+			timer.Reset(recommit)
+			return
 		}
 
 		// 获取信标链已确认的最新区块哈希和高度
-		seed, height := w.com.GetEthChainBlockHash(w.com.tbchain_height)
+		seed, height := w.com.GetEthChainBlockHash(w.com.TbChainHeight())
 		log.Debug(fmt.Sprint("com GetEthChainBlockHash"))
 
 		w.broadcastTbInCommittee(block, seed, height)
@@ -133,9 +158,15 @@ func (w *Worker) newWorkLoop(recommit time.Duration) {
 
 	for {
 		select {
+		case <-w.ctx.Done():
+			log.Debug("worker exit on context done", "comID", w.com.Node.NodeInfo.ComID)
+			return
+
 		case <-w.exitCh:
 			// log.Info("close worker..")
 			// log.Debug("worker exitch", "comID", w.chain.GetChainID())
+			// 累加器模式下停止出块前锚定未满的窗口
+			w.com.flushTBWindow()
 			return
 
 		case <-w.startCh:
@@ -182,6 +213,12 @@ func (w *Worker) broadcastTbInCommittee(block *core.Block, seed common.Hash, hei
 		StatusHash: final_header.Root.Hex(),
 	}
 
+	if w.com.config.TBSubmit == core.TBSubmitAccumulator {
+		// 交易池已空时客户端在等待这些信标（如跨分片交易的后半部分），与重组前一样立即锚定当前窗口
+		w.com.accumulateTB(tb, seed, height, w.com.txPool.Empty() || w.com.ToReconfig())
+		return
+	}
+
 	signedTB := w.com.initMultiSign(tb, seed, height)
 
 	w.com.SendTB(signedTB)
@@ -250,11 +287,19 @@ func analyseStates(states *core.ShardSendState) (map[common.Address]*types.State
 /* 生成区块，执行区块中的交易，确认状态转移，发送区块到分片，发送收据到客户端 */
 func (w *Worker) commit(timestamp int64) (*core.Block, error) {
 	// 获取分片最新的区块高度
-	parentHeight := w.com.getBlockHeight()
+	parentHeight, err := w.com.getBlockHeight()
+	if err != nil {
+		return nil, fmt.Errorf("get block height from shard: %w", err)
+	}
 	// 从交易池选取交易，排除掉超时的跨分片交易
 	txs, addrs := w.com.txPool.Pending(w.config.MaxBlockSize, parentHeight)
 	// 从分片获取交易相关账户的状态及证明
-	states := w.com.getStatusFromShard(addrs)
+	states, err := w.com.getStatusFromShard(addrs)
+	if err != nil {
+		// 交易放回交易池，下一轮重新打包
+		w.com.txPool.Requeue(txs)
+		return nil, fmt.Errorf("get status from shard: %w", err)
+	}
 	// 解析状态及证明
 	addr2State, hash2Node := analyseStates(states)
 	// 执行交易，更改账户状态
@@ -452,14 +497,14 @@ func (w *Worker) executeTransaction(
 		subBalance(addr2State[*tx.Sender], tx.Value)
 		updatedStates[string(utils.GetHash((*tx.Sender)[:]))] = senderState
 		tx.TXStatus = result.CrossTXType1Success
-		log.Trace("tracing transaction, ", "txid", tx.ID, "status", "committee commit cross1 tx", "time", now, "tbchain_height", w.com.tbchain_height)
+		log.Trace("tracing transaction, ", "txid", tx.ID, "status", "committee commit cross1 tx", "time", now, "tbchain_height", w.com.TbChainHeight())
 	} else if tx.TXtype == core.CrossTXType2 {
 		receiverState := addr2State[*tx.Recipient]
 		addBalance(receiverState, tx.Value)
 		updatedStates[string(utils.GetHash((*tx.Recipient)[:]))] = receiverState
 		tx.TXStatus = result.CrossTXType2Success
 		log.Trace("tracing transaction, ", "txid", tx.ID, "status", "committee commit cross2 tx", "time", now,
-			"tbchain_height", w.com.tbchain_height, "cross1ConfirmHeight", tx.ConfirmHeight, "txRollbackHeight", tx.RollbackHeight)
+			"tbchain_height", w.com.TbChainHeight(), "cross1ConfirmHeight", tx.ConfirmHeight, "txRollbackHeight", tx.RollbackHeight)
 	} else if tx.TXtype == core.RollbackTXType {
 		senderState := addr2State[*tx.Sender]
 		subNonceByOne(senderState)
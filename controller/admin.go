@@ -0,0 +1,286 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"go-w3chain/beaconChain"
+	"go-w3chain/cfg"
+	"go-w3chain/client"
+	"go-w3chain/committee"
+	"go-w3chain/eth_chain"
+	"go-w3chain/log"
+	"go-w3chain/messageHub"
+	"go-w3chain/node"
+	"go-w3chain/shard"
+	"go-w3chain/utils"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+/** 本地管理接口：配置了 AdminAddr 时，节点、客户端、booter 和 cluster 在该地址上提供 http/json 接口
+ *   GET  /status                  本进程中各实例的状态
+ *   POST /loglevel?level=debug    修改日志级别，level 为级别名(trace/debug/info/warn/error/crit)或 0(crit)~5(trace)
+ *   POST /injectspeed?speed=500   修改客户端每秒注入的交易数，下一秒生效；cluster 中可用 client=<id> 只修改一个客户端
+ * 未设置 AdminToken 时只能监听回环地址，见 guard
+ */
+type admin struct {
+	role    string
+	nodes   []adminNode
+	clients []*client.Client
+	booter  *node.Booter
+	tbChain *beaconChain.BeaconChain
+	hub     *messageHub.GoodMessageHub // 多进程部署时本进程的消息中心
+	network *messageHub.LocalNetwork   // cluster 的进程内网络
+}
+
+type adminNode struct {
+	node  *node.Node
+	com   *committee.Committee
+	shard *shard.Shard
+}
+
+func (a *admin) addNode(n *node.Node, com *committee.Committee, s *shard.Shard) {
+	a.nodes = append(a.nodes, adminNode{node: n, com: com, shard: s})
+}
+
+/* 节点的运行状态，只有分片leader执行区块，其他节点的分片高度停留在创世区块 */
+type NodeStatus struct {
+	ShardID        uint32
+	ComID          uint32
+	NodeID         uint32
+	Addr           string
+	IsComLeader    bool
+	ShardHeight    uint64
+	TxPoolPending  int
+	TxPoolRollback int
+	PbftSequenceID uint64
+	PbftView       uint32
+	TBChainHeight  uint64 // 委员会已知的最新信标链高度
+	ToReconfig     bool   // 出完当前区块后开始重组
+	Reconfig       node.ReconfigState
+}
+
+type BooterStatus struct {
+	Addr          string
+	TBChainHeight uint64
+	Registered    int // 已向 booter 注册的节点和客户端，未开启 Discovery 时为0
+	Expected      int
+	// 模拟信标链合约每种事件的次数，包括被拒绝的信标
+	ContractEvents map[string]int `json:",omitempty"`
+}
+
+type adminStatus struct {
+	Role     string
+	LogLevel string
+	Nodes    []*NodeStatus          `json:",omitempty"`
+	Clients  []*client.ClientStatus `json:",omitempty"`
+	Booter   *BooterStatus          `json:",omitempty"`
+	Peers    []messageHub.PeerInfo  `json:",omitempty"` // 本进程主动建立的连接
+	Inbound  []string               `json:",omitempty"` // 连入本进程的连接的对端地址
+	Links    []messageHub.LinkInfo  `json:",omitempty"` // cluster 中实例间的链路
+	// 以太坊模式下合约日志订阅的健康状态
+	TBEvents *eth_chain.SubscriptionHealth `json:",omitempty"`
+	// 开启接收队列时各发送方各类队列的长度、入队数、丢弃数和等待次数
+	InboundQueues []messageHub.InboundInfo `json:",omitempty"`
+}
+
+func (n adminNode) status() *NodeStatus {
+	info := n.node.NodeInfo
+	s := &NodeStatus{
+		ShardID:       info.ShardID,
+		ComID:         info.ComID,
+		NodeID:        info.NodeID,
+		Addr:          info.NodeAddr,
+		IsComLeader:   utils.IsComLeader(info.NodeID),
+		ShardHeight:   n.shard.GetChainHeight(),
+		TBChainHeight: n.com.TbChainHeight(),
+		ToReconfig:    n.com.ToReconfig(),
+		Reconfig:      n.node.GetReconfigState(),
+	}
+	if pool := n.com.TXpool(); pool != nil {
+		s.TxPoolPending, s.TxPoolRollback = pool.Sizes()
+	}
+	if p := n.node.GetPbftNode(); p != nil {
+		s.PbftSequenceID, s.PbftView = p.GetSequenceID(), p.GetView()
+	}
+	return s
+}
+
+func (a *admin) status() *adminStatus {
+	s := &adminStatus{
+		Role:     a.role,
+		LogLevel: log.LogLevel().String(),
+	}
+	for _, n := range a.nodes {
+		s.Nodes = append(s.Nodes, n.status())
+	}
+	for _, c := range a.clients {
+		s.Clients = append(s.Clients, c.Status())
+	}
+	if a.booter != nil {
+		s.Booter = &BooterStatus{Addr: a.booter.GetAddr()}
+		s.Booter.Registered, s.Booter.Expected = a.booter.RegistryProgress()
+		if a.tbChain != nil {
+			s.Booter.TBChainHeight = a.tbChain.Height()
+			if a.tbChain.IsSimulationChain() {
+				_, s.Booter.ContractEvents = a.tbChain.ContractEvents()
+			}
+		}
+	}
+	if a.hub != nil {
+		s.Peers = a.hub.PeerInfos()
+		s.Inbound = a.hub.InboundAddrs()
+		s.InboundQueues = messageHub.InboundInfos()
+	}
+	if a.network != nil {
+		s.Links = a.network.LinkInfos()
+	}
+	if a.tbChain != nil {
+		if h, ok := a.tbChain.EventHealth(); ok {
+			s.TBEvents = &h
+		}
+	}
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	writeJSON(w, code, map[string]string{"Error": fmt.Sprintf(format, args...)})
+}
+
+/* 修改状态的接口只接受 POST */
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "%s requires POST", r.URL.Path)
+		return false
+	}
+	return true
+}
+
+/** 管理接口的访问检查
+ * 设置了口令 token 时每个请求都需在 Authorization 中带有该口令；否则只接受 Host 为回环地址的请求，防止 DNS 重绑定。
+ * 浏览器中的其他网页不能修改状态：POST 请求带有 Origin 时须与 Host 相同，请求体只能为空或 json
+ */
+func guard(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "missing or wrong admin token")
+				return
+			}
+		} else if host, _, err := net.SplitHostPort(r.Host); err != nil || !cfg.IsLoopbackHost(host) {
+			writeError(w, http.StatusForbidden, "host %q is not a loopback address", r.Host)
+			return
+		}
+		if r.Method == http.MethodPost {
+			if origin := r.Header.Get("Origin"); origin != "" {
+				if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+					writeError(w, http.StatusForbidden, "cross-origin request from %q", origin)
+					return
+				}
+			}
+			if ct := r.Header.Get("Content-Type"); ct != "" {
+				if mediaType, _, err := mime.ParseMediaType(ct); err != nil || mediaType != "application/json" {
+					writeError(w, http.StatusUnsupportedMediaType, "unsupported content type %q, send parameters in the query string", ct)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* 级别名或与配置中 LogLevel 相同的数字 */
+func parseLogLevel(s string) (log.Lvl, error) {
+	if lvl, err := log.LvlFromString(s); err == nil {
+		return lvl, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < int(log.LvlCrit) || n > int(log.LvlTrace) {
+		return 0, fmt.Errorf("invalid log level %q, expected trace, debug, info, warn, error, crit or 0-5", s)
+	}
+	return log.Lvl(n), nil
+}
+
+func (a *admin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, a.status())
+	})
+	mux.HandleFunc("/loglevel", func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+		lvl, err := parseLogLevel(r.FormValue("level"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		// 用 Warn 记录，调高过滤级别时也能在日志中看到这次修改
+		log.Warn("admin set log level", "from", log.LogLevel(), "to", lvl)
+		log.SetLogLevel(lvl)
+		writeJSON(w, http.StatusOK, map[string]string{"LogLevel": lvl.String()})
+	})
+	mux.HandleFunc("/injectspeed", func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+		speed, err := strconv.Atoi(r.FormValue("speed"))
+		if err != nil || speed < 0 {
+			writeError(w, http.StatusBadRequest, "invalid speed %q, expected a non-negative integer", r.FormValue("speed"))
+			return
+		}
+		cid := -1
+		if v := r.FormValue("client"); v != "" {
+			if cid, err = strconv.Atoi(v); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid client %q", v)
+				return
+			}
+		}
+		changed := make(map[int]int)
+		for _, c := range a.clients {
+			if cid < 0 || c.GetCid() == cid {
+				log.Info("admin set inject speed", "clientID", c.GetCid(), "from", c.GetInjectSpeed(), "to", speed)
+				c.SetInjectSpeed(speed)
+				changed[c.GetCid()] = speed
+			}
+		}
+		if len(changed) == 0 {
+			writeError(w, http.StatusNotFound, "no matching client in this %s process", a.role)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]map[int]int{"InjectSpeed": changed})
+	})
+	return mux
+}
+
+/** 在 addr 上启动管理接口，返回关闭接口的函数；addr 为空时不启动，token 非空时请求需带有该口令
+ * 管理接口是可选的，监听失败时只记录警告，不影响实验运行
+ */
+func startAdmin(addr string, token string, a *admin) (stop func()) {
+	if addr == "" {
+		return func() {}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Warn("admin api listen fail", "addr", addr, "err", err)
+		return func() {}
+	}
+	srv := &http.Server{Handler: guard(token, a.handler())}
+	go srv.Serve(ln)
+	log.Info("admin api started", "addr", ln.Addr().String(), "role", a.role)
+	fmt.Println("admin api:", "http://"+ln.Addr().String())
+	return func() { srv.Close() }
+}
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"encoding/json"
+	"go-w3chain/client"
+	"go-w3chain/log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+	t.Cleanup(log.SwapRootHandler(log.DiscardHandler()))
+
+	c0 := client.NewClient("127.0.0.1:20001", 0, 10, 2, 0)
+	c1 := client.NewClient("127.0.0.1:20002", 1, 10, 2, 0)
+	c0.Start(100)
+	c1.Start(100)
+	srv := httptest.NewServer((&admin{role: "cluster", clients: []*client.Client{c0, c1}}).handler())
+	defer srv.Close()
+
+	var status adminStatus
+	resp, err := http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.Role != "cluster" || len(status.Clients) != 2 || status.Clients[1].InjectSpeed != 100 || len(status.Clients[0].ShardConfirmed) != 2 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	// 修改状态只接受 POST，参数不合法时不做修改
+	for _, req := range []struct {
+		method, path string
+		code         int
+	}{
+		{http.MethodGet, "/injectspeed?speed=5", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/injectspeed?speed=-5", http.StatusBadRequest},
+		{http.MethodPost, "/injectspeed?speed=5&client=7", http.StatusNotFound},
+		{http.MethodPost, "/injectspeed?speed=5&client=1", http.StatusOK},
+		{http.MethodPost, "/loglevel?level=verbose", http.StatusBadRequest},
+		{http.MethodPost, "/loglevel?level=debug", http.StatusOK},
+	} {
+		r, _ := http.NewRequest(req.method, srv.URL+req.path, nil)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != req.code {
+			t.Errorf("%s %s: got %d, want %d", req.method, req.path, resp.StatusCode, req.code)
+		}
+	}
+	if c0.GetInjectSpeed() != 100 || c1.GetInjectSpeed() != 5 {
+		t.Fatalf("unexpected inject speed: %d %d", c0.GetInjectSpeed(), c1.GetInjectSpeed())
+	}
+	if log.LogLevel() != log.LvlDebug {
+		t.Fatalf("log level not changed: %v", log.LogLevel())
+	}
+	if lvl, err := parseLogLevel("2"); err != nil || lvl != log.LvlWarn {
+		t.Fatalf("numeric level: %v %v", lvl, err)
+	}
+
+	// 其他网页发起的请求、非回环的 Host 和没有口令的请求被拒绝
+	api := &admin{role: "cluster", clients: []*client.Client{c0, c1}}
+	open := httptest.NewServer(guard("", api.handler()))
+	defer open.Close()
+	secured := httptest.NewServer(guard("secret", api.handler()))
+	defer secured.Close()
+	for _, req := range []struct {
+		url     string
+		headers map[string]string
+		host    string
+		code    int
+	}{
+		{open.URL, map[string]string{"Content-Type": "application/json"}, "", http.StatusOK},
+		{open.URL, map[string]string{"Origin": "http://evil.example"}, "", http.StatusForbidden},
+		{open.URL, map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, "", http.StatusUnsupportedMediaType},
+		{open.URL, map[string]string{"Content-Type": "text/plain"}, "", http.StatusUnsupportedMediaType},
+		{open.URL, nil, "evil.example:80", http.StatusForbidden},
+		{secured.URL, nil, "", http.StatusUnauthorized},
+		{secured.URL, map[string]string{"Authorization": "Bearer wrong"}, "", http.StatusUnauthorized},
+		{secured.URL, map[string]string{"Authorization": "Bearer secret"}, "10.0.0.5:9000", http.StatusOK},
+	} {
+		r, _ := http.NewRequest(http.MethodPost, req.url+"/injectspeed?speed=7&client=0", nil)
+		for k, v := range req.headers {
+			r.Header.Set(k, v)
+		}
+		if req.host != "" {
+			r.Host = req.host
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != req.code {
+			t.Errorf("%s %v host %q: got %d, want %d", req.url, req.headers, req.host, resp.StatusCode, req.code)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	beaconchain "go-w3chain/beaconChain"
+	"go-w3chain/cfg"
+	"go-w3chain/client"
+	"go-w3chain/committee"
+	"go-w3chain/data"
+	"go-w3chain/log"
+	"go-w3chain/messageHub"
+	"go-w3chain/node"
+	"go-w3chain/result"
+	"go-w3chain/shard"
+	"go-w3chain/utils"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const (
+	clusterHost = "127.0.0.1"
+	// booter 使用该端口，之后依次是各客户端和各分片节点
+	clusterStartPort = 30000
+)
+
+/** cluster 的地址表：所有实例都在回环地址上，按 booter、客户端、分片节点的顺序分配端口
+ * 分片 i 的节点 j 使用端口 StartPort+i*ComAllNodeNum+j
+ */
+func clusterTopology(allCfg *cfg.Cfg) *cfg.Topology {
+	t := &cfg.Topology{
+		Booter:        net.JoinHostPort(clusterHost, strconv.Itoa(clusterStartPort)),
+		Machines:      []string{clusterHost},
+		StartPort:     clusterStartPort + 1 + allCfg.ClientNum,
+		PortsPerShard: allCfg.ComAllNodeNum,
+	}
+	for i := 0; i < allCfg.ClientNum; i++ {
+		t.Clients = append(t.Clients, net.JoinHostPort(clusterHost, strconv.Itoa(clusterStartPort+1+i)))
+	}
+	return t
+}
+
+/** 在一个进程中运行完整的实验：booter、模拟信标链、所有分片节点和客户端
+ * 各实例通过进程内网络 messageHub.LocalNetwork 通信，地址表中的回环地址只作为实例的标识
+ * 等待所有委员会和客户端停止后打印交易执行结果，并写入日志目录下的 cluster-result.json
+ */
+func runCluster(ctx context.Context, allCfg *cfg.Cfg) {
+	if err := clusterTopology(allCfg).Apply(allCfg.ShardNum, allCfg.ComAllNodeNum, allCfg.ClientNum); err != nil {
+		log.Error("set cluster topology fail", "err", err)
+	}
+
+	// 进程内只能运行模拟信标链
+	if allCfg.BeaconChainMode != 0 {
+		log.Info("cluster runs on the simulated beacon chain", "BeaconChainMode in config", allCfg.BeaconChainMode)
+	}
+	beaconChainConfig := newBeaconChainConfig(allCfg)
+	beaconChainConfig.Mode = 0
+	tbChain = beaconchain.NewTBChain(ctx, beaconChainConfig, allCfg.ShardNum)
+
+	network := messageHub.NewLocalNetwork(tbChain, allCfg.ShardNum, allCfg.ShardSize, allCfg.ComAllNodeNum, allCfg.ClientNum)
+	if allCfg.Faults != nil {
+		network.InjectFaults(allCfg.Faults)
+	}
+
+	booter := node.NewBooter()
+	booter.SetTBchain(tbChain)
+	if _, err := network.AddBooter(booter); err != nil {
+		log.Error("add booter to local network fail", "err", err)
+	}
+	api := &admin{role: allCfg.Role, booter: booter, tbChain: tbChain, network: network}
+
+	// 交易数据只加载一次，由各分片leader和客户端共用
+	data.LoadETHData(allCfg.DatasetDir, allCfg.MaxTxNum)
+	data.SetTxShardId(allCfg.ShardNum)
+	data.SetTX2ClientTable(allCfg.ClientNum)
+
+	dataDir := cfg.DefaultDataDir()
+	nodes := make([]*node.Node, 0, allCfg.ShardNum*allCfg.ComAllNodeNum)
+	for shardId := 0; shardId < allCfg.ShardNum; shardId++ {
+		for nodeId := 0; nodeId < allCfg.ComAllNodeNum; nodeId++ {
+			n := node.NewNode(dataDir, allCfg.ShardNum, shardId, shardId, nodeId, allCfg.ShardSize, allCfg.ComAllNodeNum, allCfg.ReconfigMode)
+			s := shard.NewShard(uint32(shardId), n, allCfg.FastsyncBlockNum, allCfg.Height2Reconfig)
+			n.SetShard(s)
+			if utils.IsShardLeader(n.NodeInfo.NodeID) {
+				data.SetShardInitialAccountState(s)
+			}
+			com := committee.NewCommittee(ctx, uint32(shardId), allCfg.ClientNum, n, newCommitteeConfig(allCfg))
+			n.SetCommittee(com)
+			if _, err := network.AddNode(n); err != nil {
+				log.Error("add node to local network fail", "err", err)
+			}
+			nodes = append(nodes, n)
+			api.addNode(n, com, s)
+		}
+	}
+
+	clients := make([]*client.Client, 0, allCfg.ClientNum)
+	for cid := 0; cid < allCfg.ClientNum; cid++ {
+		c := client.NewClient(cfg.ClientTable[uint32(cid)], cid, allCfg.Height2Rollback, allCfg.ShardNum, allCfg.ExitMode)
+		data.InjectTX2Client(c)
+		c.Print()
+		if _, err := network.AddClient(c); err != nil {
+			log.Error("add client to local network fail", "err", err)
+		}
+		clients = append(clients, c)
+	}
+	api.clients = clients
+	stopAdmin := startAdmin(allCfg.AdminAddr, allCfg.AdminToken, api)
+	log.Info("cluster started", "shardNum", allCfg.ShardNum, "comAllNodeNum", allCfg.ComAllNodeNum, "clientNum", allCfg.ClientNum)
+
+	// 客户端先就绪，收到 booter 发来的合约地址后开始注入交易
+	for _, c := range clients {
+		startClient(c, allCfg.InjectSpeed, allCfg.RecommitIntervalSecs)
+	}
+	for _, n := range nodes {
+		startNode(n)
+	}
+
+	/* 等待所有委员会和客户端停止，进度只由第一个客户端打印 */
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n *node.Node) {
+			defer wg.Done()
+			toStopCommittee(ctx, n, allCfg.RecommitIntervalSecs, allCfg.LogProgressInterval, false, allCfg.ExitMode)
+		}(n)
+	}
+	for i, c := range clients {
+		wg.Add(1)
+		go func(c *client.Client, isLogProgress bool) {
+			defer wg.Done()
+			toStopClient(ctx, c, allCfg.RecommitIntervalSecs, allCfg.LogProgressInterval, isLogProgress, allCfg.ExitMode)
+		}(c, i == 0 && allCfg.IsLogProgress)
+	}
+	wg.Wait()
+
+	stopAdmin()
+	network.Close()
+	stopTBChain()
+	for _, n := range nodes {
+		closeNode(n)
+	}
+
+	/* 打印交易执行结果 */
+	result.PrintTXReceipt()
+	thrput, avlatency, rollbackRate, overloads := result.GetThroughtPutAndLatencyV2()
+	log.Info("GetThroughtPutAndLatency", "thrput", thrput, "avlatency", avlatency, "rollbackRate", rollbackRate, "overloads", overloads)
+	fmt.Printf("throughput: %v (tx/s)\naverage latency: %v (s)\nrollback rate: %v\nworkload for shard: %v\n",
+		thrput, avlatency, rollbackRate, overloads)
+	gas := result.GetGasSummary()
+	printGasSummary(gas)
+	writeClusterResult(allCfg.LogFile, &clusterResult{
+		Throughput:   thrput,
+		AvgLatency:   avlatency,
+		RollbackRate: rollbackRate,
+		Workload:     overloads,
+		Reconfig:     result.GetReconfigSummary(),
+		Gas:          gas,
+	})
+}
@@ -3,6 +3,8 @@ package controller
 // GO111MODULE=on go run main.go
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	beaconchain "go-w3chain/beaconChain"
 	"go-w3chain/cfg"
@@ -16,15 +18,35 @@ import (
 	"go-w3chain/shard"
 	"go-w3chain/utils"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 
 	// "go-w3chain/miner"
 	"go-w3chain/result"
 	"time"
 )
 
-func runClient(allCfg *cfg.Cfg) {
+// 等待所有节点和客户端向 booter 注册的最长时间
+const discoveryTimeout = 10 * time.Minute
+
+func runClient(ctx context.Context, allCfg *cfg.Cfg) {
 	cid := allCfg.ClientId
+	// 客户端的账户和信标链视图保存在客户端的数据目录中
+	clientDir := node.SlotDir(node.ClientSlot(uint32(cid)))
+
+	/* 创建消息中心(用于客户端和信标链的交互等) */
+	messageHub := newMessageHub(allCfg)
+	account := loadAccount(clientDir)
+	messageHub.SetAccount(account)
+	if allCfg.Discovery {
+		discover(messageHub, &core.RegisterPeer{
+			Role:     core.RegisterRoleClient,
+			ClientID: uint32(cid),
+			Addr:     listenAddr(allCfg, cfg.ClientTable[uint32(cid)]),
+		}, account)
+	}
 	addr := cfg.ClientTable[uint32(cid)]
 
 	client := client.NewClient(addr, cid, allCfg.Height2Rollback, allCfg.ShardNum, allCfg.ExitMode)
@@ -40,29 +62,27 @@ func runClient(allCfg *cfg.Cfg) {
 
 	client.Print()
 
-	// 初始化信标链接口
-	beaconChainConfig := &core.BeaconChainConfig{
-		Mode:                 allCfg.BeaconChainMode,
-		ChainId:              allCfg.BeaconChainID,
-		Port:                 allCfg.BeaconChainPort,
-		BlockInterval:        allCfg.RecommitIntervalSecs,
-		Height2Confirm:       uint64(allCfg.Height2Confirm),
-		MultiSignRequiredNum: allCfg.MultiSignRequiredNum,
-	}
-	tbChain = beaconchain.NewTBChain(beaconChainConfig, allCfg.ShardNum)
+	// 初始化信标链接口，信标链视图持久化在客户端的数据目录中，重启后恢复
+	beaconChainConfig := newBeaconChainConfig(allCfg)
+	beaconChainConfig.DataDir = clientDir
+	tbChain = beaconchain.NewTBChain(ctx, beaconChainConfig, allCfg.ShardNum)
 
 	var wg sync.WaitGroup
 
-	/* 创建消息中心(用于客户端和信标链的交互等) */
-	messageHub := messageHub.NewMessageHub()
-
 	/* 设置各个分片、委员会和客户端、信标链的通信渠道 */
-	messageHub.Init(client, nil, nil, tbChain, allCfg.ShardNum, allCfg.ShardSize, allCfg.ComAllNodeNum, allCfg.ClientNum, &wg)
+	messageHub.Init(ctx, client, nil, nil, tbChain, allCfg.ShardNum, allCfg.ShardSize, allCfg.ComAllNodeNum, allCfg.ClientNum, &wg)
+
+	api := &admin{role: allCfg.Role, hub: messageHub, tbChain: tbChain}
+	api.clients = append(api.clients, client)
+	stopAdmin := startAdmin(allCfg.AdminAddr, allCfg.AdminToken, api)
 
 	startClient(client, allCfg.InjectSpeed, allCfg.RecommitIntervalSecs)
-	toStopClient(client, allCfg.RecommitIntervalSecs, allCfg.LogProgressInterval,
+	// 重启时 booter 已部署合约，不会再次发送合约地址
+	messageHub.FetchContract()
+	toStopClient(ctx, client, allCfg.RecommitIntervalSecs, allCfg.LogProgressInterval,
 		allCfg.IsLogProgress, allCfg.ExitMode)
 
+	stopAdmin()
 	stopTBChain()
 	messageHub.Close()
 
@@ -72,10 +92,11 @@ func runClient(allCfg *cfg.Cfg) {
 	result.PrintTXReceipt()
 	thrput, avlatency, rollbackRate, overloads := result.GetThroughtPutAndLatencyV2()
 	log.Info("GetThroughtPutAndLatency", "thrput", thrput, "avlatency", avlatency, "rollbackRate", rollbackRate, "overloads", overloads)
+	printGasSummary(result.GetGasSummary())
 
 }
 
-func runNode(allCfg *cfg.Cfg) {
+func runNode(ctx context.Context, allCfg *cfg.Cfg) {
 	shardId := allCfg.ShardId
 	nodeId := allCfg.NodeId
 	comId := shardId
@@ -87,6 +108,18 @@ func runNode(allCfg *cfg.Cfg) {
 	node := node.NewNode(dataDir, allCfg.ShardNum, shardId, comId, nodeId, allCfg.ShardSize, allCfg.ComAllNodeNum, allCfg.ReconfigMode)
 	defer closeNode(node)
 
+	/* 创建消息中心(用于委员会和信标链的交互等) */
+	messageHub := newMessageHub(allCfg)
+	if allCfg.Discovery {
+		discover(messageHub, &core.RegisterPeer{
+			Role:    core.RegisterRoleNode,
+			ShardID: uint32(shardId),
+			NodeID:  uint32(nodeId),
+			Addr:    listenAddr(allCfg, node.GetAddr()),
+		}, node.GetAccount())
+		node.NodeInfo.NodeAddr = cfg.NodeTable[uint32(shardId)][uint32(nodeId)]
+	}
+
 	// TODO：建立分片内连接
 
 	// 创建本节点对应的分片实例，用于执行分片的操作
@@ -101,41 +134,32 @@ func runNode(allCfg *cfg.Cfg) {
 	}
 
 	// 创建本节点对应的委员会实例
-	committeeConfig := &core.CommitteeConfig{
-		RecommitTime:         time.Duration(allCfg.RecommitIntervalSecs) * time.Second,
-		MaxBlockSize:         allCfg.MaxBlockTXSize,
-		InjectSpeed:          allCfg.InjectSpeed,
-		Height2Reconfig:      allCfg.Height2Reconfig,
-		MultiSignRequiredNum: allCfg.MultiSignRequiredNum,
-	}
-	com := committee.NewCommittee(uint32(allCfg.ShardId), allCfg.ClientNum, node, committeeConfig)
+	com := committee.NewCommittee(ctx, uint32(allCfg.ShardId), allCfg.ClientNum, node, newCommitteeConfig(allCfg))
 	node.SetCommittee(com)
 
-	// 初始化信标链接口
-	beaconChainConfig := &core.BeaconChainConfig{
-		Mode:                 allCfg.BeaconChainMode,
-		ChainId:              allCfg.BeaconChainID,
-		Port:                 allCfg.BeaconChainPort,
-		BlockInterval:        allCfg.RecommitIntervalSecs,
-		Height2Confirm:       uint64(allCfg.Height2Confirm),
-		MultiSignRequiredNum: allCfg.MultiSignRequiredNum,
-	}
-	tbChain = beaconchain.NewTBChain(beaconChainConfig, allCfg.ShardNum)
+	// 初始化信标链接口，信标链视图持久化在节点的数据目录中，重启后恢复
+	beaconChainConfig := newBeaconChainConfig(allCfg)
+	beaconChainConfig.DataDir = node.DataDir
+	tbChain = beaconchain.NewTBChain(ctx, beaconChainConfig, allCfg.ShardNum)
 
 	var wg sync.WaitGroup
 
-	/* 创建消息中心(用于委员会和信标链的交互等) */
-	messageHub := messageHub.NewMessageHub()
 	/* 设置各个分片、委员会和客户端、信标链的通信渠道 */
-	messageHub.Init(nil, node, nil, tbChain, allCfg.ShardNum, allCfg.ShardSize, allCfg.ComAllNodeNum, allCfg.ClientNum, &wg)
+	messageHub.Init(ctx, nil, node, nil, tbChain, allCfg.ShardNum, allCfg.ShardSize, allCfg.ComAllNodeNum, allCfg.ClientNum, &wg)
+
+	api := &admin{role: allCfg.Role, hub: messageHub, tbChain: tbChain}
+	api.addNode(node, com, shard)
+	stopAdmin := startAdmin(allCfg.AdminAddr, allCfg.AdminToken, api)
 
 	// 启动节点
 	startNode(node)
+	messageHub.FetchContract()
 
 	/* 循环打印进度；判断各客户端和委员会能否停止, 若能则停止 */
-	toStopCommittee(node, allCfg.RecommitIntervalSecs, allCfg.LogProgressInterval,
+	toStopCommittee(ctx, node, allCfg.RecommitIntervalSecs, allCfg.LogProgressInterval,
 		allCfg.IsLogProgress, allCfg.ExitMode)
 
+	stopAdmin()
 	stopTBChain()
 	messageHub.Close()
 	wg.Wait()
@@ -143,41 +167,159 @@ func runNode(allCfg *cfg.Cfg) {
 }
 
 /* booterNode 的作用是接收各分片的创世区块信标及初始地址，部署合约并返回合约地址 */
-func runBooterNode(allCfg *cfg.Cfg) {
+func runBooterNode(ctx context.Context, allCfg *cfg.Cfg) {
 	// 初始化信标链接口
-	beaconChainConfig := &core.BeaconChainConfig{
-		Mode:                 allCfg.BeaconChainMode,
-		ChainId:              allCfg.BeaconChainID,
-		Port:                 allCfg.BeaconChainPort,
-		BlockInterval:        allCfg.RecommitIntervalSecs,
-		Height2Confirm:       uint64(allCfg.Height2Confirm),
-		MultiSignRequiredNum: allCfg.MultiSignRequiredNum,
-	}
-	tbChain = beaconchain.NewTBChain(beaconChainConfig, allCfg.ShardNum)
+	tbChain = beaconchain.NewTBChain(ctx, newBeaconChainConfig(allCfg), allCfg.ShardNum)
 	defer stopTBChain()
 
 	booter := node.NewBooter()
 	booter.SetTBchain(tbChain)
+	account := loadAccount(node.SlotDir(node.BooterSlot))
+	if allCfg.Discovery {
+		booter.EnableRegistry(allCfg.ShardNum, allCfg.ComAllNodeNum, allCfg.ClientNum, account, allCfg.ClusterToken)
+	}
 
 	var wg sync.WaitGroup
 
 	/* 创建消息中心(用于委员会和信标链的交互等) */
-	messageHub := messageHub.NewMessageHub()
+	messageHub := newMessageHub(allCfg)
+	messageHub.SetAccount(account)
 	/* 设置各个分片、委员会和客户端、信标链的通信渠道 */
-	messageHub.Init(nil, nil, booter, tbChain, allCfg.ShardNum, allCfg.ShardSize, allCfg.ComAllNodeNum, allCfg.ClientNum, &wg)
+	messageHub.Init(ctx, nil, nil, booter, tbChain, allCfg.ShardNum, allCfg.ShardSize, allCfg.ComAllNodeNum, allCfg.ClientNum, &wg)
 	defer messageHub.Close()
+	defer startAdmin(allCfg.AdminAddr, allCfg.AdminToken, &admin{role: allCfg.Role, booter: booter, tbChain: tbChain, hub: messageHub})()
 
 	wg.Wait()
 
 }
 
-func Main(cfgfilename string, role string, shardNum, shardID, nodeID int32) {
+func newBeaconChainConfig(allCfg *cfg.Cfg) *core.BeaconChainConfig {
+	return &core.BeaconChainConfig{
+		Mode:                 allCfg.BeaconChainMode,
+		ChainId:              allCfg.BeaconChainID,
+		Port:                 allCfg.BeaconChainPort,
+		BlockInterval:        allCfg.RecommitIntervalSecs,
+		Height2Confirm:       uint64(allCfg.Height2Confirm),
+		MultiSignRequiredNum: allCfg.MultiSignRequiredNum,
+		TBSubmit:             allCfg.TBSubmit,
+		TBBatchSize:          allCfg.TBBatchSize,
+		EventSource:          allCfg.TBEventSource,
+	}
+}
+
+func newCommitteeConfig(allCfg *cfg.Cfg) *core.CommitteeConfig {
+	return &core.CommitteeConfig{
+		RecommitTime:         time.Duration(allCfg.RecommitIntervalSecs) * time.Second,
+		MaxBlockSize:         allCfg.MaxBlockTXSize,
+		InjectSpeed:          allCfg.InjectSpeed,
+		Height2Reconfig:      allCfg.Height2Reconfig,
+		MultiSignRequiredNum: allCfg.MultiSignRequiredNum,
+		TBSubmit:             allCfg.TBSubmit,
+		TBBatchSize:          allCfg.TBBatchSize,
+	}
+}
+
+/* 按配置创建消息中心，设置需在 Init 之前设置的选项 */
+func newMessageHub(allCfg *cfg.Cfg) *messageHub.GoodMessageHub {
+	hub := messageHub.NewMessageHub()
+	if allCfg.EnableTLS {
+		hub.EnableTLS()
+	}
+	if allCfg.VerifyEnvelope {
+		hub.EnableEnvelopeVerify()
+	}
+	if allCfg.Compression != "" {
+		hub.SetCompression(allCfg.Compression, allCfg.CompressThreshold)
+	}
+	hub.SetBroadcast(allCfg.Broadcast, allCfg.BroadcastFanout)
+	hub.SetClusterToken(allCfg.ClusterToken)
+	if allCfg.InboundQueue != nil {
+		hub.SetInboundQueue(allCfg.InboundQueue)
+	}
+	if allCfg.Faults != nil {
+		hub.InjectFaults(allCfg.Faults)
+	}
+	return hub
+}
+
+/* 本进程的监听地址，未指定时使用地址表中的地址 */
+func listenAddr(allCfg *cfg.Cfg, defaultAddr string) string {
+	if allCfg.ListenAddr != "" {
+		return allCfg.ListenAddr
+	}
+	return defaultAddr
+}
+
+/* 读取保存在数据目录 dir 中的账户，不存在时创建，失败时退出 */
+func loadAccount(dir string) *node.W3Account {
+	account, err := node.LoadW3Account(dir)
+	if err != nil {
+		log.Error("load account fail", "dir", dir, "err", err)
+	}
+	return account
+}
+
+/* 向 booter 注册并获取地址表，失败时退出 */
+func discover(hub *messageHub.GoodMessageHub, req *core.RegisterPeer, account *node.W3Account) {
+	log.Info("discover topology from booter", "booter", cfg.BooterAddr, "role", req.Role, "addr", req.Addr)
+	if err := hub.Discover(cfg.BooterAddr, req, account, discoveryTimeout); err != nil {
+		log.Error("discover topology fail", "err", err)
+	}
+}
+
+/* 读取配置中指定的地址配置文件，之后命令行或配置中指定的 booter 地址覆盖其中的地址 */
+func loadTopology(allCfg *cfg.Cfg) {
+	if allCfg.Topology != "" {
+		if err := cfg.LoadTopology(allCfg.Topology, allCfg.ShardNum, allCfg.ComAllNodeNum, allCfg.ClientNum); err != nil {
+			fmt.Println("load topology fail:", err)
+			log.Error("load topology fail", "file", allCfg.Topology, "err", err)
+		}
+		log.Info("load topology", "file", allCfg.Topology, "booter", cfg.BooterAddr, "geth", cfg.GethIPAddr)
+	}
+	if allCfg.BooterAddr != "" {
+		cfg.BooterAddr = allCfg.BooterAddr
+	}
+}
+
+/** 依次用 LESSCHAIN_<字段名> 环境变量和 Key=Value 形式的 overrides 覆写配置，后者优先
+ * 返回实际应用的覆写，Role 仍为空时为 booter
+ */
+func applyOverrides(c *cfg.Cfg, overrides []string) ([]string, error) {
+	applied, err := c.ApplyEnv(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range overrides {
+		if err := c.SetKeyValue(kv); err != nil {
+			return nil, err
+		}
+		applied = append(applied, kv)
+	}
+	if c.Role == "" {
+		c.Role = "booter"
+	}
+	return applied, nil
+}
+
+func Main(cfgfilename string, overrides []string) {
 	cfg := cfg.DefaultCfg(cfgfilename)
-	// 命令行参数覆写配置文件的参数
-	cfg.Role = role
-	cfg.ShardNum = int(shardNum)
-	cfg.ShardId = int(shardID)
-	cfg.NodeId = int(nodeID)
+	// 环境变量和命令行参数覆写配置文件的参数
+	applied, err := applyOverrides(cfg, overrides)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	role := cfg.Role
+
+	/* 启动前检查配置，列出所有不合法的参数 */
+	if err := cfg.Validate(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := cfg.ApplyDataDir(); err != nil {
+		fmt.Println("invalid DataDir:", err)
+		os.Exit(1)
+	}
 
 	/* 设置日志存储路径 */
 	// 检查logs文件夹是否存在
@@ -198,20 +340,42 @@ func Main(cfgfilename string, role string, shardNum, shardID, nodeID int32) {
 	fmt.Println("log file:", cfg.LogFile)
 	log.SetLogInfo(log.Lvl(cfg.LogLevel), cfg.LogFile)
 
+	/* 从地址配置文件中读取地址表，cluster 使用自动生成的地址表 */
+	if cfg.Role != "cluster" {
+		loadTopology(cfg)
+	}
+
+	if cfg.Seed != 0 {
+		utils.SetSeed(cfg.Seed)
+	}
+
 	/* 设置 是否使用 progressbar */
 	result.SetIsProgressBar(cfg.IsProgressBar)
 	result.SetcsvFilename(cfg.LogFile)
 
-	/* 打印超参数 */
-	log.Info(fmt.Sprintf("%#v", cfg))
+	/* 打印生效的配置 */
+	effective, _ := json.Marshal(cfg)
+	log.Info("effective config", "file", cfgfilename, "overrides", strings.Join(applied, " "), "cfg", string(effective))
+
+	/* 收到 SIGINT/SIGTERM 后各角色停止出块和注入交易，关闭数据库并输出已有的结果；再次收到信号时直接退出 */
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Info("got stop signal, shutting down...")
+		fmt.Println("shutting down, interrupt again to force exit")
+	}()
 
 	switch role {
 	case "client":
-		runClient(cfg)
+		runClient(ctx, cfg)
 	case "node":
-		runNode(cfg)
+		runNode(ctx, cfg)
 	case "booter":
-		runBooterNode(cfg)
+		runBooterNode(ctx, cfg)
+	case "cluster":
+		runCluster(ctx, cfg)
 	default:
 		log.Error("unknown roleType", "type", role)
 	}
@@ -220,3 +384,29 @@ func Main(cfgfilename string, role string, shardNum, shardID, nodeID int32) {
 	log.Info(" Run finished! Bye~")
 	fmt.Println(" Run finished! Bye~")
 }
+
+/** lessChain config 的入口：打印覆写后生效的配置，供启动脚本读取
+ * 不指定字段时打印完整的 json，否则每行打印一个字段的值
+ */
+func PrintCfg(cfgfilename string, overrides []string, fields []string) error {
+	c := cfg.ReadCfg(cfgfilename)
+	if _, err := applyOverrides(c, overrides); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		data, err := json.MarshalIndent(c, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	for _, f := range fields {
+		v, err := c.Get(f)
+		if err != nil {
+			return err
+		}
+		fmt.Println(v)
+	}
+	return nil
+}
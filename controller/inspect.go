@@ -0,0 +1,301 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-w3chain/cfg"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/spf13/pflag"
+)
+
+const inspectUsage = `usage: lessChain inspect <command> [arguments]
+
+commands:
+  blocks  <datadir>                         list blocks with their tx counts
+  block   <datadir> <number|hash> [--header] dump a block, or only its header
+  account <datadir> <address> [--root hash] balance, nonce and Merkle proof of an account
+                                            at the given state root (default: head block)
+  compare <datadirA> <datadirB>             compare state roots of two nodes height by height
+
+<datadir> is a node directory such as ~/.lessChain/S0N0, its chaindata directory,
+or a node name such as S0N0 under the default data directory.
+Blocks and state are written to the database when a node stops.`
+
+/** lessChain inspect 的入口，以只读方式打开节点的链数据库并打印其中的内容
+ * 节点运行时数据库被加锁，需要在节点停止后查看
+ */
+func Inspect(args []string) error {
+	// 只在出错时打印日志，避免 log.Error 在没有设置输出时写日志
+	log.Root().SetHandler(log.LvlFilterHandler(log.LvlWarn, log.StderrHandler))
+
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Println(inspectUsage)
+		return nil
+	}
+	fs := pflag.NewFlagSet("inspect "+args[0], pflag.ContinueOnError)
+	headerOnly := fs.Bool("header", false, "dump only the block header")
+	rootHex := fs.String("root", "", "state root, default is the root of the head block")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	rest := fs.Args()
+
+	need := map[string]int{"blocks": 1, "block": 2, "account": 2, "compare": 2}
+	n, ok := need[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown inspect command %q\n%s", args[0], inspectUsage)
+	}
+	if len(rest) != n {
+		return fmt.Errorf("inspect %s expects %d argument(s), got %d\n%s", args[0], n, len(rest), inspectUsage)
+	}
+
+	db, err := openChainDB(rest[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "blocks":
+		return inspectBlocks(db)
+	case "block":
+		return inspectBlock(db, rest[1], *headerOnly)
+	case "account":
+		return inspectAccount(db, rest[1], *rootHex)
+	default:
+		other, err := openChainDB(rest[1])
+		if err != nil {
+			return err
+		}
+		defer other.Close()
+		return inspectCompare(db, other, rest[0], rest[1])
+	}
+}
+
+/* 找到节点的 chaindata 目录并以只读方式打开 */
+func openChainDB(dir string) (ethdb.Database, error) {
+	candidates := []string{
+		filepath.Join(dir, "chaindata"),
+		dir,
+		filepath.Join(cfg.DefaultDataDir(), dir, "chaindata"),
+	}
+	for _, path := range candidates {
+		if _, err := os.Stat(filepath.Join(path, "CURRENT")); err != nil {
+			continue
+		}
+		db, err := rawdb.NewLevelDBDatabase(path, 0, 0, "", true)
+		if err != nil {
+			return nil, fmt.Errorf("open %s: %v (is the node still running?)", path, err)
+		}
+		return db, nil
+	}
+	return nil, fmt.Errorf("no chain database found at %s", dir)
+}
+
+/* 数据库中记录的最新区块高度 */
+func headNumber(db ethdb.Database) (uint64, error) {
+	hash := core.ReadHeadBlockHash(db)
+	if hash == (common.Hash{}) {
+		return 0, errors.New("no head block in database")
+	}
+	number := core.ReadHeaderNumber(db, hash)
+	if number == nil {
+		return 0, fmt.Errorf("head block %x has no number", hash)
+	}
+	return *number, nil
+}
+
+/* 按高度读取规范链上的区块 */
+func blockByNumber(db ethdb.Database, number uint64) *core.Block {
+	hash := core.ReadCanonicalHash(db, number)
+	if hash == (common.Hash{}) {
+		return nil
+	}
+	return core.ReadBlock(db, hash, number)
+}
+
+func inspectBlocks(db ethdb.Database) error {
+	head, err := headNumber(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-8s %-66s %-6s %s\n", "number", "hash", "txs", "stateRoot")
+	total := 0
+	for i := uint64(0); i <= head; i++ {
+		block := blockByNumber(db, i)
+		if block == nil {
+			fmt.Printf("%-8d missing\n", i)
+			continue
+		}
+		total += len(block.Transactions)
+		fmt.Printf("%-8d %-66s %-6d %s\n", i, block.GetHash().Hex(), len(block.Transactions), block.Root().Hex())
+	}
+	fmt.Printf("%d blocks, %d txs\n", head+1, total)
+	return nil
+}
+
+/* 区块号或区块哈希 */
+func readBlockByID(db ethdb.Database, id string) (*core.Block, error) {
+	if strings.HasPrefix(id, "0x") && len(id) == 2+2*common.HashLength {
+		hash := common.HexToHash(id)
+		number := core.ReadHeaderNumber(db, hash)
+		if number == nil {
+			return nil, fmt.Errorf("block %s not found", id)
+		}
+		if block := core.ReadBlock(db, hash, *number); block != nil {
+			return block, nil
+		}
+		return nil, fmt.Errorf("block %s has no body", id)
+	}
+	number, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block number or hash %q", id)
+	}
+	block := blockByNumber(db, number)
+	if block == nil {
+		return nil, fmt.Errorf("block %d not found", number)
+	}
+	return block, nil
+}
+
+func inspectBlock(db ethdb.Database, id string, headerOnly bool) error {
+	block, err := readBlockByID(db, id)
+	if err != nil {
+		return err
+	}
+	var v interface{} = struct {
+		Hash         common.Hash
+		Header       *core.Header
+		Transactions core.Transactions
+	}{block.GetHash(), block.Header, block.Transactions}
+	if headerOnly {
+		v = block.Header
+	}
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+/* 按写入顺序记录证明中的节点，即从根节点到叶子节点 */
+type proofList [][]byte
+
+func (l *proofList) Put(key []byte, value []byte) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *proofList) Delete(key []byte) error {
+	panic("not supported")
+}
+
+func inspectAccount(db ethdb.Database, addrHex, rootHex string) error {
+	if !common.IsHexAddress(addrHex) {
+		return fmt.Errorf("invalid address %q", addrHex)
+	}
+	addr := common.HexToAddress(addrHex)
+
+	var root common.Hash
+	if rootHex != "" {
+		root = common.HexToHash(rootHex)
+	} else {
+		head, err := headNumber(db)
+		if err != nil {
+			return err
+		}
+		block := blockByNumber(db, head)
+		if block == nil {
+			return fmt.Errorf("head block %d not found", head)
+		}
+		root = block.Root()
+	}
+
+	statedb, err := state.New(root, state.NewDatabase(db), nil)
+	if err != nil {
+		return fmt.Errorf("state root %x not in database: %v", root, err)
+	}
+	fmt.Printf("stateRoot: %s\naddress:   %s\n", root.Hex(), addr.Hex())
+	if !statedb.Exist(addr) {
+		fmt.Println("account does not exist")
+	} else {
+		fmt.Printf("balance:   %v\nnonce:     %v\n", statedb.GetBalance(addr), statedb.GetNonce(addr))
+	}
+
+	/* 与分片向委员会提供的证明相同：secureTrie 中以地址哈希为键 */
+	tr, err := trie.NewSecure(root, trie.NewDatabase(db))
+	if err != nil {
+		return err
+	}
+	key := crypto.Keccak256(addr.Bytes())
+	var proof proofList
+	if err := tr.Prove(key, 0, &proof); err != nil {
+		return err
+	}
+	proofDB := memorydb.New()
+	for _, node := range proof {
+		proofDB.Put(crypto.Keccak256(node), node)
+	}
+	value, err := trie.VerifyProof(root, key, proofDB)
+	if err != nil {
+		return fmt.Errorf("verify proof fail: %v", err)
+	}
+	fmt.Printf("proof (%d nodes, verified, absent: %v):\n", len(proof), value == nil)
+	for _, node := range proof {
+		fmt.Printf("  0x%x\n", node)
+	}
+	return nil
+}
+
+/** 逐个高度比较两个节点的状态根，打印不一致的高度
+ * 两个节点的高度不同时只比较共同的部分，有不一致时返回错误
+ */
+func inspectCompare(a, b ethdb.Database, nameA, nameB string) error {
+	headA, err := headNumber(a)
+	if err != nil {
+		return fmt.Errorf("%s: %v", nameA, err)
+	}
+	headB, err := headNumber(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", nameB, err)
+	}
+	top := headA
+	if headB < top {
+		top = headB
+	}
+	fmt.Printf("%s head: %d\n%s head: %d\n", nameA, headA, nameB, headB)
+
+	mismatches := 0
+	for i := uint64(0); i <= top; i++ {
+		blockA, blockB := blockByNumber(a, i), blockByNumber(b, i)
+		if blockA == nil || blockB == nil {
+			fmt.Printf("height %d: block missing\n", i)
+			mismatches++
+			continue
+		}
+		if blockA.Root() != blockB.Root() {
+			fmt.Printf("height %d: %s %s, %s %s\n", i, nameA, blockA.Root().Hex(), nameB, blockB.Root().Hex())
+			mismatches++
+		}
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("state roots differ at %d of %d heights", mismatches, top+1)
+	}
+	fmt.Printf("state roots match at all %d common heights\n", top+1)
+	return nil
+}
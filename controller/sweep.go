@@ -0,0 +1,251 @@
+package controller
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go-w3chain/cfg"
+	"go-w3chain/result"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// cluster 在日志目录下写入的结果文件
+	clusterResultFile = "cluster-result.json"
+	// 超时或中断时先发送 SIGINT，等待该时间后仍未退出则强制结束
+	sweepStopGrace = time.Minute
+)
+
+/* cluster 运行结束时写入 clusterResultFile 的结果，sweep 从中读取 */
+type clusterResult struct {
+	Throughput   float64
+	AvgLatency   float64
+	RollbackRate float64
+	Workload     []int
+	Reconfig     result.ReconfigSummary
+	Gas          result.GasSummary
+}
+
+/* 没有执行完成的交易时指标为 NaN 或 Inf，json 不能编码，记为0 */
+func finite(f float64) float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return f
+}
+
+func writeClusterResult(logFile string, r *clusterResult) {
+	r.Throughput, r.AvgLatency, r.RollbackRate = finite(r.Throughput), finite(r.AvgLatency), finite(r.RollbackRate)
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(filepath.Dir(logFile), clusterResultFile), data, 0644)
+	}
+	if err != nil {
+		fmt.Println("write cluster result fail:", err)
+	}
+}
+
+/** lessChain sweep 的入口：按扫描配置依次运行每个参数组合的每次重复，
+ * 每次运行都是一个独立的 lessChain cluster 子进程，工作目录为 OutDir/p<组合>-r<重复>，
+ * 其中 config.json 是该次运行的完整配置，logs/ 下是日志和结果，data/ 下是各节点的数据目录
+ * （基础配置指定了 DataDir 时为 DataDir/p<组合>-r<重复>），各次运行不会读到其他运行的链数据。
+ * 环境变量和 overrides 覆写基础配置，Grid 中的参数再覆写它们
+ * 所有运行的吞吐量、时延、回滚率、负载、重组统计和信标链开销写入 OutDir/results.csv，每完成一次运行写入一行
+ */
+func Sweep(cfgfilename, sweepfile string, overrides []string) error {
+	sweep, err := cfg.ReadSweep(sweepfile)
+	if err != nil {
+		return err
+	}
+	if sweep.Base != "" {
+		cfgfilename = sweep.Base
+	}
+	fmt.Println("base cfg file:", cfgfilename)
+	base := cfg.ReadCfg(cfgfilename)
+	if _, err := applyOverrides(base, overrides); err != nil {
+		return err
+	}
+	base.Role = "cluster"
+	base.LogFile = ""
+	if base.DatasetDir, err = filepath.Abs(base.DatasetDir); err != nil {
+		return err
+	}
+	if base.DataDir != "" {
+		if base.DataDir, err = filepath.Abs(base.DataDir); err != nil {
+			return err
+		}
+	}
+	if err := sweep.Check(base); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(sweep.OutDir, 0755); err != nil {
+		return err
+	}
+
+	params := sweep.Params()
+	points := sweep.Points()
+	table, err := os.Create(filepath.Join(sweep.OutDir, "results.csv"))
+	if err != nil {
+		return err
+	}
+	defer table.Close()
+	w := csv.NewWriter(table)
+	header := append([]string{"point", "rep", "seed"}, params...)
+	header = append(header, "status", "durationSecs", "throughput", "avgLatency", "rollbackRate", "workload",
+		"reconfigRounds", "syncs", "avgSyncTimeMs", "avgSyncWireBytes",
+		"tbchainTxs", "tbchainGasUsed", "tbchainFeeGwei", "gasPerShardBlock", "gasPerTx")
+	w.Write(header)
+	w.Flush()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("sweep %s: %d points x %d repetitions, results in %s\n", sweep.Name, len(points), sweep.Repetitions, sweep.OutDir)
+	for _, point := range points {
+		for rep := 0; rep < sweep.Repetitions; rep++ {
+			if ctx.Err() != nil {
+				fmt.Println("sweep interrupted")
+				return w.Error()
+			}
+			c, _ := sweep.Apply(base, point)
+			c.Seed = sweep.Seed + int64(rep)
+			runName := fmt.Sprintf("p%03d-r%d", point.Index, rep)
+			runDir := filepath.Join(sweep.OutDir, runName)
+			// 相对路径相对于子进程的工作目录 runDir
+			c.DataDir = "data"
+			if base.DataDir != "" {
+				c.DataDir = filepath.Join(base.DataDir, runName)
+			}
+			fmt.Printf("[%d/%d rep %d] %s\n", point.Index+1, len(points), rep, describePoint(params, point))
+
+			start := time.Now()
+			status, res := runSweepPoint(ctx, exe, runDir, c, time.Duration(sweep.TimeoutSecs)*time.Second)
+			row := []string{strconv.Itoa(point.Index), strconv.Itoa(rep), strconv.FormatInt(c.Seed, 10)}
+			for _, v := range point.Values {
+				row = append(row, fmt.Sprint(v))
+			}
+			row = append(row, status, fmt.Sprintf("%.1f", time.Since(start).Seconds()))
+			if res != nil {
+				workload := make([]string, len(res.Workload))
+				for i, l := range res.Workload {
+					workload[i] = strconv.Itoa(l)
+				}
+				row = append(row, fmt.Sprint(res.Throughput), fmt.Sprint(res.AvgLatency), fmt.Sprint(res.RollbackRate),
+					strings.Join(workload, " "), strconv.Itoa(res.Reconfig.Rounds), strconv.Itoa(res.Reconfig.Syncs),
+					fmt.Sprint(res.Reconfig.AvgSyncTimeMs), fmt.Sprint(res.Reconfig.AvgSyncWireBytes),
+					strconv.Itoa(res.Gas.Total.Txs), strconv.FormatUint(res.Gas.Total.GasUsed, 10), fmt.Sprint(res.Gas.Total.FeeGwei),
+					fmt.Sprint(res.Gas.GasPerShardBlock), fmt.Sprint(res.Gas.GasPerTx))
+				fmt.Printf("  %s: throughput %.2f tx/s, latency %.2f s, rollback rate %.4f\n", status, res.Throughput, res.AvgLatency, res.RollbackRate)
+			} else {
+				fmt.Printf("  %s\n", status)
+			}
+			w.Write(row)
+			w.Flush()
+		}
+	}
+	fmt.Println("sweep finished, results:", table.Name())
+	return w.Error()
+}
+
+func describePoint(params []string, point cfg.SweepPoint) string {
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = fmt.Sprintf("%s=%v", p, point.Values[i])
+	}
+	return strings.Join(parts, " ")
+}
+
+/** 在 runDir 中运行一次 cluster，返回运行状态和 cluster 写入的结果
+ * 超时或 sweep 被中断时向子进程发送 SIGINT，cluster 会输出已执行交易的结果
+ */
+func runSweepPoint(ctx context.Context, exe, runDir string, c *cfg.Cfg, timeout time.Duration) (string, *clusterResult) {
+	if err := os.MkdirAll(runDir, 0755); err != nil {
+		return "failed: " + err.Error(), nil
+	}
+	data, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		return "failed: " + err.Error(), nil
+	}
+	if err := ioutil.WriteFile(filepath.Join(runDir, "config.json"), data, 0644); err != nil {
+		return "failed: " + err.Error(), nil
+	}
+	output, err := os.Create(filepath.Join(runDir, "output.log"))
+	if err != nil {
+		return "failed: " + err.Error(), nil
+	}
+	defer output.Close()
+	// 运行上一次留下的结果和链数据不能被当作本次的结果
+	os.Remove(filepath.Join(runDir, "logs", clusterResultFile))
+	dataDir := c.DataDir
+	if !filepath.IsAbs(dataDir) {
+		dataDir = filepath.Join(runDir, dataDir)
+	}
+	if err := os.RemoveAll(dataDir); err != nil {
+		return "failed: " + err.Error(), nil
+	}
+
+	cmd := exec.Command(exe, "cluster", "--config", "config.json")
+	cmd.Dir = runDir
+	// 环境变量中的覆写已经体现在配置中，不能再覆写 Grid 中的参数
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, cfg.EnvPrefix) {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		return "failed: " + err.Error(), nil
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+	status := "ok"
+	select {
+	case err = <-done:
+	case <-timer:
+		status = "timeout"
+	case <-ctx.Done():
+		status = "interrupted"
+	}
+	if status != "ok" {
+		cmd.Process.Signal(os.Interrupt)
+		select {
+		case err = <-done:
+		case <-time.After(sweepStopGrace):
+			cmd.Process.Kill()
+			err = <-done
+		}
+	}
+	if err != nil && status == "ok" {
+		status = "failed: " + err.Error()
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(runDir, "logs", clusterResultFile))
+	if err != nil {
+		return status, nil
+	}
+	var res clusterResult
+	if err := json.Unmarshal(data, &res); err != nil {
+		return status, nil
+	}
+	return status, &res
+}
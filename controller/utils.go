@@ -1,12 +1,16 @@
 package controller
 
 import (
+	"context"
+	"fmt"
 	"go-w3chain/beaconChain"
 	"go-w3chain/client"
 	"go-w3chain/log"
 	"go-w3chain/node"
 	"go-w3chain/result"
 	"math"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -23,8 +27,9 @@ func startClient(c *client.Client, injectSpeed int, recommitIntervalSecs int) {
 /**
  * 判断委员会能否停止, 若能则停止
  * 循环打印交易总执行进度
+ * ctx 取消时不再等待停止条件，直接停止
  */
-func toStopCommittee(node *node.Node, recommitIntervalSecs,
+func toStopCommittee(ctx context.Context, node *node.Node, recommitIntervalSecs,
 	logProgressInterval int, isLogProgress bool, exitMode int) {
 	log.Info("Monitor txpools and try to stop shards")
 	sleepSecs := int(math.Ceil(float64(recommitIntervalSecs) / 2))
@@ -44,13 +49,15 @@ func toStopCommittee(node *node.Node, recommitIntervalSecs,
 			canStop = node.GetCommittee().CanStopV2()
 		}
 
-		if canStop {
+		checkTBChainEvents()
+		if canStop || ctx.Err() != nil {
+			// worker 打包完当前区块后停止，分片执行完已收到的区块后停止
 			node.GetCommittee().Close()
 			node.GetShard().Close()
 			break
 		}
 		// 每出块间隔的一半时间打印一次进度
-		time.Sleep(time.Duration(sleepSecs) * time.Second)
+		sleep(ctx, time.Duration(sleepSecs)*time.Second)
 		/* 打印进度 */
 		if isLogProgress {
 			iter++
@@ -65,8 +72,9 @@ func toStopCommittee(node *node.Node, recommitIntervalSecs,
 /**
  * 判断委员会能否停止, 若能则停止
  * 循环打印交易总执行进度
+ * ctx 取消时不再等待停止条件，直接停止
  */
-func toStopClient(c *client.Client, recommitIntervalSecs,
+func toStopClient(ctx context.Context, c *client.Client, recommitIntervalSecs,
 	logProgressInterval int, isLogProgress bool, exitMode int) {
 	log.Info("Monitor txpools and try to stop shards")
 	sleepSecs := int(math.Ceil(float64(recommitIntervalSecs) / 2))
@@ -83,15 +91,16 @@ func toStopClient(c *client.Client, recommitIntervalSecs,
 		if exitMode == 0 {
 			canStop = c.CanStopV1()
 		} else if exitMode == 1 {
-			canStop = c.CanStopV2() && c.InjectDoneMsgSent
+			canStop = c.CanStopV2() && c.InjectDone()
 		}
 		c.LogQueues()
-		if canStop {
+		checkTBChainEvents()
+		if canStop || ctx.Err() != nil {
 			c.Close()
 			break
 		}
 		// 每出块间隔的一半时间打印一次进度
-		time.Sleep(time.Duration(sleepSecs) * time.Second)
+		sleep(ctx, time.Duration(sleepSecs)*time.Second)
 		/* 打印进度 */
 		if isLogProgress {
 			iter++
@@ -103,6 +112,53 @@ func toStopClient(c *client.Client, recommitIntervalSecs,
 	}
 }
 
+/* 合约日志订阅中断超过该时间时提醒 */
+const tbEventsGrace = 30 * time.Second
+
+var (
+	tbEventsLock   sync.Mutex
+	tbEventsWarned bool
+)
+
+/** 检查以太坊模式下的合约日志订阅，中断超过 tbEventsGrace 时提醒一次，恢复后再记录一次
+ * 订阅中断期间信标链不出块，交易不能确认；返回订阅是否正常，模拟信标链总是正常
+ */
+func checkTBChainEvents() bool {
+	if tbChain == nil {
+		return true
+	}
+	h, ok := tbChain.EventHealth()
+	if !ok {
+		return true
+	}
+	tbEventsLock.Lock()
+	defer tbEventsLock.Unlock()
+	if h.Healthy {
+		if tbEventsWarned {
+			log.Info("tbchain event subscription recovered", "source", h.Source, "reconnects", h.Reconnects)
+			tbEventsWarned = false
+		}
+		return true
+	}
+	if !tbEventsWarned && time.Since(h.Since) > tbEventsGrace {
+		log.Warn("tbchain event subscription down, no beacon blocks until it recovers",
+			"source", h.Source, "since", h.Since, "reconnects", h.Reconnects, "lastError", h.LastError)
+		fmt.Println("tbchain event subscription down since", h.Since.Format(time.RFC3339), "err:", h.LastError)
+		tbEventsWarned = true
+	}
+	return false
+}
+
+/* 等待 d 或直到 ctx 取消 */
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
 func closeNode(node *node.Node) {
 	node.Close()
 }
@@ -110,3 +166,35 @@ func closeNode(node *node.Node) {
 func stopTBChain() {
 	tbChain.Close()
 }
+
+/* 输出信标链交互的开销，模拟信标链没有开销，不输出 */
+func printGasSummary(s result.GasSummary) {
+	if s.Total.Txs == 0 {
+		return
+	}
+	log.Info("tbchain gas", "txs", s.Total.Txs, "tbs", s.Total.TBs, "gasUsed", s.Total.GasUsed, "feeGwei", s.Total.FeeGwei,
+		"avgInclusionLatencyMs", s.Total.AvgLatencyMs, "failed", s.Total.Failed,
+		"gasPerShardBlock", s.GasPerShardBlock, "gasPerTx", s.GasPerTx)
+	fmt.Printf("tbchain gas used: %d (%d txs, %d time beacons, %d failed)\ntbchain fee: %v (gwei)\naverage inclusion latency: %v (ms)\n"+
+		"gas per shard block: %v, fee per shard block: %v (gwei)\ngas per tx: %v, fee per tx: %v (gwei)\n",
+		s.Total.GasUsed, s.Total.Txs, s.Total.TBs, s.Total.Failed, s.Total.FeeGwei, s.Total.AvgLatencyMs,
+		s.GasPerShardBlock, s.FeePerShardBlock, s.GasPerTx, s.FeePerTx)
+	types := make([]string, 0, len(s.ByType))
+	for t := range s.ByType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		st := s.ByType[t]
+		log.Info("tbchain gas by type", "txType", t, "txs", st.Txs, "tbs", st.TBs, "gasUsed", st.GasUsed, "feeGwei", st.FeeGwei, "avgInclusionLatencyMs", st.AvgLatencyMs)
+	}
+	shards := make([]int, 0, len(s.ByShard))
+	for shardID := range s.ByShard {
+		shards = append(shards, int(shardID))
+	}
+	sort.Ints(shards)
+	for _, shardID := range shards {
+		st := s.ByShard[uint32(shardID)]
+		log.Info("tbchain gas by shard", "shardID", shardID, "txs", st.Txs, "tbs", st.TBs, "gasUsed", st.GasUsed, "feeGwei", st.FeeGwei, "avgInclusionLatencyMs", st.AvgLatencyMs)
+	}
+}
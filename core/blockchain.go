@@ -40,6 +40,8 @@ type BlockChain struct {
 	currentBlock atomic.Value // Current head of the block chain
 
 	blocks []*Block
+	// blocks 中前 flushed 个区块已写入数据库
+	flushed int
 }
 
 // 设置 stateDB 的 config
@@ -104,6 +106,7 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *cfg
 
 	bc.blocks = make([]*Block, 0)
 	bc.blocks = append(bc.blocks, head)
+	bc.flushed = len(bc.blocks)
 
 	return bc, nil
 }
@@ -127,3 +130,38 @@ func (bc *BlockChain) WriteBlock(block *Block) {
 func (bc *BlockChain) AllBlocks() []*Block {
 	return bc.blocks
 }
+
+/** 将内存中尚未写入的区块和状态树写入数据库，节点关闭前调用
+ * 运行过程中为了速度不写数据库，关闭时写入一次，之后可以用 lessChain inspect 查看
+ * 每个区块的状态树仍在内存中时一并写入，因此可以按任一区块的状态根查询账户
+ */
+func (bc *BlockChain) Flush() error {
+	root, err := bc.statedb.Commit(false)
+	if err != nil {
+		return err
+	}
+	trieDB := bc.statedb.Database().TrieDB()
+	for _, block := range bc.blocks[bc.flushed:] {
+		// 已写入或不在内存中的状态根被忽略
+		if err := trieDB.Commit(block.Root(), false, nil); err != nil {
+			return err
+		}
+	}
+	if err := trieDB.Commit(root, false, nil); err != nil {
+		return err
+	}
+
+	batch := bc.db.NewBatch()
+	for _, block := range bc.blocks[bc.flushed:] {
+		WriteBlock(batch, block)
+		WriteCanonicalHash(batch, block.GetHash(), block.NumberU64())
+	}
+	head := bc.CurrentBlock()
+	WriteHeadBlockHash(batch, head.GetHash())
+	WriteHeadHeaderHash(batch, head.GetHash())
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	bc.flushed = len(bc.blocks)
+	return nil
+}
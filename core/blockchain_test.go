@@ -0,0 +1,57 @@
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+/* Flush 之后区块和每个区块的状态都能从数据库中读出 */
+func TestFlush(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	DefaultGenesisBlock().MustCommit(db)
+	bc, err := NewBlockChain(db, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := common.HexToAddress("0x39235bc0736a947a843fdda7b1eedaffcc3d5506")
+	statedb := bc.GetStateDB()
+	var roots []common.Hash
+	for i := 1; i <= 2; i++ {
+		statedb.AddBalance(addr, big.NewInt(100))
+		root := statedb.IntermediateRoot(false)
+		statedb.Commit(false)
+		roots = append(roots, root)
+
+		header := &Header{Number: big.NewInt(int64(i)), Difficulty: big.NewInt(1), Root: root}
+		txs := []*Transaction{{ID: uint64(i), Sender: &addr, Recipient: &addr, Value: big.NewInt(0)}}
+		bc.WriteBlock(NewBlock(header, txs, trie.NewStackTrie(nil)))
+	}
+	if err := bc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	head := ReadHeadBlockHash(db)
+	if head != bc.CurrentBlock().GetHash() {
+		t.Fatalf("head block hash %x, want %x", head, bc.CurrentBlock().GetHash())
+	}
+	for i, root := range roots {
+		number := uint64(i + 1)
+		block := ReadBlock(db, ReadCanonicalHash(db, number), number)
+		if block == nil || block.Root() != root || len(block.Transactions) != 1 {
+			t.Fatalf("block %d not flushed: %v", number, block)
+		}
+		s, err := state.New(root, state.NewDatabase(db), nil)
+		if err != nil {
+			t.Fatalf("state of block %d not flushed: %v", number, err)
+		}
+		if balance := s.GetBalance(addr); balance.Cmp(big.NewInt(int64(100*number))) != 0 {
+			t.Fatalf("balance at block %d is %v", number, balance)
+		}
+	}
+}
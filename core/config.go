@@ -11,6 +11,8 @@ type CommitteeConfig struct {
 	InjectSpeed          int
 	Height2Reconfig      int
 	MultiSignRequiredNum int
+	TBSubmit             string // 信标的提交方式，见 TBSubmitSingle 等
+	TBBatchSize          int    // 累加器模式下一个默克尔根包含的信标数k
 }
 
 type BeaconChainConfig struct {
@@ -24,4 +26,24 @@ type BeaconChainConfig struct {
 	BlockInterval        int
 	Height2Confirm       uint64
 	MultiSignRequiredNum int
+	/* 持久化信标链视图的目录，为空时不持久化；只用于以太坊私链模式 */
+	DataDir string
+	/* 信标的提交方式，TBBatchSize 是一笔 addTBs 交易最多包含的信标数 */
+	TBSubmit    string
+	TBBatchSize int
+	/* 读取合约日志的方式，websocket 或 polling，为空时使用 websocket */
+	EventSource string
 }
+
+/** 信标的提交方式
+ * single: 委员会leader为每个区块提交一笔 addTB 交易
+ * batch: 信标链把一个出块间隔内收到的信标（可来自多个分片、多个高度）合并为一笔 addTBs 交易，每个信标带各自的多签名
+ * accumulator: leader 积累连续k个信标，委员会只对它们的默克尔根多签名，用 addTBRoot 在链上锚定根
+ */
+const (
+	TBSubmitSingle      = "single"
+	TBSubmitBatch       = "batch"
+	TBSubmitAccumulator = "accumulator"
+	/* TBBatchSize 为0时使用的默认值 */
+	DefaultTBBatchSize = 8
+)
@@ -1,16 +1,60 @@
 package core
 
+import "errors"
+
+/** 消息中心
+ * 对于请求-回复类型的消息(ComGetHeight、ComGetState、GetPoolTx、GetSyncData、GetTB)，
+ * Send 在收到回复或出错后返回，callback 的参数为 (回复, error)；
+ * GetPoolTx、GetSyncData 的 callback 还有第三个参数 TransferSize，为回复在网络上传输的字节数
+ */
 type MessageHub interface {
 	Send(msgType uint32, id uint32, msg interface{}, callback func(...interface{}))
 }
 
+/* rpc 请求失败的原因，可以用 errors.Is 判断 */
+var (
+	ErrRPCTimeout     = errors.New("rpc timeout")
+	ErrRPCUnreachable = errors.New("rpc peer unreachable")
+	ErrRPCConnClosed  = errors.New("rpc connection closed before reply")
+	ErrRPCRemote      = errors.New("rpc remote error")
+)
+
+/* 从 rpc 类消息的 callback 参数中取出错误 */
+func RPCErr(res []interface{}) error {
+	if len(res) < 2 || res[1] == nil {
+		return nil
+	}
+	return res[1].(error)
+}
+
+/** 一次传输的字节数，均包含长度前缀
+ * Raw 为压缩前的大小，Wire 为实际在网络上传输的大小，未压缩时两者相等
+ */
+type TransferSize struct {
+	Raw  int
+	Wire int
+}
+
+func (s *TransferSize) Add(other TransferSize) {
+	s.Raw += other.Raw
+	s.Wire += other.Wire
+}
+
+/* 从 rpc 类消息的 callback 参数中取出回复的传输字节数，没有经过网络时为0 */
+func RPCTransferSize(res []interface{}) TransferSize {
+	if len(res) < 3 {
+		return TransferSize{}
+	}
+	size, _ := res[2].(TransferSize)
+	return size
+}
+
 const (
 	MsgTypeNone uint32 = iota
 
 	MsgTypeComGetHeightFromShard
 
 	MsgTypeComGetStateFromShard
-	MsgTypeShardSendStateToCom
 
 	MsgTypeShardSendGenesis
 	MsgTypeBooterSendContract
@@ -19,6 +63,7 @@ const (
 	MsgTypeCommitteeReply2Client
 	MsgTypeSetInjectDone2Nodes
 	MsgTypeComAddTb2TBChain
+	MsgTypeComAddTbRoot2TBChain
 	// MsgTypeCommitteeInitialAddrs
 	MsgTypeComSendNewAddrs
 	MsgTypeGetTB
@@ -27,6 +72,7 @@ const (
 	MsgTypeReady4Reconfig
 	MsgTypeTBChainPushTB2Client
 	MsgTypeTBChainPushTB2Coms
+	MsgTypeTBChainRetractTB2Client
 
 	MsgTypeGetLatestBlockHashFromEthChain
 	MsgTypeGetBlockHashFromEthChain
@@ -1,16 +1,50 @@
 package core
 
 import (
+	"encoding/binary"
 	"fmt"
 	"math/big"
+	"sort"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
+/** 网络中传输的消息信封
+ * 除消息类型和数据外，还携带发送方的网络地址、账户地址、纪元和序号，以及发送方账户对以上内容的签名，
+ * 接收方据此验证消息来源并拒绝重放的消息
+ */
 type Msg struct {
 	MsgType string
 	Data    []byte
+
+	From   string         // 发送方的网络地址(ip:port)
+	To     string         // 接收方的网络地址，转发的广播消息为所有接收方的地址，以逗号分隔
+	Signer common.Address // 发送方的账户地址
+	Epoch  uint64         // 发送方本次运行的纪元，进程重启后变大
+	Nonce  uint64         // 同一纪元内发送方的消息序号，单调递增
+	Sig    []byte
+
+	ReqID uint64 // 非0表示rpc请求或回复，回复与请求的ReqID相同
+	Err   string // rpc回复中服务端处理请求的错误
+}
+
+/* 计算信封中除签名外所有字段的哈希，作为签名的对象 */
+func (msg *Msg) SigHash() []byte {
+	var num [24]byte
+	binary.BigEndian.PutUint64(num[:8], msg.Epoch)
+	binary.BigEndian.PutUint64(num[8:16], msg.Nonce)
+	binary.BigEndian.PutUint64(num[16:], msg.ReqID)
+	return crypto.Keccak256(
+		[]byte(msg.MsgType), []byte{0},
+		[]byte(msg.From), []byte{0},
+		[]byte(msg.To), []byte{0},
+		msg.Signer[:],
+		num[:],
+		crypto.Keccak256(msg.Data),
+		[]byte(msg.Err),
+	)
 }
 
 type ComGetHeight struct {
@@ -18,6 +52,11 @@ type ComGetHeight struct {
 	Target_shardID uint32
 }
 
+type GetTB struct {
+	ShardID uint32
+	Height  uint64
+}
+
 type ComGetState struct {
 	From_comID     uint32
 	Target_shardID uint32
@@ -47,6 +86,110 @@ type BooterSendContract struct {
 	Addr common.Address
 }
 
+/** 节点或客户端启动时向 booter 注册的信息
+ * 节点用自己的账户对注册信息签名，booter 据此把网络地址与账户绑定；客户端没有账户，不签名
+ */
+const (
+	RegisterRoleNode   = "node"
+	RegisterRoleClient = "client"
+)
+
+type RegisterPeer struct {
+	Role     string // node 或 client
+	ShardID  uint32
+	NodeID   uint32
+	ClientID uint32
+	Addr     string // 监听地址(ip:port)
+	Account  common.Address
+	Sig      []byte
+	Mac      []byte // 配置了 ClusterToken 时，用该口令对 SigHash 计算的 hmac
+}
+
+func (r *RegisterPeer) SigHash() []byte {
+	var ids [12]byte
+	binary.BigEndian.PutUint32(ids[:4], r.ShardID)
+	binary.BigEndian.PutUint32(ids[4:8], r.NodeID)
+	binary.BigEndian.PutUint32(ids[8:], r.ClientID)
+	return crypto.Keccak256([]byte("lesschain-register:"), []byte(r.Role), []byte{0}, ids[:], []byte(r.Addr), []byte{0}, r.Account[:])
+}
+
+/** booter 在所有节点和客户端注册完成后返回的地址表
+ * 由 booter 的账户对 SigHash 签名，Nonce 为查询者随机生成的挑战，防止重放旧的地址表
+ */
+type Topology struct {
+	NodeTable   map[uint32]map[uint32]string
+	ClientTable map[uint32]string
+	Accounts    map[string]common.Address // 节点和客户端的网络地址 -> 账户地址
+	GethAddr    string
+
+	Nonce  []byte
+	Booter common.Address // booter 的账户地址
+	Sig    []byte
+	Mac    []byte // 配置了 ClusterToken 时，用该口令对 SigHash 计算的 hmac
+}
+
+/* 地址表的签名内容，各表按编号和地址排序后编码，与 map 的遍历顺序无关 */
+func (t *Topology) SigHash() []byte {
+	var buf []byte
+	putString := func(s string) {
+		buf = append(buf, s...)
+		buf = append(buf, 0)
+	}
+	putUint32 := func(v uint32) {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], v)
+		buf = append(buf, b[:]...)
+	}
+	putString("lesschain-topology:")
+	for _, shardID := range sortedShardIDs(t.NodeTable) {
+		putUint32(shardID)
+		list := t.NodeTable[shardID]
+		putUint32(uint32(len(list)))
+		for _, nodeID := range sortedIDs(list) {
+			putUint32(nodeID)
+			putString(list[nodeID])
+		}
+	}
+	putString("clients")
+	for _, cid := range sortedIDs(t.ClientTable) {
+		putUint32(cid)
+		putString(t.ClientTable[cid])
+	}
+	putString("accounts")
+	addrs := make([]string, 0, len(t.Accounts))
+	for addr := range t.Accounts {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		putString(addr)
+		account := t.Accounts[addr]
+		buf = append(buf, account[:]...)
+	}
+	putString(t.GethAddr)
+	buf = append(buf, t.Nonce...)
+	buf = append(buf, t.Booter[:]...)
+	return crypto.Keccak256(buf)
+}
+
+func sortedShardIDs(m map[uint32]map[uint32]string) []uint32 {
+	keys := make([]uint32, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func sortedIDs(m map[uint32]string) []uint32 {
+	keys := make([]uint32, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
 type ComSendBlock struct {
 	Block *Block
 }
@@ -59,6 +202,15 @@ type ComLeaderInitMultiSign struct {
 	Seed       common.Hash
 	SeedHeight uint64
 	Tb         *TimeBeacon
+	Root       *TBRoot // 累加器模式下对默克尔根多签名，此时 Tb 为空
+}
+
+/* 签名者需要签名的哈希 */
+func (r *ComLeaderInitMultiSign) SignHash() []byte {
+	if r.Root != nil {
+		return r.Root.Hash()
+	}
+	return r.Tb.Hash()
 }
 
 type MultiSignReply struct {
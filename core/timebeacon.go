@@ -98,3 +98,72 @@ type SignedTB struct {
 	Sigs       [][]byte
 	Vrfs       [][]byte
 }
+
+/** 累加器模式下锚定到信标链的默克尔根，覆盖分片 ShardID 从 StartHeight 开始的 Count 个连续信标
+ * 委员会对 Hash() 多签名，与合约 addTBRoot 中的哈希相同
+ */
+type TBRoot struct {
+	ShardID     uint32
+	StartHeight uint64
+	Count       uint64
+	Root        common.Hash
+}
+
+/* abi.encode(shardID, startHeight, count, root) 的 Keccak256 哈希 */
+func (r *TBRoot) Hash() []byte {
+	uint32Ty, e1 := abi.NewType("uint32", "uint32", nil)
+	uint64Ty, e2 := abi.NewType("uint64", "uint64", nil)
+	bytes32Ty, e3 := abi.NewType("bytes32", "bytes32", nil)
+	if e1 != nil || e2 != nil || e3 != nil {
+		log.Error("abi.newtype err")
+	}
+	arguments := abi.Arguments{{Type: uint32Ty}, {Type: uint64Ty}, {Type: uint64Ty}, {Type: bytes32Ty}}
+	encoded, err := arguments.Pack(r.ShardID, r.StartHeight, r.Count, [32]byte(r.Root))
+	if err != nil {
+		log.Error("arguments.pack", "err", err)
+	}
+
+	hash := sha3.NewLegacyKeccak256()
+	hash.Write(encoded)
+	return hash.Sum(nil)
+}
+
+/** 信标序列的默克尔根，叶子是每个信标的 Hash()，父节点是两个子节点拼接后的 Keccak256 哈希
+ * 某一层节点数为奇数时，最后一个节点直接进入上一层；空序列的根为空哈希
+ */
+func TBMerkleRoot(tbs []TimeBeacon) common.Hash {
+	if len(tbs) == 0 {
+		return common.Hash{}
+	}
+	level := make([][]byte, len(tbs))
+	for i := range tbs {
+		level[i] = tbs[i].Hash()
+	}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			hash := sha3.NewLegacyKeccak256()
+			hash.Write(level[i])
+			hash.Write(level[i+1])
+			next = append(next, hash.Sum(nil))
+		}
+		level = next
+	}
+	return common.BytesToHash(level[0])
+}
+
+/** 委员会多签名后的默克尔根，Tbs 是根覆盖的信标
+ * 信标随根一起提交，合约重新计算默克尔根后存储每个信标，信标链的监听者据此推送给客户端和委员会
+ */
+type SignedTBRoot struct {
+	TBRoot
+	Tbs        []TimeBeacon
+	SeedHeight uint64
+	Signers    []common.Address
+	Sigs       [][]byte
+	Vrfs       [][]byte
+}
@@ -0,0 +1,38 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestTBMerkleRoot(t *testing.T) {
+	tbs := make([]TimeBeacon, 3)
+	for i := range tbs {
+		tbs[i] = TimeBeacon{ShardID: 1, Height: uint64(i + 1), BlockHash: common.Hash{byte(i)}.Hex()}
+	}
+	if TBMerkleRoot(nil) != (common.Hash{}) {
+		t.Fatal("root of no time beacons is not empty")
+	}
+	if got := TBMerkleRoot(tbs[:1]); got != common.BytesToHash(tbs[0].Hash()) {
+		t.Fatalf("root of one time beacon: %x", got)
+	}
+	// 奇数个节点时最后一个直接进入上一层
+	want := crypto.Keccak256Hash(crypto.Keccak256(tbs[0].Hash(), tbs[1].Hash()), tbs[2].Hash())
+	if got := TBMerkleRoot(tbs); got != want {
+		t.Fatalf("got root %x, want %x", got, want)
+	}
+	tbs[2].StatusHash = "0x01"
+	if TBMerkleRoot(tbs) == want {
+		t.Fatal("root unchanged after a time beacon changed")
+	}
+
+	// 根的哈希覆盖分片、起始高度、数量和根
+	root := TBRoot{ShardID: 1, StartHeight: 1, Count: 3, Root: want}
+	other := root
+	other.Count = 2
+	if common.BytesToHash(root.Hash()) == common.BytesToHash(other.Hash()) || len(root.Hash()) != 32 {
+		t.Fatal("root hash does not cover the count")
+	}
+}
@@ -0,0 +1,253 @@
+package eth_chain
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"go-w3chain/cfg"
+	"go-w3chain/core"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+
+	gethcore "github.com/ethereum/go-ethereum/core"
+)
+
+/* 部署合约的链，commit 让已发送的交易上链（Ganache 自动出块，不需要） */
+type contractBackend interface {
+	bind.ContractBackend
+	bind.DeployBackend
+}
+
+type contractChain struct {
+	backend contractBackend
+	commit  func()
+	auth    *bind.TransactOpts
+}
+
+/* 在 go-ethereum 的模拟后端上执行 bytecode.txt，不需要外部的链 */
+func TestContractSimulatedBackend(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := bind.NewKeyedTransactorWithChainID(key, big.NewInt(1337))
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance := new(big.Int).Exp(big.NewInt(10), big.NewInt(20), nil)
+	sim := backends.NewSimulatedBackend(gethcore.GenesisAlloc{auth.From: {Balance: balance}}, 30000000)
+	defer sim.Close()
+	testContract(t, &contractChain{backend: sim, commit: sim.Commit, auth: auth})
+}
+
+/** 在 Ganache 上执行 bytecode.txt，需要用 GANACHE_URL 指定 Ganache 的 http 地址，
+ * 且 cfg.GanacheChainAccounts 的第一个账户有余额，与 BeaconChainMode 1 部署合约的账户相同
+ */
+func TestContractGanache(t *testing.T) {
+	url := os.Getenv("GANACHE_URL")
+	if url == "" {
+		t.Skip("GANACHE_URL not set, e.g. GANACHE_URL=http://127.0.0.1:8545")
+	}
+	client, err := ethclient.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	chainID, err := client.ChainID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.HexToECDSA(cfg.GanacheChainAccounts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := bind.NewKeyedTransactorWithChainID(key, chainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testContract(t, &contractChain{backend: client, commit: func() {}, auth: auth})
+}
+
+/* 签名者的私钥和地址 */
+type contractSigner struct {
+	key  *ecdsa.PrivateKey
+	addr common.Address
+}
+
+func newContractSigners(t *testing.T, n int) []contractSigner {
+	signers := make([]contractSigner, n)
+	for i := range signers {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[i] = contractSigner{key: key, addr: crypto.PubkeyToAddress(key.PublicKey)}
+	}
+	return signers
+}
+
+/* 各签名者对 msgHash 的签名和对 seed 的 vrf，与委员会多签名的格式相同 */
+func multiSign(t *testing.T, msgHash []byte, seed common.Hash, signers []contractSigner) ([][]byte, [][]byte, []common.Address) {
+	var sigs, vrfs [][]byte
+	var addrs []common.Address
+	for _, s := range signers {
+		sig, err := crypto.Sign(msgHash, s.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vrf, err := crypto.Sign(seed[:], s.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs, vrfs, addrs = append(sigs, sig), append(vrfs, vrf), append(addrs, s.addr)
+	}
+	return sigs, vrfs, addrs
+}
+
+func toContractTB(tb core.TimeBeacon) ContractTB {
+	return ContractTB{ShardID: tb.ShardID, Height: tb.Height, BlockHash: tb.BlockHash, TxHash: tb.TxHash, StatusHash: tb.StatusHash}
+}
+
+/** 部署合约后依次调用 addTB、addTBs 和 addTBRoot，检查存储的信标、默克尔根和事件
+ * 两个分片各有两个签名者，需要2个有效签名
+ */
+func testContract(t *testing.T, chain *contractChain) {
+	ctx := context.Background()
+	contractABI, err := abi.JSON(strings.NewReader(MyContractABI()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := newContractSigners(t, 4)
+	shard0, shard1 := keys[0:2], keys[2:4]
+	addrs := [][]common.Address{{shard0[0].addr, shard0[1].addr}, {shard1[0].addr, shard1[1].addr}}
+	genesisTBs := []ContractTB{{ShardID: 0}, {ShardID: 1}}
+
+	addr, tx, contract, err := bind.DeployContract(chain.auth, contractABI, common.FromHex(myContractByteCode()), chain.backend,
+		genesisTBs, uint32(2), uint32(2), addrs)
+	if err != nil {
+		t.Fatalf("deploy: %v", err)
+	}
+	chain.commit()
+	if _, err := bind.WaitDeployed(ctx, chain.backend, tx); err != nil {
+		t.Fatalf("wait deployed: %v", err)
+	}
+	transact := func(method string, args ...interface{}) {
+		t.Helper()
+		tx, err := contract.Transact(chain.auth, method, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		chain.commit()
+		receipt, err := bind.WaitMined(ctx, chain.backend, tx)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			t.Fatalf("%s reverted", method)
+		}
+	}
+
+	header, err := chain.backend.HeaderByNumber(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, seedHeight := header.Hash(), header.Number.Uint64()
+	tb := func(shardID uint32, height uint64) core.TimeBeacon {
+		return core.TimeBeacon{ShardID: shardID, Height: height, BlockHash: fmt.Sprintf("0x%02x%02x", shardID, height)}
+	}
+
+	// addTB：分片0高度1
+	tb01 := tb(0, 1)
+	sigs, vrfs, signers := multiSign(t, tb01.Hash(), seed, shard0)
+	transact("addTB", toContractTB(tb01), sigs, vrfs, seedHeight, signers)
+
+	// addTBs：分片0高度2有足够的签名，分片1高度1只有一个签名，不影响前者
+	tb02, tb11 := tb(0, 2), tb(1, 1)
+	sigs02, vrfs02, signers02 := multiSign(t, tb02.Hash(), seed, shard0)
+	sigs11, vrfs11, signers11 := multiSign(t, tb11.Hash(), seed, shard1[:1])
+	transact("addTBs", []ContractTB{toContractTB(tb02), toContractTB(tb11)}, [][][]byte{sigs02, sigs11},
+		[][][]byte{vrfs02, vrfs11}, []uint64{seedHeight, seedHeight}, [][]common.Address{signers02, signers11})
+
+	// addTBRoot：分片1高度1到5，奇数个信标使默克尔树的最后一个节点直接进入上一层
+	window := make([]core.TimeBeacon, 5)
+	contractTBs := make([]ContractTB, len(window))
+	for i := range window {
+		window[i] = tb(1, uint64(i+1))
+		contractTBs[i] = toContractTB(window[i])
+	}
+	root := core.TBRoot{ShardID: 1, StartHeight: 1, Count: uint64(len(window)), Root: core.TBMerkleRoot(window)}
+	sigs, vrfs, signers = multiSign(t, root.Hash(), seed, shard1)
+	transact("addTBRoot", contractTBs, [32]byte(root.Root), sigs, vrfs, seedHeight, signers)
+
+	// 与根不一致的信标不被存储：分片0高度3到4，签名针对原来的根
+	tampered := []core.TimeBeacon{tb(0, 3), tb(0, 4)}
+	tamperedRoot := core.TBRoot{ShardID: 0, StartHeight: 3, Count: 2, Root: core.TBMerkleRoot(tampered)}
+	sigs, vrfs, signers = multiSign(t, tamperedRoot.Hash(), seed, shard0)
+	tampered[1].BlockHash = "0xff"
+	transact("addTBRoot", []ContractTB{toContractTB(tampered[0]), toContractTB(tampered[1])}, [32]byte(tamperedRoot.Root),
+		sigs, vrfs, seedHeight, signers)
+
+	getTB := func(shardID uint32, height uint64) ContractTB {
+		t.Helper()
+		var out []interface{}
+		if err := contract.Call(&bind.CallOpts{Context: ctx}, &out, "getTB", shardID, height); err != nil {
+			t.Fatalf("getTB(%d, %d): %v", shardID, height, err)
+		}
+		return *abi.ConvertType(out[0], new(ContractTB)).(*ContractTB)
+	}
+	stored := map[[2]uint64]bool{{0, 1}: true, {0, 2}: true, {1, 1}: true, {1, 2}: true, {1, 3}: true, {1, 4}: true, {1, 5}: true}
+	for _, key := range [][2]uint64{{0, 1}, {0, 2}, {0, 3}, {0, 4}, {1, 1}, {1, 2}, {1, 3}, {1, 4}, {1, 5}} {
+		want := ContractTB{}
+		if stored[key] {
+			want = toContractTB(tb(uint32(key[0]), key[1]))
+		}
+		if got := getTB(uint32(key[0]), key[1]); got != want {
+			t.Errorf("getTB(%d, %d) = %+v, want %+v", key[0], key[1], got, want)
+		}
+	}
+	var rootOut []interface{}
+	if err := contract.Call(&bind.CallOpts{Context: ctx}, &rootOut, "tbRoots", uint32(1), uint64(5)); err != nil {
+		t.Fatal(err)
+	}
+	if got := common.Hash(rootOut[0].([32]byte)); got != root.Root {
+		t.Errorf("tbRoots(1, 5) = %x, want %x", got, root.Root)
+	}
+
+	// 每个被存储的信标一个 addTB 事件，签名不足和与根不一致各一个事件
+	logs, err := chain.backend.FilterLogs(ctx, ethereum.FilterQuery{FromBlock: big.NewInt(0), Addresses: []common.Address{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, l := range logs {
+		out, err := contractABI.Unpack("LogMessage", l.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[out[0].(string)] += 1
+	}
+	want := map[string]int{
+		"addTB":                                  7,
+		"addTB... insufficient valid signatures": 1,
+		"addTBRoot... time beacons do not match the root": 1,
+	}
+	if len(counts) != len(want) {
+		t.Errorf("events: %v", counts)
+	}
+	for msg, n := range want {
+		if counts[msg] != n {
+			t.Errorf("event %q: got %d, want %d", msg, counts[msg], n)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package eth_chain
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+/* 轮询交易收据的间隔，也是打包时延的精度 */
+const receiptPollInterval = 250 * time.Millisecond
+
+var errTxReplaced = errors.New("transaction replaced by another transaction with the same nonce")
+
+/* 一笔信标链交易被打包后的开销 */
+type TxCost struct {
+	GasUsed     uint64
+	GasPrice    *big.Int      // 实际支付的单位 gas 价格(wei)
+	Latency     time.Duration // 从发送交易到观察到收据
+	BlockNumber uint64
+	Status      uint64 // 收据状态，0 表示交易执行失败（合约 revert），gas 仍被扣除
+}
+
+/* 交易的手续费(wei) */
+func (c *TxCost) Fee() *big.Int {
+	return new(big.Int).Mul(new(big.Int).SetUint64(c.GasUsed), c.GasPrice)
+}
+
+/** 实际支付的单位 gas 价格，当前版本的收据中没有 effectiveGasPrice 字段，需要自己计算
+ * 没有 baseFee 的区块（伦敦升级前或 ganache）按交易的 gasPrice 计费，
+ * 否则为 baseFee 加上交易实际给出的小费
+ */
+func effectiveGasPrice(tx *types.Transaction, baseFee *big.Int) *big.Int {
+	if baseFee == nil {
+		return tx.GasPrice()
+	}
+	tip, err := tx.EffectiveGasTip(baseFee)
+	if err != nil {
+		// gasFeeCap 低于 baseFee 的交易不会被打包，这里只是防御
+		return tx.GasPrice()
+	}
+	return new(big.Int).Add(baseFee, tip)
+}
+
+/** 等待 sentAt 时刻发送的交易 tx 被打包，返回它的开销
+ * 交易被提高手续费重发时，等待任意一个版本被打包，时延从第一次发送算起；
+ * 交易的 nonce 被其他交易占用时返回 errTxReplaced
+ * ctx 取消时返回 ctx 的错误
+ */
+func WaitTxCost(ctx context.Context, client *ethclient.Client, tx *types.Transaction, sentAt time.Time) (*TxCost, error) {
+	ticker := time.NewTicker(receiptPollInterval)
+	defer ticker.Stop()
+	for {
+		receipt, mined, err := nonces.minedVersion(ctx, client, tx)
+		if err == nil {
+			latency := time.Since(sentAt)
+			header, err := client.HeaderByNumber(ctx, receipt.BlockNumber)
+			if err != nil {
+				return nil, err
+			}
+			return &TxCost{
+				GasUsed:     receipt.GasUsed,
+				GasPrice:    effectiveGasPrice(mined, header.BaseFee),
+				Latency:     latency,
+				BlockNumber: receipt.BlockNumber.Uint64(),
+				Status:      receipt.Status,
+			}, nil
+		}
+		if err != ethereum.NotFound {
+			return nil, err
+		}
+		if nonces.isReplaced(tx) {
+			return nil, errTxReplaced
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+/* tx 被打包的版本及其收据，都还未被打包时返回 ethereum.NotFound */
+func (m *nonceManager) minedVersion(ctx context.Context, client *ethclient.Client, tx *types.Transaction) (*types.Receipt, *types.Transaction, error) {
+	for _, version := range m.versions(tx) {
+		receipt, err := client.TransactionReceipt(ctx, version.Hash())
+		if err != ethereum.NotFound {
+			return receipt, version, err
+		}
+	}
+	return nil, tx, ethereum.NotFound
+}
@@ -7,10 +7,9 @@ import (
 	"go-w3chain/cfg"
 	"go-w3chain/log"
 	"go-w3chain/utils"
-	"math"
 	"math/big"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
@@ -73,7 +72,7 @@ func GetBlockHash(client *ethclient.Client, height uint64) (common.Hash, uint64)
 	return header.Hash(), got_height
 }
 
-// 部署合约
+/* 部署合约，返回合约地址、ABI 和部署交易的开销 */
 func DeployContract(client *ethclient.Client,
 	mode int,
 	genesisTBs []ContractTB,
@@ -81,12 +80,12 @@ func DeployContract(client *ethclient.Client,
 	shard_num uint32,
 	addrs [][]common.Address,
 	chainID int,
-) (common.Address, *abi.ABI, *big.Int, error) {
+) (common.Address, *abi.ABI, *TxCost, error) {
 
 	// 编译 Solidity 合约并获取合约 ABI 和字节码
 	contractABI, err := abi.JSON(strings.NewReader(MyContractABI()))
 	if err != nil {
-		return common.Address{}, nil, big.NewInt(0), err
+		return common.Address{}, nil, nil, err
 	}
 	bytecode := common.FromHex(myContractByteCode())
 
@@ -103,12 +102,17 @@ func DeployContract(client *ethclient.Client,
 
 	// 部署合约
 	log.Debug("addrs", "addr", addrs)
+	sentAt := time.Now()
 	address, tx, _, err := bind.DeployContract(auth, contractABI, bytecode, client, genesisTBs, required_sig_cnt, shard_num, addrs)
 	if err != nil {
 		log.Error(fmt.Sprintf("DeployContract err: %v", err))
 	}
 
 	// 等待交易被挖矿确认
+	cost, err := WaitTxCost(context.Background(), client, tx, sentAt)
+	if err != nil {
+		log.Warn("get deploy tx receipt fail", "err", err)
+	}
 	_, err = bind.WaitDeployed(context.Background(), client, tx)
 	if err != nil {
 		log.Error(fmt.Sprintf("WaitDeployed err: %v", err))
@@ -116,118 +120,57 @@ func DeployContract(client *ethclient.Client,
 
 	fmt.Printf("contract deploy. address: %v\n", address)
 
-	return address, &contractABI, nil, nil
+	return address, &contractABI, cost, nil
 }
 
-var (
-	// lastNonce map[uint32]uint64 = make(map[uint32]uint64)
-	// lastNonce map[string]uint64 = make(map[string]uint64)
-	lastNonce uint64 = math.MaxUint64
-	// 通过该锁使不同委员会的AddTB方法串行执行，避免一些并发调用导致的问题
-	call_lock      sync.Mutex
-	lowestGasPrice *big.Int = big.NewInt(0)
-)
-
 // 存储信标到合约
 func AddTB(client *ethclient.Client, contractAddr common.Address,
 	abi *abi.ABI, mode int, tb *ContractTB,
 	sigs [][]byte, vrfs [][]byte, seedHeight uint64,
 	signers []common.Address, chainID int, nodeID uint32,
-) error {
-
-	call_lock.Lock()
-	defer call_lock.Unlock()
-
-	var comID uint32 = 0
-	comID = tb.ShardID
-
+) (*types.Transaction, error) {
 	// 构造调用数据
 	callData, err := abi.Pack("addTB", *tb, sigs, vrfs, seedHeight, signers)
 	if err != nil {
 		log.Error(fmt.Sprintf("abi.Pack err: %v", err))
-		return err
+		return nil, err
 	}
+	return sendContractTx(client, contractAddr, callData, mode, tb.ShardID, nodeID, chainID,
+		"txtype", "AddTB", "shardID", tb.ShardID, "height", tb.Height)
+}
 
-	// 通过私钥构造签名者
-	privateKey, err := myPrivateKey(comID, nodeID, mode)
-	if err != nil {
-		log.Error(fmt.Sprintf("get myPrivateKey err: %v", err))
-		return err
-	}
-	auth, err := bind.NewKeyedTransactorWithChainID(privateKey, big.NewInt(int64(chainID)))
+/** 批量存储信标，每个信标带有各自的多签名，合约对每个信标单独验证
+ * 使用 comID 委员会 nodeID 节点的账户发送交易
+ */
+func AddTBs(client *ethclient.Client, contractAddr common.Address,
+	abi *abi.ABI, mode int, tbs []ContractTB,
+	sigs [][][]byte, vrfs [][][]byte, seedHeights []uint64,
+	signers [][]common.Address, chainID int, comID uint32, nodeID uint32,
+) (*types.Transaction, error) {
+	callData, err := abi.Pack("addTBs", tbs, sigs, vrfs, seedHeights, signers)
 	if err != nil {
-		log.Error("bind.NewKeyedTransactorWithChainID err: %v", err)
-		return err
-	}
-
-	// 设置交易参数
-	auth.GasLimit = uint64(30000000) // 设置 gas 限制
-	auth.Value = big.NewInt(0)       // 设置发送的以太币数量（如果有的话）
-
-	var nonce uint64
-	if lastNonce == math.MaxUint64 {
-		// 如果在之前的交易中使用了相同的账户地址，而这些交易还未被确认（被区块打包），那么下一笔交易的nonce应该是
-		// 当前账户的最新nonce+1。
-		nonce, err = client.PendingNonceAt(context.Background(), auth.From)
-		if err != nil {
-			log.Error("client.PendingNonceAt err", "err", err)
-			fmt.Println("client.PendingNonceAt err: ", err)
-			return err
-		}
-
-		lastNonce = nonce
-	} else {
-		nonce = lastNonce + 1
-		lastNonce = nonce
-	}
-	// nonce_lock.Unlock()
-
-	if lowestGasPrice.Uint64() == 0 {
-		gasPrice, err := client.SuggestGasPrice(context.Background())
-		if err != nil {
-			log.Error("client.SuggestGasPrice err", "err", err)
-			fmt.Println("client.SuggestGasPrice err: ", err)
-			return err
-		}
-		lowestGasPrice = gasPrice
+		log.Error(fmt.Sprintf("abi.Pack err: %v", err))
+		return nil, err
 	}
+	return sendContractTx(client, contractAddr, callData, mode, comID, nodeID, chainID,
+		"txtype", "AddTBs", "count", len(tbs))
+}
 
-	// mustSend：循环发送直到交易发送成功
-	for {
-		tx := types.NewTransaction(nonce, contractAddr, big.NewInt(0), auth.GasLimit, lowestGasPrice, callData)
-
-		// 签名交易
-		signedTx, err := auth.Signer(auth.From, tx)
-		if err != nil {
-			log.Error("auth.Signer err", "err", err)
-			fmt.Println("auth.Signer err: ", err)
-			return err
-		}
-
-		// 发送交易
-		err = client.SendTransaction(context.Background(), signedTx)
-		if err != nil {
-			log.Debug("client.SendTransaction err", "err", err, "txtype", "AddTB", "shardID", tb.ShardID, "height", tb.Height,
-				"gasPrice", lowestGasPrice, "nonce", nonce)
-			fmt.Println("client.SendTransaction err: ", err)
-
-			if strings.Contains(err.Error(), "replacement transaction underpriced") || strings.Contains(err.Error(), "nonce too low") {
-				nonce = nonce + 1
-				lastNonce = nonce
-			} else if strings.Contains(err.Error(), "transaction underpriced") {
-				// 每次提升10%的手续费，并将该手续费作为最低手续费
-				toAdd := new(big.Int).Div(lowestGasPrice, big.NewInt(10))
-				lowestGasPrice = new(big.Int).Add(lowestGasPrice, toAdd)
-			} else {
-				return err
-			}
-		} else {
-			// fmt.Printf("signedTX: %v\n", signedTx.Hash().Hex())
-			break
-		}
+/** 锚定一个分片连续信标 tbs 的默克尔根并存储每个信标，多签名针对根的哈希
+ * 合约重新计算 tbs 的默克尔根，与 root 不同时不存储
+ */
+func AddTBRoot(client *ethclient.Client, contractAddr common.Address,
+	abi *abi.ABI, mode int, tbs []ContractTB, root common.Hash,
+	sigs [][]byte, vrfs [][]byte, seedHeight uint64,
+	signers []common.Address, chainID int, nodeID uint32,
+) (*types.Transaction, error) {
+	callData, err := abi.Pack("addTBRoot", tbs, [32]byte(root), sigs, vrfs, seedHeight, signers)
+	if err != nil {
+		log.Error(fmt.Sprintf("abi.Pack err: %v", err))
+		return nil, err
 	}
-
-	return nil
+	return sendContractTx(client, contractAddr, callData, mode, tbs[0].ShardID, nodeID, chainID,
+		"txtype", "AddTBRoot", "shardID", tbs[0].ShardID, "startHeight", tbs[0].Height, "count", len(tbs))
 }
 
 func AdjustRecordedAddrs(client *ethclient.Client, contractAddr common.Address,
@@ -235,98 +178,37 @@ func AdjustRecordedAddrs(client *ethclient.Client, contractAddr common.Address,
 	comID uint32, addrs []common.Address,
 	vrfs [][]byte, seedHeight uint64,
 	chainID int, nodeID uint32,
-) error {
-
-	call_lock.Lock()
-	defer call_lock.Unlock()
+) (*types.Transaction, error) {
 	// 构造调用数据
 	callData, err := abi.Pack("adjustRecordedAddrs", addrs, vrfs, seedHeight)
 	if err != nil {
 		log.Error(fmt.Sprint("abi.Pack err: ", err))
-		return err
+		return nil, err
 	}
+	return sendContractTx(client, contractAddr, callData, mode, comID, nodeID, chainID,
+		"txtype", "adjustRecordedAddrs", "shardID", comID, "seedHeight", seedHeight)
+}
 
+/** 用 comID 委员会 nodeID 节点的账户向合约发送一笔调用交易，logCtx 是发送失败时日志中的交易信息
+ * nonce 和手续费按发送账户管理，不同账户的交易并行发送；返回发送成功的已签名交易
+ */
+func sendContractTx(client *ethclient.Client, contractAddr common.Address, callData []byte,
+	mode int, comID uint32, nodeID uint32, chainID int, logCtx ...interface{},
+) (*types.Transaction, error) {
 	// 通过私钥构造签名者
 	privateKey, err := myPrivateKey(comID, nodeID, mode)
 	if err != nil {
-		log.Error(fmt.Sprint("get myPrivateKey err: ", err))
-		return err
+		log.Error(fmt.Sprintf("get myPrivateKey err: %v", err))
+		return nil, err
 	}
 	auth, err := bind.NewKeyedTransactorWithChainID(privateKey, big.NewInt(int64(chainID)))
 	if err != nil {
-		log.Error(fmt.Sprint("bind.NewKeyedTransactorWithChainID err: ", err))
-		return err
-	}
-
-	// 设置交易参数
-	auth.GasLimit = uint64(30000000) // 设置 gas 限制
-	auth.Value = big.NewInt(0)       // 设置发送的以太币数量（如果有的话）
-
-	var nonce uint64
-	if lastNonce == math.MaxUint64 {
-		// 如果在之前的交易中使用了相同的账户地址，而这些交易还未被确认（被区块打包），那么下一笔交易的nonce应该是
-		// 当前账户的最新nonce+1。
-		nonce, err = client.PendingNonceAt(context.Background(), auth.From)
-		if err != nil {
-			log.Error("client.PendingNonceAt err", "err", err)
-			fmt.Println("client.PendingNonceAt err: ", err)
-			return err
-		}
-
-		lastNonce = nonce
-	} else {
-		nonce = lastNonce + 1
-		lastNonce = nonce
-	}
-	// nonce_lock.Unlock()
-
-	if lowestGasPrice.Uint64() == 0 {
-		gasPrice, err := client.SuggestGasPrice(context.Background())
-		if err != nil {
-			log.Error("client.SuggestGasPrice err", "err", err)
-			fmt.Println("client.SuggestGasPrice err: ", err)
-			return err
-		}
-		lowestGasPrice = gasPrice
-	}
-
-	// mustSend：循环发送直到交易发送成功
-	for {
-		tx := types.NewTransaction(nonce, contractAddr, big.NewInt(0), auth.GasLimit, lowestGasPrice, callData)
-
-		// 签名交易
-		signedTx, err := auth.Signer(auth.From, tx)
-		if err != nil {
-			log.Error("auth.Signer err", "err", err)
-			fmt.Println("auth.Signer err: ", err)
-			return err
-		}
-
-		// 发送交易
-		err = client.SendTransaction(context.Background(), signedTx)
-		if err != nil {
-			log.Debug("client.SendTransaction err", "err", err, "txtype", "adjustRecordedAddrs", "shardID", comID, "seedHeight", seedHeight,
-				"gasPrice", lowestGasPrice, "nonce", nonce)
-			fmt.Println("client.SendTransaction err: ", err)
-
-			if strings.Contains(err.Error(), "replacement transaction underpriced") || strings.Contains(err.Error(), "nonce too low") {
-				nonce = nonce + 1
-				lastNonce = nonce
-			} else if strings.Contains(err.Error(), "transaction underpriced") {
-				// 每次提升10%的手续费，并将该手续费作为最低手续费
-				toAdd := new(big.Int).Div(lowestGasPrice, big.NewInt(10))
-				lowestGasPrice = new(big.Int).Add(lowestGasPrice, toAdd)
-			} else {
-				return err
-			}
-		} else {
-			// fmt.Printf("signedTX: %v\n", signedTx.Hash().Hex())
-			break
-		}
+		log.Error("bind.NewKeyedTransactorWithChainID err: %v", err)
+		return nil, err
 	}
 
-	return nil
-
+	// 设置 gas 限制
+	return nonces.send(context.Background(), client, auth, contractAddr, uint64(30000000), callData, logCtx...)
 }
 
 // 从合约读取信标
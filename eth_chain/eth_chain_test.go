@@ -1,8 +1,14 @@
 package eth_chain
 
 import (
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
 )
 
@@ -88,3 +94,54 @@ var (
 // 	// 	assert.Equal(t, true, err == nil)
 // 	// }
 // }
+
+func TestContractABI(t *testing.T) {
+	contractABI, err := abi.JSON(strings.NewReader(MyContractABI()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbs := []ContractTB{{ShardID: 0, Height: 1}, {ShardID: 1, Height: 1}}
+	sigs := [][][]byte{{make([]byte, 65)}, {make([]byte, 65), make([]byte, 65)}}
+	signers := [][]common.Address{{{1}}, {{2}, {3}}}
+	if _, err := contractABI.Pack("addTBs", tbs, sigs, sigs, []uint64{1, 1}, signers); err != nil {
+		t.Fatalf("pack addTBs: %v", err)
+	}
+	if _, err := contractABI.Pack("addTBRoot", tbs[:1], [32]byte{1}, sigs[1], sigs[1], uint64(1), signers[1]); err != nil {
+		t.Fatalf("pack addTBRoot: %v", err)
+	}
+	if _, ok := contractABI.Methods["tbRoots"]; !ok {
+		t.Fatal("tbRoots getter missing")
+	}
+}
+
+/* 合约 ABI 中每个方法的选择器都应出现在部署的字节码中，即 abi.json 和 bytecode.txt 来自同一次编译 */
+func TestContractBytecode(t *testing.T) {
+	contractABI, err := abi.JSON(strings.NewReader(MyContractABI()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytecode := strings.ToLower(myContractByteCode())
+	for name, method := range contractABI.Methods {
+		if !strings.Contains(bytecode, hex.EncodeToString(method.ID)) {
+			t.Errorf("selector of %s missing in bytecode.txt", name)
+		}
+	}
+}
+
+/* 没有 baseFee 时按 gasPrice 计费，否则为 baseFee 加实际小费 */
+func TestEffectiveGasPrice(t *testing.T) {
+	legacy := types.NewTransaction(0, common.Address{}, big.NewInt(0), 21000, big.NewInt(30), nil)
+	if p := effectiveGasPrice(legacy, nil); p.Int64() != 30 {
+		t.Fatalf("legacy without base fee: %v", p)
+	}
+	if p := effectiveGasPrice(legacy, big.NewInt(20)); p.Int64() != 30 {
+		t.Fatalf("legacy with base fee: %v", p)
+	}
+	dynamic := types.NewTx(&types.DynamicFeeTx{GasTipCap: big.NewInt(5), GasFeeCap: big.NewInt(40), Gas: 21000})
+	if p := effectiveGasPrice(dynamic, big.NewInt(20)); p.Int64() != 25 {
+		t.Fatalf("dynamic fee tip: %v", p)
+	}
+	if p := effectiveGasPrice(dynamic, big.NewInt(38)); p.Int64() != 40 {
+		t.Fatalf("dynamic fee capped: %v", p)
+	}
+}
@@ -0,0 +1,326 @@
+package eth_chain
+
+import (
+	"context"
+	"go-w3chain/log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	// 检查待确认交易的间隔
+	pendingCheckInterval = 3 * time.Second
+	// 交易在交易池中停留超过该时间仍未上链时提高手续费重发
+	pendingResendAfter = time.Minute
+	// nonce 上链后仍保留其重发和替换记录的时间，等待交易开销的 WaitTxCost 在此期间得到结果
+	settledRetention = time.Minute
+)
+
+/* 一笔已发送、还未确认的交易，重发后 txs 中依次是每次发送的版本 */
+type pendingTx struct {
+	txs    []*types.Transaction
+	sentAt time.Time // 最近一次发送的时间
+}
+
+func (p *pendingTx) latest() *types.Transaction {
+	return p.txs[len(p.txs)-1]
+}
+
+/* nonce 已上链的交易的所有版本，超过 settledRetention 后删除其重发和替换记录 */
+type settledTx struct {
+	txs []*types.Transaction
+	at  time.Time
+}
+
+/* 一个发送账户的 nonce 和待确认交易，同一账户的交易串行发送，不同账户互不影响 */
+type senderAccount struct {
+	lock     sync.Mutex
+	auth     *bind.TransactOpts
+	next     uint64 // 下一笔交易的 nonce，首次使用时从节点读取
+	loaded   bool
+	gasPrice *big.Int // 该账户发送交易的最低 gas 价格，交易池拒绝或交易迟迟不上链时提高
+	pending  map[uint64]*pendingTx
+}
+
+/** 按发送账户管理 nonce，跟踪已发送的交易：
+ * 交易从交易池中消失（被丢弃）或长时间不上链时，用相同 nonce 提高手续费重发；
+ * 该 nonce 被其他交易占用并上链时（被替换），放弃该交易
+ */
+type nonceManager struct {
+	lock     sync.Mutex
+	accounts map[common.Address]*senderAccount
+	// 被重发的交易哈希 -> 重发的版本，WaitTxCost 据此找到实际上链的版本
+	resent map[common.Hash]*types.Transaction
+	// 被其他交易替换而放弃的交易，记录第一次发送的版本
+	replaced map[common.Hash]bool
+	// 按上链时间排序，checkPending 据此清理 resent 和 replaced
+	settled []settledTx
+}
+
+var nonces = newNonceManager()
+
+func newNonceManager() *nonceManager {
+	return &nonceManager{
+		accounts: make(map[common.Address]*senderAccount),
+		resent:   make(map[common.Hash]*types.Transaction),
+		replaced: make(map[common.Hash]bool),
+	}
+}
+
+func (m *nonceManager) account(auth *bind.TransactOpts) *senderAccount {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	acc, ok := m.accounts[auth.From]
+	if !ok {
+		acc = &senderAccount{pending: make(map[uint64]*pendingTx)}
+		m.accounts[auth.From] = acc
+	}
+	return acc
+}
+
+/* 提高10%的手续费，与 geth 交易池替换交易的最低涨幅相同 */
+func bumpGasPrice(price *big.Int) *big.Int {
+	bumped := new(big.Int).Add(price, new(big.Int).Div(price, big.NewInt(10)))
+	if bumped.Cmp(price) == 0 {
+		bumped.Add(bumped, big.NewInt(1))
+	}
+	return bumped
+}
+
+/** 用 auth 账户的下一个 nonce 发送一笔调用交易，直到交易进入交易池，logCtx 是发送失败时日志中的交易信息
+ * nonce 已被使用时从节点重新读取，手续费过低时提高10%
+ */
+func (m *nonceManager) send(ctx context.Context, client *ethclient.Client, auth *bind.TransactOpts,
+	to common.Address, gasLimit uint64, callData []byte, logCtx ...interface{},
+) (*types.Transaction, error) {
+	acc := m.account(auth)
+	acc.lock.Lock()
+	defer acc.lock.Unlock()
+	acc.auth = auth
+
+	if !acc.loaded {
+		// 之前发送、还未被打包的交易也计入 pending nonce
+		nonce, err := client.PendingNonceAt(ctx, auth.From)
+		if err != nil {
+			log.Warn("client.PendingNonceAt err", "from", auth.From, "err", err)
+			return nil, err
+		}
+		acc.next, acc.loaded = nonce, true
+	}
+	if acc.gasPrice == nil {
+		gasPrice, err := client.SuggestGasPrice(ctx)
+		if err != nil {
+			log.Warn("client.SuggestGasPrice err", "err", err)
+			return nil, err
+		}
+		acc.gasPrice = gasPrice
+	}
+
+	nonce := acc.next
+	for {
+		tx := types.NewTransaction(nonce, to, big.NewInt(0), gasLimit, acc.gasPrice, callData)
+		signedTx, err := auth.Signer(auth.From, tx)
+		if err != nil {
+			log.Warn("auth.Signer err", "err", err)
+			return nil, err
+		}
+
+		err = client.SendTransaction(ctx, signedTx)
+		if err == nil || strings.Contains(err.Error(), "already known") {
+			acc.next = nonce + 1
+			acc.pending[nonce] = &pendingTx{txs: []*types.Transaction{signedTx}, sentAt: time.Now()}
+			return signedTx, nil
+		}
+		log.Debug("client.SendTransaction err", append([]interface{}{"err", err, "from", auth.From, "gasPrice", acc.gasPrice, "nonce", nonce}, logCtx...)...)
+
+		msg := err.Error()
+		if strings.Contains(msg, "nonce too low") || strings.Contains(msg, "replacement transaction underpriced") {
+			// 该 nonce 已上链，或交易池中有不是本进程发送的同 nonce 交易（如上次运行留下的），从节点重新读取
+			pendingNonce, err := client.PendingNonceAt(ctx, auth.From)
+			if err != nil {
+				log.Warn("client.PendingNonceAt err", "from", auth.From, "err", err)
+				return nil, err
+			}
+			if pendingNonce <= nonce {
+				pendingNonce = nonce + 1
+			}
+			nonce = pendingNonce
+		} else if strings.Contains(msg, "transaction underpriced") {
+			acc.gasPrice = bumpGasPrice(acc.gasPrice)
+		} else {
+			return nil, err
+		}
+	}
+}
+
+/* tx 及其每次重发的版本 */
+func (m *nonceManager) versions(tx *types.Transaction) []*types.Transaction {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	txs := []*types.Transaction{tx}
+	for {
+		next, ok := m.resent[txs[len(txs)-1].Hash()]
+		if !ok {
+			return txs
+		}
+		txs = append(txs, next)
+	}
+}
+
+func (m *nonceManager) isReplaced(tx *types.Transaction) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.replaced[tx.Hash()]
+}
+
+/* 定期检查待确认的交易，直到 ctx 取消 */
+func MonitorPending(ctx context.Context, client *ethclient.Client) {
+	ticker := time.NewTicker(pendingCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			nonces.checkPending(ctx, client)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *nonceManager) checkPending(ctx context.Context, client *ethclient.Client) {
+	m.lock.Lock()
+	m.forgetSettled(time.Now().Add(-settledRetention))
+	accounts := make([]*senderAccount, 0, len(m.accounts))
+	for _, acc := range m.accounts {
+		accounts = append(accounts, acc)
+	}
+	m.lock.Unlock()
+	for _, acc := range accounts {
+		m.checkAccount(ctx, client, acc)
+	}
+}
+
+/* 删除 before 之前上链的交易的重发和替换记录，调用者需持有 m.lock */
+func (m *nonceManager) forgetSettled(before time.Time) {
+	n := 0
+	for n < len(m.settled) && m.settled[n].at.Before(before) {
+		for _, tx := range m.settled[n].txs {
+			delete(m.resent, tx.Hash())
+			delete(m.replaced, tx.Hash())
+		}
+		n++
+	}
+	m.settled = m.settled[n:]
+}
+
+/** 检查一个账户的待确认交易，查询节点时不持有 acc.lock，该账户可以同时发送新的交易
+ * 待确认交易只由本函数删除和重发，查询期间只会增加新的 nonce
+ */
+func (m *nonceManager) checkAccount(ctx context.Context, client *ethclient.Client, acc *senderAccount) {
+	acc.lock.Lock()
+	from := acc.auth.From
+	pending := make(map[uint64]*pendingTx, len(acc.pending))
+	for nonce, p := range acc.pending {
+		pending[nonce] = &pendingTx{txs: append([]*types.Transaction(nil), p.txs...), sentAt: p.sentAt}
+	}
+	acc.lock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	mined, err := client.NonceAt(ctx, from, nil)
+	if err != nil {
+		log.Warn("client.NonceAt err", "from", from, "err", err)
+		return
+	}
+	for nonce, p := range pending {
+		if nonce < mined {
+			// 该 nonce 已上链，没有一个版本有收据说明它被其他交易替换了
+			replaced := !m.isMined(ctx, client, p)
+			if replaced {
+				log.Warn("tbchain tx replaced by another transaction with the same nonce", "from", from, "nonce", nonce, "tx", p.latest().Hash())
+			}
+			acc.lock.Lock()
+			delete(acc.pending, nonce)
+			acc.lock.Unlock()
+			m.lock.Lock()
+			if replaced {
+				m.replaced[p.txs[0].Hash()] = true
+			}
+			m.settled = append(m.settled, settledTx{txs: p.txs, at: time.Now()})
+			m.lock.Unlock()
+			continue
+		}
+		latest := p.latest()
+		_, _, err := client.TransactionByHash(ctx, latest.Hash())
+		dropped := err == ethereum.NotFound
+		if err != nil && !dropped {
+			log.Debug("client.TransactionByHash err", "tx", latest.Hash(), "err", err)
+			continue
+		}
+		if dropped || time.Since(p.sentAt) > pendingResendAfter {
+			m.resend(ctx, client, acc, nonce, latest, dropped)
+		}
+	}
+}
+
+func (m *nonceManager) isMined(ctx context.Context, client *ethclient.Client, p *pendingTx) bool {
+	for _, tx := range p.txs {
+		if _, err := client.TransactionReceipt(ctx, tx.Hash()); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+/* 用相同 nonce 和更高的手续费重发最新版本为 latest 的交易，该账户之后的交易也使用更高的手续费 */
+func (m *nonceManager) resend(ctx context.Context, client *ethclient.Client, acc *senderAccount, nonce uint64, latest *types.Transaction, dropped bool) {
+	acc.lock.Lock()
+	price := bumpGasPrice(latest.GasPrice())
+	if acc.gasPrice.Cmp(price) > 0 {
+		price = acc.gasPrice
+	}
+	auth := acc.auth
+	acc.lock.Unlock()
+	tx := types.NewTransaction(nonce, *latest.To(), latest.Value(), latest.Gas(), price, latest.Data())
+	signedTx, err := auth.Signer(auth.From, tx)
+	if err != nil {
+		log.Warn("auth.Signer err", "err", err)
+		return
+	}
+	err = client.SendTransaction(ctx, signedTx)
+
+	acc.lock.Lock()
+	defer acc.lock.Unlock()
+	if err != nil {
+		// 交易可能已上链（nonce too low），下次检查时处理；涨幅不够时下次再提高
+		log.Debug("resend tbchain tx fail", "from", auth.From, "nonce", nonce, "gasPrice", price, "err", err)
+		if bumped := bumpGasPrice(price); strings.Contains(err.Error(), "underpriced") && bumped.Cmp(acc.gasPrice) > 0 {
+			acc.gasPrice = bumped
+		}
+		return
+	}
+	if p, ok := acc.pending[nonce]; ok {
+		p.txs = append(p.txs, signedTx)
+		p.sentAt = time.Now()
+	}
+	if price.Cmp(acc.gasPrice) > 0 {
+		acc.gasPrice = price
+	}
+	m.lock.Lock()
+	m.resent[latest.Hash()] = signedTx
+	m.lock.Unlock()
+	reason := "stuck"
+	if dropped {
+		reason = "dropped"
+	}
+	log.Info("tbchain tx resent with higher gas price", "reason", reason, "from", auth.From, "nonce", nonce,
+		"gasPrice", price, "old", latest.Hash(), "new", signedTx.Hash())
+}
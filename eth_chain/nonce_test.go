@@ -0,0 +1,307 @@
+package eth_chain
+
+import (
+	"context"
+	"encoding/json"
+	"go-w3chain/log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const testChainID = 1337
+
+/** 模拟以太坊节点的交易池：按 geth 的规则拒绝 nonce 过低、手续费过低和涨幅不够的替换交易
+ * mine 把每个账户从已上链 nonce 开始连续的交易打包
+ */
+type fakeTxPool struct {
+	t        *testing.T
+	lock     sync.Mutex
+	signer   types.Signer
+	minPrice *big.Int
+	mined    map[common.Address]uint64
+	pool     map[common.Address]map[uint64]*types.Transaction
+	receipts map[common.Hash]*types.Receipt
+	// 不为nil时，查询已上链 nonce 的请求等待从中读到值后才处理
+	stall chan struct{}
+}
+
+func newFakeTxPool(t *testing.T) *fakeTxPool {
+	return &fakeTxPool{
+		t:        t,
+		signer:   types.LatestSignerForChainID(big.NewInt(testChainID)),
+		minPrice: big.NewInt(100),
+		mined:    make(map[common.Address]uint64),
+		pool:     make(map[common.Address]map[uint64]*types.Transaction),
+		receipts: make(map[common.Hash]*types.Receipt),
+	}
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (f *fakeTxPool) add(tx *types.Transaction) *rpcError {
+	from, err := types.Sender(f.signer, tx)
+	if err != nil {
+		return &rpcError{-32000, err.Error()}
+	}
+	if tx.Nonce() < f.mined[from] {
+		return &rpcError{-32000, "nonce too low"}
+	}
+	if tx.GasPrice().Cmp(f.minPrice) < 0 {
+		return &rpcError{-32000, "transaction underpriced"}
+	}
+	if f.pool[from] == nil {
+		f.pool[from] = make(map[uint64]*types.Transaction)
+	}
+	if old, ok := f.pool[from][tx.Nonce()]; ok {
+		if old.Hash() == tx.Hash() {
+			return &rpcError{-32000, "already known"}
+		}
+		if tx.GasPrice().Cmp(bumpGasPrice(old.GasPrice())) < 0 {
+			return &rpcError{-32000, "replacement transaction underpriced"}
+		}
+	}
+	f.pool[from][tx.Nonce()] = tx
+	return nil
+}
+
+func (f *fakeTxPool) pendingNonce(from common.Address) uint64 {
+	n := f.mined[from]
+	for f.pool[from][n] != nil {
+		n++
+	}
+	return n
+}
+
+func (f *fakeTxPool) mine() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for from, txs := range f.pool {
+		for {
+			tx, ok := txs[f.mined[from]]
+			if !ok {
+				break
+			}
+			delete(txs, tx.Nonce())
+			f.receipts[tx.Hash()] = &types.Receipt{Status: 1, TxHash: tx.Hash(), GasUsed: 21000, BlockNumber: big.NewInt(1), Logs: []*types.Log{}}
+			f.mined[from]++
+		}
+	}
+}
+
+func (f *fakeTxPool) lookup(hash common.Hash) *types.Transaction {
+	for _, txs := range f.pool {
+		for _, tx := range txs {
+			if tx.Hash() == hash {
+				return tx
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakeTxPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	if f.stall != nil && req.Method == "eth_getTransactionCount" && string(req.Params[1]) == `"latest"` {
+		<-f.stall
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var result interface{}
+	var rpcErr *rpcError
+	switch req.Method {
+	case "eth_gasPrice":
+		result = (*hexutil.Big)(f.minPrice)
+	case "eth_getTransactionCount":
+		var from common.Address
+		var block string
+		json.Unmarshal(req.Params[0], &from)
+		json.Unmarshal(req.Params[1], &block)
+		if block == "pending" {
+			result = hexutil.Uint64(f.pendingNonce(from))
+		} else {
+			result = hexutil.Uint64(f.mined[from])
+		}
+	case "eth_sendRawTransaction":
+		var raw hexutil.Bytes
+		json.Unmarshal(req.Params[0], &raw)
+		tx := new(types.Transaction)
+		if err := tx.UnmarshalBinary(raw); err != nil {
+			f.t.Error(err)
+		}
+		if rpcErr = f.add(tx); rpcErr == nil {
+			result = tx.Hash()
+		}
+	case "eth_getTransactionByHash":
+		var hash common.Hash
+		json.Unmarshal(req.Params[0], &hash)
+		if tx := f.lookup(hash); tx != nil {
+			result = tx
+		}
+	case "eth_getTransactionReceipt":
+		var hash common.Hash
+		json.Unmarshal(req.Params[0], &hash)
+		if receipt, ok := f.receipts[hash]; ok {
+			result = receipt
+		}
+	default:
+		f.t.Errorf("unexpected method %s", req.Method)
+	}
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+	if rpcErr != nil {
+		resp["error"] = rpcErr
+	} else {
+		resp["result"] = result
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newTestTransactor(t *testing.T) *bind.TransactOpts {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := bind.NewKeyedTransactorWithChainID(key, big.NewInt(testChainID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+/** 不同账户并行发送，各自的 nonce 连续；nonce 被其他交易使用后重新读取；
+ * 被丢弃的交易提高手续费重发，nonce 被其他交易占用的交易被放弃
+ */
+func TestNonceManager(t *testing.T) {
+	t.Cleanup(log.SwapRootHandler(log.DiscardHandler()))
+
+	pool := newFakeTxPool(t)
+	srv := httptest.NewServer(pool)
+	defer srv.Close()
+	client, err := ethclient.Dial(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newNonceManager()
+	ctx := context.Background()
+	a, b := newTestTransactor(t), newTestTransactor(t)
+	to := common.Address{1}
+
+	var wg sync.WaitGroup
+	for _, auth := range []*bind.TransactOpts{a, b, a, b, a, b} {
+		wg.Add(1)
+		go func(auth *bind.TransactOpts) {
+			defer wg.Done()
+			if _, err := m.send(ctx, client, auth, to, 100000, []byte{1}); err != nil {
+				t.Error(err)
+			}
+		}(auth)
+	}
+	wg.Wait()
+	if pool.pendingNonce(a.From) != 3 || pool.pendingNonce(b.From) != 3 {
+		t.Fatalf("nonces not consecutive: %d %d", pool.pendingNonce(a.From), pool.pendingNonce(b.From))
+	}
+
+	// 其他进程用 a 的账户发送了 nonce 3、4 并上链
+	pool.mine()
+	pool.lock.Lock()
+	pool.mined[a.From] = 5
+	pool.lock.Unlock()
+	tx, err := m.send(ctx, client, a, to, 100000, []byte{2})
+	if err != nil || tx.Nonce() != 5 {
+		t.Fatalf("nonce not resynced: %v %v", tx.Nonce(), err)
+	}
+
+	// a 的交易被交易池丢弃，b 的 nonce 3 被其他交易占用并上链
+	btx, err := m.send(ctx, client, b, to, 100000, []byte{3})
+	if err != nil || btx.Nonce() != 3 {
+		t.Fatalf("unexpected b tx: %v %v", btx.Nonce(), err)
+	}
+	pool.lock.Lock()
+	delete(pool.pool[a.From], 5)
+	delete(pool.pool[b.From], 3)
+	pool.mined[b.From] = 4
+	pool.lock.Unlock()
+	m.checkPending(ctx, client)
+
+	pool.lock.Lock()
+	resent := pool.pool[a.From][5]
+	pool.lock.Unlock()
+	if resent == nil || resent.GasPrice().Cmp(bumpGasPrice(tx.GasPrice())) != 0 {
+		t.Fatalf("dropped tx not resent with higher gas price: %v", resent)
+	}
+	if versions := m.versions(tx); len(versions) != 2 || versions[1].Hash() != resent.Hash() {
+		t.Fatalf("unexpected versions: %d", len(versions))
+	}
+	if !m.isReplaced(btx) {
+		t.Fatal("replaced tx not detected")
+	}
+	for _, addr := range []common.Address{a.From, b.From} {
+		if n := len(m.accounts[addr].pending); n != map[common.Address]int{a.From: 1, b.From: 0}[addr] {
+			t.Fatalf("unexpected pending for %v: %d", addr, n)
+		}
+	}
+
+	// 重发的版本上链后，等待原交易的开销得到重发版本的收据
+	pool.mine()
+	receipt, mined, err := m.minedVersion(ctx, client, tx)
+	if err != nil || mined.Hash() != resent.Hash() || receipt.TxHash != resent.Hash() {
+		t.Fatalf("resent version not found: %v", err)
+	}
+	m.checkPending(ctx, client)
+	if len(m.accounts[a.From].pending) != 0 {
+		t.Fatal("mined tx still pending")
+	}
+
+	// 上链一段时间后删除重发和替换记录
+	if len(m.resent) != 1 || len(m.replaced) != 1 {
+		t.Fatalf("records forgotten too early: %d %d", len(m.resent), len(m.replaced))
+	}
+	m.forgetSettled(time.Now().Add(settledRetention))
+	if len(m.resent) != 0 || len(m.replaced) != 0 || len(m.settled) != 0 {
+		t.Fatalf("records of settled txs not forgotten: %d %d %d", len(m.resent), len(m.replaced), len(m.settled))
+	}
+
+	// 检查待确认交易时查询节点不阻塞同一账户发送交易
+	if _, err := m.send(ctx, client, a, to, 100000, []byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	pool.stall = make(chan struct{})
+	checked := make(chan struct{})
+	go func() {
+		m.checkPending(ctx, client)
+		close(checked)
+	}()
+	sent := make(chan error)
+	go func() {
+		_, err := m.send(ctx, client, a, to, 100000, []byte{5})
+		sent <- err
+	}()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("send blocked by checkPending")
+	}
+	close(pool.stall)
+	<-checked
+}
@@ -1,16 +1,19 @@
 package eth_chain
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"go-w3chain/cfg"
 	"go-w3chain/log"
+	"math/big"
 	"strconv"
 	"strings"
 
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/gorilla/websocket"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
 )
 
 type WebSocketResponse struct {
@@ -28,6 +31,7 @@ type WebSocketResponse struct {
 			Data             string   `json:"data"`
 			Topics           []string `json:"topics"`
 			Type             string   `json:"type"`
+			Removed          bool     `json:"removed"`
 		} `json:"result"`
 	} `json:"params"`
 }
@@ -37,84 +41,85 @@ type Event struct {
 	ShardID    uint32
 	Height     uint64
 	Eth_height uint64
+	/* 日志所在区块的哈希和日志在区块中的序号，回滚时据此找到被移除的日志 */
+	BlockHash string
+	LogIndex  uint64
+	/* 日志所在区块被回滚，日志已从链上移除 */
+	Removed bool
 }
 
-func SubscribeEvents(port int, contractAddr common.Address, eventChannel chan *Event) {
-	// WebSocket 连接地址
-	url := fmt.Sprintf("ws://%s:%d", cfg.GethIPAddr, port)
+/* websocket 订阅中一条 addTB 之外的合约日志：合约中验证失败的信息 */
+func logContractMessage(event *Event) {
+	if event.Removed {
+		log.Debug("contract log removed by reorg", "msg", event.Msg, "ethHeight", event.Eth_height)
+	} else if strings.Contains(event.Msg, "addTB...") || strings.Contains(event.Msg, "addTBRoot...") || strings.Contains(event.Msg, "adjustAddr") {
+		log.Error(event.Msg)
+	}
+}
 
-	// 创建 WebSocket 连接
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+/* 解析 websocket 推送的一条日志通知，不是 addTB 日志时返回 nil */
+func parseWebSocketLog(message []byte) *Event {
+	var response WebSocketResponse
+	err := json.Unmarshal(message, &response)
 	if err != nil {
-		log.Error("Failed to connect to eth_chain WebSocket:", "err", err)
+		log.Debug("Failed to unmarshal JSON", "err", err)
+		return nil
+	}
+	result := response.Params.Result
+	if response.Method != "eth_subscription" || result.BlockNumber == "" {
+		log.Debug("unexpected websocket message", "content", string(message))
+		return nil
 	}
-	defer conn.Close()
-
-	// 订阅合约事件
-	subscribeRequest := []byte(fmt.Sprintf(`{
-		"jsonrpc": "2.0",
-		"method": "eth_subscribe",
-		"params": ["logs", {
-			"address": "%v"
-		}],
-		"id": 1
-	}`, contractAddr.Hex()))
 
-	err = conn.WriteMessage(websocket.TextMessage, subscribeRequest)
+	eth_height, err := strconv.ParseUint(result.BlockNumber, 0, 64)
 	if err != nil {
-		log.Error("Failed to send subscription request:", "err", err)
+		log.Warn(fmt.Sprintf("parseInt fail. stringValue: %v err: %v", result.BlockNumber, err))
+		return nil
 	}
-
-	defer close(eventChannel)
-
-	// 第一个返回消息
-	_, message, err := conn.ReadMessage()
+	event := handleMessage(result.Data, eth_height)
+	if event == nil {
+		return nil
+	}
+	event.Eth_height = eth_height
+	event.BlockHash = result.BlockHash
+	logIndex, err := strconv.ParseUint(result.LogIndex, 0, 64)
 	if err != nil {
-		log.Error("Failed to read message from eth_chain WebSocket:", "err", err)
+		log.Warn("parse log index fail", "logIndex", result.LogIndex, "err", err)
 	}
-	log.Debug("websocket subscribe response", "content", string(message))
-
-	// 处理事件通知
-	for {
-		_, message, err := conn.ReadMessage()
-		if err != nil {
-			log.Error("Failed to read message from eth_chain WebSocket:", "err", err)
-		}
-
-		// fmt.Println("Received message:", string(message))
-
-		// // 在这里处理事件通知，解析事件数据等
-		// if string(message)[2:4] == "id" {
-		// 	continue
-		// }
-		var response WebSocketResponse
-		err = json.Unmarshal(message, &response)
-		if err != nil {
-			fmt.Println("Failed to unmarshal JSON:", err)
-			log.Debug("Failed to unmarshal JSON", "err", err)
-			continue
-		}
-
-		heightStr := response.Params.Result.BlockNumber
-		eth_height, err := strconv.ParseInt(heightStr, 0, 64)
-		if err != nil {
-			log.Error(fmt.Sprintf("parseInt fail. stringValue: %v err: %v", heightStr, err))
-		}
+	event.LogIndex = logIndex
+	event.Removed = result.Removed
+	if event.Msg != "addTB" {
+		logContractMessage(event)
+		return nil
+	}
+	return event
+}
 
-		// log.Debug(fmt.Sprintf("suscribe ethchain height: %v", height))
-		data := response.Params.Result.Data
-		// fmt.Println("Data:", data)
-		event := handleMessage(data, uint64(eth_height))
-		if event == nil {
+/** 用 eth_getLogs 读取合约在 [fromBlock, toBlock] 中的 addTB 日志，按链上顺序返回
+ * toBlock 为 nil 时读到最新区块；用于订阅前后补齐日志和轮询模式
+ */
+func FilterTBEvents(ctx context.Context, client *ethclient.Client, contractAddr common.Address, fromBlock uint64, toBlock *big.Int) ([]*Event, error) {
+	logs, err := client.FilterLogs(ctx, ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(fromBlock),
+		ToBlock:   toBlock,
+		Addresses: []common.Address{contractAddr},
+	})
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*Event, 0, len(logs))
+	for _, l := range logs {
+		event := handleMessage(hexutil.Encode(l.Data), l.BlockNumber)
+		if event == nil || event.Msg != "addTB" {
 			continue
 		}
-		event.Eth_height = uint64(eth_height)
-		if event.Msg == "addTB" {
-			eventChannel <- event
-		} else if strings.Contains(event.Msg, "addTB...") || strings.Contains(event.Msg, "adjustAddr") {
-			log.Error(event.Msg)
-		}
+		event.Eth_height = l.BlockNumber
+		event.BlockHash = l.BlockHash.Hex()
+		event.LogIndex = uint64(l.Index)
+		event.Removed = l.Removed
+		events = append(events, event)
 	}
+	return events, nil
 }
 
 func handleMessage(data string, eth_height uint64) *Event {
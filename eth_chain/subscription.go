@@ -0,0 +1,392 @@
+package eth_chain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-w3chain/cfg"
+	"go-w3chain/log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/gorilla/websocket"
+)
+
+/* 读取合约日志的方式 */
+const (
+	EventSourceWebsocket = "websocket" // eth_subscribe 订阅，断开后重新订阅并用 eth_getLogs 补齐
+	EventSourcePolling   = "polling"   // 只用 http 接口，定期 eth_getLogs
+)
+
+const (
+	// 轮询间隔
+	eventPollInterval = time.Second
+	// 轮询时重新读取最近的区块数，其中消失的日志视为被回滚
+	pollReorgDepth = 16
+	// 去重记录保留的区块数，不能小于 pollReorgDepth，否则重读的日志会被当作新日志再次推送
+	dedupWindow = 128
+	// websocket 重新订阅的等待时间，每次失败翻倍
+	minResubscribeDelay = time.Second
+	maxResubscribeDelay = 30 * time.Second
+	// websocket 心跳：每 wsPingPeriod 发送 ping，wsPongWait 内没有收到任何消息视为连接已断开
+	wsPingPeriod = 15 * time.Second
+	wsPongWait   = 2 * wsPingPeriod
+)
+
+/* 编译期检查 dedupWindow >= pollReorgDepth，否则数组长度为负，无法编译 */
+var _ [dedupWindow - pollReorgDepth]struct{}
+
+/* 一条合约日志，回滚时以相同的区块哈希和日志序号推送 removed */
+type logKey struct {
+	blockHash string
+	logIndex  uint64
+}
+
+/* 订阅的健康状态，供控制器检查 */
+type SubscriptionHealth struct {
+	Source     string
+	Healthy    bool      // websocket 订阅中，或最近一次轮询成功
+	Since      time.Time // 进入当前状态的时间
+	Reconnects int       // websocket 重新订阅的次数
+	LastError  string    `json:",omitempty"`
+	LastHeight uint64    // 已读到的日志的最高以太坊高度
+	Duplicates int       // 去重丢弃的日志数
+}
+
+/** 合约 addTB 日志的订阅，日志按 (区块哈希, 日志序号) 去重后写入 out
+ * websocket 断开后自动重新订阅，并从已读到的最高高度开始用 eth_getLogs 补齐断开期间的日志；
+ * 轮询模式每次重读最近 pollReorgDepth 个区块，消失的日志以 removed 推送
+ */
+type Subscription struct {
+	ctx          context.Context
+	client       *ethclient.Client // http 连接，用于 eth_getLogs
+	port         int
+	contractAddr common.Address
+	source       string
+	out          chan<- *Event
+
+	lock sync.Mutex
+	// 下一次补齐或轮询需要读取的最低高度，该高度的日志可能还未读全；0表示从订阅时的最新区块开始
+	next   uint64
+	seen   map[logKey]*Event
+	health SubscriptionHealth
+}
+
+/* 新建订阅，from 为需要补齐的起始高度，source 为空时使用 websocket */
+func NewSubscription(ctx context.Context, client *ethclient.Client, port int, contractAddr common.Address,
+	source string, from uint64, out chan<- *Event) *Subscription {
+	if source == "" {
+		source = EventSourceWebsocket
+	}
+	return &Subscription{
+		ctx:          ctx,
+		client:       client,
+		port:         port,
+		contractAddr: contractAddr,
+		source:       source,
+		out:          out,
+		next:         from,
+		seen:         make(map[logKey]*Event),
+		health:       SubscriptionHealth{Source: source, Since: time.Now()},
+	}
+}
+
+func (s *Subscription) Health() SubscriptionHealth {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.health
+}
+
+func (s *Subscription) setHealth(healthy bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if healthy != s.health.Healthy {
+		s.health.Healthy = healthy
+		s.health.Since = time.Now()
+		if healthy {
+			log.Info("eth_chain event subscription healthy", "source", s.source)
+		} else {
+			log.Warn("eth_chain event subscription unhealthy", "source", s.source, "err", err)
+		}
+	}
+	if err != nil {
+		s.health.LastError = err.Error()
+	}
+}
+
+/* 读取日志直到 ctx 取消 */
+func (s *Subscription) Run() {
+	if s.source == EventSourcePolling {
+		s.runPolling()
+	} else {
+		s.runWebsocket()
+	}
+	log.Info("eth_chain event subscription stop.")
+}
+
+/** 推送一条日志，重复的日志被丢弃；被回滚的日志删除去重记录后推送
+ * ctx 取消时返回 false
+ */
+func (s *Subscription) deliver(event *Event) bool {
+	key := logKey{blockHash: event.BlockHash, logIndex: event.LogIndex}
+	s.lock.Lock()
+	if event.Removed {
+		delete(s.seen, key)
+	} else if _, ok := s.seen[key]; ok {
+		s.health.Duplicates++
+		s.lock.Unlock()
+		return true
+	} else {
+		s.seen[key] = event
+		if event.Eth_height > s.next {
+			s.next = event.Eth_height
+		}
+		if event.Eth_height > s.health.LastHeight {
+			s.health.LastHeight = event.Eth_height
+			for k, e := range s.seen {
+				if e.Eth_height+dedupWindow < event.Eth_height {
+					delete(s.seen, k)
+				}
+			}
+		}
+	}
+	s.lock.Unlock()
+
+	select {
+	case s.out <- event:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+/* 已读全 head 及以下高度的日志 */
+func (s *Subscription) advance(head uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if head+1 > s.next {
+		s.next = head + 1
+	}
+}
+
+/** 用 eth_getLogs 读取 [next, 最新区块] 的日志，next 为0（首次订阅且没有持久化的视图）时不补齐
+ * 返回 ctx 取消或读取失败的错误
+ */
+func (s *Subscription) catchUp() error {
+	head, err := s.client.BlockNumber(s.ctx)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	from := s.next
+	s.lock.Unlock()
+	if from == 0 || from > head {
+		s.advance(head)
+		return nil
+	}
+	events, err := FilterTBEvents(s.ctx, s.client, s.contractAddr, from, new(big.Int).SetUint64(head))
+	if err != nil {
+		return err
+	}
+	log.Info("catch up time beacon logs", "from", from, "to", head, "logs", len(events))
+	for _, event := range events {
+		if !s.deliver(event) {
+			return s.ctx.Err()
+		}
+	}
+	s.advance(head)
+	return nil
+}
+
+/* 订阅失败或断开后等待一段时间再重新订阅，直到 ctx 取消 */
+func (s *Subscription) runWebsocket() {
+	delay := minResubscribeDelay
+	for s.ctx.Err() == nil {
+		subscribed, err := s.subscribeOnce()
+		if s.ctx.Err() != nil {
+			return
+		}
+		s.setHealth(false, err)
+		if subscribed {
+			delay = minResubscribeDelay
+		}
+		log.Warn("eth_chain event subscription lost, resubscribing", "err", err, "after", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		}
+		if delay *= 2; delay > maxResubscribeDelay {
+			delay = maxResubscribeDelay
+		}
+		s.lock.Lock()
+		s.health.Reconnects++
+		s.lock.Unlock()
+	}
+}
+
+/** 建立一次 websocket 订阅，先订阅再补齐，两者重复的日志被去重
+ * 返回是否订阅成功以及订阅结束的原因
+ */
+func (s *Subscription) subscribeOnce() (bool, error) {
+	// WebSocket 连接地址
+	url := fmt.Sprintf("ws://%s:%d", cfg.GethIPAddr, s.port)
+	conn, _, err := websocket.DefaultDialer.DialContext(s.ctx, url, nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	// 阻塞在读取上时，通过关闭连接退出
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(wsPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				conn.Close()
+				return
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+					log.Debug("websocket ping fail", "err", err)
+				}
+			}
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	// 订阅合约事件
+	subscribeRequest := []byte(fmt.Sprintf(`{
+		"jsonrpc": "2.0",
+		"method": "eth_subscribe",
+		"params": ["logs", {
+			"address": "%v"
+		}],
+		"id": 1
+	}`, s.contractAddr.Hex()))
+	if err := conn.WriteMessage(websocket.TextMessage, subscribeRequest); err != nil {
+		return false, err
+	}
+
+	// 第一个返回消息是订阅结果
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return false, err
+	}
+	log.Debug("websocket subscribe response", "content", string(message))
+	var reply struct {
+		Result string `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(message, &reply); err != nil {
+		return false, err
+	}
+	if reply.Error != nil || reply.Result == "" {
+		return false, fmt.Errorf("eth_subscribe rejected: %s", message)
+	}
+
+	if err := s.catchUp(); err != nil {
+		return false, err
+	}
+	s.setHealth(true, nil)
+
+	// 处理事件通知
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		event := parseWebSocketLog(message)
+		if event == nil {
+			continue
+		}
+		if !s.deliver(event) {
+			return true, s.ctx.Err()
+		}
+	}
+}
+
+/* 每 eventPollInterval 读取一次日志，读取失败时只标记为不健康，下次继续 */
+func (s *Subscription) runPolling() {
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+	for {
+		err := s.poll()
+		if s.ctx.Err() != nil {
+			return
+		}
+		s.setHealth(err == nil, err)
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Subscription) poll() error {
+	head, err := s.client.BlockNumber(s.ctx)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	if s.next == 0 {
+		s.next = head
+	}
+	start := s.next
+	s.lock.Unlock()
+	if start > head {
+		return nil
+	}
+	if start > pollReorgDepth {
+		start -= pollReorgDepth
+	} else {
+		start = 0
+	}
+	events, err := FilterTBEvents(s.ctx, s.client, s.contractAddr, start, new(big.Int).SetUint64(head))
+	if err != nil {
+		return err
+	}
+	for _, event := range s.reconcile(start, head, events) {
+		if !s.deliver(event) {
+			return s.ctx.Err()
+		}
+	}
+	s.advance(head)
+	return nil
+}
+
+/** 轮询读到 [start, head] 的日志 events 后需要推送的日志：
+ * 之前读到、这次已不在该范围内的日志被回滚，先推送它们的 removed，再推送 events
+ */
+func (s *Subscription) reconcile(start, head uint64, events []*Event) []*Event {
+	present := make(map[logKey]bool, len(events))
+	for _, event := range events {
+		present[logKey{blockHash: event.BlockHash, logIndex: event.LogIndex}] = true
+	}
+	s.lock.Lock()
+	removed := make([]*Event, 0)
+	for key, event := range s.seen {
+		if event.Eth_height >= start && event.Eth_height <= head && !present[key] {
+			e := *event
+			e.Removed = true
+			removed = append(removed, &e)
+		}
+	}
+	s.lock.Unlock()
+	return append(removed, events...)
+}
@@ -0,0 +1,200 @@
+package eth_chain
+
+import (
+	"context"
+	"encoding/json"
+	"go-w3chain/cfg"
+	"go-w3chain/log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/gorilla/websocket"
+)
+
+/* 合约 LogMessage 事件的一条 addTB 日志 */
+func testTBLog(t *testing.T, ethHeight uint64, index uint, height uint64) *types.Log {
+	str, _ := abi.NewType("string", "", nil)
+	u32, _ := abi.NewType("uint32", "", nil)
+	u64, _ := abi.NewType("uint64", "", nil)
+	addr, _ := abi.NewType("address", "", nil)
+	data, err := abi.Arguments{{Type: str}, {Type: u32}, {Type: u64}, {Type: addr}}.Pack("addTB", uint32(0), height, common.Address{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &types.Log{
+		Topics:      []common.Hash{{1}},
+		Data:        data,
+		BlockNumber: ethHeight,
+		BlockHash:   common.BigToHash(new(big.Int).SetUint64(ethHeight)),
+		Index:       index,
+	}
+}
+
+/** 模拟以太坊节点：http 接口返回最新高度和日志，websocket 接口每次订阅推送一组日志
+ * sessions[i] 是第i次订阅推送的日志，推送完成后除最后一次外都断开连接
+ */
+type fakeEthNode struct {
+	t        *testing.T
+	lock     sync.Mutex
+	head     uint64
+	logs     []*types.Log
+	sessions [][]*types.Log
+	session  int
+}
+
+func (f *fakeEthNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		f.serveWebsocket(w, r)
+		return
+	}
+	var req struct {
+		ID     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var result interface{}
+	switch req.Method {
+	case "eth_blockNumber":
+		result = hexutil.Uint64(f.head)
+	case "eth_getLogs":
+		var q struct {
+			FromBlock hexutil.Uint64 `json:"fromBlock"`
+		}
+		json.Unmarshal(req.Params[0], &q)
+		logs := make([]*types.Log, 0)
+		for _, l := range f.logs {
+			if l.BlockNumber >= uint64(q.FromBlock) {
+				logs = append(logs, l)
+			}
+		}
+		result = logs
+	default:
+		f.t.Errorf("unexpected method %s", req.Method)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+}
+
+func (f *fakeEthNode) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		f.t.Error(err)
+		return
+	}
+	defer conn.Close()
+	conn.ReadMessage()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":1,"result":"0xabc"}`))
+	f.lock.Lock()
+	i := f.session
+	f.session++
+	f.lock.Unlock()
+	for _, l := range f.sessions[i] {
+		data, _ := json.Marshal(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  "eth_subscription",
+			"params":  map[string]interface{}{"subscription": "0xabc", "result": l},
+		})
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+	if i == len(f.sessions)-1 {
+		// 最后一次订阅保持连接直到客户端关闭
+		conn.ReadMessage()
+	}
+}
+
+/* 断开后重新订阅，并从已读到的高度补齐断开期间的日志，重复的日志只推送一次 */
+func TestSubscriptionResubscribe(t *testing.T) {
+	t.Cleanup(log.SwapRootHandler(log.DiscardHandler()))
+
+	a, b, c := testTBLog(t, 6, 0, 1), testTBLog(t, 7, 0, 2), testTBLog(t, 8, 0, 3)
+	node := &fakeEthNode{t: t, head: 5, sessions: [][]*types.Log{{a}, {b, c}}}
+	srv := httptest.NewServer(node)
+	defer srv.Close()
+	host, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	oldAddr := cfg.GethIPAddr
+	cfg.GethIPAddr = host
+	defer func() { cfg.GethIPAddr = oldAddr }()
+	client, err := ethclient.Dial(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 断开期间链上产生了 b，重新订阅时补齐读到 a、b，订阅又推送一次 b，重复的两条被丢弃
+	node.lock.Lock()
+	node.logs = []*types.Log{a, b}
+	node.lock.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan *Event, 10)
+	sub := NewSubscription(ctx, client, port, common.Address{}, "", 0, out)
+	done := make(chan struct{})
+	go func() {
+		sub.Run()
+		close(done)
+	}()
+	go func() {
+		// 第一次订阅读到 a 后，链增长到 8
+		time.Sleep(200 * time.Millisecond)
+		node.lock.Lock()
+		node.head = 8
+		node.lock.Unlock()
+	}()
+
+	var heights []uint64
+	for len(heights) < 3 {
+		select {
+		case e := <-out:
+			heights = append(heights, e.Height)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout, got %v", heights)
+		}
+	}
+	if heights[0] != 1 || heights[1] != 2 || heights[2] != 3 {
+		t.Fatalf("unexpected events: %v", heights)
+	}
+	h := sub.Health()
+	if !h.Healthy || h.Reconnects != 1 || h.Duplicates != 2 || h.LastHeight != 8 {
+		t.Fatalf("unexpected health: %+v", h)
+	}
+	cancel()
+	<-done
+}
+
+/* 轮询时重读的区块中消失的日志以 removed 推送 */
+func TestSubscriptionReconcile(t *testing.T) {
+	t.Cleanup(log.SwapRootHandler(log.DiscardHandler()))
+
+	out := make(chan *Event, 10)
+	sub := NewSubscription(context.Background(), nil, 0, common.Address{}, EventSourcePolling, 0, out)
+	old := &Event{Msg: "addTB", Height: 1, Eth_height: 10, BlockHash: "0x01"}
+	deep := &Event{Msg: "addTB", Height: 0, Eth_height: 2, BlockHash: "0x02"}
+	sub.deliver(old)
+	sub.deliver(deep)
+	sub.deliver(old)
+	if len(out) != 2 || sub.Health().Duplicates != 1 {
+		t.Fatalf("duplicate delivered: %d %+v", len(out), sub.Health())
+	}
+
+	// 区块10被替换，信标 1 被打包到区块11
+	moved := &Event{Msg: "addTB", Height: 1, Eth_height: 11, BlockHash: "0x11"}
+	events := sub.reconcile(5, 12, []*Event{moved})
+	if len(events) != 2 || !events[0].Removed || events[0].BlockHash != "0x01" || events[1] != moved {
+		t.Fatalf("unexpected reconcile: %+v", events)
+	}
+	if old.Removed {
+		t.Fatal("seen event modified")
+	}
+}
@@ -27,6 +27,7 @@ contract TBStorage {
     uint32 minSigCnt; // the minimum number of signatures required for multi-signature
     uint32 shardNum;
     mapping(uint32 => mapping(uint64 => ContractTB)) public tbs;
+    mapping(uint32 => mapping(uint64 => bytes32)) public tbRoots; // merkle roots anchored by addTBRoot, keyed by the last height
     mapping(address => uint32) public addr2Shard;
     mapping(address => bool) public addrRecorded; 
 
@@ -51,49 +52,112 @@ contract TBStorage {
     // store ContractTB of specific shard and height
     function addTB(ContractTB memory tb, bytes[] memory sigs, bytes[] memory vrfs, 
                     uint64 seedHeight, address[] memory signers) public {
-        // verify every signature until validSigCnt reaches minSigCnt
+        bytes32 msgHash = keccak256(abi.encode(tb.shardID, tb.height, tb.blockHash, tb.txHash, tb.statusHash));
+        uint32 validSigCnt = countValidSigs(msgHash, tb.shardID, tb.height, sigs, vrfs, seedHeight, signers);
+
+        if (validSigCnt < minSigCnt) {
+            emit LogMessage("addTB... insufficient valid signatures", tb.shardID, tb.height, address(0));
+        } else {
+            emit LogMessage("addTB", tb.shardID, tb.height, address(0));
+            tbs[tb.shardID][tb.height] = tb;
+        }
+
+        // require(validSigCnt >= minSigCnt, "Insufficient valid signatures");
+    }
+
+    // store several ContractTBs in one transaction, each with its own multi-signature
+    // an entry with insufficient valid signatures does not affect the others
+    function addTBs(ContractTB[] memory _tbs, bytes[][] memory sigs, bytes[][] memory vrfs,
+                    uint64[] memory seedHeights, address[][] memory signers) public {
+        for (uint32 i = 0; i < _tbs.length; i++) {
+            addTB(_tbs[i], sigs[i], vrfs[i], seedHeights[i], signers[i]);
+        }
+    }
+
+    // anchor the merkle root of consecutive ContractTBs of a shard and store each of them
+    // the committee signs only the root, which must be the merkle root of _tbs computed as in core.TBMerkleRoot
+    function addTBRoot(ContractTB[] memory _tbs, bytes32 root,
+                    bytes[] memory sigs, bytes[] memory vrfs, uint64 seedHeight, address[] memory signers) public {
+        require(_tbs.length > 0, "addTBRoot... no time beacons");
+        uint32 shardID = _tbs[0].shardID;
+        uint64 endHeight = _tbs[0].height + uint64(_tbs.length) - 1;
+        bytes32 msgHash = keccak256(abi.encode(shardID, _tbs[0].height, uint64(_tbs.length), root));
+        uint32 validSigCnt = countValidSigs(msgHash, shardID, endHeight, sigs, vrfs, seedHeight, signers);
+
+        if (validSigCnt < minSigCnt) {
+            emit LogMessage("addTB... insufficient valid signatures", shardID, endHeight, address(0));
+            return;
+        }
+        if (!tbsMatchRoot(_tbs, root)) {
+            emit LogMessage("addTBRoot... time beacons do not match the root", shardID, endHeight, address(0));
+            return;
+        }
+        tbRoots[shardID][endHeight] = root;
+        for (uint32 i = 0; i < _tbs.length; i++) {
+            tbs[shardID][_tbs[i].height] = _tbs[i];
+            emit LogMessage("addTB", shardID, _tbs[i].height, address(0));
+        }
+    }
+
+    // _tbs are consecutive ContractTBs of one shard and root is their merkle root
+    // a leaf is the hash signed by addTB, a parent is keccak256 of its two children, an odd last node moves up as is
+    function tbsMatchRoot(ContractTB[] memory _tbs, bytes32 root) internal pure returns (bool) {
+        bytes32[] memory level = new bytes32[](_tbs.length);
+        for (uint32 i = 0; i < _tbs.length; i++) {
+            ContractTB memory tb = _tbs[i];
+            if (tb.shardID != _tbs[0].shardID || tb.height != _tbs[0].height + i) {
+                return false;
+            }
+            level[i] = keccak256(abi.encode(tb.shardID, tb.height, tb.blockHash, tb.txHash, tb.statusHash));
+        }
+        for (uint256 n = level.length; n > 1; n = (n + 1) / 2) {
+            for (uint256 j = 0; j < n / 2; j++) {
+                level[j] = keccak256(abi.encodePacked(level[2 * j], level[2 * j + 1]));
+            }
+            if (n % 2 == 1) {
+                level[n / 2] = level[n - 1];
+            }
+        }
+        return level[0] == root;
+    }
+
+    // verify every signature of msgHash until validSigCnt reaches minSigCnt
+    function countValidSigs(bytes32 msgHash, uint32 shardID, uint64 height, bytes[] memory sigs, bytes[] memory vrfs,
+                    uint64 seedHeight, address[] memory signers) internal returns (uint32) {
         uint32 validSigCnt = 0;
         // get the block hash corresponding to seedHeight, as seed of vrf
         bytes32 seed = blockhash(seedHeight);
         for (uint32 i = 0; i < sigs.length; i++) {
             // step 0. check that the signer is recorded in contract, and is in the right shard
             if (!addrRecorded[signers[i]]) {
-                emit LogMessage("addTB... address not recorded", tb.shardID, tb.height, signers[i]);
+                emit LogMessage("addTB... address not recorded", shardID, height, signers[i]);
                 continue;
             }
-            if (addr2Shard[signers[i]] != tb.shardID) {
-                emit LogMessage("addTB... signer not in this shard", tb.shardID, tb.height, signers[i]);
+            if (addr2Shard[signers[i]] != shardID) {
+                emit LogMessage("addTB... signer not in this shard", shardID, height, signers[i]);
                 continue;
             }
             // step 1. check the vrf result is generated by signer
             if (!verifyVrfResult(seed, vrfs[i], signers[i])) {
-                emit LogMessage("addTB... vrf verification not passed", tb.shardID, tb.height, signers[i]);
+                emit LogMessage("addTB... vrf verification not passed", shardID, height, signers[i]);
                 continue;
             }
             // step2. check that the vrfValue is qualified for being a signer
             if (!vrfIsQualified(vrfs[i])) {
-                emit LogMessage("addTB... vrf not qualified", tb.shardID, tb.height, signers[i]);
+                emit LogMessage("addTB... vrf not qualified", shardID, height, signers[i]);
                 continue;
             }
             // step 3. verify the signature
-            if (verifySignature(tb, sigs[i], signers[i])) {
+            if (verifySignature(msgHash, sigs[i], signers[i])) {
                 validSigCnt++;
                 if (validSigCnt >= minSigCnt) {
                     break;
                 }
             } else {
-                emit LogMessage("addTB... signature verification not passed", tb.shardID, tb.height, signers[i]);
+                emit LogMessage("addTB... signature verification not passed", shardID, height, signers[i]);
             }
         }
-
-        if (validSigCnt < minSigCnt) {
-            emit LogMessage("addTB... insufficient valid signatures", tb.shardID, tb.height, address(0));
-        } else {
-            emit LogMessage("addTB", tb.shardID, tb.height, address(0));
-            tbs[tb.shardID][tb.height] = tb;
-        }
-
-        // require(validSigCnt >= minSigCnt, "Insufficient valid signatures");
+        return validSigCnt;
     }
 
     function vrfIsQualified(bytes memory vrfValue) internal pure returns (bool) {
@@ -141,12 +205,8 @@ contract TBStorage {
     }
 
 
-    // Verify signature of ContractTB
-    function verifySignature(ContractTB memory tb, bytes memory sig, address signer) internal pure returns (bool) {
-        // abi-encode and Keccak-256 hash
-        bytes memory encoded = abi.encode(tb.shardID, tb.height, tb.blockHash, tb.txHash, tb.statusHash);
-        bytes32 msgHash = keccak256(encoded);
-
+    // Verify signature of a message hash, e.g. the hash of abi-encoded ContractTB
+    function verifySignature(bytes32 msgHash, bytes memory sig, address signer) internal pure returns (bool) {
         // Extract r, s, and v values from the signature
         (bytes32 r, bytes32 s, uint8 v) = decomposeSig(sig);
 
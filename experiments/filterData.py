@@ -24,13 +24,20 @@ def parse_log_line(line):
     sync_time_match = re.search(r"sync time: (\d+)", line)
     sync_time = sync_time_match.group(1) if sync_time_match else None
 
+    # 同步数据压缩前后在网络上传输的字节数，旧日志中没有这两项
+    sync_raw_match = re.search(r"sync raw\(bytes\): (\d+)", line)
+    sync_raw = sync_raw_match.group(1) if sync_raw_match else 0
+
+    sync_wire_match = re.search(r"sync wire\(bytes\): (\d+)", line)
+    sync_wire = sync_wire_match.group(1) if sync_wire_match else 0
+
     # 返回解析的数据
-    return shard_id, [shard_id, msg_type, states_size, blocks_size, pooltx_size, sync_time]
+    return shard_id, [shard_id, msg_type, states_size, blocks_size, pooltx_size, sync_time, sync_raw, sync_wire]
 
 def write_logs_to_csv(file_path, logs):
     with open(file_path, 'w', newline='') as file:
         writer = csv.writer(file)
-        writer.writerow(["shardID", "msgType", "sizeofStates", "sizeofBlocks", "sizeofPoolTxs", "syncTime(ms)"])  # 标题行
+        writer.writerow(["shardID", "msgType", "sizeofStates", "sizeofBlocks", "sizeofPoolTxs", "syncTime(ms)", "syncRawBytes", "syncWireBytes"])  # 标题行
         for log in logs:
             writer.writerow(log)
             
@@ -98,7 +105,7 @@ def average_csv_data(input_directory, output_file):
     # 检查计算后的平均数据
     print("Average data:", average_data)
     
-    header = ["shardID", "msgType", "Average of sizeofStates(bytes)", "Average of sizeofBlocks(bytes)", "Average of sizeofPoolTxs(bytes)", "Average of syncTime(ms)"]
+    header = ["shardID", "msgType", "Average of sizeofStates(bytes)", "Average of sizeofBlocks(bytes)", "Average of sizeofPoolTxs(bytes)", "Average of syncTime(ms)", "Average of syncRawBytes", "Average of syncWireBytes"]
     write_average_to_csv(output_file, average_data, header)
 
 
@@ -20,5 +20,8 @@ func (h *swapHandler) Swap(newHandler Handler) {
 }
 
 func (h *swapHandler) Get() Handler {
-	return *h.handler.Load().(*Handler)
+	if handler, ok := h.handler.Load().(*Handler); ok {
+		return *handler
+	}
+	return nil
 }
@@ -131,7 +131,7 @@ type logger struct {
 }
 
 func (l *logger) write(msg string, lvl Lvl, ctx []interface{}, skip int) {
-	if Loglvl < lvl {
+	if LogLevel() < lvl {
 		return
 	}
 	l.h.Log(&Record{
@@ -3,6 +3,7 @@ package log
 import (
 	"fmt"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,11 +11,17 @@ var (
 	root          = &logger{[]interface{}{}, new(swapHandler)}
 	StdoutHandler = StreamHandler(os.Stdout, LogfmtFormat())
 	StderrHandler = StreamHandler(os.Stderr, LogfmtFormat())
-	Loglvl        = LvlTrace
+	// 日志级别，管理接口可能在运行中修改，原子读写
+	loglvl = int32(LvlTrace)
 )
 
 func SetLogLevel(lvl Lvl) {
-	Loglvl = lvl
+	atomic.StoreInt32(&loglvl, int32(lvl))
+}
+
+/* 当前的日志级别 */
+func LogLevel() Lvl {
+	return Lvl(atomic.LoadInt32(&loglvl))
 }
 
 func SetTimeLog(lvl Lvl) {
@@ -47,6 +54,20 @@ func SetLogInfo(lvl Lvl, logname string) {
 	SetLogLevel(lvl)
 }
 
+/** 把根日志的输出替换为 h，返回恢复原输出和日志级别的函数，测试中用 t.Cleanup(log.SwapRootHandler(h)) 调用
+ * 之前未设置过输出时，恢复时保留 h
+ */
+func SwapRootHandler(h Handler) (restore func()) {
+	old, lvl := root.GetHandler(), LogLevel()
+	root.SetHandler(h)
+	return func() {
+		if old != nil {
+			root.SetHandler(old)
+		}
+		SetLogLevel(lvl)
+	}
+}
+
 // New returns a new logger with the given context.
 // New is a convenient alias for Root().New
 func New(ctx ...interface{}) Logger {
@@ -21,18 +21,72 @@ type Args struct {
 	NodeId   int32
 }
 
-var mode = pflag.StringP("mode", "m", "debug", "mode (run or debug)")
-var role = pflag.StringP("role", "r", "booter", "role type (booter, node or client)")
-var shardNum = pflag.Int32P("shardNum", "S", 1, "number of shards(and committees)")
-var shardId = pflag.Int32P("shardId", "s", 0, "shard id")
-var nodeId = pflag.Int32P("nodeId", "n", 0, "node id")
+var mode = pflag.StringP("mode", "m", "debug", "mode (run or debug), selects cfg/debug.json or cfg/run.json")
+var config = pflag.StringP("config", "c", "", "config file, overrides --mode")
+var sets = pflag.StringArray("set", nil, "override a config field as Key=Value, repeatable; LESSCHAIN_<KEY> environment variables work the same")
+
+// 以下参数只在显式给出时覆写配置，未给出时使用配置文件中的值（Role 为空时为 booter）
+var role = pflag.StringP("role", "r", "", "role type (booter, node or client), overrides Role of the config file")
+var shardNum = pflag.Int32P("shardNum", "S", 0, "number of shards(and committees), overrides ShardNum of the config file")
+var shardId = pflag.Int32P("shardId", "s", 0, "shard id, overrides ShardId of the config file")
+var nodeId = pflag.Int32P("nodeId", "n", 0, "node id, overrides NodeId of the config file")
+var listen = pflag.StringP("listen", "l", "", "listen address(ip:port) registered to the booter, overrides the node table")
+var booterAddr = pflag.StringP("booter", "b", "", "booter address(ip:port), overrides cfg/node.go")
 
 /** go build -o brokerChain.exe
  * brokerChain.exe -m run >> nohup.out 2>&1
+ * brokerChain.exe -c my.json --set InjectSpeed=500 -r client  配置文件 < LESSCHAIN_ 环境变量 < --set < -r/-S/-s/-n/-l/-b
+ * brokerChain.exe config ShardNum  打印生效的配置字段，供启动脚本使用
+ * brokerChain.exe cluster -m debug -S 2  在一个进程中运行 booter、所有节点和客户端
+ * brokerChain.exe sweep experiments/sweep.yaml  按扫描配置依次运行 cluster，结果汇总到一个表中
+ * brokerChain.exe inspect blocks S0N0  查看节点的链数据库，其余参数由 inspect 自己解析
  */
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		if err := controller.Inspect(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	pflag.Parse()
 
+	/* 只有显式给出的命令行参数才覆写配置文件，优先级高于 --set */
+	overrides := append([]string{}, *sets...)
+	flagFields := []struct {
+		flag, field, value string
+	}{
+		{"role", "Role", *role},
+		{"shardNum", "ShardNum", fmt.Sprint(*shardNum)},
+		{"shardId", "ShardId", fmt.Sprint(*shardId)},
+		{"nodeId", "NodeId", fmt.Sprint(*nodeId)},
+		{"listen", "ListenAddr", *listen},
+		{"booter", "BooterAddr", *booterAddr},
+	}
+	for _, f := range flagFields {
+		if pflag.CommandLine.Changed(f.flag) {
+			overrides = append(overrides, f.field+"="+f.value)
+		}
+	}
+
+	command := ""
+	if pflag.NArg() > 0 {
+		command = pflag.Arg(0)
+		switch command {
+		case "cluster":
+			overrides = append(overrides, "Role=cluster")
+		case "sweep":
+			if pflag.NArg() != 2 {
+				fmt.Println("usage: lessChain sweep <sweep file> [-m debug|run] [--set Key=Value]")
+				os.Exit(1)
+			}
+		case "config":
+		default:
+			fmt.Println("unknown command:", command)
+			return
+		}
+	}
+
 	// args := &Args{
 	// 	Mode:     *mode,
 	// 	Role:     *role,
@@ -42,12 +96,30 @@ func main() {
 	// }
 
 	cfgfilename := "cfg/debug.json"
-	if *mode == "run" {
+	if *config != "" {
+		cfgfilename = *config
+	} else if *mode == "run" {
 		cfgfilename = "cfg/run.json"
 	} else if *mode != "debug" {
 		fmt.Println("wrong mode")
 		return
 	}
+
+	switch command {
+	case "config":
+		// 输出只包含配置的值，便于脚本读取
+		if err := controller.PrintCfg(cfgfilename, overrides, pflag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	case "sweep":
+		if err := controller.Sweep(cfgfilename, pflag.Arg(1), overrides); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 	fmt.Println("cfg file:", cfgfilename)
 
 	// if *role == "node" && *nodeId < 4 {
@@ -57,7 +129,7 @@ func main() {
 	// 	wg.Wait()
 	// }
 
-	controller.Main(cfgfilename, *role, *shardNum, *shardId, *nodeId)
+	controller.Main(cfgfilename, overrides)
 	// closeTerminalWindow(*nodeId)
 }
 
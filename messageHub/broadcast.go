@@ -0,0 +1,208 @@
+package messageHub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	BroadcastDirect = "direct" // 发送方依次发给每个接收方
+	BroadcastTree   = "tree"   // 按k叉树逐层转发
+	BroadcastGossip = "gossip" // 每个节点第一次收到时转发给随机的若干成员
+
+	defaultTreeFanout = 3
+	// gossip 默认每次转发 ln(N)+gossipFanoutExtra 个节点，N 个节点全部收到的概率约为 exp(-exp(-gossipFanoutExtra))
+	gossipFanoutExtra = 3
+	// 记录已收到的广播消息摘要的数量，用于去重
+	relaySeenCacheSize = 4096
+)
+
+/** 转发的广播消息
+ * Inner 为原始发送方签名的消息（不含长度前缀），转发时不变，接收方按原始发送方验证。
+ * 树形广播时 Targets 为接收方负责的子树中的其他节点；gossip 时为所有接收方
+ */
+type relayMsg struct {
+	Strategy string
+	Inner    []byte
+	Targets  []string
+	Hops     int
+	SentAt   int64 // 原始发送方发出的时间(UnixNano)，用于统计传播延迟
+}
+
+/** 委员会内广播的分发策略
+ * 树形广播中每个节点恰好收到一次；gossip 是随机的，节点较多时有很小的概率漏掉个别节点，
+ * 依赖 pbft 本身对少数节点失联的容忍。所有节点的策略和 fanout 必须一致
+ */
+type broadcaster struct {
+	strategy string
+	fanout   int // 树形广播的分叉数，或 gossip 每次转发的节点数，0表示按策略取默认值
+	self     string
+
+	seen *lru.Cache // 已处理的消息摘要
+
+	randLock sync.Mutex
+	rand     *rand.Rand
+}
+
+func newBroadcaster(strategy string, fanout int, self string) (*broadcaster, error) {
+	switch strategy {
+	case "":
+		strategy = BroadcastDirect
+	case BroadcastDirect, BroadcastTree, BroadcastGossip:
+	default:
+		return nil, fmt.Errorf("unknown broadcast strategy %s", strategy)
+	}
+	if fanout < 0 {
+		fanout = 0
+	}
+	seen, _ := lru.New(relaySeenCacheSize)
+	return &broadcaster{
+		strategy: strategy,
+		fanout:   fanout,
+		self:     self,
+		seen:     seen,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+/* 记录消息摘要，返回该消息是否第一次出现 */
+func (b *broadcaster) markSeen(inner []byte) bool {
+	digest := string(crypto.Keccak256(inner))
+	ok, _ := b.seen.ContainsOrAdd(digest, struct{}{})
+	return !ok
+}
+
+/** 把 envelope 发给 addrs 中的所有节点
+ * 发给自己的消息直接发送；其他节点不超过 fanout 个时也直接发送，否则按策略转发，
+ * 转发的原始消息以所有接收方为接收方签名
+ */
+func (b *broadcaster) broadcast(caller string, addrs []string, envelope *core.Msg) {
+	others := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr == b.self {
+			sendMsg(caller, addr, envelope)
+			continue
+		}
+		others = append(others, addr)
+	}
+	if b.strategy == BroadcastDirect || len(others) <= b.fanoutFor(b.strategy, len(others)) {
+		for _, addr := range others {
+			sendMsg(caller, addr, envelope)
+		}
+		return
+	}
+
+	relay := &relayMsg{
+		Strategy: b.strategy,
+		Inner:    packEnvelope(envelope, strings.Join(others, ","))[4:],
+		SentAt:   time.Now().UnixNano(),
+	}
+	// 转发回来的副本不再处理
+	b.markSeen(relay.Inner)
+	b.forward(caller, relay, others)
+}
+
+/* 按策略把消息转发给 targets 中的节点，targets 中不包括本节点 */
+func (b *broadcaster) forward(caller string, relay *relayMsg, targets []string) {
+	if len(targets) == 0 {
+		return
+	}
+	switch relay.Strategy {
+	case BroadcastTree:
+		// 把 targets 分成 fanout 棵子树，每棵子树的第一个节点负责转发给其余节点
+		fanout := b.fanoutFor(BroadcastTree, len(targets))
+		for i := 0; i < fanout; i++ {
+			start := i * len(targets) / fanout
+			end := (i + 1) * len(targets) / fanout
+			if start == end {
+				continue
+			}
+			if !b.sendRelay(caller, targets[start], relay, targets[start+1:end]) {
+				// 子树的根不可达时，由本节点把消息转发给子树中的其余节点
+				b.forward(caller, relay, targets[start+1:end])
+			}
+		}
+	case BroadcastGossip:
+		for _, addr := range b.pick(targets, b.fanoutFor(BroadcastGossip, len(targets))) {
+			b.sendRelay(caller, addr, relay, targets)
+		}
+	}
+}
+
+/* n 为接收方的数量 */
+func (b *broadcaster) fanoutFor(strategy string, n int) int {
+	if b.fanout > 0 {
+		return b.fanout
+	}
+	if strategy == BroadcastGossip {
+		return int(math.Ceil(math.Log(float64(n)))) + gossipFanoutExtra
+	}
+	return defaultTreeFanout
+}
+
+/* 把转发消息发给 addr，由它继续转发给 targets，返回是否发送成功 */
+func (b *broadcaster) sendRelay(caller string, addr string, relay *relayMsg, targets []string) bool {
+	child := *relay
+	child.Targets = targets
+	child.Hops++
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&child); err != nil {
+		log.Error("gobEncodeErr", "err", err, "data", child)
+	}
+	return sendMsg(caller, addr, packMsg(Relay, buf.Bytes()))
+}
+
+/* 从 addrs 中随机选取除本节点外的至多 n 个节点 */
+func (b *broadcaster) pick(addrs []string, n int) []string {
+	candidates := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr != b.self {
+			candidates = append(candidates, addr)
+		}
+	}
+	b.randLock.Lock()
+	b.rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	b.randLock.Unlock()
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+/** 处理收到的转发消息
+ * 重复的消息直接丢弃；第一次收到且原始消息验证通过时，先继续转发，再返回原始消息交给本节点处理
+ */
+func (b *broadcaster) handleRelay(dataBytes []byte) *core.Msg {
+	var relay relayMsg
+	if err := gob.NewDecoder(bytes.NewReader(dataBytes)).Decode(&relay); err != nil {
+		log.Warn("decodeDataErr", "err", err, "msgType", Relay)
+		return nil
+	}
+	if !b.markSeen(relay.Inner) {
+		return nil
+	}
+	inner := unpackMsg(relay.Inner)
+	if msgVerifier != nil {
+		if err := msgVerifier.verify(inner); err != nil {
+			log.Warn(envelopeErrMsg(inner, err))
+			return nil
+		}
+	}
+	go b.forward("relay", &relay, relay.Targets)
+
+	log.Debug(fmt.Sprintf("Relay Received: %s strategy: %s hops: %d delay: %v", inner.MsgType, relay.Strategy, relay.Hops, time.Since(time.Unix(0, relay.SentAt))))
+	return inner
+}
@@ -0,0 +1,112 @@
+package messageHub
+
+import (
+	"go-w3chain/log"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* 启动 n 个只处理 Relay 消息的节点，记录每个节点收到的原始消息 */
+func startRelayTestNodes(t *testing.T, n int, strategy string, fanout int) ([]string, func() map[string]int) {
+	var lock sync.Mutex
+	delivered := make(map[string]int)
+	addrs := make([]string, n)
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		addr := ln.Addr().String()
+		addrs[i] = addr
+		b, _ := newBroadcaster(strategy, fanout, addr)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func(conn net.Conn) {
+					defer conn.Close()
+					for {
+						packed, err := readFrame(conn)
+						if err != nil {
+							return
+						}
+						msg := unpackMsg(packed)
+						if msg.MsgType == Relay {
+							msg = b.handleRelay(msg.Data)
+						}
+						if msg != nil {
+							lock.Lock()
+							delivered[addr]++
+							lock.Unlock()
+						}
+					}
+				}(conn)
+			}
+		}()
+	}
+	return addrs, func() map[string]int {
+		lock.Lock()
+		defer lock.Unlock()
+		copied := make(map[string]int)
+		for addr, count := range delivered {
+			copied[addr] = count
+		}
+		return copied
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testBroadcast.log"))
+	for _, c := range []struct {
+		strategy string
+		fanout   int
+	}{
+		{BroadcastDirect, 0},
+		{BroadcastTree, 3},
+		{BroadcastGossip, 0},
+	} {
+		// gossip 取足够大的 fanout 使结果确定，重点检验去重
+		n := 20
+		fanout := c.fanout
+		if c.strategy == BroadcastGossip {
+			fanout = n - 1
+		}
+		addrs, delivered := startRelayTestNodes(t, n, c.strategy, fanout)
+		root, _ := newBroadcaster(c.strategy, fanout, "")
+		for i := 0; i < 3; i++ {
+			root.broadcast("test", addrs, packMsg(ReportAny, []byte{byte(i)}))
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got := delivered()
+			done := len(got) == n
+			for _, addr := range addrs {
+				if got[addr] > 3 {
+					t.Fatalf("%s: %s delivered %d times", c.strategy, addr, got[addr])
+				}
+				done = done && got[addr] == 3
+			}
+			if done {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: not all nodes received the broadcast: %v", c.strategy, got)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		// 等待可能迟到的重复消息
+		time.Sleep(100 * time.Millisecond)
+		for addr, count := range delivered() {
+			if count != 3 {
+				t.Fatalf("%s: %s delivered %d times", c.strategy, addr, count)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package messageHub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"go-w3chain/core"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	codecSnappy = "snappy"
+	// 长度前缀的最高位表示消息体经过压缩，其余31位为消息体在网络上的长度
+	compressedFlag uint32 = 1 << 31
+	// 消息体小于该大小时不压缩
+	defaultCompressThreshold = 1024
+	// 建立连接后等待对端回复压缩协商的最长时间，超时则该连接不压缩
+	helloTimeout = 5 * time.Second
+	// 一帧消息体在网络上和解压后的最大字节数，长度前缀来自对端，分配内存前必须检查
+	maxFrameSize = 128 << 20
+)
+
+var errFrameTooLarge = errors.New("frame exceeds the maximum size")
+
+var (
+	compressCodec     string // 本进程使用的压缩算法，为空时不压缩
+	compressThreshold = defaultCompressThreshold
+)
+
+/** 压缩协商，在连接建立后由主动方以rpc形式发送
+ * 请求中为主动方支持的算法，回复中为被动方选中的算法，为空表示不压缩。
+ * 不认识 Hello 的旧节点会回复错误，此时同样不压缩
+ */
+type codecHello struct {
+	Codecs []string
+}
+
+func negotiateCodec(offered []string) string {
+	if compressCodec == "" {
+		return ""
+	}
+	for _, codec := range offered {
+		if codec == compressCodec {
+			return codec
+		}
+	}
+	return ""
+}
+
+/* 按连接协商的算法压缩一帧，frame 包含长度前缀；不压缩或压缩后没有变小时原样返回 */
+func compressFrame(frame []byte, codec string) []byte {
+	if codec != codecSnappy || len(frame)-4 < compressThreshold {
+		return frame
+	}
+	body := snappy.Encode(nil, frame[4:])
+	if len(body) >= len(frame)-4 {
+		return frame
+	}
+	compressed := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(compressed, uint32(len(body))|compressedFlag)
+	copy(compressed[4:], body)
+	return compressed
+}
+
+/** 读取一帧，返回解压后的消息体，以及解压前后整帧（含长度前缀）的字节数
+ * 消息体超过 maxFrameSize 时返回 errFrameTooLarge，调用方关闭连接
+ */
+func readWireFrame(conn net.Conn) ([]byte, core.TransferSize, error) {
+	var size core.TransferSize
+	lengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, lengthBuf); err != nil {
+		return nil, size, err
+	}
+	length := binary.BigEndian.Uint32(lengthBuf)
+	compressed := length&compressedFlag != 0
+	length &^= compressedFlag
+	if length > maxFrameSize {
+		return nil, size, fmt.Errorf("%w: %d bytes", errFrameTooLarge, length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, size, err
+	}
+	size.Wire = 4 + len(body)
+	if compressed {
+		decodedLen, err := snappy.DecodedLen(body)
+		if err != nil {
+			return nil, size, fmt.Errorf("decompress frame: %v", err)
+		}
+		if decodedLen > maxFrameSize {
+			return nil, size, fmt.Errorf("%w: %d bytes after decompression", errFrameTooLarge, decodedLen)
+		}
+		decoded, err := snappy.Decode(nil, body)
+		if err != nil {
+			return nil, size, fmt.Errorf("decompress frame: %v", err)
+		}
+		body = decoded
+	}
+	size.Raw = 4 + len(body)
+	return body, size, nil
+}
+
+/** 在新建立的连接上协商压缩算法，返回双方都使用的算法
+ * 调用时连接的读协程已经启动，回复经由 pending 交给本函数
+ */
+func (pm *PeerManager) hello(conn net.Conn, addr string) string {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&codecHello{Codecs: []string{compressCodec}}); err != nil {
+		return ""
+	}
+	reqID := atomic.AddUint64(&pm.nextReqID, 1)
+	call := &pendingCall{
+		conn:    conn,
+		replyCh: make(chan *rpcReply, 1),
+		errCh:   make(chan error, 1),
+	}
+	pm.pendingLock.Lock()
+	pm.pending[reqID] = call
+	pm.pendingLock.Unlock()
+	defer func() {
+		pm.pendingLock.Lock()
+		delete(pm.pending, reqID)
+		pm.pendingLock.Unlock()
+	}()
+
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := conn.Write(packEnvelope(&core.Msg{MsgType: Hello, Data: buf.Bytes(), ReqID: reqID}, addr)); err != nil {
+		return ""
+	}
+	timer := time.NewTimer(helloTimeout)
+	defer timer.Stop()
+	select {
+	case reply := <-call.replyCh:
+		var chosen codecHello
+		if reply.msg.Err != "" || gob.NewDecoder(bytes.NewReader(reply.msg.Data)).Decode(&chosen) != nil || len(chosen.Codecs) == 0 {
+			return ""
+		}
+		return negotiateCodec(chosen.Codecs)
+	case <-call.errCh:
+	case <-timer.C:
+	case <-pm.stopCh:
+	}
+	return ""
+}
+
+/* 被动方处理压缩协商：用明文回复选中的算法，之后该连接上的回复按选中的算法压缩 */
+func handleHello(msg *core.Msg, w *connWriter) {
+	var offered codecHello
+	var codec string
+	if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(&offered); err == nil {
+		codec = negotiateCodec(offered.Codecs)
+	}
+	var buf bytes.Buffer
+	chosen := &codecHello{}
+	if codec != "" {
+		chosen.Codecs = []string{codec}
+	}
+	gob.NewEncoder(&buf).Encode(chosen)
+	if err := w.write(packEnvelope(&core.Msg{MsgType: Hello, Data: buf.Bytes(), ReqID: msg.ReqID}, msg.From)); err != nil {
+		return
+	}
+	w.lock.Lock()
+	w.codec = codec
+	w.lock.Unlock()
+}
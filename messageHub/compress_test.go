@@ -0,0 +1,111 @@
+package messageHub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompressFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	frames := [][]byte{
+		packEnvelope(packMsg(ReportAny, bytes.Repeat([]byte("lesschain"), 1000)), ""), // 可压缩
+		packEnvelope(packMsg(ReportAny, []byte("short")), ""),                         // 低于阈值
+	}
+	go func() {
+		for _, frame := range frames {
+			client.Write(compressFrame(frame, codecSnappy))
+		}
+	}()
+	for i, frame := range frames {
+		packed, size, err := readWireFrame(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(packed, frame[4:]) || size.Raw != len(frame) {
+			t.Fatalf("frame %d changed after decompression", i)
+		}
+		if compressed := size.Wire < size.Raw; compressed != (i == 0) {
+			t.Fatalf("frame %d: raw %d wire %d", i, size.Raw, size.Wire)
+		}
+	}
+}
+
+/* 长度前缀或解压后的大小超过上限的帧在分配内存前被拒绝 */
+func TestReadWireFrameLimit(t *testing.T) {
+	oversized := make([]byte, 4)
+	binary.BigEndian.PutUint32(oversized, maxFrameSize+1)
+	// 声明的解压后大小超过上限的 snappy 数据
+	bomb := make([]byte, binary.MaxVarintLen64)
+	bomb = bomb[:binary.PutUvarint(bomb, maxFrameSize+1)]
+	compressed := make([]byte, 4, 4+len(bomb))
+	binary.BigEndian.PutUint32(compressed, uint32(len(bomb))|compressedFlag)
+	compressed = append(compressed, bomb...)
+	for i, frame := range [][]byte{oversized, compressed} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(frame)
+			client.Close()
+		}()
+		if _, _, err := readWireFrame(server); !errors.Is(err, errFrameTooLarge) {
+			t.Fatalf("frame %d: unexpected err %v", i, err)
+		}
+		server.Close()
+	}
+}
+
+/* 双方都开启压缩时，协商后的大回复被压缩；对端不支持协商时退回明文 */
+func TestCompressNegotiation(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testCompress.log"))
+	defer func() { compressCodec = "" }()
+	compressCodec = codecSnappy
+
+	bigReply := func(msg *core.Msg, w *connWriter) {
+		w.write(packEnvelope(&core.Msg{MsgType: msg.MsgType, ReqID: msg.ReqID, Data: bytes.Repeat([]byte{1, 2, 3, 4}, 4096)}, msg.From))
+	}
+	compressing := startRPCTestPeer(t, func(msg *core.Msg, conn net.Conn, w *connWriter) {
+		if msg.MsgType == Hello {
+			handleHello(msg, w)
+			return
+		}
+		bigReply(msg, w)
+	})
+	defer compressing.Close()
+	legacy := startRPCTestPeer(t, func(msg *core.Msg, conn net.Conn, w *connWriter) {
+		if msg.MsgType == Hello {
+			handleRPCRequest(msg, w) // 旧节点不认识 Hello，回复错误
+			return
+		}
+		bigReply(msg, w)
+	})
+	defer legacy.Close()
+
+	pm := NewPeerManager()
+	defer pm.Close()
+	for _, c := range []struct {
+		addr       string
+		compressed bool
+	}{{compressing.Addr().String(), true}, {legacy.Addr().String(), false}} {
+		reply, size, err := pm.Call(c.addr, GetSyncData, bytes.Repeat([]byte{0}, 4096), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Data) != 4*4096 || (size.Wire < size.Raw) != c.compressed {
+			t.Fatalf("unexpected reply size, raw %d wire %d, want compressed %v", size.Raw, size.Wire, c.compressed)
+		}
+		info := pm.PeerInfos()
+		for _, p := range info {
+			if p.Addr == c.addr && (p.WireBytesSent < p.RawBytesSent) != c.compressed {
+				t.Fatalf("unexpected sent bytes: %+v", p)
+			}
+		}
+	}
+}
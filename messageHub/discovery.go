@@ -0,0 +1,152 @@
+package messageHub
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"go-w3chain/cfg"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"go-w3chain/node"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// 向 booter 注册或查询地址表失败后的重试间隔
+const discoveryRetryInterval = 500 * time.Millisecond
+
+var (
+	applyTopologyOnce sync.Once
+	// 注册时各节点和客户端上报的账户，信封验证时预先绑定
+	topologyAccounts map[string]common.Address
+)
+
+/** 注册和查询地址表的请求不经过信封验证（此时还没有地址表，无法确定对端的账户），
+ * 注册信息由注册者的账户单独签名，booter 返回的地址表由 booter 的账户签名，见 node.VerifyTopology
+ */
+func isRegistryRPC(msg *core.Msg) bool {
+	return msg.ReqID != 0 && (msg.MsgType == Register || msg.MsgType == GetTopology)
+}
+
+/** 向 booter 注册本进程的监听地址，并等待所有节点和客户端注册完成，用 booter 返回的地址表替换 cfg 中的地址表
+ * 需在 Init 之前调用。account 为节点或客户端自己的账户，用于对注册信息签名，
+ * 注册前先写入公开身份表；booter 只接受身份表中该角色应使用的账户的注册，没有时绑定第一个注册的账户。
+ * 返回的地址表需由身份表中 booter 的账户签名，或带有集群口令的 hmac，否则返回错误。
+ * booter 尚未启动或地址表未完成时每隔一段时间重试，超过 timeout 返回错误
+ */
+func (hub *GoodMessageHub) Discover(booterAddr string, req *core.RegisterPeer, account *node.W3Account, timeout time.Duration) error {
+	slot := node.ClientSlot(req.ClientID)
+	if req.Role == core.RegisterRoleNode {
+		slot = node.NodeSlot(req.ShardID, req.NodeID)
+	}
+	if err := node.PublishAccount(slot, *account.GetAccountAddress()); err != nil {
+		log.Warn("publish account fail", "slot", slot, "err", err)
+	}
+	req.Account = *account.GetAccountAddress()
+	req.Sig = account.SignHash(req.SigHash())
+	if hub.clusterToken != "" {
+		req.Mac = node.ClusterMAC(hub.clusterToken, req.SigHash())
+	}
+	if hub.useTLS {
+		// 注册使用临时的tls连接，Init 时重新创建
+		transport, err := newTLSTransport(account)
+		if err != nil {
+			return err
+		}
+		peers.SetTLS(transport)
+		defer peers.SetTLS(nil)
+	}
+	defer peers.CloseExcept(nil)
+
+	deadline := time.Now().Add(timeout)
+	retry := func(step string, err error) error {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s to booter %s: %w", step, booterAddr, err)
+		}
+		log.Debug("discovery retry", "step", step, "err", err)
+		time.Sleep(discoveryRetryInterval)
+		return nil
+	}
+
+	for {
+		var ack bool
+		_, err := rpcCall(booterAddr, Register, req, &ack)
+		if err == nil {
+			break
+		}
+		// booter 拒绝注册时重试没有意义
+		if errors.Is(err, core.ErrRPCRemote) {
+			return fmt.Errorf("register to booter %s: %w", booterAddr, err)
+		}
+		if err := retry("register", err); err != nil {
+			return err
+		}
+	}
+	log.Info("registered to booter", "booter", booterAddr, "role", req.Role, "addr", req.Addr)
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	var topology core.Topology
+	for {
+		_, err := rpcCall(booterAddr, GetTopology, nonce, &topology)
+		if err == nil {
+			break
+		}
+		if err := retry("get topology", err); err != nil {
+			return err
+		}
+	}
+	// 伪造的地址表重试也没有意义
+	if err := node.VerifyTopology(&topology, nonce, hub.clusterToken); err != nil {
+		return fmt.Errorf("topology from booter %s: %w", booterAddr, err)
+	}
+	applyTopologyOnce.Do(func() { applyTopology(&topology) })
+	return nil
+}
+
+/** 向 booter 查询已部署的合约地址，已部署时按收到 BooterSendContract 处理，需在 Init 之后调用
+ * booter 只在部署后发送一次合约地址，重启的节点和客户端据此恢复信标链视图、补齐合约日志并继续运行。
+ * booter 还未部署合约或无法连接时返回 false，之后按正常流程等待 booter 发送
+ */
+func (hub *GoodMessageHub) FetchContract() bool {
+	var data core.BooterSendContract
+	if _, err := rpcCall(cfg.BooterAddr, GetContract, struct{}{}, &data); err != nil {
+		return false
+	}
+	log.Info("Msg Received: BooterSendContract", "data", data, "via", GetContract)
+	deliverContract(&data)
+	return true
+}
+
+/** 用 booter 下发的地址表替换 cfg 中的地址表
+ * ComNodeTable 与 NodeTable 仍指向同一张表，与 cfg 中初始化时一致
+ */
+func applyTopology(t *core.Topology) {
+	cfg.NodeTable = t.NodeTable
+	cfg.ComNodeTable = cfg.NodeTable
+	cfg.ClientTable = t.ClientTable
+	// 地址相同时不写，booter 与节点在同一进程时 booter 仍在读取该地址
+	if t.GethAddr != "" && t.GethAddr != cfg.GethIPAddr {
+		cfg.GethIPAddr = t.GethAddr
+	}
+	topologyAccounts = t.Accounts
+	if msgVerifier != nil {
+		msgVerifier.setKnownAddrs(knownAddrsFromCfg())
+		pinTopologyAccounts()
+	}
+	nodeNum := 0
+	for _, list := range t.NodeTable {
+		nodeNum += len(list)
+	}
+	log.Info("apply topology from booter", "shards", len(t.NodeTable), "nodes", nodeNum, "clients", len(t.ClientTable), "geth", cfg.GethIPAddr)
+}
+
+func pinTopologyAccounts() {
+	for addr, account := range topologyAccounts {
+		msgVerifier.pin(addr, account)
+	}
+}
@@ -0,0 +1,187 @@
+package messageHub
+
+import (
+	"context"
+	"errors"
+	"go-w3chain/beaconChain"
+	"go-w3chain/cfg"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"go-w3chain/node"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiscover(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testDiscover.log"))
+	defer func(nodeTable map[uint32]map[uint32]string, clientTable map[uint32]string, booterAddr string, booter *node.Booter) {
+		cfg.NodeTable, cfg.ComNodeTable, cfg.ClientTable, cfg.BooterAddr = nodeTable, nodeTable, clientTable, booterAddr
+		booter_ref = booter
+		topologyAccounts = nil
+		applyTopologyOnce = sync.Once{}
+	}(cfg.NodeTable, cfg.ClientTable, cfg.BooterAddr, booter_ref)
+	applyTopologyOnce = sync.Once{}
+	defer func(dir string, table map[string]string) { node.IdentityDir, cfg.AccountTable = dir, table }(node.IdentityDir, cfg.AccountTable)
+	node.IdentityDir = t.TempDir()
+	accounts := []*node.W3Account{node.NewW3Account(""), node.NewW3Account("")}
+	clientAccount := node.NewW3Account("")
+	// S0N1 的账户由地址配置文件给出，其余角色的账户由注册者写入身份表
+	cfg.AccountTable = map[string]string{"S0N1": accounts[1].GetAccountAddress().Hex()}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg.BooterAddr = ln.Addr().String()
+	// booter 的账户写入身份表，节点和客户端据此验证地址表的签名
+	booterAccount := node.NewW3Account("")
+	if err := node.PublishAccount(node.BooterSlot, *booterAccount.GetAccountAddress()); err != nil {
+		t.Fatal(err)
+	}
+	booter_ref = node.NewBooter()
+	booter_ref.EnableRegistry(1, 2, 1, booterAccount, "")
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn)
+		}
+	}()
+
+	// 未签名的注册被拒绝
+	client := &core.RegisterPeer{Role: core.RegisterRoleClient, Addr: "10.0.0.9:19000"}
+	if err := booter_ref.HandleRegister(client); err == nil {
+		t.Fatalf("unsigned client registration accepted")
+	}
+	// 身份表中没有账户的客户端先注册，其账户与该角色绑定，之后可以重复注册同一地址
+	client.Account = *clientAccount.GetAccountAddress()
+	client.Sig = clientAccount.SignHash(client.SigHash())
+	if err := booter_ref.HandleRegister(client); err != nil {
+		t.Fatalf("first client registration rejected: %v", err)
+	}
+	if err := booter_ref.HandleRegister(client); err != nil {
+		t.Fatal(err)
+	}
+	// 其他账户不能再注册为该客户端
+	intruder := node.NewW3Account("")
+	stolen := &core.RegisterPeer{Role: core.RegisterRoleClient, Addr: "10.0.0.9:19002", Account: *intruder.GetAccountAddress()}
+	stolen.Sig = intruder.SignHash(stolen.SigHash())
+	if err := booter_ref.HandleRegister(stolen); err == nil {
+		t.Fatalf("client slot taken over by another account")
+	}
+	nodeAddrs := []string{"10.0.0.1:20000", "10.0.0.2:20000"}
+
+	// 用其他账户冒充 S0N1、使用已注册地址的节点注册被拒绝，且不重试
+	forged := &core.RegisterPeer{Role: core.RegisterRoleNode, NodeID: 1, Addr: nodeAddrs[1]}
+	if err := NewMessageHub().Discover(cfg.BooterAddr, forged, node.NewW3Account(""), 10*time.Second); !errors.Is(err, core.ErrRPCRemote) {
+		t.Fatalf("node registration with another account not rejected, err: %v", err)
+	}
+	taken := &core.RegisterPeer{Role: core.RegisterRoleNode, NodeID: 1, Addr: client.Addr}
+	if err := NewMessageHub().Discover(cfg.BooterAddr, taken, accounts[1], 10*time.Second); !errors.Is(err, core.ErrRPCRemote) {
+		t.Fatalf("duplicated address not rejected, err: %v", err)
+	}
+
+	// 两个节点并发注册，都等到地址表完成
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(accounts))
+	for i := range accounts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := &core.RegisterPeer{Role: core.RegisterRoleNode, NodeID: uint32(i), Addr: nodeAddrs[i]}
+			errCh <- NewMessageHub().Discover(cfg.BooterAddr, req, accounts[i], 10*time.Second)
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			t.Fatalf("node discover fail: %v", err)
+		}
+	}
+	if err := NewMessageHub().Discover(cfg.BooterAddr, client, clientAccount, 10*time.Second); err != nil {
+		t.Fatalf("client discover fail: %v", err)
+	}
+
+	if cfg.NodeTable[0][0] != nodeAddrs[0] || cfg.NodeTable[0][1] != nodeAddrs[1] || len(cfg.NodeTable[0]) != 2 {
+		t.Fatalf("unexpected node table: %v", cfg.NodeTable)
+	}
+	if cfg.ComNodeTable[0][1] != nodeAddrs[1] || cfg.ClientTable[0] != client.Addr || len(cfg.ClientTable) != 1 {
+		t.Fatalf("unexpected tables: %v %v", cfg.ComNodeTable, cfg.ClientTable)
+	}
+	if topologyAccounts[nodeAddrs[1]] != *accounts[1].GetAccountAddress() || topologyAccounts[client.Addr] != *clientAccount.GetAccountAddress() {
+		t.Fatalf("accounts not in topology: %v", topologyAccounts)
+	}
+
+	// 地址表完成后不能再改变注册
+	moved := &core.RegisterPeer{Role: core.RegisterRoleClient, Addr: "10.0.0.9:19001", Account: client.Account}
+	moved.Sig = clientAccount.SignHash(moved.SigHash())
+	if err := booter_ref.HandleRegister(moved); err == nil {
+		t.Fatalf("registration changed after topology complete")
+	}
+
+	// 身份表中 booter 的账户不是签名者时，地址表被拒绝
+	if err := node.PublishAccount(node.BooterSlot, *intruder.GetAccountAddress()); err != nil {
+		t.Fatal(err)
+	}
+	applyTopologyOnce = sync.Once{}
+	if err := NewMessageHub().Discover(cfg.BooterAddr, client, clientAccount, 10*time.Second); err == nil {
+		t.Fatalf("topology signed by an unexpected booter account accepted")
+	}
+}
+
+func TestFetchContract(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testFetchContract.log"))
+	defer func(booterAddr string, booter *node.Booter, tbChain *beaconChain.BeaconChain, delivered bool) {
+		cfg.BooterAddr, booter_ref, tbChain_ref, contractDelivered = booterAddr, booter, tbChain, delivered
+	}(cfg.BooterAddr, booter_ref, tbChain_ref, contractDelivered)
+	defer peers.CloseExcept(nil)
+	contractDelivered = false
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg.BooterAddr = ln.Addr().String()
+	tbChain := beaconChain.NewTBChain(context.Background(), &core.BeaconChainConfig{BlockInterval: 100}, 1)
+	defer tbChain.Close()
+	tbChain_ref = tbChain
+	booter_ref = node.NewBooter()
+	booter_ref.SetTBchain(tbChain)
+	hub := &recordHub{}
+	booter_ref.SetMessageHub(hub)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn)
+		}
+	}()
+
+	// 部署前查询不到合约地址，按正常流程等待 booter 发送
+	if NewMessageHub().FetchContract() || contractDelivered {
+		t.Fatalf("contract fetched before deployment")
+	}
+	booter_ref.HandleShardSendGenesis(&core.ShardSendGenesis{Gtb: &core.TimeBeacon{ShardID: 0}})
+	if len(hub.msgs) != 1 {
+		t.Fatalf("contract not sent after all genesis received: %v", hub.msgs)
+	}
+
+	// 部署后 booter 继续提供合约地址，重启的节点再次发送的创世信标被忽略
+	if !NewMessageHub().FetchContract() || !contractDelivered {
+		t.Fatalf("contract not fetched after deployment")
+	}
+	booter_ref.HandleShardSendGenesis(&core.ShardSendGenesis{Gtb: &core.TimeBeacon{ShardID: 0}})
+	if len(hub.msgs) != 1 {
+		t.Fatalf("contract sent again: %v", hub.msgs)
+	}
+}
@@ -0,0 +1,261 @@
+package messageHub
+
+import (
+	"errors"
+	"fmt"
+	"go-w3chain/cfg"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"go-w3chain/node"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// 接收方为每个发送方保留的序号窗口大小
+	// 同一发送方的多个协程并发写同一连接时，序号可能略微乱序到达，窗口内的乱序消息仍被接受
+	replayWindow uint64 = 1024
+)
+
+var (
+	errUnknownSender     = errors.New("sender address not in node table")
+	errSignerMismatch    = errors.New("signer does not match the expected account of sender address")
+	errNoExpectedAccount = errors.New("no account known for sender address")
+	errWrongRecipient    = errors.New("envelope is addressed to another process")
+	errWrongReplier      = errors.New("reply is not sent from the dialed address")
+	errInvalidSig        = errors.New("invalid envelope signature")
+	errStaleEpoch        = errors.New("envelope epoch is older than the current epoch of sender")
+	errReplayedMsg       = errors.New("envelope nonce already seen")
+	errNonceOutOfRange   = errors.New("envelope nonce is too old")
+)
+
+/** 对发出的消息信封签名
+ * 每个进程一个 envelopeSigner，纪元取创建时的时间，序号从1开始递增
+ */
+type envelopeSigner struct {
+	account *node.W3Account
+	from    string
+	epoch   uint64
+	nonce   uint64
+}
+
+func newEnvelopeSigner(account *node.W3Account, from string) *envelopeSigner {
+	return &envelopeSigner{
+		account: account,
+		from:    from,
+		epoch:   uint64(time.Now().UnixNano()),
+	}
+}
+
+/** 初始化本进程的签名者，并把签名使用的账户写入公开身份表，返回该账户
+ * account 为 nil 时（客户端和booter未通过 SetAccount 设置账户）使用保存在该角色数据目录中的账户，重启后不变。
+ * verify 为 true 时同时初始化验证者，否则不验证收到的消息信封
+ */
+func initEnvelope(account *node.W3Account, slot string, addr string, verify bool) *node.W3Account {
+	if account == nil {
+		var err error
+		if account, err = node.LoadW3Account(node.SlotDir(slot)); err != nil {
+			log.Warn("load envelope account fail, use a temporary account", "slot", slot, "err", err)
+			account = node.NewW3Account("")
+		}
+	}
+	log.Info("envelope account", "slot", slot, "address", account.GetAccountAddress().Hex(), "verify", verify)
+	if err := node.PublishAccount(slot, *account.GetAccountAddress()); err != nil {
+		log.Warn("publish account fail", "slot", slot, "err", err)
+	}
+	msgSigner = newEnvelopeSigner(account, addr)
+	msgVerifier = nil
+	if verify {
+		msgVerifier = newEnvelopeVerifier(knownAddrsFromCfg(), addr)
+	}
+	return account
+}
+
+/* 本进程的监听地址和在身份表中的角色名 */
+func localIdentity() (addr string, slot string) {
+	switch {
+	case node_ref != nil:
+		return node_ref.GetAddr(), node.NodeSlot(node_ref.NodeInfo.ShardID, node_ref.NodeInfo.NodeID)
+	case client_ref != nil:
+		return client_ref.GetAddr(), node.ClientSlot(uint32(client_ref.GetCid()))
+	case booter_ref != nil:
+		return booter_ref.GetAddr(), node.BooterSlot
+	}
+	return "", ""
+}
+
+func (signer *envelopeSigner) seal(msg *core.Msg) {
+	msg.From = signer.from
+	msg.Signer = *signer.account.GetAccountAddress()
+	msg.Epoch = signer.epoch
+	msg.Nonce = atomic.AddUint64(&signer.nonce, 1)
+	msg.Sig = signer.account.SignHash(msg.SigHash())
+}
+
+/* 接收方记录的某一发送方的状态 */
+type peerEnvelopeState struct {
+	signer   common.Address
+	epoch    uint64
+	maxNonce uint64
+	seen     map[uint64]struct{} // (maxNonce-replayWindow, maxNonce] 内已收到的序号
+}
+
+/** 验证收到的消息信封
+ * 发送方的网络地址必须在地址表中，且消息必须由身份表中该地址对应角色的账户签名，
+ * 身份表中没有该角色的账户时拒绝。接收方必须是本进程，发给其他进程的消息不能被转投过来。
+ * 同一发送方的纪元不能变小，同一纪元内的序号不能重复
+ */
+type envelopeVerifier struct {
+	lock       sync.Mutex
+	self       string // 本进程的网络地址
+	knownAddrs map[string]struct{}
+	peers      map[string]*peerEnvelopeState
+	// 网络地址应使用的账户
+	lookup func(addr string) (common.Address, bool)
+}
+
+func newEnvelopeVerifier(knownAddrs map[string]struct{}, self string) *envelopeVerifier {
+	return &envelopeVerifier{
+		self:       self,
+		knownAddrs: knownAddrs,
+		peers:      make(map[string]*peerEnvelopeState),
+		lookup:     expectedAccount,
+	}
+}
+
+/** 网络地址 addr 应使用的账户
+ * 先按地址表找到对应的角色，使用身份表中该角色的账户；
+ * 其次使用 booter 下发的地址表中的账户，booter 注册时已按身份表检查过
+ */
+func expectedAccount(addr string) (common.Address, bool) {
+	if slot, ok := node.SlotOfAddr(addr); ok {
+		if account, ok := node.ExpectedAccount(slot); ok {
+			return account, true
+		}
+	}
+	account, ok := topologyAccounts[addr]
+	return account, ok
+}
+
+/* 地址表中所有节点、客户端以及booter的地址 */
+func knownAddrsFromCfg() map[string]struct{} {
+	addrs := make(map[string]struct{})
+	for _, list := range cfg.NodeTable {
+		for _, addr := range list {
+			addrs[addr] = struct{}{}
+		}
+	}
+	for _, addr := range cfg.ClientTable {
+		addrs[addr] = struct{}{}
+	}
+	addrs[cfg.BooterAddr] = struct{}{}
+	return addrs
+}
+
+/* 通过 booter 获取地址表后更新已知地址 */
+func (verifier *envelopeVerifier) setKnownAddrs(knownAddrs map[string]struct{}) {
+	verifier.lock.Lock()
+	defer verifier.lock.Unlock()
+	verifier.knownAddrs = knownAddrs
+}
+
+/* 预先绑定网络地址与账户，不必等到第一条消息 */
+func (verifier *envelopeVerifier) pin(addr string, signer common.Address) {
+	verifier.lock.Lock()
+	defer verifier.lock.Unlock()
+	if _, ok := verifier.peers[addr]; ok {
+		return
+	}
+	verifier.peers[addr] = &peerEnvelopeState{
+		signer: signer,
+		seen:   make(map[uint64]struct{}),
+	}
+}
+
+func (verifier *envelopeVerifier) verify(msg *core.Msg) error {
+	verifier.lock.Lock()
+	_, known := verifier.knownAddrs[msg.From]
+	state := verifier.peers[msg.From]
+	verifier.lock.Unlock()
+	if !known {
+		return errUnknownSender
+	}
+	if len(msg.Sig) == 0 || !node.VerifySignature(msg.SigHash(), msg.Sig, msg.Signer) {
+		return errInvalidSig
+	}
+	if !addressedTo(msg.To, verifier.self) {
+		return errWrongRecipient
+	}
+	if state == nil || state.signer != msg.Signer {
+		// 还未绑定账户，或发送方更换了账户（如数据目录被清空后重新生成了私钥），从身份表读取
+		expected, ok := verifier.lookup(msg.From)
+		if !ok {
+			return errNoExpectedAccount
+		}
+		if expected != msg.Signer {
+			return errSignerMismatch
+		}
+		verifier.lock.Lock()
+		if state = verifier.peers[msg.From]; state == nil || state.signer != expected {
+			verifier.peers[msg.From] = &peerEnvelopeState{
+				signer: expected,
+				epoch:  msg.Epoch,
+				seen:   make(map[uint64]struct{}),
+			}
+		}
+		verifier.lock.Unlock()
+	}
+
+	verifier.lock.Lock()
+	defer verifier.lock.Unlock()
+
+	state = verifier.peers[msg.From]
+	if msg.Epoch < state.epoch {
+		return errStaleEpoch
+	}
+	if msg.Epoch > state.epoch {
+		// 发送方进入新的纪元，序号重新计数
+		state.epoch = msg.Epoch
+		state.maxNonce = 0
+		state.seen = make(map[uint64]struct{})
+	}
+
+	if state.maxNonce >= replayWindow && msg.Nonce <= state.maxNonce-replayWindow {
+		return errNonceOutOfRange
+	}
+	if _, ok := state.seen[msg.Nonce]; ok {
+		return errReplayedMsg
+	}
+	state.seen[msg.Nonce] = struct{}{}
+	if msg.Nonce > state.maxNonce {
+		state.maxNonce = msg.Nonce
+		// 窗口右移，清理移出窗口的序号
+		if state.maxNonce > replayWindow && uint64(len(state.seen)) > 2*replayWindow {
+			for nonce := range state.seen {
+				if nonce <= state.maxNonce-replayWindow {
+					delete(state.seen, nonce)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+/* 信封的接收方 to 中是否包括地址 self */
+func addressedTo(to string, self string) bool {
+	for _, addr := range strings.Split(to, ",") {
+		if addr == self {
+			return true
+		}
+	}
+	return false
+}
+
+func envelopeErrMsg(msg *core.Msg, err error) string {
+	return fmt.Sprintf("reject msg. msgType: %s from: %s to: %s signer: %x epoch: %d nonce: %d err: %v",
+		msg.MsgType, msg.From, msg.To, msg.Signer, msg.Epoch, msg.Nonce, err)
+}
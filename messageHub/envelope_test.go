@@ -0,0 +1,116 @@
+package messageHub
+
+import (
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"go-w3chain/node"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestEnvelopeVerify(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testEnvelope.log"))
+	const addr, self = "127.0.0.1:20000", "127.0.0.1:20002"
+	signer := newEnvelopeSigner(node.NewW3Account(""), addr)
+	verifier := newEnvelopeVerifier(map[string]struct{}{addr: {}, "127.0.0.1:20001": {}, self: {}}, self)
+	expected := map[string]common.Address{addr: *signer.account.GetAccountAddress()}
+	verifier.lookup = func(a string) (common.Address, bool) {
+		account, ok := expected[a]
+		return account, ok
+	}
+
+	// 冒充者先于真正的节点发来消息，也不能占用该地址
+	forger := newEnvelopeSigner(node.NewW3Account(""), addr)
+	forged := &core.Msg{MsgType: SendReconfigResults2ComNodes, To: self}
+	forger.seal(forged)
+	if err := verifier.verify(forged); err != errSignerMismatch {
+		t.Fatalf("forged sender not rejected, err: %v", err)
+	}
+
+	newMsg := func() *core.Msg {
+		msg := &core.Msg{MsgType: CPrePrepare, Data: []byte("block"), To: self}
+		signer.seal(msg)
+		return msg
+	}
+
+	first, second := newMsg(), newMsg()
+	// 窗口内乱序到达的消息可以接受
+	if err := verifier.verify(second); err != nil {
+		t.Fatalf("verify msg fail: %v", err)
+	}
+	if err := verifier.verify(first); err != nil {
+		t.Fatalf("verify out of order msg fail: %v", err)
+	}
+	if err := verifier.verify(first); err != errReplayedMsg {
+		t.Fatalf("replayed msg not rejected, err: %v", err)
+	}
+
+	tampered := newMsg()
+	tampered.Data = []byte("forged block")
+	if err := verifier.verify(tampered); err != errInvalidSig {
+		t.Fatalf("tampered msg not rejected, err: %v", err)
+	}
+
+	// 发给其他进程的消息被转投过来，改写接收方会使签名失效
+	misdirected := &core.Msg{MsgType: ClientSendTx, To: "127.0.0.1:20001"}
+	signer.seal(misdirected)
+	if err := verifier.verify(misdirected); err != errWrongRecipient {
+		t.Fatalf("msg for another process not rejected, err: %v", err)
+	}
+	misdirected.To = self
+	if err := verifier.verify(misdirected); err != errInvalidSig {
+		t.Fatalf("msg with rewritten recipient not rejected, err: %v", err)
+	}
+	// 转发的广播消息的接收方包括本进程
+	relayed := &core.Msg{MsgType: CPrepare, To: "127.0.0.1:20001," + self}
+	signer.seal(relayed)
+	if err := verifier.verify(relayed); err != nil {
+		t.Fatalf("relayed msg rejected, err: %v", err)
+	}
+
+	// 其他账户冒充已绑定的地址
+	forged = &core.Msg{MsgType: SendReconfigResults2ComNodes, To: self}
+	forger.seal(forged)
+	if err := verifier.verify(forged); err != errSignerMismatch {
+		t.Fatalf("forged sender not rejected, err: %v", err)
+	}
+
+	// 身份表中没有账户的地址
+	orphan := &core.Msg{MsgType: ClientSendTx, To: self}
+	newEnvelopeSigner(node.NewW3Account(""), "127.0.0.1:20001").seal(orphan)
+	if err := verifier.verify(orphan); err != errNoExpectedAccount {
+		t.Fatalf("sender without expected account not rejected, err: %v", err)
+	}
+
+	unknown := &core.Msg{MsgType: ClientSendTx, To: self}
+	newEnvelopeSigner(node.NewW3Account(""), "10.0.0.1:1").seal(unknown)
+	if err := verifier.verify(unknown); err != errUnknownSender {
+		t.Fatalf("unknown sender not rejected, err: %v", err)
+	}
+
+	for i := uint64(0); i < replayWindow; i++ {
+		newMsg()
+	}
+	if err := verifier.verify(newMsg()); err != nil {
+		t.Fatalf("verify msg fail: %v", err)
+	}
+	if err := verifier.verify(tampered); err != errInvalidSig {
+		t.Fatalf("tampered msg not rejected, err: %v", err)
+	}
+	stale := &core.Msg{MsgType: CPrePrepare, From: addr, To: self, Signer: first.Signer, Epoch: first.Epoch, Nonce: 3}
+	stale.Sig = signer.account.SignHash(stale.SigHash())
+	if err := verifier.verify(stale); err != errNonceOutOfRange {
+		t.Fatalf("msg out of window not rejected, err: %v", err)
+	}
+
+	// 身份表中的账户更换后（节点重新生成了私钥），接受新账户的消息
+	expected[addr] = *forger.account.GetAccountAddress()
+	if err := verifier.verify(forged); err != nil {
+		t.Fatalf("msg of new account rejected, err: %v", err)
+	}
+	if err := verifier.verify(newMsg()); err != errSignerMismatch {
+		t.Fatalf("msg of old account not rejected, err: %v", err)
+	}
+}
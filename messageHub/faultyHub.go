@@ -0,0 +1,464 @@
+package messageHub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"go-w3chain/beaconChain"
+	"go-w3chain/cfg"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"hash/fnv"
+	"math"
+	"math/big"
+	"math/rand"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 信标链在故障规则中的名字
+	tbChainLabel = "TB"
+	// 每条链路上等待投递的消息上限，超过时发送方阻塞
+	faultLinkQueueSize = 4096
+)
+
+/* rpc类消息被丢弃时，等待对应的超时时间后以 core.ErrRPCTimeout 回复，回复的第一个参数为对应类型的nil */
+var faultRPCs = map[uint32]struct {
+	name  string
+	reply interface{}
+}{
+	core.MsgTypeComGetHeightFromShard: {ComGetHeight, (*big.Int)(nil)},
+	core.MsgTypeComGetStateFromShard:  {ComGetState, (*core.ShardSendState)(nil)},
+	core.MsgTypeGetPoolTx:             {GetPoolTx, (*core.PoolTx)(nil)},
+	core.MsgTypeGetSyncData:           {GetSyncData, (*core.SyncData)(nil)},
+	core.MsgTypeGetTB:                 {GetTB, (*beaconChain.ConfirmedTB)(nil)},
+}
+
+/* 故障注入的统计，多目标消息按目标计数 */
+type FaultStats struct {
+	Delayed     uint64
+	Dropped     uint64 // 包括被分区丢弃的消息
+	Partitioned uint64
+	Duplicated  uint64
+	Reordered   uint64
+}
+
+/** FaultyMessageHub 包装任意 core.MessageHub（GoodMessageHub 或 LocalMessageHub），
+ * 按 cfg.FaultConfig 中的规则对本实例发出的消息注入延迟、限速、丢弃、重复、乱序和分区。
+ * 没有匹配规则的消息直接交给内部的消息中心。
+ * 有延迟的消息在链路协程中按顺序投递，同一链路上未被乱序的消息保持发送顺序；
+ * 带 callback 的请求在调用方协程中等待后再发送。
+ * 一次 Send 发往多个目标（如pbft广播）时逐个目标判断链路规则和分区，
+ * 内部消息中心只向没有故障的目标直接发送，被丢弃的目标不发送，有延迟的目标在各自的链路上单独投递
+ */
+type FaultyMessageHub struct {
+	inner  FaultableHub
+	self   string
+	config *cfg.FaultConfig
+	start  time.Time
+
+	randLock sync.Mutex
+	rand     *rand.Rand
+
+	linkLock sync.Mutex
+	links    map[string]*faultLink
+
+	stats  FaultStats
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+/* 一条有故障规则的链路，相当于一个有限带宽、有传播延迟的队列 */
+type faultLink struct {
+	queue     chan *delayedMsg
+	busyUntil time.Time // 按带宽计算，链路发送完已排队消息的时间
+	lastDue   time.Time // 链路上最后一条有序消息的投递时间
+}
+
+type delayedMsg struct {
+	msgType uint32
+	id      uint32
+	msg     interface{}
+	only    map[string]bool // 多目标消息只投递给其中的目标，为nil时投递给全部目标
+	due     time.Time
+}
+
+/** 可被 FaultyMessageHub 包装的消息中心
+ * SendToTargets 与 Send 相同，但多目标消息只发往 keep 返回 true 的地址；
+ * Targets 返回 Send 发送消息时使用的所有地址，为nil时消息不经过网络
+ */
+type FaultableHub interface {
+	core.MessageHub
+	SendToTargets(msgType uint32, id uint32, msg interface{}, keep func(addr string) bool)
+	Targets(msgType uint32, id uint32, msg interface{}) []string
+}
+
+/* selfAddr 为本实例在地址表中的地址 */
+func NewFaultyMessageHub(inner FaultableHub, selfAddr string, config *cfg.FaultConfig) *FaultyMessageHub {
+	self := addrLabel(selfAddr)
+	// 各实例使用不同但确定的随机序列
+	h := fnv.New64a()
+	h.Write([]byte(self))
+	hub := &FaultyMessageHub{
+		inner:  inner,
+		self:   self,
+		config: config,
+		start:  time.Now(),
+		rand:   rand.New(rand.NewSource(config.Seed ^ int64(h.Sum64()))),
+		links:  make(map[string]*faultLink),
+		stopCh: make(chan struct{}),
+	}
+	log.Info("FaultyMessageHub", "self", self, "seed", config.Seed, "links", len(config.Links), "partitions", len(config.Partitions))
+	return hub
+}
+
+/* 地址在故障规则中的名字 */
+func addrLabel(addr string) string {
+	for shardID, list := range cfg.NodeTable {
+		for nodeID, nodeAddr := range list {
+			if nodeAddr == addr {
+				return fmt.Sprintf("S%dN%d", shardID, nodeID)
+			}
+		}
+	}
+	for cid, clientAddr := range cfg.ClientTable {
+		if clientAddr == addr {
+			return fmt.Sprintf("C%d", cid)
+		}
+	}
+	if addr == cfg.BooterAddr {
+		return "B"
+	}
+	return addr
+}
+
+func addrLabels(addrs ...string) []string {
+	labels := make([]string, len(addrs))
+	for i, addr := range addrs {
+		labels[i] = addrLabel(addr)
+	}
+	return labels
+}
+
+/** 消息的所有目标在故障规则中的名字，网络消息的目标取自内部消息中心的路由；返回nil表示不注入故障
+ * 与信标链交互的消息以信标链为目标；信标链推送给本实例的区块和撤回的信标以本实例为目标，incoming 为 true，
+ * 按信标链到本实例的链路规则注入故障
+ */
+func (hub *FaultyMessageHub) targets(msgType uint32, id uint32, msg interface{}) (labels []string, incoming bool) {
+	switch msgType {
+	case core.MsgTypeComSendNewAddrs, core.MsgTypeComAddTb2TBChain, core.MsgTypeComAddTbRoot2TBChain,
+		core.MsgTypeGetLatestBlockHashFromEthChain, core.MsgTypeGetBlockHashFromEthChain:
+		return []string{tbChainLabel}, false
+	case core.MsgTypeTBChainPushTB2Client, core.MsgTypeTBChainPushTB2Coms, core.MsgTypeTBChainRetractTB2Client:
+		return []string{hub.self}, true
+	}
+	addrs := hub.inner.Targets(msgType, id, msg)
+	if addrs == nil {
+		return nil, false
+	}
+	return addrLabels(addrs...), false
+}
+
+/* spec 为组名或成员名（可含通配符），判断 label 是否属于 spec */
+func (hub *FaultyMessageHub) matchSpec(spec string, label string) bool {
+	members, ok := hub.config.Groups[spec]
+	if !ok {
+		members = []string{spec}
+	}
+	for _, member := range members {
+		if matched, _ := path.Match(member, label); matched {
+			return true
+		}
+	}
+	return false
+}
+
+/* 返回第一条匹配 from 到 to 的链路规则 */
+func (hub *FaultyMessageHub) linkRule(from string, to string) (int, *cfg.LinkFault) {
+	for i := range hub.config.Links {
+		rule := &hub.config.Links[i]
+		if hub.matchSpec(rule.From, from) && hub.matchSpec(rule.To, to) {
+			return i, rule
+		}
+	}
+	return -1, nil
+}
+
+/* 当前时间本实例与 target 被分区隔开时返回true */
+func (hub *FaultyMessageHub) partitioned(target string) bool {
+	elapsed := time.Since(hub.start).Seconds()
+	for _, partition := range hub.config.Partitions {
+		if elapsed < partition.StartSecs || (partition.EndSecs > 0 && elapsed >= partition.EndSecs) {
+			continue
+		}
+		selfGroup := -1
+		for i, group := range partition.Groups {
+			if hub.matchSpec(group, hub.self) {
+				selfGroup = i
+				break
+			}
+		}
+		if selfGroup < 0 {
+			continue
+		}
+		for i, group := range partition.Groups {
+			if i != selfGroup && hub.matchSpec(group, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (hub *FaultyMessageHub) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	hub.randLock.Lock()
+	defer hub.randLock.Unlock()
+	return hub.rand.Float64() < p
+}
+
+/* 按分布采样一次延迟 */
+func (hub *FaultyMessageHub) sampleLatency(dist cfg.LatencyDist) time.Duration {
+	hub.randLock.Lock()
+	defer hub.randLock.Unlock()
+	var ms float64
+	switch dist.Dist {
+	case "", "const":
+		ms = dist.MeanMs
+	case "uniform":
+		ms = dist.MeanMs - dist.StdMs + 2*dist.StdMs*hub.rand.Float64()
+	case "normal":
+		ms = dist.MeanMs + dist.StdMs*hub.rand.NormFloat64()
+	case "exp":
+		ms = dist.MeanMs * hub.rand.ExpFloat64()
+	default:
+		log.Error("unknown latency distribution", "dist", dist.Dist)
+	}
+	return time.Duration(math.Max(ms, 0) * float64(time.Millisecond))
+}
+
+/* 消息按 gob 编码后的大小，用于带宽限制 */
+func faultMsgSize(msg interface{}) int {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return 0
+	}
+	return buf.Len()
+}
+
+func (hub *FaultyMessageHub) Send(msgType uint32, id uint32, msg interface{}, callback func(...interface{})) {
+	targets, incoming := hub.targets(msgType, id, msg)
+	if targets == nil {
+		hub.inner.Send(msgType, id, msg, callback)
+		return
+	}
+	if callback != nil {
+		// 带 callback 的请求只有一个目标
+		hub.sendRequest(targets[0], msgType, id, msg, callback)
+		return
+	}
+
+	direct := make(map[string]bool)
+	directNum := 0
+	for _, target := range targets {
+		if target == hub.self && !incoming {
+			// 发给自己的消息不经过网络
+			direct[target] = true
+			directNum++
+			continue
+		}
+		// 信标链推送的消息按信标链到本实例的链路判断
+		from, peer := hub.self, target
+		if incoming {
+			from, peer = tbChainLabel, tbChainLabel
+		}
+		if hub.partitioned(peer) {
+			atomic.AddUint64(&hub.stats.Partitioned, 1)
+			hub.drop(msgType, target, nil, "partitioned")
+			continue
+		}
+		ruleIndex, rule := hub.linkRule(from, target)
+		if rule == nil {
+			direct[target] = true
+			directNum++
+			continue
+		}
+		if hub.chance(rule.DropRate) {
+			hub.drop(msgType, target, nil, "dropped")
+			continue
+		}
+		var only map[string]bool
+		if len(targets) > 1 {
+			only = map[string]bool{target: true}
+		}
+		key := fmt.Sprintf("%d:%s->%s", ruleIndex, from, target)
+		hub.enqueue(key, rule, &delayedMsg{msgType: msgType, id: id, msg: msg, only: only})
+		if hub.chance(rule.DupRate) {
+			atomic.AddUint64(&hub.stats.Duplicated, 1)
+			hub.enqueue(key, rule, &delayedMsg{msgType: msgType, id: id, msg: msg, only: only})
+		}
+	}
+	if directNum == len(targets) {
+		hub.inner.Send(msgType, id, msg, nil)
+	} else if directNum > 0 {
+		hub.sendTo(direct, msgType, id, msg)
+	}
+}
+
+/* 多目标消息只发给 only 中的目标 */
+func (hub *FaultyMessageHub) sendTo(only map[string]bool, msgType uint32, id uint32, msg interface{}) {
+	hub.inner.SendToTargets(msgType, id, msg, func(addr string) bool {
+		return only[addrLabel(addr)]
+	})
+}
+
+/* 带 callback 的请求在调用方协程中等待链路延迟；rpc请求被丢弃时按超时处理 */
+func (hub *FaultyMessageHub) sendRequest(target string, msgType uint32, id uint32, msg interface{}, callback func(...interface{})) {
+	_, isRPC := faultRPCs[msgType]
+	if hub.partitioned(target) {
+		if !isRPC {
+			// 查询信标链等非rpc请求没有超时机制，丢弃会使调用方一直阻塞，因此照常发送
+			hub.inner.Send(msgType, id, msg, callback)
+			return
+		}
+		atomic.AddUint64(&hub.stats.Partitioned, 1)
+		hub.drop(msgType, target, callback, "partitioned")
+		return
+	}
+	_, rule := hub.linkRule(hub.self, target)
+	if rule == nil {
+		hub.inner.Send(msgType, id, msg, callback)
+		return
+	}
+	if isRPC && hub.chance(rule.DropRate) {
+		hub.drop(msgType, target, callback, "dropped")
+		return
+	}
+	delay := hub.sampleLatency(rule.Latency)
+	if rule.BandwidthKBps > 0 {
+		delay += time.Duration(float64(faultMsgSize(msg)) / (rule.BandwidthKBps * 1024) * float64(time.Second))
+	}
+	if delay > 0 {
+		atomic.AddUint64(&hub.stats.Delayed, 1)
+		select {
+		case <-time.After(delay):
+		case <-hub.stopCh:
+		}
+	}
+	hub.inner.Send(msgType, id, msg, callback)
+}
+
+/* 丢弃消息；带 callback 的只能是rpc请求 */
+func (hub *FaultyMessageHub) drop(msgType uint32, target string, callback func(...interface{}), reason string) {
+	atomic.AddUint64(&hub.stats.Dropped, 1)
+	log.Debug("fault injection drop msg", "self", hub.self, "msgType", msgType, "target", target, "reason", reason)
+	if callback == nil {
+		return
+	}
+	rpc := faultRPCs[msgType]
+	select {
+	case <-time.After(rpcTimeouts[rpc.name]):
+	case <-hub.stopCh:
+	}
+	callback(rpc.reply, fmt.Errorf("%w: %s %s by fault injection", core.ErrRPCTimeout, rpc.name, reason))
+}
+
+/* 计算消息在链路上的投递时间并放入链路队列 */
+func (hub *FaultyMessageHub) enqueue(key string, rule *cfg.LinkFault, dm *delayedMsg) {
+	now := time.Now()
+	latency := hub.sampleLatency(rule.Latency)
+	reorder := hub.chance(rule.ReorderRate)
+
+	hub.linkLock.Lock()
+	link, ok := hub.links[key]
+	if !ok {
+		link = &faultLink{queue: make(chan *delayedMsg, faultLinkQueueSize)}
+		hub.links[key] = link
+		hub.wg.Add(1)
+		go hub.linkLoop(link)
+	}
+	sendStart := now
+	if rule.BandwidthKBps > 0 {
+		if link.busyUntil.After(sendStart) {
+			sendStart = link.busyUntil
+		}
+		link.busyUntil = sendStart.Add(time.Duration(float64(faultMsgSize(dm.msg)) / (rule.BandwidthKBps * 1024) * float64(time.Second)))
+		sendStart = link.busyUntil
+	}
+	dm.due = sendStart.Add(latency)
+	if !reorder {
+		if dm.due.Before(link.lastDue) {
+			dm.due = link.lastDue
+		}
+		link.lastDue = dm.due
+	}
+	hub.linkLock.Unlock()
+
+	if dm.due.After(now) {
+		atomic.AddUint64(&hub.stats.Delayed, 1)
+	}
+	if reorder {
+		// 被乱序的消息不进入链路队列，额外延迟后单独投递，使后发的消息先到达
+		atomic.AddUint64(&hub.stats.Reordered, 1)
+		dm.due = dm.due.Add(time.Duration(rule.ReorderDelayMs * float64(time.Millisecond)))
+		hub.wg.Add(1)
+		go func() {
+			defer hub.wg.Done()
+			hub.deliverAt(dm)
+		}()
+		return
+	}
+	select {
+	case link.queue <- dm:
+	case <-hub.stopCh:
+	}
+}
+
+func (hub *FaultyMessageHub) linkLoop(link *faultLink) {
+	defer hub.wg.Done()
+	for {
+		select {
+		case <-hub.stopCh:
+			return
+		case dm := <-link.queue:
+			hub.deliverAt(dm)
+		}
+	}
+}
+
+func (hub *FaultyMessageHub) deliverAt(dm *delayedMsg) {
+	if wait := time.Until(dm.due); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-hub.stopCh:
+			return
+		}
+	}
+	if dm.only != nil {
+		hub.sendTo(dm.only, dm.msgType, dm.id, dm.msg)
+		return
+	}
+	hub.inner.Send(dm.msgType, dm.id, dm.msg, nil)
+}
+
+func (hub *FaultyMessageHub) Stats() FaultStats {
+	return FaultStats{
+		Delayed:     atomic.LoadUint64(&hub.stats.Delayed),
+		Dropped:     atomic.LoadUint64(&hub.stats.Dropped),
+		Partitioned: atomic.LoadUint64(&hub.stats.Partitioned),
+		Duplicated:  atomic.LoadUint64(&hub.stats.Duplicated),
+		Reordered:   atomic.LoadUint64(&hub.stats.Reordered),
+	}
+}
+
+/* 停止投递，链路中尚未投递的消息被丢弃 */
+func (hub *FaultyMessageHub) Close() {
+	close(hub.stopCh)
+	hub.wg.Wait()
+	log.Info("FaultyMessageHub closed", "self", hub.self, "stats", fmt.Sprintf("%+v", hub.Stats()))
+}
@@ -0,0 +1,256 @@
+package messageHub
+
+import (
+	"errors"
+	"go-w3chain/cfg"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* 记录收到的消息的内部消息中心，按地址表中的所有地址路由 */
+type recordHub struct {
+	self     string
+	lock     sync.Mutex
+	msgs     []interface{}
+	targeted [][]string // 每次 SendToTargets 保留的目标
+}
+
+func (r *recordHub) Send(msgType uint32, id uint32, msg interface{}, callback func(...interface{})) {
+	r.lock.Lock()
+	r.msgs = append(r.msgs, msg)
+	r.lock.Unlock()
+	if callback != nil {
+		callback(msg, nil)
+	}
+}
+
+func (r *recordHub) SendToTargets(msgType uint32, id uint32, msg interface{}, keep func(addr string) bool) {
+	labels := make([]string, 0)
+	for _, addr := range cfg.ComNodeTable[id] {
+		if keep(addr) {
+			labels = append(labels, addrLabel(addr))
+		}
+	}
+	sort.Strings(labels)
+	r.lock.Lock()
+	r.targeted = append(r.targeted, labels)
+	r.lock.Unlock()
+}
+
+func (r *recordHub) Targets(msgType uint32, id uint32, msg interface{}) []string {
+	return routing{
+		self:          r.self,
+		shardNum:      len(cfg.NodeTable),
+		shardSize:     len(cfg.ComNodeTable[0]),
+		comAllNodeNum: len(cfg.NodeTable[0]),
+		clientNum:     len(cfg.ClientTable),
+	}.targets(msgType, id, msg)
+}
+
+func (r *recordHub) targetedSends() [][]string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([][]string{}, r.targeted...)
+}
+
+func (r *recordHub) received() []interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]interface{}{}, r.msgs...)
+}
+
+func TestFaultyMessageHub(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testFaultyHub.log"))
+	config := &cfg.FaultConfig{
+		Seed:   1,
+		Groups: map[string][]string{"shard0": {"S0N*"}, "shard1": {"S1N*"}},
+		Links: []cfg.LinkFault{
+			{From: "shard0", To: "S1N0", Latency: cfg.LatencyDist{Dist: "normal", MeanMs: 30, StdMs: 20}},
+			{From: "shard0", To: "S2N0", DropRate: 1},
+			{From: "shard0", To: "S3N0", DupRate: 1},
+		},
+		Partitions: []cfg.Partition{{Groups: []string{"shard0", "shard1"}, StartSecs: 0.3, EndSecs: 0.6}},
+	}
+	inner := &recordHub{self: cfg.NodeTable[0][1]}
+	hub := NewFaultyMessageHub(inner, inner.self, config)
+	defer hub.Close()
+
+	// 有延迟的链路上消息保持发送顺序
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		hub.Send(core.MsgTypeSendBlock2Shard, 1, i, nil)
+	}
+	if len(inner.received()) != 0 {
+		t.Fatalf("msgs delivered without latency")
+	}
+	time.Sleep(200 * time.Millisecond)
+	got := inner.received()
+	if len(got) != 20 {
+		t.Fatalf("delivered %d msgs, want 20", len(got))
+	}
+	for i, msg := range got {
+		if msg.(int) != i {
+			t.Fatalf("msgs out of order: %v", got)
+		}
+	}
+	if time.Since(start) < 30*time.Millisecond {
+		t.Fatalf("latency not applied")
+	}
+
+	// 丢弃、重复，以及没有规则的链路
+	hub.Send(core.MsgTypeSendBlock2Shard, 2, "dropped", nil)
+	hub.Send(core.MsgTypeSendBlock2Shard, 3, "dup", nil)
+	hub.Send(core.MsgTypeSendBlock2Shard, 4, "direct", nil)
+	time.Sleep(50 * time.Millisecond)
+	counts := make(map[interface{}]int)
+	for _, msg := range inner.received()[20:] {
+		counts[msg]++
+	}
+	if counts["dropped"] != 0 || counts["dup"] != 2 || counts["direct"] != 1 {
+		t.Fatalf("unexpected deliveries: %v", counts)
+	}
+
+	// 分区期间rpc请求超时，分区结束后恢复
+	rpcTimeouts[ComGetHeight] = 20 * time.Millisecond
+	defer func() { rpcTimeouts[ComGetHeight] = 10 * time.Second }()
+	time.Sleep(time.Until(hub.start.Add(300 * time.Millisecond)))
+	var rpcErr error
+	hub.Send(core.MsgTypeComGetHeightFromShard, 1, &core.ComGetHeight{}, func(res ...interface{}) {
+		rpcErr = core.RPCErr(res)
+	})
+	if !errors.Is(rpcErr, core.ErrRPCTimeout) {
+		t.Fatalf("rpc during partition should time out, err: %v", rpcErr)
+	}
+	time.Sleep(time.Until(hub.start.Add(600 * time.Millisecond)))
+	hub.Send(core.MsgTypeComGetHeightFromShard, 1, &core.ComGetHeight{}, func(res ...interface{}) {
+		rpcErr = core.RPCErr(res)
+	})
+	if rpcErr != nil {
+		t.Fatalf("rpc after partition fail: %v", rpcErr)
+	}
+	if stats := hub.Stats(); stats.Dropped != 2 || stats.Partitioned != 1 || stats.Duplicated != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+/* 相同的种子和配置下，随机决策相同 */
+func TestFaultyMessageHubSeed(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testFaultyHub.log"))
+	config := &cfg.FaultConfig{
+		Seed:  42,
+		Links: []cfg.LinkFault{{From: "*", To: "*", DropRate: 0.5}},
+	}
+	run := func() []interface{} {
+		inner := &recordHub{self: cfg.NodeTable[0][0]}
+		hub := NewFaultyMessageHub(inner, inner.self, config)
+		for i := 0; i < 50; i++ {
+			hub.Send(core.MsgTypeSendBlock2Shard, 1, i, nil)
+		}
+		time.Sleep(50 * time.Millisecond)
+		hub.Close()
+		return inner.received()
+	}
+	first, second := run(), run()
+	if len(first) == 0 || len(first) == 50 || len(first) != len(second) {
+		t.Fatalf("unexpected drops: %d %d", len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("drop decisions differ: %v %v", first, second)
+		}
+	}
+}
+
+/* 多目标消息逐个目标判断分区和链路规则，只发给没有故障的目标，有延迟的目标单独投递 */
+func TestFaultyMessageHubPerTarget(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testFaultyHub.log"))
+	config := &cfg.FaultConfig{
+		Seed: 1,
+		Links: []cfg.LinkFault{
+			{From: "S0N1", To: "S0N2", DropRate: 1},
+			{From: "S0N1", To: "S0N3", Latency: cfg.LatencyDist{MeanMs: 20}},
+		},
+		Partitions: []cfg.Partition{{Groups: []string{"S0N1", "S0N0"}}},
+	}
+	inner := &recordHub{self: cfg.NodeTable[0][1]}
+	hub := NewFaultyMessageHub(inner, inner.self, config)
+	defer hub.Close()
+
+	// pbft消息不发给自己
+	hub.Send(core.MsgTypePbftPrePrepare, 0, "pp", nil)
+	want := make([]string, 0)
+	for _, addr := range cfg.ComNodeTable[0] {
+		if label := addrLabel(addr); label != "S0N0" && label != "S0N1" && label != "S0N2" && label != "S0N3" {
+			want = append(want, label)
+		}
+	}
+	sort.Strings(want)
+	if sends := inner.targetedSends(); len(sends) != 1 || !reflect.DeepEqual(sends[0], want) {
+		t.Fatalf("unexpected direct targets: %v", sends)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if sends := inner.targetedSends(); len(sends) != 2 || !reflect.DeepEqual(sends[1], []string{"S0N3"}) {
+		t.Fatalf("delayed target not delivered alone: %v", sends)
+	}
+	if len(inner.received()) != 0 {
+		t.Fatalf("msg sent to all targets")
+	}
+	if stats := hub.Stats(); stats.Dropped != 2 || stats.Partitioned != 1 || stats.Delayed != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+/* 目标取自内部消息中心的路由；信标链推送的区块按信标链到本实例的链路注入故障 */
+func TestFaultyMessageHubRouting(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testFaultyHub.log"))
+	config := &cfg.FaultConfig{
+		Seed: 1,
+		Links: []cfg.LinkFault{
+			{From: "S0N1", To: "S0N2", DropRate: 1},
+			{From: "TB", To: "S0N1", DropRate: 1},
+			{From: "TB", To: "S0N2", Latency: cfg.LatencyDist{MeanMs: 20}},
+		},
+	}
+	rpcTimeouts[GetPoolTx] = 20 * time.Millisecond
+	defer func() { rpcTimeouts[GetPoolTx] = 30 * time.Second }()
+
+	inner := &recordHub{self: cfg.NodeTable[0][1]}
+	hub := NewFaultyMessageHub(inner, inner.self, config)
+	defer hub.Close()
+	// 地址在消息中的rpc请求同样按链路规则丢弃
+	var rpcErr error
+	hub.Send(core.MsgTypeGetPoolTx, 0, &core.GetPoolTx{ServerAddr: cfg.NodeTable[0][2]}, func(res ...interface{}) {
+		rpcErr = core.RPCErr(res)
+	})
+	if !errors.Is(rpcErr, core.ErrRPCTimeout) {
+		t.Fatalf("rpc on a dropping link should time out, err: %v", rpcErr)
+	}
+	hub.Send(core.MsgTypeTBChainPushTB2Client, 0, "block", nil)
+	hub.Send(core.MsgTypeTBChainPushTB2Coms, 0, "block", nil)
+	time.Sleep(20 * time.Millisecond)
+	if got := inner.received(); len(got) != 0 {
+		t.Fatalf("pushed blocks delivered on a dropping link: %v", got)
+	}
+
+	// 另一个实例与信标链之间的链路有延迟，推送的区块延迟后到达
+	other := &recordHub{self: cfg.NodeTable[0][2]}
+	otherHub := NewFaultyMessageHub(other, other.self, config)
+	defer otherHub.Close()
+	otherHub.Send(core.MsgTypeTBChainPushTB2Coms, 0, "block", nil)
+	if len(other.received()) != 0 {
+		t.Fatalf("pushed block delivered without latency")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if got := other.received(); len(got) != 1 || got[0] != "block" {
+		t.Fatalf("pushed block not delivered after latency: %v", got)
+	}
+	if stats := hub.Stats(); stats.Dropped != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,249 @@
+package messageHub
+
+import (
+	"fmt"
+	"go-w3chain/cfg"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/** 收到的消息按类别放入不同的队列，由各自的协程处理
+ * 共识类消息与交易类消息互不阻塞，处理交易时的等待不会拖慢共识。
+ * 接收队列需在配置中给出 InboundQueue 才开启，否则消息在读协程中依次处理
+ */
+type msgClass int
+
+const (
+	classControl   msgClass = iota // 在读协程中直接处理
+	classConsensus                 // pbft、多签和重组
+	classTx                        // 交易、回执和区块
+)
+
+// 需要入队的类别数，共识类和交易类
+const numQueuedClasses = 2
+
+const (
+	QueuePolicyBlock = "block" // 队列满时读协程等待，tcp 流控把压力传回发送方
+	QueuePolicyDrop  = "drop"  // 队列满时丢弃新收到的消息，mustDeliver 的消息仍然等待
+
+	// 每个发送方第一次丢弃和之后每丢弃这么多条消息时记录一次警告
+	dropWarnInterval = 1000
+
+	defaultConsensusQueueSize = 1024
+	defaultTxQueueSize        = 4096
+)
+
+func (c msgClass) String() string {
+	switch c {
+	case classConsensus:
+		return "consensus"
+	case classTx:
+		return "tx"
+	default:
+		return "control"
+	}
+}
+
+func classOf(msgType string) msgClass {
+	switch msgType {
+	case CPrePrepare, CPrepare, CCommit, CReply, CRequestOldrequest, CSendOldrequest,
+		LeaderInitMultiSign, MultiSignReply, NodeSendInfo,
+		LeaderInitReconfig, SendReconfigResult2ComLeader, SendReconfigResults2AllComLeaders, SendReconfigResults2ComNodes:
+		return classConsensus
+	case ClientSendTx, ClientSetInjectDone, ComSendTxReceipt, ComSendBlock:
+		return classTx
+	default:
+		return classControl
+	}
+}
+
+/** 丢失后协议无法恢复的消息，队列满时即使策略为 drop 也等待空位
+ * 区块和注入完成消息频率很低；回执丢失后客户端会一直等待这些交易，因此也不丢弃
+ */
+func mustDeliver(msgType string) bool {
+	switch msgType {
+	case ClientSetInjectDone, ComSendBlock, ComSendTxReceipt:
+		return true
+	default:
+		return false
+	}
+}
+
+/* 某一类队列的容量和满时的策略 */
+type queueSetting struct {
+	size   int
+	policy string
+}
+
+var (
+	// 为 false 时不使用接收队列
+	inboundEnabled bool
+	// 两类默认都等待，交易不会因队列满而丢失；交易类可配置为 drop，交易过多时同一连接上的共识消息仍能被读取
+	inboundSettings = [numQueuedClasses]queueSetting{
+		{defaultConsensusQueueSize, QueuePolicyBlock},
+		{defaultTxQueueSize, QueuePolicyBlock},
+	}
+
+	inboundStatsLock sync.Mutex
+	inboundStats     = make(map[string]*peerInboundStats) // 发送方地址 -> 统计
+)
+
+/* 开启接收队列并按配置设置各类队列，字段为空时保留默认值 */
+func setInboundQueue(config *cfg.InboundQueueConfig) error {
+	settings := inboundSettings
+	apply := func(c msgClass, size int, policy string) error {
+		s := &settings[c-classConsensus]
+		if size > 0 {
+			s.size = size
+		}
+		switch policy {
+		case "":
+		case QueuePolicyBlock, QueuePolicyDrop:
+			s.policy = policy
+		default:
+			return fmt.Errorf("unknown %s queue policy %s", c, policy)
+		}
+		return nil
+	}
+	if err := apply(classConsensus, config.ConsensusSize, config.ConsensusPolicy); err != nil {
+		return err
+	}
+	if err := apply(classTx, config.TxSize, config.TxPolicy); err != nil {
+		return err
+	}
+	inboundSettings = settings
+	inboundEnabled = true
+	return nil
+}
+
+/* 某一发送方某一类消息的计数，同一发送方的多条连接共用 */
+type classStats struct {
+	depth    int64 // 已入队尚未处理完的消息数
+	maxDepth int64
+	enqueued uint64
+	dropped  uint64
+	blocked  uint64 // 入队时队列已满、读协程需要等待的次数
+}
+
+type peerInboundStats struct {
+	classes [numQueuedClasses]classStats
+}
+
+func getInboundStats(from string) *peerInboundStats {
+	inboundStatsLock.Lock()
+	defer inboundStatsLock.Unlock()
+	stats, ok := inboundStats[from]
+	if !ok {
+		stats = &peerInboundStats{}
+		inboundStats[from] = stats
+	}
+	return stats
+}
+
+/* 某一发送方某一类消息队列的状态，通过管理接口的 /status 查看 */
+type InboundInfo struct {
+	From     string
+	Class    string
+	Depth    int64
+	MaxDepth int64
+	Enqueued uint64
+	Dropped  uint64
+	Blocked  uint64
+}
+
+/* 所有发送方各类队列的状态，按地址和类别排序 */
+func InboundInfos() []InboundInfo {
+	inboundStatsLock.Lock()
+	defer inboundStatsLock.Unlock()
+	infos := make([]InboundInfo, 0, len(inboundStats)*numQueuedClasses)
+	for from, stats := range inboundStats {
+		for i := range stats.classes {
+			s := &stats.classes[i]
+			infos = append(infos, InboundInfo{
+				From:     from,
+				Class:    (classConsensus + msgClass(i)).String(),
+				Depth:    atomic.LoadInt64(&s.depth),
+				MaxDepth: atomic.LoadInt64(&s.maxDepth),
+				Enqueued: atomic.LoadUint64(&s.enqueued),
+				Dropped:  atomic.LoadUint64(&s.dropped),
+				Blocked:  atomic.LoadUint64(&s.blocked),
+			})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].From != infos[j].From {
+			return infos[i].From < infos[j].From
+		}
+		return infos[i].Class < infos[j].Class
+	})
+	return infos
+}
+
+/** 一条被动连接的接收队列，每类消息一个有界队列和一个处理协程
+ * 同一类消息按收到的顺序处理
+ */
+type inboundQueue struct {
+	queues   [numQueuedClasses]chan *core.Msg
+	settings [numQueuedClasses]queueSetting
+	wg       sync.WaitGroup
+	handle   func(*core.Msg)
+}
+
+func newInboundQueue(handle func(*core.Msg)) *inboundQueue {
+	q := &inboundQueue{settings: inboundSettings, handle: handle}
+	for i := range q.queues {
+		q.queues[i] = make(chan *core.Msg, q.settings[i].size)
+		q.wg.Add(1)
+		go q.work(q.queues[i])
+	}
+	return q
+}
+
+func (q *inboundQueue) work(queue chan *core.Msg) {
+	defer q.wg.Done()
+	for msg := range queue {
+		q.handle(msg)
+		stats := &getInboundStats(msg.From).classes[classOf(msg.MsgType)-classConsensus]
+		atomic.AddInt64(&stats.depth, -1)
+	}
+}
+
+/* 把消息放入对应的队列，队列满时按策略等待或丢弃 */
+func (q *inboundQueue) push(msg *core.Msg) {
+	i := classOf(msg.MsgType) - classConsensus
+	stats := &getInboundStats(msg.From).classes[i]
+	queue := q.queues[i]
+
+	depth := atomic.AddInt64(&stats.depth, 1)
+	select {
+	case queue <- msg:
+	default:
+		if q.settings[i].policy == QueuePolicyDrop && !mustDeliver(msg.MsgType) {
+			atomic.AddInt64(&stats.depth, -1)
+			if dropped := atomic.AddUint64(&stats.dropped, 1); dropped%dropWarnInterval == 1 {
+				log.Warn("inbound queue full, drop msg", "from", msg.From, "msgType", msg.MsgType, "dropped", dropped)
+			}
+			return
+		}
+		atomic.AddUint64(&stats.blocked, 1)
+		queue <- msg
+	}
+	atomic.AddUint64(&stats.enqueued, 1)
+	for {
+		max := atomic.LoadInt64(&stats.maxDepth)
+		if depth <= max || atomic.CompareAndSwapInt64(&stats.maxDepth, max, depth) {
+			break
+		}
+	}
+}
+
+/* 连接关闭后处理完已入队的消息 */
+func (q *inboundQueue) close() {
+	for _, queue := range q.queues {
+		close(queue)
+	}
+	q.wg.Wait()
+}
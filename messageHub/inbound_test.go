@@ -0,0 +1,101 @@
+package messageHub
+
+import (
+	"go-w3chain/cfg"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInboundQueue(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testInbound.log"))
+	defer func(enabled bool, settings [numQueuedClasses]queueSetting) {
+		inboundEnabled, inboundSettings = enabled, settings
+	}(inboundEnabled, inboundSettings)
+	// 未给出配置时不开启，开启后交易队列默认等待
+	if inboundEnabled {
+		t.Fatal("inbound queues enabled without config")
+	}
+	if err := setInboundQueue(&cfg.InboundQueueConfig{TxSize: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if !inboundEnabled || inboundSettings[classTx-classConsensus].policy != QueuePolicyBlock {
+		t.Fatalf("unexpected default tx policy: %+v", inboundSettings)
+	}
+	if err := setInboundQueue(&cfg.InboundQueueConfig{TxSize: 2, TxPolicy: QueuePolicyDrop}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setInboundQueue(&cfg.InboundQueueConfig{TxPolicy: "unknown"}); err == nil {
+		t.Fatalf("unknown policy accepted")
+	}
+
+	// 交易处理被阻塞时，共识消息仍被处理
+	release := make(chan struct{})
+	consensusDone := make(chan *core.Msg, 10)
+	q := newInboundQueue(func(msg *core.Msg) {
+		if classOf(msg.MsgType) == classTx {
+			<-release
+			return
+		}
+		consensusDone <- msg
+	})
+	from := "inbound-test-peer-" + time.Now().String()
+	q.push(&core.Msg{MsgType: ClientSendTx, From: from})
+	for len(q.queues[classTx-classConsensus]) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		q.push(&core.Msg{MsgType: ClientSendTx, From: from})
+	}
+	q.push(&core.Msg{MsgType: CPrepare, From: from})
+	select {
+	case <-consensusDone:
+	case <-time.After(time.Second):
+		t.Fatalf("consensus msg stalled behind tx")
+	}
+
+	// 1条正在处理，2条在队列中，其余被丢弃
+	var tx, consensus InboundInfo
+	for _, info := range InboundInfos() {
+		if info.From != from {
+			continue
+		}
+		switch info.Class {
+		case "tx":
+			tx = info
+		case "consensus":
+			consensus = info
+		}
+	}
+	if tx.Enqueued != 3 || tx.Dropped != 2 || tx.Depth != 3 || tx.MaxDepth != 3 {
+		t.Fatalf("unexpected tx queue stats: %+v", tx)
+	}
+	if consensus.Enqueued != 1 || consensus.Dropped != 0 {
+		t.Fatalf("unexpected consensus queue stats: %+v", consensus)
+	}
+
+	// 区块不会被丢弃，等待队列出现空位
+	blockPushed := make(chan struct{})
+	go func() {
+		q.push(&core.Msg{MsgType: ComSendBlock, From: from})
+		close(blockPushed)
+	}()
+	select {
+	case <-blockPushed:
+		t.Fatalf("block pushed into a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-blockPushed
+	q.close()
+	for _, info := range InboundInfos() {
+		if info.From == from && info.Depth != 0 {
+			t.Fatalf("queue not drained: %+v", info)
+		}
+		if info.From == from && info.Class == "tx" && (info.Dropped != 2 || info.Blocked != 1 || info.Enqueued != 4) {
+			t.Fatalf("block msg dropped: %+v", info)
+		}
+	}
+}
@@ -0,0 +1,772 @@
+package messageHub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"go-w3chain/beaconChain"
+	"go-w3chain/cfg"
+	"go-w3chain/client"
+	"go-w3chain/committee"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"go-w3chain/node"
+	"go-w3chain/pbft"
+	"go-w3chain/result"
+	"go-w3chain/shard"
+	"math/big"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+const (
+	// 信标链在进程内网络中的逻辑地址，用于区分信标链推送消息的链路
+	localTBChainAddr = "tbchain"
+)
+
+/** LocalNetwork 是进程内的消息网络
+ * 多个 node.Node、client.Client、node.Booter 共享同一个 LocalNetwork 和同一条信标链，
+ * 消息按照 cfg 中的地址表找到目标实例，通过 channel 投递，不建立任何 TCP 连接。
+ * 地址表中的地址只作为实例的标识，不需要真正可用。
+ */
+type LocalNetwork struct {
+	lock  sync.RWMutex
+	peers map[string]*LocalMessageHub // 地址 -> 该地址上实例的消息中心
+	links map[string]*localLink       // "from->to" -> 两实例间的有序链路
+
+	tbChain *beaconChain.BeaconChain
+
+	shardNum      int
+	shardSize     int
+	comAllNodeNum int
+	clientNum     int
+
+	faults *cfg.FaultConfig // 不为nil时各实例的消息中心被 FaultyMessageHub 包装
+	faulty []*FaultyMessageHub
+
+	closed bool
+	wg     sync.WaitGroup
+}
+
+/** LocalMessageHub 是某一实例（节点、客户端或booter）在进程内网络中的消息中心
+ * 实现了 core.MessageHub 接口，发送消息时以本实例地址作为链路起点
+ */
+type LocalMessageHub struct {
+	addr    string
+	network *LocalNetwork
+
+	node      *node.Node
+	shard     *shard.Shard
+	committee *committee.Committee
+	pbftNode  *pbft.PbftConsensusNode
+	client    *client.Client
+	booter    *node.Booter
+
+	// 实例的各模块使用的消息中心，信标链推送的消息也经过它投递
+	sender core.MessageHub
+	// SendToTargets 使用的副本中不为nil，被过滤的目标不发送
+	keep targetFilter
+}
+
+// 两个实例之间的有序链路，相当于 GoodMessageHub 中的一条 tcp 长连接
+// 消息按发送顺序在链路自己的协程中被处理，队列不设上限，发送方不会被阻塞
+type localLink struct {
+	lock   sync.Mutex
+	queue  []func()
+	notify chan struct{}
+	stopCh chan struct{}
+}
+
+func NewLocalNetwork(tbChain *beaconChain.BeaconChain, shardNum, shardSize, comAllNodeNum, clientNum int) *LocalNetwork {
+	network := &LocalNetwork{
+		peers:         make(map[string]*LocalMessageHub),
+		links:         make(map[string]*localLink),
+		tbChain:       tbChain,
+		shardNum:      shardNum,
+		shardSize:     shardSize,
+		comAllNodeNum: comAllNodeNum,
+		clientNum:     clientNum,
+	}
+	// 信标链推送区块时通过 network 发送
+	tbChain.SetMessageHub(network)
+	log.Info("NewLocalNetwork", "shardNum", shardNum, "shardSize", shardSize, "comAllNodeNum", comAllNodeNum, "clientNum", clientNum)
+	return network
+}
+
+/* 按配置对之后加入的实例发出的消息注入网络故障，需在加入实例之前调用 */
+func (network *LocalNetwork) InjectFaults(config *cfg.FaultConfig) {
+	network.faults = config
+}
+
+/* 将节点加入进程内网络，并为节点及其分片、委员会、pbft模块设置消息中心 */
+func (network *LocalNetwork) AddNode(n *node.Node) (*LocalMessageHub, error) {
+	hub := &LocalMessageHub{
+		addr:      n.GetAddr(),
+		network:   network,
+		node:      n,
+		shard:     n.GetShard().(*shard.Shard),
+		committee: n.GetCommittee().(*committee.Committee),
+		pbftNode:  n.GetPbftNode(),
+	}
+	if err := network.addPeer(hub); err != nil {
+		return nil, err
+	}
+	hub.committee.SetMessageHub(hub.sender)
+	hub.shard.SetMessageHub(hub.sender)
+	hub.pbftNode.SetMessageHub(hub.sender)
+	n.SetMessageHub(hub.sender)
+	return hub, nil
+}
+
+func (network *LocalNetwork) AddClient(c *client.Client) (*LocalMessageHub, error) {
+	hub := &LocalMessageHub{
+		addr:    c.GetAddr(),
+		network: network,
+		client:  c,
+	}
+	if err := network.addPeer(hub); err != nil {
+		return nil, err
+	}
+	c.SetMessageHub(hub.sender)
+	return hub, nil
+}
+
+func (network *LocalNetwork) AddBooter(booter *node.Booter) (*LocalMessageHub, error) {
+	hub := &LocalMessageHub{
+		addr:    booter.GetAddr(),
+		network: network,
+		booter:  booter,
+	}
+	if err := network.addPeer(hub); err != nil {
+		return nil, err
+	}
+	booter.SetMessageHub(hub.sender)
+	return hub, nil
+}
+
+/** 地址已被其他实例占用时不加入，返回错误
+ * 加入时设置实例的各模块使用的消息中心，注入故障时为包装后的消息中心
+ */
+func (network *LocalNetwork) addPeer(hub *LocalMessageHub) error {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	if _, ok := network.peers[hub.addr]; ok {
+		log.Warn("local network peer address conflict", "addr", hub.addr)
+		return fmt.Errorf("local network peer address conflict: %s", hub.addr)
+	}
+	hub.sender = hub
+	if network.faults != nil {
+		faulty := NewFaultyMessageHub(hub, hub.addr, network.faults)
+		network.faulty = append(network.faulty, faulty)
+		hub.sender = faulty
+	}
+	network.peers[hub.addr] = hub
+	return nil
+}
+
+/* 本实例使用的路由规则，与 GoodMessageHub 一致 */
+func (network *LocalNetwork) routing(self string) routing {
+	return routing{
+		self:          self,
+		shardNum:      network.shardNum,
+		shardSize:     network.shardSize,
+		comAllNodeNum: network.comAllNodeNum,
+		clientNum:     network.clientNum,
+	}
+}
+
+func (network *LocalNetwork) getPeer(addr string) *LocalMessageHub {
+	network.lock.RLock()
+	defer network.lock.RUnlock()
+	return network.peers[addr]
+}
+
+/* 关闭所有链路，等待链路中正在处理的消息结束 */
+func (network *LocalNetwork) Close() {
+	log.Debug("local network closing...")
+	// 先停止故障注入的投递协程，它们会向链路中投递消息
+	for _, faulty := range network.faulty {
+		faulty.Close()
+	}
+	network.lock.Lock()
+	network.closed = true
+	for _, link := range network.links {
+		close(link.stopCh)
+	}
+	network.lock.Unlock()
+	network.wg.Wait()
+	log.Debug("local network is close.")
+}
+
+/* 进程内网络中一条链路的状态，用于调试 */
+type LinkInfo struct {
+	Link   string // from->to
+	Queued int    // 尚未处理的消息数
+}
+
+/* 所有已建立的链路的状态，按链路排序 */
+func (network *LocalNetwork) LinkInfos() []LinkInfo {
+	network.lock.RLock()
+	infos := make([]LinkInfo, 0, len(network.links))
+	links := make([]*localLink, 0, len(network.links))
+	for key, link := range network.links {
+		infos = append(infos, LinkInfo{Link: key})
+		links = append(links, link)
+	}
+	network.lock.RUnlock()
+
+	for i, link := range links {
+		link.lock.Lock()
+		infos[i].Queued = len(link.queue)
+		link.lock.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Link < infos[j].Link })
+	return infos
+}
+
+/* 把消息处理函数放入 from->to 链路中，由链路协程按顺序执行 */
+func (network *LocalNetwork) deliver(from, to string, handle func()) {
+	network.lock.Lock()
+	if network.closed {
+		network.lock.Unlock()
+		return
+	}
+	key := from + "->" + to
+	link, ok := network.links[key]
+	if !ok {
+		link = &localLink{
+			notify: make(chan struct{}, 1),
+			stopCh: make(chan struct{}),
+		}
+		network.links[key] = link
+		network.wg.Add(1)
+		go link.loop(&network.wg)
+	}
+	network.lock.Unlock()
+
+	link.lock.Lock()
+	link.queue = append(link.queue, handle)
+	link.lock.Unlock()
+	select {
+	case link.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (link *localLink) loop(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-link.stopCh:
+			return
+		case <-link.notify:
+		}
+		for {
+			link.lock.Lock()
+			if len(link.queue) == 0 {
+				link.lock.Unlock()
+				break
+			}
+			handle := link.queue[0]
+			link.queue = link.queue[1:]
+			link.lock.Unlock()
+			handle()
+		}
+	}
+}
+
+// 对消息做一次 gob 编解码，得到与发送方不共享内存的副本
+// 与 tcp 传输时接收方拿到的数据保持一致，编解码失败时返回错误，消息不应被投递
+func cloneMsg(msg interface{}) (interface{}, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return nil, fmt.Errorf("gob encode %T: %w", msg, err)
+	}
+	ptr := reflect.New(reflect.TypeOf(msg))
+	if err := gob.NewDecoder(&buf).Decode(ptr.Interface()); err != nil {
+		return nil, fmt.Errorf("gob decode %T: %w", msg, err)
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+/** 将消息发送给地址为 to 的实例，handle 在目标实例上执行
+ * 目标不存在时返回 core.ErrRPCUnreachable，消息被丢弃
+ */
+func (hub *LocalMessageHub) sendTo(to string, msgType string, handle func(target *LocalMessageHub)) error {
+	if !hub.keep.allows(to) {
+		return nil
+	}
+	target := hub.network.getPeer(to)
+	if target == nil {
+		log.Warn(fmt.Sprintf("local network peer not found. caller: %s msgType: %s targetAddr: %s", hub.addr, msgType, to))
+		return fmt.Errorf("%w: %s", core.ErrRPCUnreachable, to)
+	}
+	hub.network.deliver(hub.addr, to, func() { handle(target) })
+	return nil
+}
+
+/** 同步请求：直接在调用方协程中执行目标实例的处理函数
+ * 目标不存在时返回 core.ErrRPCUnreachable，与 GoodMessageHub 的rpc错误一致
+ */
+func (hub *LocalMessageHub) request(to string, msgType string) (*LocalMessageHub, error) {
+	target := hub.network.getPeer(to)
+	if target == nil {
+		log.Warn(fmt.Sprintf("local network peer not found. caller: %s msgType: %s targetAddr: %s", hub.addr, msgType, to))
+		return nil, fmt.Errorf("%w: %s", core.ErrRPCUnreachable, to)
+	}
+	return target, nil
+}
+
+/* 与 Send 相同，但多目标消息只发往 keep 返回 true 的地址 */
+func (hub *LocalMessageHub) SendToTargets(msgType uint32, id uint32, msg interface{}, keep func(addr string) bool) {
+	filtered := *hub
+	filtered.keep = keep
+	filtered.Send(msgType, id, msg, nil)
+}
+
+/* 消息发往的所有地址，与 GoodMessageHub 使用同一路由规则 */
+func (hub *LocalMessageHub) Targets(msgType uint32, id uint32, msg interface{}) []string {
+	return hub.network.routing(hub.addr).targets(msgType, id, msg)
+}
+
+/** 用于分片、委员会、客户端、信标链在进程内传送消息，路由规则与 GoodMessageHub 一致
+ * 消息无法复制或类型未知时丢弃该消息，不影响进程内的其他实例
+ */
+func (hub *LocalMessageHub) Send(msgType uint32, id uint32, msg interface{}, callback func(res ...interface{})) {
+	if err := hub.send(msgType, id, msg, callback); err != nil {
+		log.Warn("local message hub drop msg", "caller", hub.addr, "msgType", msgType, "err", err)
+	}
+}
+
+func (hub *LocalMessageHub) send(msgType uint32, id uint32, msg interface{}, callback func(res ...interface{})) error {
+	tbChain := hub.network.tbChain
+	// 单目标消息的地址为 addrs[0]
+	addrs := hub.Targets(msgType, id, msg)
+	switch msgType {
+	case core.MsgTypeComGetHeightFromShard:
+		target, err := hub.request(addrs[0], ComGetHeight)
+		if err != nil {
+			callback((*big.Int)(nil), err)
+			return nil
+		}
+		data, err := cloneMsg(msg)
+		if err != nil {
+			callback((*big.Int)(nil), err)
+			return err
+		}
+		height := target.shard.HandleComGetHeight(data.(*core.ComGetHeight))
+		height = new(big.Int).Set(height)
+		log.Info("Msg Response Received: ComGetHeight", "height", height)
+		callback(height, nil)
+
+	case core.MsgTypeShardSendGenesis:
+		v, err := cloneMsg(msg)
+		if err != nil {
+			return err
+		}
+		data := v.(*core.ShardSendGenesis)
+		hub.sendTo(addrs[0], ShardSendGenesis, func(target *LocalMessageHub) {
+			log.Info("Msg Received: ShardSendGenesis", "shardId", data.ShardID)
+			target.booter.HandleShardSendGenesis(data)
+		})
+	case core.MsgTypeBooterSendContract:
+		return hub.localBooterSendContract(msg, addrs)
+
+	case core.MsgTypeComGetStateFromShard:
+		target, err := hub.request(addrs[0], ComGetState)
+		if err != nil {
+			callback((*core.ShardSendState)(nil), err)
+			return nil
+		}
+		v, err := cloneMsg(msg)
+		if err != nil {
+			callback((*core.ShardSendState)(nil), err)
+			return err
+		}
+		data := v.(*core.ComGetState)
+		log.Info("Msg Received: ComGetState", "addr count", len(data.AddrList))
+		state := target.shard.HandleComGetState(data)
+		if state == nil {
+			callback(state, fmt.Errorf("%w: shard failed to get state", core.ErrRPCRemote))
+			return nil
+		}
+		if v, err = cloneMsg(state); err != nil {
+			callback((*core.ShardSendState)(nil), err)
+			return err
+		}
+		state = v.(*core.ShardSendState)
+		log.Info("Msg Response Received: ShardSendState", "addr count", len(state.AccountData))
+		callback(state, nil)
+
+	case core.MsgTypeClientInjectTX2Committee:
+		v, err := cloneMsg(msg)
+		if err != nil {
+			return err
+		}
+		data := v.([]*core.Transaction)
+		hub.sendTo(addrs[0], ClientSendTx, func(target *LocalMessageHub) {
+			log.Info("Msg Received: ClientSendTx", "tx count", len(data))
+			go target.committee.HandleClientSendtx(data)
+		})
+	case core.MsgTypeSetInjectDone2Nodes:
+		for _, addr := range addrs {
+			hub.sendTo(addr, ClientSetInjectDone, func(target *LocalMessageHub) {
+				log.Info("Msg Received: ClientSetInjectDone", "clientID", id)
+				target.committee.SetInjectTXDone(id)
+			})
+		}
+
+	case core.MsgTypeSendBlock2Shard:
+		v, err := cloneMsg(msg)
+		if err != nil {
+			return err
+		}
+		data := v.(*core.ComSendBlock)
+		hub.sendTo(addrs[0], ComSendBlock, func(target *LocalMessageHub) {
+			log.Info("Msg Received: ComSendBlock", "tx count", len(data.Block.Transactions))
+			go target.shard.HandleComSendBlock(data)
+		})
+
+	case core.MsgTypeCommitteeReply2Client:
+		v, err := cloneMsg(msg)
+		if err != nil {
+			return err
+		}
+		data := v.([]*result.TXReceipt)
+		hub.sendTo(addrs[0], ComSendTxReceipt, func(target *LocalMessageHub) {
+			go target.client.HandleComSendTxReceipt(data)
+		})
+
+	case core.MsgTypeLeaderInitMultiSign:
+		// 向委员会中的所有共识节点发送（包括自己）
+		for _, addr := range addrs {
+			v, err := cloneMsg(msg)
+			if err != nil {
+				return err
+			}
+			data := v.(*core.ComLeaderInitMultiSign)
+			hub.sendTo(addr, LeaderInitMultiSign, func(target *LocalMessageHub) {
+				log.Info("Msg Received: LeaderInitMultiSign")
+				target.committee.HandleMultiSignRequest(data)
+			})
+		}
+	case core.MsgTypeSendMultiSignReply:
+		v, err := cloneMsg(msg)
+		if err != nil {
+			return err
+		}
+		data := v.(*core.MultiSignReply)
+		hub.sendTo(addrs[0], MultiSignReply, func(target *LocalMessageHub) {
+			log.Info("Msg Received: MultiSignReply")
+			target.committee.HandleMultiSignReply(data)
+		})
+
+	case core.MsgTypeLeaderInitReconfig:
+		for _, addr := range addrs {
+			v, err := cloneMsg(msg)
+			if err != nil {
+				return err
+			}
+			data := v.(*core.InitReconfig)
+			hub.sendTo(addr, LeaderInitReconfig, func(target *LocalMessageHub) {
+				log.Info(fmt.Sprintf("Msg Received: %s comID: %d", LeaderInitReconfig, data.ComID))
+				target.node.HandleLeaderInitReconfig(data)
+			})
+		}
+	case core.MsgTypeSendReconfigResult2ComLeader:
+		v, err := cloneMsg(msg)
+		if err != nil {
+			return err
+		}
+		data := v.(*core.ReconfigResult)
+		hub.sendTo(addrs[0], SendReconfigResult2ComLeader, func(target *LocalMessageHub) {
+			log.Info(fmt.Sprintf("Msg Received: %s comID: %d nodeID: %d", SendReconfigResult2ComLeader, data.Belong_ComID, data.OldNodeInfo.NodeID))
+			target.node.HandleSendReconfigResult2ComLeader(data)
+		})
+	case core.MsgTypeSendReconfigResults2AllComLeaders:
+		// 待发送地址在路由时已拷贝，leader接收到该消息后更新地址表不影响发送
+		for _, addr := range addrs {
+			v, err := cloneMsg(msg)
+			if err != nil {
+				return err
+			}
+			data := v.(*core.ComReconfigResults)
+			hub.sendTo(addr, SendReconfigResults2AllComLeaders, func(target *LocalMessageHub) {
+				log.Info(fmt.Sprintf("Msg Received: %s from_comID: %d", SendReconfigResults2AllComLeaders, data.ComID))
+				target.node.HandleSendReconfigResults2AllComLeaders(data)
+			})
+		}
+	case core.MsgTypeSendReconfigResults2ComNodes:
+		for _, addr := range addrs {
+			v, err := cloneMsg(msg)
+			if err != nil {
+				return err
+			}
+			data := v.(map[uint32]*core.ComReconfigResults)
+			hub.sendTo(addr, SendReconfigResults2ComNodes, func(target *LocalMessageHub) {
+				log.Info(fmt.Sprintf("Msg Received: %s", SendReconfigResults2ComNodes))
+				target.node.HandleSendReconfigResults2ComNodes(&data)
+			})
+		}
+	case core.MsgTypeGetPoolTx:
+		v, err := cloneMsg(msg)
+		if err != nil {
+			callback((*core.PoolTx)(nil), err)
+			return err
+		}
+		data := v.(*core.GetPoolTx)
+		target, err := hub.request(addrs[0], GetPoolTx)
+		if err != nil {
+			callback((*core.PoolTx)(nil), err)
+			return nil
+		}
+		if v, err = cloneMsg(target.committee.HandleGetPoolTx(data)); err != nil {
+			callback((*core.PoolTx)(nil), err)
+			return err
+		}
+		poolTx := v.(*core.PoolTx)
+		log.Info(fmt.Sprintf("Msg Response Received: %s pendingLen: %d pendingRollbackLen: %d", GetPoolTx, len(poolTx.Pending), len(poolTx.PendingRollback)))
+		callback(poolTx, nil)
+	case core.MsgTypeGetSyncData:
+		v, err := cloneMsg(msg)
+		if err != nil {
+			callback((*core.SyncData)(nil), err)
+			return err
+		}
+		data := v.(*core.GetSyncData)
+		target, err := hub.request(addrs[0], GetSyncData)
+		if err != nil {
+			callback((*core.SyncData)(nil), err)
+			return nil
+		}
+		if v, err = cloneMsg(target.shard.HandleGetSyncData(data)); err != nil {
+			callback((*core.SyncData)(nil), err)
+			return err
+		}
+		syncData := v.(*core.SyncData)
+		log.Info(fmt.Sprintf("Msg Response Received: %s syncMode: %s", GetSyncData, data.SyncType))
+		callback(syncData, nil)
+	case core.MsgTypeComSendNewAddrs:
+		data := msg.(*core.AdjustAddrs)
+		tbChain.SetAddrs(data.Addrs, data.Vrfs, data.SeedHeight, data.ComID, id)
+	case core.MsgTypeSendNewNodeTable2Client:
+		for _, addr := range addrs {
+			v, err := cloneMsg(msg)
+			if err != nil {
+				return err
+			}
+			data := v.(map[uint32]map[uint32]string)
+			hub.sendTo(addr, SendNewNodeTable2Client, func(target *LocalMessageHub) {
+				log.Info(fmt.Sprintf("Msg Received: %s", SendNewNodeTable2Client))
+				updateComNodeTable(data)
+			})
+		}
+
+	////////////////////
+	// 进程内所有实例共享同一条信标链，直接调用
+	///////////////////
+	case core.MsgTypeGetLatestBlockHashFromEthChain:
+		hash, height := tbChain.GetEthChainLatestBlockHash()
+		callback(hash, height)
+	case core.MsgTypeGetBlockHashFromEthChain:
+		hash, height := tbChain.GetEthChainBlockHash(msg.(uint64))
+		callback(hash, height)
+	case core.MsgTypeGetTB:
+		// 进程内所有实例共用同一条信标链，直接读取
+		height := msg.(uint64)
+		tb := tbChain.GetTimeBeacon(int(id), height)
+		if tb == nil {
+			callback(tb, fmt.Errorf("%w: time beacon of shard %d height %d not confirmed", core.ErrRPCRemote, id, height))
+			return nil
+		}
+		callback(tb, nil)
+	case core.MsgTypeComAddTb2TBChain:
+		tbChain.AddTimeBeacon(msg.(*core.SignedTB), id)
+	case core.MsgTypeComAddTbRoot2TBChain:
+		tbChain.AddTimeBeaconRoot(msg.(*core.SignedTBRoot), id)
+	case core.MsgTypeTBChainPushTB2Client, core.MsgTypeTBChainPushTB2Coms, core.MsgTypeTBChainRetractTB2Client:
+		// 信标链推送给本实例的消息，经 LocalNetwork.Send 和本实例的故障注入后到达
+		return hub.localRecvFromTBChain(msgType, msg)
+
+	////////////////////
+	///// pbft  ////////
+	////////////////////
+	case core.MsgTypePbftPrePrepare:
+		return hub.localSendPbftMsg(addrs, msg, CPrePrepare)
+	case core.MsgTypePbftPrepare:
+		return hub.localSendPbftMsg(addrs, msg, CPrepare)
+	case core.MsgTypePbftCommit:
+		return hub.localSendPbftMsg(addrs, msg, CCommit)
+	case core.MsgTypePbftReply:
+		return hub.localSendPbftMsg(addrs, msg, CReply)
+	case core.MsgTypePbftRequestOldMessage:
+		return hub.localSendPbftMsg(addrs, msg, CRequestOldrequest)
+	case core.MsgTypePbftSendOldMessage:
+		v, err := cloneMsg(msg)
+		if err != nil {
+			return err
+		}
+		data := v.(*core.SendOldMessage)
+		hub.sendTo(addrs[0], CSendOldrequest, func(target *LocalMessageHub) {
+			log.Info(fmt.Sprintf("Msg Received: %s ComID: %v", CSendOldrequest, target.node.NodeInfo.ComID))
+			go target.pbftNode.HandleSendOldSeq(data)
+		})
+
+	case core.MsgTypeNodeSendInfo2Leader:
+		v, err := cloneMsg(msg)
+		if err != nil {
+			return err
+		}
+		data := v.(*core.NodeSendInfo)
+		hub.sendTo(addrs[0], NodeSendInfo, func(target *LocalMessageHub) {
+			log.Info("Msg Received: NodeSendInfo")
+			target.node.HandleNodeSendInfo(data)
+		})
+
+	case core.MsgTypeClearConnection:
+		// 进程内没有长连接需要清理
+	case core.MsgTypeReportError:
+		v, err := cloneMsg(msg)
+		if err != nil {
+			return err
+		}
+		data := v.(*core.ErrReport)
+		hub.sendTo(addrs[0], ReportError, func(target *LocalMessageHub) {
+			log.Info(fmt.Sprintf("Msg Received: %s", ReportError))
+			log.Warn("got err report.", "fromAddr", data.NodeAddr, "errMsg", data.Err)
+		})
+	case core.MsgTypeReportAny:
+		data := msg.(string)
+		hub.sendTo(addrs[0], ReportAny, func(target *LocalMessageHub) {
+			log.Info(fmt.Sprintf("Msg Received: %s", ReportAny))
+			log.Info("got msg report.", "msg", data)
+			result.AddReport(data)
+		})
+	default:
+		return fmt.Errorf("unknown msgType for local message hub: %d", msgType)
+	}
+	return nil
+}
+
+/* 在信标链到本实例的链路上按顺序处理信标链推送的区块和撤回的信标 */
+func (hub *LocalMessageHub) localRecvFromTBChain(msgType uint32, msg interface{}) error {
+	v, err := cloneMsg(msg)
+	if err != nil {
+		return err
+	}
+	switch msgType {
+	case core.MsgTypeTBChainPushTB2Client:
+		block := v.(*beaconChain.TBBlock)
+		hub.network.deliver(localTBChainAddr, hub.addr, func() { hub.client.AddTBs(block) })
+	case core.MsgTypeTBChainRetractTB2Client:
+		tb := v.(*beaconChain.ConfirmedTB)
+		hub.network.deliver(localTBChainAddr, hub.addr, func() { hub.client.RetractTB(tb) })
+	case core.MsgTypeTBChainPushTB2Coms:
+		block := v.(*beaconChain.TBBlock)
+		hub.network.deliver(localTBChainAddr, hub.addr, func() {
+			hub.committee.AddTBs(block)
+			hub.shard.AddTBs(block)
+		})
+	}
+	return nil
+}
+
+/* 向所有节点和客户端发送合约地址 */
+func (hub *LocalMessageHub) localBooterSendContract(msg interface{}, addrs []string) error {
+	network := hub.network
+	clone := func() (*core.BooterSendContract, error) {
+		v, err := cloneMsg(msg)
+		if err != nil {
+			return nil, err
+		}
+		return v.(*core.BooterSendContract), nil
+	}
+	// 地址中包括节点和客户端，按目标实例的角色处理
+	for _, addr := range addrs {
+		data, err := clone()
+		if err != nil {
+			return err
+		}
+		hub.sendTo(addr, BooterSendContract, func(target *LocalMessageHub) {
+			log.Info("Msg Received: BooterSendContract", "data", data)
+			if target.node != nil {
+				target.node.HandleBooterSendContract(data)
+			} else if target.client != nil {
+				target.client.HandleBooterSendContract(data)
+			}
+		})
+	}
+	// 所有实例共享一条信标链，只需通知一次
+	data, err := clone()
+	if err != nil {
+		return err
+	}
+	network.tbChain.HandleBooterSendContract(data)
+	log.Info("Msg Sent: BooterSendContract", "data", msg)
+	return nil
+}
+
+/* addrs 中不包括自己，reply、CRequestOldrequest 只发给leader */
+func (hub *LocalMessageHub) localSendPbftMsg(addrs []string, msg interface{}, msgType string) error {
+	for _, addr := range addrs {
+		data, err := cloneMsg(msg)
+		if err != nil {
+			return err
+		}
+		hub.sendTo(addr, msgType, func(target *LocalMessageHub) {
+			p := target.pbftNode
+			log.Info(fmt.Sprintf("Msg Received: %s ComID: %v", msgType, target.node.NodeInfo.ComID))
+			switch msgType {
+			case CPrePrepare:
+				go p.HandlePrePrepare(data.(*core.PrePrepare))
+			case CPrepare:
+				p.HandlePrepare(data.(*core.Prepare))
+			case CCommit:
+				p.HandleCommit(data.(*core.Commit))
+			case CReply:
+				p.HandleReply(data.(*core.Reply))
+			case CRequestOldrequest:
+				p.HandleRequestOldSeq(data.(*core.RequestOldMessage))
+			}
+		})
+	}
+	return nil
+}
+
+/** 信标链在进程内网络中发送消息，推送区块给所有客户端或所有委员会
+ * 消息经各实例的消息中心投递给实例自己，注入故障时按信标链到该实例的链路处理；
+ * 每个接收的实例得到一份复制的区块，与 tcp 传输时一致
+ */
+func (network *LocalNetwork) Send(msgType uint32, id uint32, msg interface{}, callback func(res ...interface{})) {
+	if err := network.send(msgType, msg); err != nil {
+		log.Warn("local network drop tbchain msg", "msgType", msgType, "err", err)
+	}
+}
+
+func (network *LocalNetwork) send(msgType uint32, msg interface{}) error {
+	network.lock.RLock()
+	peers := make([]*LocalMessageHub, 0, len(network.peers))
+	for _, peer := range network.peers {
+		peers = append(peers, peer)
+	}
+	network.lock.RUnlock()
+
+	switch msgType {
+	case core.MsgTypeTBChainPushTB2Client, core.MsgTypeTBChainRetractTB2Client:
+		for _, peer := range peers {
+			if peer.client != nil {
+				peer.sender.Send(msgType, 0, msg, nil)
+			}
+		}
+	case core.MsgTypeTBChainPushTB2Coms:
+		for _, peer := range peers {
+			if peer.node != nil {
+				peer.sender.Send(msgType, 0, msg, nil)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown msgType for local network: %d", msgType)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package messageHub
+
+import (
+	"context"
+	"go-w3chain/beaconChain"
+	"go-w3chain/cfg"
+	"go-w3chain/committee"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"go-w3chain/node"
+	"go-w3chain/shard"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newLocalTestNode(t *testing.T, dataDir string, nodeID int) *node.Node {
+	n := node.NewNode(dataDir, 1, 0, 0, nodeID, 4, 3, "")
+	s := shard.NewShard(0, n, 10, 100)
+	n.SetShard(s)
+	com := committee.NewCommittee(context.Background(), 0, 1, n, &core.CommitteeConfig{RecommitTime: 3 * time.Second, Height2Reconfig: 100})
+	n.SetCommittee(com)
+	t.Cleanup(n.Close)
+	return n
+}
+
+func TestLocalNetwork(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testLocalHub.log"))
+	// pbft 节点会在当前目录下创建日志目录
+	defer os.RemoveAll("pbftLog")
+	tbChain := beaconChain.NewTBChain(context.Background(), &core.BeaconChainConfig{Mode: 0, BlockInterval: 1, MultiSignRequiredNum: 1}, 1)
+	defer tbChain.Close()
+	network := NewLocalNetwork(tbChain, 1, 4, 3, 1)
+	defer network.Close()
+
+	dataDir := t.TempDir()
+	leader := newLocalTestNode(t, dataDir, 0)
+	member := newLocalTestNode(t, dataDir, 1)
+	if _, err := network.AddNode(leader); err != nil {
+		t.Fatal(err)
+	}
+	hub, err := network.AddNode(member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := network.AddNode(member); err == nil {
+		t.Fatal("address conflict not detected")
+	}
+
+	// 同步请求：回调在 Send 返回前被调用
+	var height *big.Int
+	hub.Send(core.MsgTypeComGetHeightFromShard, 0, &core.ComGetHeight{}, func(res ...interface{}) {
+		height = res[0].(*big.Int)
+	})
+	if height == nil || height.Uint64() != 0 {
+		t.Fatalf("unexpected height from shard leader: %v", height)
+	}
+
+	// 异步消息：按地址表投递给委员会 leader
+	hub.Send(core.MsgTypeNodeSendInfo2Leader, 0, &core.NodeSendInfo{
+		NodeInfo: member.NodeInfo,
+		Addr:     *member.GetAccount().GetAccountAddress(),
+	}, nil)
+	// 同一链路上的消息按顺序处理，标记消息处理完时 NodeSendInfo 已处理
+	done := make(chan struct{})
+	network.deliver(member.GetAddr(), leader.GetAddr(), func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("NodeSendInfo not delivered")
+	}
+	leaderShard := leader.GetShard().(*shard.Shard)
+	if len(leaderShard.GetNodeAddrs()) != 2 {
+		t.Fatalf("leader got wrong addrs: %v", leaderShard.GetNodeAddrs())
+	}
+	if got := leaderShard.GetNodeAddrs()[1]; got != *member.GetAccount().GetAccountAddress() {
+		t.Fatalf("leader got wrong addr %x", got)
+	}
+
+	if cfg.NodeTable[0][1] != member.GetAddr() {
+		t.Fatalf("member addr %s not taken from node table", member.GetAddr())
+	}
+
+	// 未知的消息类型和无法编码的消息被丢弃，不会退出进程
+	hub.Send(1<<31, 0, nil, nil)
+	hub.Send(core.MsgTypeNodeSendInfo2Leader, 0, make(chan int), nil)
+	network.Send(1<<31, 0, nil, nil)
+}
+
+func TestCloneMsg(t *testing.T) {
+	block := &beaconChain.TBBlock{Height: 3, Tbs: [][]*beaconChain.ConfirmedTB{{{
+		TimeBeacon:    core.TimeBeacon{ShardID: 0, Height: 7},
+		ConfirmHeight: 3,
+	}}}}
+	v, err := cloneMsg(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := v.(*beaconChain.TBBlock)
+	if clone == block || clone.Tbs[0][0] == block.Tbs[0][0] {
+		t.Fatal("clone shares memory with the original block")
+	}
+	if clone.Height != 3 || clone.Tbs[0][0].Height != 7 || clone.Tbs[0][0].ConfirmHeight != 3 {
+		t.Fatalf("clone differs from the original block: %+v", clone.Tbs[0][0])
+	}
+	if _, err := cloneMsg(make(chan int)); err == nil {
+		t.Fatal("expected an error for a message gob cannot encode")
+	}
+}
@@ -1,9 +1,11 @@
 package messageHub
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
 	"go-w3chain/beaconChain"
+	"go-w3chain/cfg"
 	"go-w3chain/client"
 	"go-w3chain/committee"
 	"go-w3chain/core"
@@ -12,6 +14,7 @@ import (
 	"go-w3chain/pbft"
 	"go-w3chain/shard"
 	"net"
+	"sort"
 	"sync"
 )
 
@@ -28,12 +31,23 @@ var (
 	shardSize     int
 	comAllNodeNum int // 包括共识节点和非共识节点，该字段仅在初始化时有效
 	clientNum     int
-	conns2Node    *ConnectionsMap
-	listenConn    net.Listener
+	peers         *PeerManager // 管理本节点主动建立的tcp长连接
+
+	listenLock   sync.Mutex
+	listeners    map[net.Listener]struct{} // 本进程的所有监听，Close 时全部关闭
+	inboundConns map[net.Conn]struct{}     // 其他进程连入的连接，Close 时全部关闭
+
+	msgSigner   *envelopeSigner   // 对发出的消息签名
+	msgVerifier *envelopeVerifier // 验证收到的消息的来源，拒绝伪造和重放的消息
+
+	secureTransport *tlsTransport // 为nil时节点间使用明文tcp
+	relayer         *broadcaster  // 委员会内广播的分发策略
 )
 
 func init() {
-	conns2Node = NewConnectionsMap()
+	peers = NewPeerManager()
+	listeners = make(map[net.Listener]struct{})
+	inboundConns = make(map[net.Conn]struct{})
 	gob.Register(core.Msg{})
 	gob.Register(core.BooterSendContract{})
 
@@ -42,6 +56,23 @@ func init() {
 type GoodMessageHub struct {
 	mid      int
 	exitChan chan struct{}
+	useTLS   bool
+	account  *node.W3Account
+	// 集群口令，非空时向 booter 注册和查询地址表都需带有该口令的 hmac
+	clusterToken string
+	// 验证收到的消息信封，为 false 时只签名不验证
+	verifyEnvelope bool
+
+	compression       string
+	compressThreshold int
+
+	broadcast       string
+	broadcastFanout int
+
+	inbound *cfg.InboundQueueConfig
+
+	faults *cfg.FaultConfig
+	faulty *FaultyMessageHub
 }
 
 func NewMessageHub() *GoodMessageHub {
@@ -52,7 +83,61 @@ func NewMessageHub() *GoodMessageHub {
 	return hub
 }
 
-func (hub *GoodMessageHub) Init(client *client.Client, node *node.Node, booter *node.Booter,
+/* 设置客户端或booter签名消息和建立tls连接使用的账户，需在 Init 之前调用；节点使用自己的账户 */
+func (hub *GoodMessageHub) SetAccount(account *node.W3Account) {
+	hub.account = account
+}
+
+/* 设置向 booter 注册时使用的集群口令，需在 Discover 之前调用，且必须与 booter 的口令相同 */
+func (hub *GoodMessageHub) SetClusterToken(token string) {
+	hub.clusterToken = token
+}
+
+/* 使用tls加密节点间的通信，需在 Init 之前调用，且所有进程的设置必须一致 */
+func (hub *GoodMessageHub) EnableTLS() {
+	hub.useTLS = true
+}
+
+/** 验证收到的消息信封，拒绝伪造、重放和发给其他进程的消息，需在 Init 之前调用
+ * 需要能确定每个发送方的账户：同一台机器上的进程共享身份表，跨机器时由地址配置文件的 Accounts 给出，
+ * 或开启 Discovery 由 booter 在地址表中下发。所有进程的设置必须一致
+ */
+func (hub *GoodMessageHub) EnableEnvelopeVerify() {
+	hub.verifyEnvelope = true
+}
+
+/** 协商压缩节点间传输的消息，需在 Init 之前调用
+ * 目前支持 snappy；消息体小于 threshold 字节时不压缩，threshold 不大于0时使用默认值。
+ * 连接双方都开启同一算法时才压缩，与未开启的进程仍可正常通信
+ */
+func (hub *GoodMessageHub) SetCompression(codec string, threshold int) {
+	hub.compression = codec
+	hub.compressThreshold = threshold
+}
+
+/** 设置委员会内广播（pbft消息、多签请求、重组请求）的分发策略，需在 Init 之前调用
+ * strategy 为 direct、tree 或 gossip，为空时等同 direct；fanout 为树的分叉数或 gossip 每次转发的节点数，
+ * 不大于0时使用默认值。所有节点的设置必须一致
+ */
+func (hub *GoodMessageHub) SetBroadcast(strategy string, fanout int) {
+	hub.broadcast = strategy
+	hub.broadcastFanout = fanout
+}
+
+/* 开启接收队列并设置其容量和队列满时的策略，需在 Init 之前调用；不调用时消息在读协程中依次处理 */
+func (hub *GoodMessageHub) SetInboundQueue(config *cfg.InboundQueueConfig) {
+	hub.inbound = config
+}
+
+/* 按配置对本进程发出的消息注入网络故障，需在 Init 之前调用 */
+func (hub *GoodMessageHub) InjectFaults(config *cfg.FaultConfig) {
+	hub.faults = config
+}
+
+/** 设置各模块的消息中心并开始监听
+ * ctx 取消后停止监听，已连入的连接由 Close 关闭
+ */
+func (hub *GoodMessageHub) Init(ctx context.Context, client *client.Client, node *node.Node, booter *node.Booter,
 	tbChain *beaconChain.BeaconChain, _shardNum int, _shardSize, _shardAllNodeNum, _clientNum int, wg *sync.WaitGroup) {
 	clientNum = _clientNum
 	client_ref = client
@@ -71,45 +156,114 @@ func (hub *GoodMessageHub) Init(client *client.Client, node *node.Node, booter *
 	comAllNodeNum = _shardAllNodeNum
 	log.Info("messageHubInit", "shardNum", shardNum)
 
+	localAddr, slot := localIdentity()
+	account := hub.account
+	if node_ref != nil {
+		account = node_ref.GetAccount()
+	}
+	account = initEnvelope(account, slot, localAddr, hub.verifyEnvelope)
+	if topologyAccounts != nil && msgVerifier != nil {
+		pinTopologyAccounts()
+	}
+	if hub.useTLS {
+		transport, err := newTLSTransport(account)
+		if err != nil {
+			log.Error("create tls transport fail", "err", err)
+		}
+		secureTransport = transport
+		peers.SetTLS(transport)
+		log.Info("messageHub use tls", "identity", transport.identity)
+	}
+	if hub.compression != "" {
+		if hub.compression != codecSnappy {
+			log.Error("unknown compression codec", "codec", hub.compression)
+		}
+		compressCodec = hub.compression
+		compressThreshold = defaultCompressThreshold
+		if hub.compressThreshold > 0 {
+			compressThreshold = hub.compressThreshold
+		}
+		log.Info("messageHub use compression", "codec", compressCodec, "threshold", compressThreshold)
+	}
+	b, err := newBroadcaster(hub.broadcast, hub.broadcastFanout, localAddr)
+	if err != nil {
+		log.Error("create broadcaster fail", "err", err)
+	}
+	relayer = b
+	log.Info("messageHub broadcast", "strategy", relayer.strategy, "fanout", relayer.fanout)
+	if hub.inbound != nil {
+		if err := setInboundQueue(hub.inbound); err != nil {
+			log.Error("invalid inbound queue config", "err", err)
+		}
+		log.Info("messageHub inbound queues", "consensus", inboundSettings[0], "tx", inboundSettings[1])
+	}
+
+	// 各模块通过 sender 发送消息，注入故障时为包装后的消息中心
+	var sender core.MessageHub = hub
+	if hub.faults != nil {
+		hub.faulty = NewFaultyMessageHub(hub, localAddr, hub.faults)
+		sender = hub.faulty
+	}
 	if committee_ref != nil {
-		committee_ref.SetMessageHub(hub)
+		committee_ref.SetMessageHub(sender)
 	}
 	if shard_ref != nil {
-		shard_ref.SetMessageHub(hub)
+		shard_ref.SetMessageHub(sender)
 	}
 	if pbftNode_ref != nil {
-		pbftNode_ref.SetMessageHub(hub)
+		pbftNode_ref.SetMessageHub(sender)
 	}
+
 	if client_ref != nil {
-		client_ref.SetMessageHub(hub)
+		client_ref.SetMessageHub(sender)
 		wg.Add(1)
-		go listen(client.GetAddr(), wg)
+		go listen(ctx, client.GetAddr(), wg)
 	}
 	// 目前所有角色都需要连接tbchain
 	if tbChain_ref == nil {
 		log.Error("tbchain instance is nil")
 	}
-	tbChain_ref.SetMessageHub(hub)
+	// 信标链推送给本进程的区块也经过故障注入
+	tbChain_ref.SetMessageHub(sender)
+	peers.Start()
 
 	if node_ref != nil {
-		node_ref.SetMessageHub(hub)
+		node_ref.SetMessageHub(sender)
 		wg.Add(1)
-		go listen(node_ref.GetAddr(), wg)
+		go listen(ctx, node_ref.GetAddr(), wg)
 	}
 	if booter_ref != nil {
-		booter_ref.SetMessageHub(hub)
+		booter_ref.SetMessageHub(sender)
 		wg.Add(1)
-		go listen(booter.GetAddr(), wg)
+		go listen(ctx, booter.GetAddr(), wg)
 	}
 
 }
 
+/* 本节点主动建立的所有连接的状态，用于调试 */
+func (hub *GoodMessageHub) PeerInfos() []PeerInfo {
+	return peers.PeerInfos()
+}
+
+/* 其他进程连入本进程的连接的对端地址，按地址排序，用于调试 */
+func (hub *GoodMessageHub) InboundAddrs() []string {
+	listenLock.Lock()
+	addrs := make([]string, 0, len(inboundConns))
+	for conn := range inboundConns {
+		addrs = append(addrs, conn.RemoteAddr().String())
+	}
+	listenLock.Unlock()
+	sort.Strings(addrs)
+	return addrs
+}
+
 func (hub GoodMessageHub) Close() {
 	// 关闭所有tcp连接，防止资源泄露
 	log.Debug(fmt.Sprintf("messageHub closing..."))
-	for _, conn := range conns2Node.connections {
-		conn.Close()
+	if hub.faulty != nil {
+		hub.faulty.Close()
 	}
-	listenConn.Close()
+	peers.Close()
+	closeListeners()
 	log.Debug(fmt.Sprintf("messageHub is close."))
 }
@@ -6,8 +6,7 @@ const (
 
 	ComGetHeight string = "ComGetHeight"
 
-	ComGetState    string = "ComGetState"
-	ShardSendState string = "ShardSendState"
+	ComGetState string = "ComGetState"
 
 	ClientSendTx        string = "ClientSendTx"
 	ClientSetInjectDone string = "ClientSetInjectDone"
@@ -25,6 +24,13 @@ const (
 	GetPoolTx                         string = "GetPoolTx" // 新leader向旧leader请求交易池中的交易
 	GetSyncData                       string = "GetSyncData"
 	SendNewNodeTable2Client           string = "SendNewNodeTable2Client"
+	GetTB                             string = "GetTB" // 客户端向分片leader请求已确认的信标
+
+	// 节点和客户端启动时向 booter 注册监听地址并获取地址表，以rpc的形式发送
+	Register    string = "Register"
+	GetTopology string = "GetTopology"
+	// 重启的节点和客户端向 booter 查询已部署的合约地址，以rpc的形式发送
+	GetContract string = "GetContract"
 
 	// pbft part
 	CPrePrepare        string = "CPrePrepare"
@@ -38,4 +44,11 @@ const (
 
 	ReportError string = "ReportError"
 	ReportAny   string = "ReportAny"
+
+	// 心跳，以rpc的形式发送，接收方回复空消息
+	Ping string = "Ping"
+	// 压缩协商，以rpc的形式在连接建立后发送
+	Hello string = "Hello"
+	// 委员会内树形或 gossip 广播时转发的消息，内部为原始发送方签名的消息
+	Relay string = "Relay"
 )
@@ -0,0 +1,629 @@
+package messageHub
+
+import (
+	"errors"
+	"fmt"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minDialBackoff = 100 * time.Millisecond
+	maxDialBackoff = 3 * time.Second
+	// 普通消息建立连接的最长等待时间，超过后放弃本次发送
+	defaultDialTimeout = 10 * time.Second
+	// 节点启动时其他节点可能尚未开始监听，等待更久
+	startupDialTimeout = 2 * time.Minute
+
+	// dial失败后，该对端在一段时间内的发送直接失败，避免每条消息都等待dial超时
+	minPeerBackoff = 1 * time.Second
+	maxPeerBackoff = 30 * time.Second
+
+	// 写一条消息的最长时间，对端长时间不读取时放弃该连接
+	writeTimeout = 30 * time.Second
+
+	// 连接空闲超过该时间后发送心跳
+	heartbeatInterval = 10 * time.Second
+	pingTimeout       = 5 * time.Second
+)
+
+var (
+	errPeerManagerClosed = errors.New("peer manager is closed")
+	errDialTimeout       = errors.New("dial timeout")
+	errPeerBackoff       = errors.New("peer is in dial backoff")
+)
+
+type PeerState int
+
+const (
+	PeerDisconnected PeerState = iota
+	PeerConnecting
+	PeerConnected
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerDisconnected:
+		return "disconnected"
+	case PeerConnecting:
+		return "connecting"
+	case PeerConnected:
+		return "connected"
+	default:
+		return "unknown"
+	}
+}
+
+/* 某一对端连接的状态，用于调试 */
+type PeerInfo struct {
+	Addr       string
+	State      string
+	Reconnects int // 连接断开后重新建立连接的次数
+	DialFails  int // 累计dial失败次数
+	MsgsSent   uint64
+	Codec      string // 当前连接协商的压缩算法，为空表示不压缩
+	// 累计发送的字节数，RawBytesSent 为压缩前的大小，WireBytesSent 为实际写入连接的大小
+	RawBytesSent  uint64
+	WireBytesSent uint64
+	LastActive    time.Time // 最近一次成功写入或收到心跳回复的时间
+	LastErr       string
+}
+
+/** 与某一地址的长连接
+ * lock 保证同一连接上一条消息完整写入，只在写入和替换连接时短暂持有，dial 期间不持有
+ * infoLock 保护连接的状态和统计信息，查询状态时不必等待正在进行的请求
+ */
+type peer struct {
+	addr    string
+	lock    sync.Mutex
+	conn    net.Conn
+	dialing chan struct{} // 正在建立连接时不为nil，建立结束后关闭，由 lock 保护
+
+	infoLock   sync.Mutex
+	state      PeerState
+	everDialed bool
+	codec      string // 当前连接上协商的压缩算法
+	reconnects int
+	dialFails  int
+	msgsSent   uint64
+	rawSent    uint64
+	wireSent   uint64
+	lastActive time.Time
+	lastErr    string
+
+	backoff time.Duration // dial失败后的退避时间，连续失败时翻倍
+	retryAt time.Time     // 退避结束的时间
+}
+
+/* 一个等待回复的rpc请求 */
+type pendingCall struct {
+	conn    net.Conn // 发出请求的连接，该连接断开时请求失败
+	replyCh chan *rpcReply
+	errCh   chan error
+}
+
+type rpcReply struct {
+	msg  *core.Msg
+	size core.TransferSize
+}
+
+/** PeerManager 管理本节点主动建立的所有 tcp 连接
+ * 连接在第一次发送时建立，dial失败时按指数退避重试；写失败时关闭连接并重新dial一次；
+ * 后台协程定期向空闲连接发送心跳，心跳失败的连接被关闭，下一次发送时重新建立。
+ * 每条连接有一个读协程，按 ReqID 把rpc回复交给等待的请求
+ */
+type PeerManager struct {
+	lock  sync.RWMutex
+	peers map[string]*peer
+
+	nextReqID   uint64
+	pendingLock sync.Mutex
+	pending     map[uint64]*pendingCall
+
+	transport *tlsTransport // 为nil时使用明文tcp
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewPeerManager() *PeerManager {
+	return &PeerManager{
+		peers:   make(map[string]*peer),
+		pending: make(map[uint64]*pendingCall),
+		stopCh:  make(chan struct{}),
+	}
+}
+
+/* 之后建立的连接都使用tls，需在发送任何消息之前调用 */
+func (pm *PeerManager) SetTLS(transport *tlsTransport) {
+	pm.transport = transport
+}
+
+func (pm *PeerManager) getPeer(addr string) *peer {
+	pm.lock.RLock()
+	p, ok := pm.peers[addr]
+	pm.lock.RUnlock()
+	if ok {
+		return p
+	}
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if p, ok = pm.peers[addr]; !ok {
+		p = &peer{addr: addr}
+		pm.peers[addr] = p
+	}
+	return p
+}
+
+func (pm *PeerManager) closed() bool {
+	select {
+	case <-pm.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+/* 按指数退避dial，直到成功、超过 maxWait 或 PeerManager 关闭 */
+func (pm *PeerManager) dial(addr string, maxWait time.Duration) (net.Conn, int, error) {
+	deadline := time.Now().Add(maxWait)
+	backoff := minDialBackoff
+	fails := 0
+	for {
+		var conn net.Conn
+		var err error
+		if pm.transport != nil {
+			conn, err = pm.transport.dial(addr, handshakeTimeout)
+		} else {
+			conn, err = net.DialTimeout("tcp", addr, maxDialBackoff)
+		}
+		if err == nil {
+			return conn, fails, nil
+		}
+		fails++
+		log.Debug("DialTCPError", "target_addr", addr, "err", err, "retry_after", backoff)
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, fails, fmt.Errorf("%w: %s after %d attempts, last err: %v", errDialTimeout, addr, fails, err)
+		}
+		select {
+		case <-pm.stopCh:
+			return nil, fails, errPeerManagerClosed
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxDialBackoff {
+			backoff = maxDialBackoff
+		}
+	}
+}
+
+func (p *peer) setState(state PeerState, err error) {
+	p.infoLock.Lock()
+	defer p.infoLock.Unlock()
+	p.state = state
+	if err != nil {
+		p.lastErr = err.Error()
+	}
+}
+
+func (p *peer) markActive(sent bool) {
+	p.infoLock.Lock()
+	defer p.infoLock.Unlock()
+	if sent {
+		p.msgsSent++
+	}
+	p.lastActive = time.Now()
+}
+
+func (p *peer) markSent(raw, wire int) {
+	p.infoLock.Lock()
+	defer p.infoLock.Unlock()
+	p.msgsSent++
+	p.rawSent += uint64(raw)
+	p.wireSent += uint64(wire)
+	p.lastActive = time.Now()
+}
+
+func (p *peer) idle() bool {
+	p.infoLock.Lock()
+	defer p.infoLock.Unlock()
+	return time.Since(p.lastActive) >= heartbeatInterval
+}
+
+/** 返回与对端的连接，没有连接时建立连接，调用方不能持有 p.lock
+ * dial 和压缩协商期间不持有 p.lock，其他协程仍可以检查连接状态和心跳；
+ * 同一对端同时只有一个协程在建立连接，其他需要连接的协程最多等待到各自的 maxWait
+ */
+func (pm *PeerManager) connect(p *peer, maxWait time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(maxWait)
+	for {
+		p.lock.Lock()
+		if p.conn != nil {
+			conn := p.conn
+			p.lock.Unlock()
+			return conn, nil
+		}
+		if pm.closed() {
+			p.lock.Unlock()
+			return nil, errPeerManagerClosed
+		}
+		// 启动阶段的发送不受退避限制
+		p.infoLock.Lock()
+		retryAt := p.retryAt
+		p.infoLock.Unlock()
+		if maxWait <= defaultDialTimeout && time.Now().Before(retryAt) {
+			p.lock.Unlock()
+			return nil, fmt.Errorf("%w: retry after %v", errPeerBackoff, time.Until(retryAt).Round(time.Millisecond))
+		}
+		if dialing := p.dialing; dialing != nil {
+			p.lock.Unlock()
+			timer := time.NewTimer(time.Until(deadline))
+			select {
+			case <-dialing:
+				timer.Stop()
+				continue
+			case <-timer.C:
+				return nil, fmt.Errorf("%w: %s is being dialed by another sender", errDialTimeout, p.addr)
+			case <-pm.stopCh:
+				timer.Stop()
+				return nil, errPeerManagerClosed
+			}
+		}
+		dialing := make(chan struct{})
+		p.dialing = dialing
+		p.lock.Unlock()
+
+		conn, codec, err := pm.dialPeer(p, time.Until(deadline))
+
+		p.lock.Lock()
+		p.dialing = nil
+		if err == nil {
+			p.conn = conn
+			p.infoLock.Lock()
+			p.codec = codec
+			p.infoLock.Unlock()
+		}
+		p.lock.Unlock()
+		close(dialing)
+		return conn, err
+	}
+}
+
+/* 建立连接并协商压缩算法，更新对端的状态和退避时间，不持有 p.lock */
+func (pm *PeerManager) dialPeer(p *peer, maxWait time.Duration) (net.Conn, string, error) {
+	p.setState(PeerConnecting, nil)
+	conn, fails, err := pm.dial(p.addr, maxWait)
+
+	p.infoLock.Lock()
+	p.dialFails += fails
+	if err != nil {
+		p.state = PeerDisconnected
+		p.lastErr = err.Error()
+		p.backoff *= 2
+		if p.backoff < minPeerBackoff {
+			p.backoff = minPeerBackoff
+		}
+		if p.backoff > maxPeerBackoff {
+			p.backoff = maxPeerBackoff
+		}
+		p.retryAt = time.Now().Add(p.backoff)
+		p.infoLock.Unlock()
+		return nil, "", err
+	}
+	p.backoff = 0
+	p.retryAt = time.Time{}
+	if p.everDialed {
+		p.reconnects++
+		log.Debug("peer reconnected", "addr", p.addr, "reconnects", p.reconnects)
+	}
+	p.everDialed = true
+	p.state = PeerConnected
+	p.lastActive = time.Now()
+	p.infoLock.Unlock()
+
+	go pm.readLoop(p, conn)
+	// 开启压缩时先协商算法，协商的回复由读协程交给 hello
+	codec := ""
+	if compressCodec != "" {
+		codec = pm.hello(conn, p.addr)
+	}
+	return conn, codec, nil
+}
+
+/* 关闭并丢弃连接，调用方需持有 p.lock */
+func (p *peer) evict(err error) {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	p.setState(PeerDisconnected, err)
+	if err != nil {
+		log.Debug("evict peer connection", "addr", p.addr, "err", err)
+	}
+}
+
+/** 调用方不能持有 p.lock；写失败时重新建立连接并再写一次
+ * before 不为nil时在写入前以将要写入的连接调用，此时持有 p.lock
+ */
+func (pm *PeerManager) write(p *peer, msgBytes []byte, maxWait time.Duration, before func(conn net.Conn)) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn net.Conn
+		if conn, err = pm.connect(p, maxWait); err != nil {
+			return err
+		}
+		p.lock.Lock()
+		if p.conn != conn {
+			// 连接在建立后被关闭或替换
+			p.lock.Unlock()
+			err = fmt.Errorf("connection to %s closed before write", p.addr)
+			continue
+		}
+		p.infoLock.Lock()
+		codec := p.codec
+		p.infoLock.Unlock()
+		if before != nil {
+			before(conn)
+		}
+		wire := compressFrame(msgBytes, codec)
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err = conn.Write(wire); err == nil {
+			p.markSent(len(msgBytes), len(wire))
+			p.lock.Unlock()
+			return nil
+		}
+		p.evict(err)
+		p.lock.Unlock()
+	}
+	return err
+}
+
+/* 通过与 addr 的长连接发送一条消息 */
+func (pm *PeerManager) Send(addr string, msgBytes []byte) error {
+	return pm.send(addr, msgBytes, defaultDialTimeout)
+}
+
+/* 与 Send 相同，但建立连接时等待更久，用于启动阶段对端可能还未监听的情况 */
+func (pm *PeerManager) SendPersistent(addr string, msgBytes []byte) error {
+	return pm.send(addr, msgBytes, startupDialTimeout)
+}
+
+func (pm *PeerManager) send(addr string, msgBytes []byte, maxWait time.Duration) error {
+	return pm.write(pm.getPeer(addr), msgBytes, maxWait, nil)
+}
+
+/** 新建一条短连接发送一条消息后关闭，不影响长连接
+ * 与长连接一样设置写超时，开启压缩时先协商算法
+ */
+func (pm *PeerManager) SendOnce(addr string, msgBytes []byte) error {
+	conn, _, err := pm.dial(addr, defaultDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	codec := ""
+	if compressCodec != "" {
+		// 协商的回复由读协程交给 hello，连接关闭后读协程退出
+		go pm.readLoop(&peer{addr: addr}, conn)
+		codec = pm.hello(conn, addr)
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = conn.Write(compressFrame(msgBytes, codec))
+	return err
+}
+
+/** 向 addr 发送一条rpc请求，并等待对端在同一连接上的回复，同时返回回复的传输字节数
+ * 超时、连接断开或对端处理出错时返回对应的 core.ErrRPC* 错误
+ */
+func (pm *PeerManager) Call(addr string, msgType string, data []byte, timeout time.Duration) (*core.Msg, core.TransferSize, error) {
+	reqID := atomic.AddUint64(&pm.nextReqID, 1)
+	call := &pendingCall{
+		replyCh: make(chan *rpcReply, 1),
+		errCh:   make(chan error, 1),
+	}
+	msgBytes := packEnvelope(&core.Msg{MsgType: msgType, Data: data, ReqID: reqID}, addr)
+
+	defer func() {
+		pm.pendingLock.Lock()
+		delete(pm.pending, reqID)
+		pm.pendingLock.Unlock()
+	}()
+	// 在写入之前登记，保证读协程收到回复时能找到该请求；重写到新连接时更新
+	err := pm.write(pm.getPeer(addr), msgBytes, defaultDialTimeout, func(conn net.Conn) {
+		pm.pendingLock.Lock()
+		call.conn = conn
+		pm.pending[reqID] = call
+		pm.pendingLock.Unlock()
+	})
+	if err != nil {
+		return nil, core.TransferSize{}, fmt.Errorf("%w: %s %v", core.ErrRPCUnreachable, addr, err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-call.replyCh:
+		if reply.msg.Err != "" {
+			return reply.msg, reply.size, fmt.Errorf("%w: %s", core.ErrRPCRemote, reply.msg.Err)
+		}
+		return reply.msg, reply.size, nil
+	case err := <-call.errCh:
+		return nil, core.TransferSize{}, err
+	case <-timer.C:
+		return nil, core.TransferSize{}, fmt.Errorf("%w: %s %s after %v", core.ErrRPCTimeout, msgType, addr, timeout)
+	case <-pm.stopCh:
+		return nil, core.TransferSize{}, fmt.Errorf("%w: %v", core.ErrRPCConnClosed, errPeerManagerClosed)
+	}
+}
+
+/* 读取一条带长度前缀的消息，压缩过的消息返回解压后的内容 */
+func readFrame(conn net.Conn) ([]byte, error) {
+	packed, _, err := readWireFrame(conn)
+	return packed, err
+}
+
+/* 读取连接上的rpc回复，连接出错时关闭连接，并使该连接上所有未完成的请求失败 */
+func (pm *PeerManager) readLoop(p *peer, conn net.Conn) {
+	identity, err := handshakeIdentity(conn)
+	for err == nil {
+		var packed []byte
+		var size core.TransferSize
+		packed, size, err = readWireFrame(conn)
+		if err != nil {
+			break
+		}
+		msg := unpackMsg(packed)
+		if msgVerifier != nil {
+			// 回复必须来自拨号的地址，verify 再检查签名者是该地址应使用的账户
+			if msg.From != p.addr {
+				log.Warn(envelopeErrMsg(msg, fmt.Errorf("%w: dialed %s", errWrongReplier, p.addr)))
+				continue
+			}
+			if verr := msgVerifier.verify(msg); verr != nil {
+				log.Warn(envelopeErrMsg(msg, verr))
+				continue
+			}
+		}
+		if identity != nil && msg.Signer != *identity {
+			log.Warn(envelopeErrMsg(msg, errTLSIdentityMismatch))
+			continue
+		}
+		pm.pendingLock.Lock()
+		call, ok := pm.pending[msg.ReqID]
+		pm.pendingLock.Unlock()
+		if !ok || call.conn != conn {
+			log.Debug("drop rpc reply without pending request", "addr", p.addr, "reqID", msg.ReqID, "msgType", msg.MsgType)
+			continue
+		}
+		select {
+		case call.replyCh <- &rpcReply{msg: msg, size: size}:
+		default: // 重复的回复
+		}
+	}
+
+	// 先使请求失败，再关闭连接：连接建立时的压缩协商持有 p.lock 等待回复
+	pm.pendingLock.Lock()
+	for _, call := range pm.pending {
+		if call.conn == conn {
+			select {
+			case call.errCh <- fmt.Errorf("%w: %s %v", core.ErrRPCConnClosed, p.addr, err):
+			default:
+			}
+		}
+	}
+	pm.pendingLock.Unlock()
+
+	p.lock.Lock()
+	if p.conn == conn {
+		p.evict(err)
+	}
+	p.lock.Unlock()
+}
+
+/* 启动心跳协程 */
+func (pm *PeerManager) Start() {
+	pm.wg.Add(1)
+	go pm.heartbeatLoop()
+}
+
+func (pm *PeerManager) heartbeatLoop() {
+	defer pm.wg.Done()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pm.stopCh:
+			return
+		case <-ticker.C:
+			pm.lock.RLock()
+			list := make([]*peer, 0, len(pm.peers))
+			for _, p := range pm.peers {
+				list = append(list, p)
+			}
+			pm.lock.RUnlock()
+			for _, p := range list {
+				pm.ping(p)
+			}
+		}
+	}
+}
+
+/* 向空闲的连接发送心跳并等待回复，失败则关闭连接 */
+func (pm *PeerManager) ping(p *peer) {
+	p.lock.Lock()
+	conn := p.conn
+	p.lock.Unlock()
+	if conn == nil || !p.idle() {
+		return
+	}
+
+	_, _, err := pm.Call(p.addr, Ping, nil, pingTimeout)
+	if err != nil {
+		p.lock.Lock()
+		if p.conn == conn {
+			p.evict(fmt.Errorf("heartbeat fail: %v", err))
+		}
+		p.lock.Unlock()
+		return
+	}
+	p.markActive(false)
+}
+
+/* 关闭除 preserved 外的所有连接 */
+func (pm *PeerManager) CloseExcept(preserved map[string]struct{}) (before, after int) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	before = len(pm.peers)
+	for addr, p := range pm.peers {
+		if _, ok := preserved[addr]; ok {
+			continue
+		}
+		p.lock.Lock()
+		p.evict(nil)
+		p.lock.Unlock()
+		delete(pm.peers, addr)
+	}
+	return before, len(pm.peers)
+}
+
+/* 停止心跳并关闭所有连接 */
+func (pm *PeerManager) Close() {
+	close(pm.stopCh)
+	pm.wg.Wait()
+	pm.CloseExcept(nil)
+}
+
+/* 所有对端连接的状态，按地址排序 */
+func (pm *PeerManager) PeerInfos() []PeerInfo {
+	pm.lock.RLock()
+	list := make([]*peer, 0, len(pm.peers))
+	for _, p := range pm.peers {
+		list = append(list, p)
+	}
+	pm.lock.RUnlock()
+
+	infos := make([]PeerInfo, 0, len(list))
+	for _, p := range list {
+		p.infoLock.Lock()
+		infos = append(infos, PeerInfo{
+			Addr:          p.addr,
+			State:         p.state.String(),
+			Reconnects:    p.reconnects,
+			DialFails:     p.dialFails,
+			MsgsSent:      p.msgsSent,
+			Codec:         p.codec,
+			RawBytesSent:  p.rawSent,
+			WireBytesSent: p.wireSent,
+			LastActive:    p.lastActive,
+			LastErr:       p.lastErr,
+		})
+		p.infoLock.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr < infos[j].Addr })
+	return infos
+}
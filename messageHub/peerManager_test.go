@@ -0,0 +1,181 @@
+package messageHub
+
+import (
+	"encoding/binary"
+	"errors"
+	"go-w3chain/log"
+	"io"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/* 启动一个简单的接收端，统计收到的消息数，收到rpc请求时按 serveRPC 回复 */
+func startTestPeer(t *testing.T, received *int32) net.Listener {
+	return startTestPeerAt(t, "127.0.0.1:0", received)
+}
+
+func startTestPeerAt(t *testing.T, addr string, received *int32) net.Listener {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				writer := &connWriter{conn: conn}
+				for {
+					lenBuf := make([]byte, 4)
+					if _, err := io.ReadFull(conn, lenBuf); err != nil {
+						return
+					}
+					packed := make([]byte, binary.BigEndian.Uint32(lenBuf))
+					if _, err := io.ReadFull(conn, packed); err != nil {
+						return
+					}
+					if msg := unpackMsg(packed); msg.ReqID != 0 {
+						handleRPCRequest(msg, writer)
+						continue
+					}
+					atomic.AddInt32(received, 1)
+				}
+			}(conn)
+		}
+	}()
+	return ln
+}
+
+func waitReceived(t *testing.T, received *int32, want int32) {
+	deadline := time.Now().Add(3 * time.Second)
+	for atomic.LoadInt32(received) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d msgs, want %d", atomic.LoadInt32(received), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPeerManagerRedial(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testPeerManager.log"))
+	var received int32
+	ln := startTestPeer(t, &received)
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	pm := NewPeerManager()
+	defer pm.Close()
+	if err := pm.Send(addr, packEnvelope(packMsg(ReportAny, nil), addr)); err != nil {
+		t.Fatalf("send fail: %v", err)
+	}
+	waitReceived(t, &received, 1)
+
+	// 连接失效后，写失败的消息在重新建立的连接上发送
+	p := pm.getPeer(addr)
+	p.conn.Close()
+	if err := pm.Send(addr, packEnvelope(packMsg(ReportAny, nil), addr)); err != nil {
+		t.Fatalf("send after conn broken fail: %v", err)
+	}
+	waitReceived(t, &received, 2)
+
+	// 空闲连接的心跳
+	p.lastActive = time.Now().Add(-2 * heartbeatInterval)
+	pm.ping(p)
+	if p.conn == nil || p.idle() {
+		t.Fatalf("heartbeat fail, state: %v lastErr: %s", p.state, p.lastErr)
+	}
+
+	// 心跳也通过rpc发送，计入发送的消息数
+	infos := pm.PeerInfos()
+	if len(infos) != 1 || infos[0].Reconnects != 1 || infos[0].MsgsSent != 3 || infos[0].State != "connected" {
+		t.Fatalf("unexpected peer info: %+v", infos)
+	}
+}
+
+func TestPeerManagerBackoff(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testPeerManager.log"))
+	var received int32
+	ln := startTestPeer(t, &received)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	pm := NewPeerManager()
+	defer pm.Close()
+	if err := pm.send(addr, packEnvelope(packMsg(ReportAny, nil), addr), 300*time.Millisecond); !errors.Is(err, errDialTimeout) {
+		t.Fatalf("send to closed peer should time out, err: %v", err)
+	}
+	// 退避期间不再dial，立即失败
+	start := time.Now()
+	if err := pm.Send(addr, packEnvelope(packMsg(ReportAny, nil), addr)); !errors.Is(err, errPeerBackoff) {
+		t.Fatalf("send during backoff should fail fast, err: %v", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("send during backoff took %v", time.Since(start))
+	}
+	if infos := pm.PeerInfos(); infos[0].State != "disconnected" || infos[0].DialFails == 0 {
+		t.Fatalf("unexpected peer info: %+v", infos)
+	}
+
+	// 发送失败只记录警告，不退出进程，由调用方处理
+	oldPeers := peers
+	peers = pm
+	defer func() { peers = oldPeers }()
+	if sendMsg("test", addr, packMsg(ReportAny, nil)) {
+		t.Fatal("send to closed peer reported success")
+	}
+}
+
+func TestPeerManagerDialWithoutLock(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testPeerManager.log"))
+	var received int32
+	ln := startTestPeer(t, &received)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	pm := NewPeerManager()
+	defer pm.Close()
+	persistent := make(chan error, 1)
+	go func() { persistent <- pm.SendPersistent(addr, packEnvelope(packMsg(ReportAny, nil), addr)) }()
+	p := pm.getPeer(addr)
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		p.lock.Lock()
+		dialing := p.dialing != nil
+		p.lock.Unlock()
+		if dialing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("persistent send did not start dialing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 启动阶段的 dial 不持有连接锁，其他发送方只等待到自己的超时
+	start := time.Now()
+	if err := pm.send(addr, packEnvelope(packMsg(ReportAny, nil), addr), 300*time.Millisecond); !errors.Is(err, errDialTimeout) {
+		t.Fatalf("send while another sender dials should time out, err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("send blocked by the persistent dial for %v", elapsed)
+	}
+
+	// 对端开始监听后，正在 dial 的发送成功
+	ln = startTestPeerAt(t, addr, &received)
+	defer ln.Close()
+	select {
+	case err := <-persistent:
+		if err != nil {
+			t.Fatalf("persistent send fail: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("persistent send not finished after the peer started listening")
+	}
+	waitReceived(t, &received, 1)
+}
@@ -2,30 +2,50 @@ package messageHub
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/gob"
 	"fmt"
 	"go-w3chain/cfg"
 	"go-w3chain/core"
 	"go-w3chain/log"
 	"go-w3chain/result"
-	"go-w3chain/utils"
 	"io"
 	"net"
 	"reflect"
 	"sync"
 )
 
-func listen(addr string, wg *sync.WaitGroup) {
+var (
+	contractLock      sync.Mutex
+	contractDelivered bool // 本进程已处理过合约地址
+)
+
+/* 监听直到 ctx 取消或调用 Close */
+func listen(ctx context.Context, addr string, wg *sync.WaitGroup) {
 	defer wg.Done()
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Error("Error setting up listener", "err", err)
 	}
+	if secureTransport != nil {
+		ln = secureTransport.listen(ln)
+	}
 	log.Info(fmt.Sprintf("start listening on %s", addr))
-	listenConn = ln
+	track(ln, nil)
+	defer untrack(ln, nil)
 	defer ln.Close()
 
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Info(fmt.Sprintf("stop listening on %s", addr))
+			ln.Close()
+		case <-stop:
+		}
+	}()
+
 	for {
 		// // 超过时间限制没有收到新的连接则退出
 		// ln.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
@@ -34,7 +54,7 @@ func listen(addr string, wg *sync.WaitGroup) {
 			log.Debug("Error accepting connection", "err", err)
 			return
 		}
-		go handleConnection(conn, ln)
+		go handleConnection(conn)
 
 	}
 }
@@ -83,71 +103,6 @@ func handleClientSetInjectDone(dataBytes []byte) {
 	committee_ref.SetInjectTXDone(data.Cid)
 }
 
-func handleComGetHeight(dataBytes []byte, conn net.Conn) {
-	var buf bytes.Buffer
-	buf.Write(dataBytes)
-	dataDec := gob.NewDecoder(&buf)
-
-	var data core.ComGetHeight
-	err := dataDec.Decode(&data)
-	if err != nil {
-		log.Error("decodeDataErr", "err", err, "dataBytes", data)
-	}
-
-	log.Info("Msg Received: ComGetHeight", "data", data)
-
-	// 直接通过这个连接回复请求方
-	height := shard_ref.HandleComGetHeight(&data)
-	var buf1 bytes.Buffer
-	encoder := gob.NewEncoder(&buf1)
-	err = encoder.Encode(height)
-	if err != nil {
-		log.Error("gobEncodeErr", "err", err, "data", data)
-	}
-	msgBytes := buf1.Bytes()
-
-	// 前缀加上长度，防止粘包
-	networkBuf := make([]byte, 4+len(msgBytes))
-	binary.BigEndian.PutUint32(networkBuf[:4], uint32(len(msgBytes)))
-	copy(networkBuf[4:], msgBytes)
-	// 发送回复
-	_, err = conn.Write(networkBuf)
-	if err != nil {
-		log.Error("WriteError", "err", err)
-	}
-
-}
-
-func handleComGetState(dataBytes []byte) {
-	var buf bytes.Buffer
-	buf.Write(dataBytes)
-	dataDec := gob.NewDecoder(&buf)
-
-	var data core.ComGetState
-	err := dataDec.Decode(&data)
-	if err != nil {
-		log.Error("decodeDataErr", "err", err, "dataBytes", data)
-	}
-
-	log.Info("Msg Received: ComGetState", "addr count", len(data.AddrList))
-	shard_ref.HandleComGetState(&data)
-}
-
-func handleShardSendState(dataBytes []byte) {
-	var buf bytes.Buffer
-	buf.Write(dataBytes)
-	dataDec := gob.NewDecoder(&buf)
-
-	var data core.ShardSendState
-	err := dataDec.Decode(&data)
-	if err != nil {
-		log.Error("decodeDataErr", "err", err, "dataBytes", data)
-	}
-
-	log.Info("Msg Received: ShardSendState", "addr count", len(data.AccountData))
-	committee_ref.HandleShardSendState(&data)
-}
-
 func handleBooterSendContract(dataBytes []byte) {
 	var buf bytes.Buffer
 	buf.Write(dataBytes)
@@ -160,16 +115,28 @@ func handleBooterSendContract(dataBytes []byte) {
 	}
 
 	log.Info("Msg Received: BooterSendContract", "data", data)
+	deliverContract(&data)
+}
 
+/** 把合约地址交给本进程的节点、客户端和信标链
+ * 重启后向 booter 查询到的地址可能与 booter 部署后发送的地址都到达，只处理第一次
+ */
+func deliverContract(data *core.BooterSendContract) {
+	contractLock.Lock()
+	defer contractLock.Unlock()
+	if contractDelivered {
+		log.Debug("contract address already received", "data", data)
+		return
+	}
+	contractDelivered = true
 	if node_ref != nil {
 		// 注意是节点处理而不是分片或委员会处理
-		node_ref.HandleBooterSendContract(&data)
+		node_ref.HandleBooterSendContract(data)
 	}
 	if client_ref != nil {
-		client_ref.HandleBooterSendContract(&data)
+		client_ref.HandleBooterSendContract(data)
 	}
-	tbChain_ref.HandleBooterSendContract(&data)
-
+	tbChain_ref.HandleBooterSendContract(data)
 }
 
 func handleComSendBlock(dataBytes []byte) {
@@ -244,7 +211,7 @@ func handleComSendTxReceipt(dataBytes []byte) {
 ////  booter  ////
 //////////////////////////////////////////////////
 
-func handleShardSendGenesis(dataBytes []byte) (exit bool) {
+func handleShardSendGenesis(dataBytes []byte) {
 	var buf bytes.Buffer
 	buf.Write(dataBytes)
 	dataDec := gob.NewDecoder(&buf)
@@ -257,8 +224,7 @@ func handleShardSendGenesis(dataBytes []byte) (exit bool) {
 
 	log.Info("Msg Received: ShardSendGenesis", "shardId", data.ShardID)
 
-	exit = booter_ref.HandleShardSendGenesis(&data)
-	return exit
+	booter_ref.HandleShardSendGenesis(&data)
 }
 
 // ////////////////////////////////////////////////
@@ -405,80 +371,6 @@ func handleSendReconfigResults2ComNodes(dataBytes []byte) {
 	node_ref.HandleSendReconfigResults2ComNodes(&data)
 }
 
-func handleGetPoolTx(dataBytes []byte, conn net.Conn) {
-	var buf bytes.Buffer
-	buf.Write(dataBytes)
-	dataDec := gob.NewDecoder(&buf)
-
-	var data core.GetPoolTx
-	err := dataDec.Decode(&data)
-	if err != nil {
-		log.Error("decodeDataErr", "err", err, "dataBytes", data)
-	}
-
-	log.Info(fmt.Sprintf("Msg Received: %s", GetPoolTx))
-
-	// 直接通过这个连接回复请求方
-	poolTx := committee_ref.HandleGetPoolTx(&data)
-	var buf1 bytes.Buffer
-	encoder := gob.NewEncoder(&buf1)
-	err = encoder.Encode(poolTx)
-	if err != nil {
-		log.Error("gobEncodeErr", "err", err, "data", data)
-	}
-	msgBytes := buf1.Bytes()
-
-	// 前缀加上长度，防止粘包
-	networkBuf := make([]byte, 4+len(msgBytes))
-	binary.BigEndian.PutUint32(networkBuf[:4], uint32(len(msgBytes)))
-	copy(networkBuf[4:], msgBytes)
-	// 发送回复
-	_, err = conn.Write(networkBuf)
-	if err != nil {
-		log.Error("WriteError", "err", err)
-	}
-
-	log.Info(fmt.Sprintf("Msg response Sent: %s len(Pending): %d len(PendingRollback): %d", GetPoolTx, len(poolTx.Pending), len(poolTx.PendingRollback)))
-	log.Info(fmt.Sprintf("Analyse txPool size... sizeof txPool: %d", len(utils.EncodeAny(poolTx))))
-
-}
-
-func handleGetSyncData(dataBytes []byte, conn net.Conn) {
-	var buf bytes.Buffer
-	buf.Write(dataBytes)
-	dataDec := gob.NewDecoder(&buf)
-
-	var data core.GetSyncData
-	err := dataDec.Decode(&data)
-	if err != nil {
-		log.Error("decodeDataErr", "err", err, "dataBytes", data)
-	}
-
-	log.Info(fmt.Sprintf("Msg Received: %s syncMode: %s", GetSyncData, data.SyncType))
-
-	// 直接通过这个连接回复请求方
-	syncData := shard_ref.HandleGetSyncData(&data)
-	var buf1 bytes.Buffer
-	encoder := gob.NewEncoder(&buf1)
-	err = encoder.Encode(syncData)
-	if err != nil {
-		log.Error("gobEncodeErr", "err", err, "data", data)
-	}
-	msgBytes := buf1.Bytes()
-
-	// 前缀加上长度，防止粘包
-	networkBuf := make([]byte, 4+len(msgBytes))
-	binary.BigEndian.PutUint32(networkBuf[:4], uint32(len(msgBytes)))
-	copy(networkBuf[4:], msgBytes)
-	// 发送回复
-	_, err = conn.Write(networkBuf)
-	if err != nil {
-		log.Error("WriteError", "err", err)
-	}
-	log.Info(fmt.Sprintf("Msg response Sent: %s syncMode: %s len(states): %d len(blocks): %d", GetSyncData, data.SyncType, len(syncData.States), len(syncData.Blocks)))
-	log.Info(fmt.Sprintf("Analyse SyncData size... sizeof State(bytes): %d  sizeof Blocks(bytes): %d", len(utils.EncodeAny(syncData.States)), len(utils.EncodeAny(syncData.Blocks))))
-}
-
 func handleSendNewNodeTable2Client(dataBytes []byte) {
 	var buf bytes.Buffer
 	buf.Write(dataBytes)
@@ -492,6 +384,11 @@ func handleSendNewNodeTable2Client(dataBytes []byte) {
 
 	log.Info(fmt.Sprintf("Msg Received: %s", SendNewNodeTable2Client))
 
+	updateComNodeTable(data)
+}
+
+/* 客户端收到新的委员会地址表后更新本地的地址表 */
+func updateComNodeTable(data map[uint32]map[uint32]string) {
 	if !reflect.DeepEqual(cfg.ComNodeTable, data) {
 		cfg.ComNodeTable = data
 		// 打印各委员会的新leader，以及各委员会有的成员
@@ -536,19 +433,63 @@ func handleReportAny(dataBytes []byte) {
 	log.Info(fmt.Sprintf("Msg Received: %s", ReportAny))
 
 	log.Info("got msg report.", "msg", data)
+	result.AddReport(data)
+}
+
+/* 记录监听和连入的连接，Close 时关闭 */
+func track(ln net.Listener, conn net.Conn) {
+	listenLock.Lock()
+	defer listenLock.Unlock()
+	if ln != nil {
+		listeners[ln] = struct{}{}
+	}
+	if conn != nil {
+		inboundConns[conn] = struct{}{}
+	}
+}
+
+func untrack(ln net.Listener, conn net.Conn) {
+	listenLock.Lock()
+	defer listenLock.Unlock()
+	delete(listeners, ln)
+	delete(inboundConns, conn)
 }
 
-func handleConnection(conn net.Conn, ln net.Listener) {
+/* 关闭所有监听和连入的连接，各连接已入队的消息处理完后其协程退出 */
+func closeListeners() {
+	listenLock.Lock()
+	defer listenLock.Unlock()
+	for ln := range listeners {
+		ln.Close()
+	}
+	for conn := range inboundConns {
+		conn.Close()
+	}
+}
+
+func handleConnection(conn net.Conn) {
+	track(nil, conn)
+	defer untrack(nil, conn)
 	defer conn.Close()
+	writer := &connWriter{conn: conn}
+	identity, err := handshakeIdentity(conn)
+	if err != nil {
+		log.Warn("tls handshake fail", "remoteAddr", conn.RemoteAddr(), "err", err)
+		return
+	}
 
 	// reader := bufio.NewReader(conn)
+	var inbound *inboundQueue
+	if inboundEnabled {
+		inbound = newInboundQueue(func(msg *core.Msg) { handleMsg(msg) })
+		defer inbound.close()
+	}
 
 	for {
-		// 先接收消息长度，再读消息
-		lenBuf := make([]byte, 4)
-		_, err := io.ReadFull(conn, lenBuf)
+		// 先接收消息长度，再读消息；压缩过的消息在此解压
+		packedMsg, _, err := readWireFrame(conn)
 		if err != nil {
-			if err.Error() == "EOF" {
+			if err == io.EOF {
 				// 发送端主动关闭连接
 				return
 			}
@@ -559,81 +500,103 @@ func handleConnection(conn net.Conn, ln net.Listener) {
 			log.Debug("Error reading from connection", "err", err)
 			return
 		}
-		length := int(binary.BigEndian.Uint32(lenBuf))
-		packedMsg := make([]byte, length)
-		_, err = io.ReadFull(conn, packedMsg)
-		if err != nil {
-			log.Error("Error reading from connection", "err", err)
-		}
 
 		msg := unpackMsg(packedMsg)
-		switch msg.MsgType {
-		// booter
-		case ShardSendGenesis:
-			exit := handleShardSendGenesis(msg.Data)
-			if exit {
-				ln.Close()
-				return
+		// 注册时发送方尚不在地址表中，也还没有签名者，注册信息由节点账户单独签名
+		if !isRegistryRPC(msg) {
+			if msgVerifier != nil {
+				if err := msgVerifier.verify(msg); err != nil {
+					log.Warn(envelopeErrMsg(msg, err))
+					continue
+				}
+			}
+			if identity != nil && msg.Signer != *identity {
+				log.Warn(envelopeErrMsg(msg, errTLSIdentityMismatch))
+				continue
 			}
-		case BooterSendContract:
-			handleBooterSendContract(msg.Data)
-
-		case ComGetHeight:
-			handleComGetHeight(msg.Data, conn)
-
-		case ComGetState:
-			go handleComGetState(msg.Data)
-		case ShardSendState:
-			go handleShardSendState(msg.Data)
-
-		case ClientSendTx:
-			go handleClientSendTx(msg.Data)
-		case ClientSetInjectDone:
-			handleClientSetInjectDone(msg.Data)
-		case ComSendTxReceipt:
-			go handleComSendTxReceipt(msg.Data)
-
-		case ComSendBlock:
-			go handleComSendBlock(msg.Data)
-
-		case LeaderInitMultiSign:
-			handleLeaderInitMultiSign(msg.Data)
-		case MultiSignReply:
-			handleMultiSignReply(msg.Data)
-
-		case LeaderInitReconfig:
-			handleLeaderInitReconfig(msg.Data)
-		case SendReconfigResult2ComLeader:
-			handleSendReconfigResult2ComLeader(msg.Data)
-		case SendReconfigResults2AllComLeaders:
-			handleSendReconfigResults2AllComLeaders(msg.Data)
-		case SendReconfigResults2ComNodes:
-			handleSendReconfigResults2ComNodes(msg.Data)
-		case GetPoolTx:
-			handleGetPoolTx(msg.Data, conn)
-		case GetSyncData:
-			handleGetSyncData(msg.Data, conn)
-		case SendNewNodeTable2Client:
-			handleSendNewNodeTable2Client(msg.Data)
-		// case SendTxPool:
-		// 	handleSendTxPool(msg.Data)
-
-		/////////////////////////
-		//// pbft /////
-		/////////////////////////
-		case CPrePrepare, CPrepare, CCommit, CReply, CRequestOldrequest, CSendOldrequest:
-			go handlePbftMsg(msg.Data, msg.MsgType)
-
-		case NodeSendInfo:
-			handleNodeSendInfo(msg.Data)
-
-		case ReportError:
-			handleReportErr(msg.Data)
-		case ReportAny:
-			handleReportAny(msg.Data)
-
-		default:
-			log.Error("Unknown message type received", "msgType", msg.MsgType)
 		}
+		// 压缩协商需在处理之后的消息之前完成
+		if msg.MsgType == Hello && msg.ReqID != 0 {
+			handleHello(msg, writer)
+			continue
+		}
+		// rpc请求由单独的协程处理，处理完后在该连接上回复
+		if msg.ReqID != 0 {
+			go handleRPCRequest(msg, writer)
+			continue
+		}
+		// 转发的广播消息，取出原始消息处理
+		if msg.MsgType == Relay {
+			if relayer == nil {
+				continue
+			}
+			if msg = relayer.handleRelay(msg.Data); msg == nil {
+				continue
+			}
+		}
+		// 开启接收队列时共识类和交易类消息入队，由各自的协程处理，避免处理较慢时阻塞读取
+		if inbound != nil && classOf(msg.MsgType) != classControl {
+			inbound.push(msg)
+			continue
+		}
+		handleMsg(msg)
+	}
+}
+
+/** 按消息类型交给对应模块处理
+ * 开启接收队列时，共识类和交易类消息在接收队列的协程中调用，处理完一条再处理下一条，使队列长度能够反映处理的积压
+ */
+func handleMsg(msg *core.Msg) {
+	switch msg.MsgType {
+	// booter
+	case ShardSendGenesis:
+		handleShardSendGenesis(msg.Data)
+	case BooterSendContract:
+		handleBooterSendContract(msg.Data)
+
+	case ClientSendTx:
+		handleClientSendTx(msg.Data)
+	case ClientSetInjectDone:
+		handleClientSetInjectDone(msg.Data)
+	case ComSendTxReceipt:
+		handleComSendTxReceipt(msg.Data)
+
+	case ComSendBlock:
+		handleComSendBlock(msg.Data)
+
+	case LeaderInitMultiSign:
+		handleLeaderInitMultiSign(msg.Data)
+	case MultiSignReply:
+		handleMultiSignReply(msg.Data)
+
+	case LeaderInitReconfig:
+		handleLeaderInitReconfig(msg.Data)
+	case SendReconfigResult2ComLeader:
+		handleSendReconfigResult2ComLeader(msg.Data)
+	case SendReconfigResults2AllComLeaders:
+		handleSendReconfigResults2AllComLeaders(msg.Data)
+	case SendReconfigResults2ComNodes:
+		handleSendReconfigResults2ComNodes(msg.Data)
+	case SendNewNodeTable2Client:
+		handleSendNewNodeTable2Client(msg.Data)
+	// case SendTxPool:
+	// 	handleSendTxPool(msg.Data)
+
+	/////////////////////////
+	//// pbft /////
+	/////////////////////////
+	case CPrePrepare, CPrepare, CCommit, CReply, CRequestOldrequest, CSendOldrequest:
+		handlePbftMsg(msg.Data, msg.MsgType)
+
+	case NodeSendInfo:
+		handleNodeSendInfo(msg.Data)
+
+	case ReportError:
+		handleReportErr(msg.Data)
+	case ReportAny:
+		handleReportAny(msg.Data)
+
+	default:
+		log.Error("Unknown message type received", "msgType", msg.MsgType)
 	}
 }
@@ -0,0 +1,151 @@
+package messageHub
+
+import (
+	"go-w3chain/cfg"
+	"go-w3chain/core"
+	"go-w3chain/log"
+)
+
+/** 消息的路由规则，GoodMessageHub、LocalMessageHub 发送消息和 FaultyMessageHub 注入故障时共用
+ * self 为本实例的地址，其余字段为地址表的规模
+ */
+type routing struct {
+	self          string
+	shardNum      int
+	shardSize     int
+	comAllNodeNum int
+	clientNum     int
+}
+
+/* GoodMessageHub 使用的路由规则，地址表规模在 Init 时设置 */
+func goodRouting() routing {
+	r := routing{
+		shardNum:      shardNum,
+		shardSize:     shardSize,
+		comAllNodeNum: comAllNodeNum,
+		clientNum:     clientNum,
+	}
+	if node_ref != nil {
+		r.self = node_ref.NodeInfo.NodeAddr
+	}
+	return r
+}
+
+/** 返回消息经网络发往的所有地址；返回nil表示消息不经过网络（如在本进程的信标链中处理）
+ * 多目标消息的地址在调用时从地址表中拷贝，接收方收到消息后更新地址表不影响本次发送
+ */
+func (r routing) targets(msgType uint32, id uint32, msg interface{}) []string {
+	switch msgType {
+	case core.MsgTypeComGetHeightFromShard, core.MsgTypeComGetStateFromShard,
+		core.MsgTypeSendBlock2Shard, core.MsgTypeGetTB:
+		// 分片的leader节点
+		return []string{cfg.NodeTable[id][0]}
+	case core.MsgTypeShardSendGenesis:
+		return []string{msg.(*core.ShardSendGenesis).Target_nodeAddr}
+	case core.MsgTypeGetPoolTx:
+		// 旧委员会的leader节点
+		return []string{msg.(*core.GetPoolTx).ServerAddr}
+	case core.MsgTypeGetSyncData:
+		return []string{msg.(*core.GetSyncData).ServerAddr}
+	case core.MsgTypeClientInjectTX2Committee, core.MsgTypeSendMultiSignReply,
+		core.MsgTypeSendReconfigResult2ComLeader, core.MsgTypeNodeSendInfo2Leader:
+		// 委员会的leader节点
+		return []string{cfg.ComNodeTable[id][0]}
+	case core.MsgTypeCommitteeReply2Client, core.MsgTypeReportError, core.MsgTypeReportAny:
+		return []string{cfg.ClientTable[id]}
+
+	case core.MsgTypeLeaderInitMultiSign:
+		// 委员会中的所有共识节点（包括自己）
+		return r.consensusAddrs(id, false, false)
+	case core.MsgTypePbftPrePrepare, core.MsgTypePbftPrepare, core.MsgTypePbftCommit:
+		return r.consensusAddrs(id, true, false)
+	case core.MsgTypePbftReply, core.MsgTypePbftRequestOldMessage:
+		// reply、RequestOldMessage 只需发给leader
+		return r.consensusAddrs(id, true, true)
+	case core.MsgTypePbftSendOldMessage:
+		receiver := msg.(*core.SendOldMessage).ReceiverInfo
+		return []string{cfg.ComNodeTable[receiver.ComID][receiver.NodeID]}
+
+	case core.MsgTypeLeaderInitReconfig:
+		// 委员会内包括非共识节点在内的所有节点
+		return r.comNodeAddrs(id, msg.(*core.InitReconfig).ComNodeNum)
+	case core.MsgTypeSendReconfigResults2ComNodes:
+		return r.comNodeAddrs(id, msg.(map[uint32]*core.ComReconfigResults)[id].ComNodeNum)
+	case core.MsgTypeSendReconfigResults2AllComLeaders:
+		addrs := make([]string, 0, r.shardNum)
+		var i uint32
+		for i = 0; i < uint32(r.shardNum); i++ {
+			addrs = append(addrs, cfg.ComNodeTable[i][0])
+		}
+		return addrs
+
+	case core.MsgTypeSetInjectDone2Nodes:
+		return r.nodeAddrs()
+	case core.MsgTypeBooterSendContract:
+		// 所有节点和客户端
+		return append(r.nodeAddrs(), r.clientAddrs()...)
+	case core.MsgTypeSendNewNodeTable2Client:
+		return r.clientAddrs()
+	default:
+		return nil
+	}
+}
+
+/** 委员会 comID 中共识节点的地址
+ * skipSelf 为 true 时不包括本实例，leaderOnly 为 true 时只包括leader
+ */
+func (r routing) consensusAddrs(comID uint32, skipSelf bool, leaderOnly bool) []string {
+	addrs := make([]string, 0, r.shardSize)
+	var i uint32
+	for i = 0; i < uint32(r.shardSize); i++ {
+		if i > 0 && leaderOnly {
+			break
+		}
+		addr := cfg.ComNodeTable[comID][i]
+		if skipSelf && addr == r.self {
+			continue
+		}
+		if addr == "" {
+			if i == 3 {
+				// pbft最低允许只有3个节点
+				continue
+			} else {
+				log.Error("address is empty.")
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+/* 委员会 comID 中前 num 个节点的地址 */
+func (r routing) comNodeAddrs(comID uint32, num uint32) []string {
+	addrs := make([]string, 0, num)
+	var i uint32
+	for i = 0; i < num; i++ {
+		addrs = append(addrs, cfg.ComNodeTable[comID][i])
+	}
+	return addrs
+}
+
+/* 所有分片的所有节点的地址 */
+func (r routing) nodeAddrs() []string {
+	addrs := make([]string, 0, r.shardNum*r.comAllNodeNum)
+	var i, j uint32
+	for i = 0; i < uint32(r.shardNum); i++ {
+		for j = 0; j < uint32(r.comAllNodeNum); j++ {
+			addrs = append(addrs, cfg.NodeTable[i][j])
+		}
+	}
+	return addrs
+}
+
+/* 所有客户端的地址 */
+func (r routing) clientAddrs() []string {
+	addrs := make([]string, 0, r.clientNum)
+	var i uint32
+	for i = 0; i < uint32(r.clientNum); i++ {
+		addrs = append(addrs, cfg.ClientTable[i])
+	}
+	return addrs
+}
@@ -0,0 +1,201 @@
+package messageHub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"net"
+	"sync"
+	"time"
+)
+
+/** 各类rpc请求等待回复的最长时间
+ * rpc出错只记录警告（log.Error 会退出进程），由调用方根据返回的错误决定如何处理
+ */
+var rpcTimeouts = map[string]time.Duration{
+	Ping:         pingTimeout,
+	ComGetHeight: 10 * time.Second,
+	ComGetState:  30 * time.Second,
+	GetPoolTx:    30 * time.Second,
+	GetSyncData:  2 * time.Minute, // fullsync 需要传输整个分片的区块和状态
+	GetTB:        10 * time.Second,
+	Register:     10 * time.Second,
+	GetTopology:  10 * time.Second,
+	GetContract:  10 * time.Second,
+}
+
+var errNoRPCHandler = errors.New("no handler for this rpc on the node")
+
+/** 向 addr 发起rpc请求，请求 req 与回复 reply 都用 gob 编码，返回回复的传输字节数
+ * reply 必须是指针，出错时其内容不变
+ */
+func rpcCall(addr string, msgType string, req interface{}, reply interface{}) (core.TransferSize, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(req); err != nil {
+		log.Error("gobEncodeErr", "err", err, "data", req)
+		return core.TransferSize{}, err
+	}
+
+	start := time.Now()
+	msg, size, err := peers.Call(addr, msgType, buf.Bytes(), rpcTimeouts[msgType])
+	if err != nil {
+		log.Warn(fmt.Sprintf("RPC Error. msgType: %s targetAddr: %s err: %v", msgType, addr, err))
+		return size, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(reply); err != nil {
+		log.Warn("decodeDataErr", "err", err, "msgType", msgType)
+		return size, fmt.Errorf("%w: decode reply: %v", core.ErrRPCRemote, err)
+	}
+	log.Debug(fmt.Sprintf("RPC Done. msgType: %s targetAddr: %s elapsed: %v raw(bytes): %d wire(bytes): %d", msgType, addr, time.Since(start), size.Raw, size.Wire))
+	return size, nil
+}
+
+/* 被动连接的写端，rpc回复可能由多个协程并发写入 */
+type connWriter struct {
+	lock  sync.Mutex
+	conn  net.Conn
+	codec string // 对端在该连接上协商的压缩算法
+}
+
+func (w *connWriter) write(msgBytes []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := w.conn.Write(compressFrame(msgBytes, w.codec))
+	return err
+}
+
+/* 处理rpc请求，并通过收到请求的连接回复 */
+func handleRPCRequest(msg *core.Msg, w *connWriter) {
+	result, err := serveRPC(msg.MsgType, msg.Data)
+
+	reply := &core.Msg{MsgType: msg.MsgType, ReqID: msg.ReqID}
+	if err == nil && result != nil {
+		var buf bytes.Buffer
+		err = gob.NewEncoder(&buf).Encode(result)
+		reply.Data = buf.Bytes()
+	}
+	if err != nil {
+		log.Warn(fmt.Sprintf("RPC Handle Error. msgType: %s from: %s err: %v", msg.MsgType, msg.From, err))
+		reply.Err = err.Error()
+	}
+	if err := w.write(packEnvelope(reply, msg.From)); err != nil {
+		log.Warn("WriteError", "err", err)
+	}
+}
+
+func decodeRPCRequest(dataBytes []byte, req interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(dataBytes)).Decode(req)
+}
+
+/* 调用本节点对应模块处理rpc请求，返回需要回复的数据 */
+func serveRPC(msgType string, dataBytes []byte) (interface{}, error) {
+	switch msgType {
+	case Ping:
+		return nil, nil
+
+	case ComGetHeight:
+		if shard_ref == nil {
+			return nil, errNoRPCHandler
+		}
+		var req core.ComGetHeight
+		if err := decodeRPCRequest(dataBytes, &req); err != nil {
+			return nil, err
+		}
+		log.Info("Msg Received: ComGetHeight", "data", req)
+		return shard_ref.HandleComGetHeight(&req), nil
+
+	case ComGetState:
+		if shard_ref == nil {
+			return nil, errNoRPCHandler
+		}
+		var req core.ComGetState
+		if err := decodeRPCRequest(dataBytes, &req); err != nil {
+			return nil, err
+		}
+		log.Info("Msg Received: ComGetState", "addr count", len(req.AddrList))
+		state := shard_ref.HandleComGetState(&req)
+		if state == nil {
+			return nil, errors.New("shard failed to get state")
+		}
+		return state, nil
+
+	case GetPoolTx:
+		if committee_ref == nil {
+			return nil, errNoRPCHandler
+		}
+		var req core.GetPoolTx
+		if err := decodeRPCRequest(dataBytes, &req); err != nil {
+			return nil, err
+		}
+		log.Info(fmt.Sprintf("Msg Received: %s", GetPoolTx))
+		return committee_ref.HandleGetPoolTx(&req), nil
+
+	case GetSyncData:
+		if shard_ref == nil {
+			return nil, errNoRPCHandler
+		}
+		var req core.GetSyncData
+		if err := decodeRPCRequest(dataBytes, &req); err != nil {
+			return nil, err
+		}
+		log.Info(fmt.Sprintf("Msg Received: %s syncMode: %s", GetSyncData, req.SyncType))
+		return shard_ref.HandleGetSyncData(&req), nil
+
+	case GetTB:
+		if tbChain_ref == nil {
+			return nil, errNoRPCHandler
+		}
+		var req core.GetTB
+		if err := decodeRPCRequest(dataBytes, &req); err != nil {
+			return nil, err
+		}
+		log.Info(fmt.Sprintf("Msg Received: %s shardID: %d height: %d", GetTB, req.ShardID, req.Height))
+		tb := tbChain_ref.GetTimeBeacon(int(req.ShardID), req.Height)
+		if tb == nil {
+			return nil, fmt.Errorf("time beacon of shard %d height %d not confirmed", req.ShardID, req.Height)
+		}
+		return tb, nil
+
+	case Register:
+		if booter_ref == nil || !booter_ref.RegistryEnabled() {
+			return nil, errNoRPCHandler
+		}
+		var req core.RegisterPeer
+		if err := decodeRPCRequest(dataBytes, &req); err != nil {
+			return nil, err
+		}
+		log.Info(fmt.Sprintf("Msg Received: %s role: %s addr: %s", Register, req.Role, req.Addr))
+		if err := booter_ref.HandleRegister(&req); err != nil {
+			return nil, err
+		}
+		// 最后一个注册完成时，booter 自己也使用新的地址表
+		if t, err := booter_ref.HandleGetTopology(nil); err == nil {
+			applyTopologyOnce.Do(func() { applyTopology(t) })
+		}
+		return true, nil
+
+	case GetTopology:
+		if booter_ref == nil || !booter_ref.RegistryEnabled() {
+			return nil, errNoRPCHandler
+		}
+		var nonce []byte
+		if err := decodeRPCRequest(dataBytes, &nonce); err != nil {
+			return nil, err
+		}
+		return booter_ref.HandleGetTopology(nonce)
+
+	case GetContract:
+		if booter_ref == nil {
+			return nil, errNoRPCHandler
+		}
+		log.Info(fmt.Sprintf("Msg Received: %s", GetContract))
+		return booter_ref.HandleGetContract()
+
+	default:
+		return nil, fmt.Errorf("unknown rpc msgType %s", msgType)
+	}
+}
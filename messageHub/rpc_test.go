@@ -0,0 +1,173 @@
+package messageHub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"go-w3chain/node"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/* 启动一个接收端，每条rpc请求交给 handle 处理 */
+func startRPCTestPeer(t *testing.T, handle func(msg *core.Msg, conn net.Conn, w *connWriter)) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				writer := &connWriter{conn: conn}
+				for {
+					packed, err := readFrame(conn)
+					if err != nil {
+						return
+					}
+					handle(unpackMsg(packed), conn, writer)
+				}
+			}(conn)
+		}
+	}()
+	return ln
+}
+
+func TestRPCCall(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testRPC.log"))
+	pm := NewPeerManager()
+	defer pm.Close()
+
+	// 各请求在独立协程中处理，回复的顺序与请求不同
+	ln := startRPCTestPeer(t, func(msg *core.Msg, conn net.Conn, w *connWriter) {
+		go func() {
+			time.Sleep(time.Duration(msg.ReqID%5) * 10 * time.Millisecond)
+			handleRPCRequest(&core.Msg{MsgType: msg.MsgType, ReqID: msg.ReqID}, w)
+		}()
+	})
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply, _, err := pm.Call(addr, Ping, nil, time.Second)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if reply.MsgType != Ping {
+				errCh <- errors.New("reply msgType mismatch")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("concurrent call fail: %v", err)
+	}
+
+	// 本节点不是分片节点，对端处理出错
+	if _, _, err := pm.Call(addr, ComGetHeight, nil, time.Second); !errors.Is(err, core.ErrRPCRemote) {
+		t.Fatalf("call without handler should return remote error, err: %v", err)
+	}
+}
+
+func TestRPCCallFailure(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testRPC.log"))
+	pm := NewPeerManager()
+	defer pm.Close()
+
+	// 丢失的回复变为超时错误
+	silent := startRPCTestPeer(t, func(msg *core.Msg, conn net.Conn, w *connWriter) {})
+	defer silent.Close()
+	start := time.Now()
+	if _, _, err := pm.Call(silent.Addr().String(), Ping, nil, 200*time.Millisecond); !errors.Is(err, core.ErrRPCTimeout) {
+		t.Fatalf("lost reply should time out, err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("timeout took %v", elapsed)
+	}
+
+	// 对端未回复就关闭连接
+	closing := startRPCTestPeer(t, func(msg *core.Msg, conn net.Conn, w *connWriter) { conn.Close() })
+	defer closing.Close()
+	if _, _, err := pm.Call(closing.Addr().String(), Ping, nil, 5*time.Second); !errors.Is(err, core.ErrRPCConnClosed) {
+		t.Fatalf("closed conn should fail pending call, err: %v", err)
+	}
+
+	// 对端不可达（处于dial退避期间）
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+	pm.getPeer(addr).retryAt = time.Now().Add(time.Hour)
+	if _, _, err := pm.Call(addr, Ping, nil, time.Second); !errors.Is(err, core.ErrRPCUnreachable) {
+		t.Fatalf("call to unreachable peer should fail, err: %v", err)
+	}
+}
+
+func TestRPCCallVerifyReplier(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testRPC.log"))
+	defer func(signer *envelopeSigner, verifier *envelopeVerifier) { msgSigner, msgVerifier = signer, verifier }(msgSigner, msgVerifier)
+	pm := NewPeerManager()
+	defer pm.Close()
+
+	const self, other = "127.0.0.1:1", "127.0.0.1:2"
+	peerAccount, otherAccount := node.NewW3Account(""), node.NewW3Account("")
+	var addr string
+	// Ping 由对端如实回复，ComGetHeight 的回复冒充另一个已知地址，用该地址自己的账户签名
+	ln := startRPCTestPeer(t, func(msg *core.Msg, conn net.Conn, w *connWriter) {
+		reply := &core.Msg{MsgType: msg.MsgType, ReqID: msg.ReqID, To: msg.From}
+		if msg.MsgType == Ping {
+			newEnvelopeSigner(peerAccount, addr).seal(reply)
+		} else {
+			newEnvelopeSigner(otherAccount, other).seal(reply)
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(reply); err != nil {
+			t.Error(err)
+			return
+		}
+		frame := make([]byte, 4+buf.Len())
+		binary.BigEndian.PutUint32(frame[:4], uint32(buf.Len()))
+		copy(frame[4:], buf.Bytes())
+		w.write(frame)
+	})
+	defer ln.Close()
+	addr = ln.Addr().String()
+
+	msgSigner = newEnvelopeSigner(node.NewW3Account(""), self)
+	msgVerifier = newEnvelopeVerifier(map[string]struct{}{addr: {}, other: {}}, self)
+	msgVerifier.lookup = func(from string) (common.Address, bool) {
+		switch from {
+		case addr:
+			return *peerAccount.GetAccountAddress(), true
+		case other:
+			return *otherAccount.GetAccountAddress(), true
+		}
+		return common.Address{}, false
+	}
+
+	if _, _, err := pm.Call(addr, Ping, nil, time.Second); err != nil {
+		t.Fatalf("reply from the dialed address rejected: %v", err)
+	}
+	// 签名有效但不是来自拨号地址的回复被丢弃，请求超时
+	if _, _, err := pm.Call(addr, ComGetHeight, nil, 300*time.Millisecond); !errors.Is(err, core.ErrRPCTimeout) {
+		t.Fatalf("reply from another address should be dropped, err: %v", err)
+	}
+}
@@ -1,7 +1,6 @@
 package messageHub
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
@@ -12,51 +11,84 @@ import (
 	"go-w3chain/log"
 	"go-w3chain/result"
 	"go-w3chain/utils"
-	"io"
 	"math/big"
-	"net"
-	"time"
 )
 
-func dial(addr string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", addr)
+/** 通过与 addr 的长连接发送消息，信封发往 addr 时才签名，发送失败时记录警告并返回 false
+ * 对端退避、拨号超时或重启都可能导致发送失败，由调用方决定重试或放弃，不能退出进程
+ */
+func sendMsg(caller string, addr string, envelope *core.Msg) bool {
+	err := peers.Send(addr, packEnvelope(envelope, addr))
 	if err != nil {
-		log.Debug("DialTCPError", "target_addr", addr, "err", err)
-		// 再dial一次
-		log.Debug("Try dial again...")
-		conn, err = net.Dial("tcp", addr)
-		if err != nil {
-			log.Debug("DialTCPError", "target_addr", addr, "err", err)
-			return nil, nil
-		} else {
-			log.Debug("dial success.", "target_addr", addr)
-		}
+		log.Warn(fmt.Sprintf("Send Error. caller: %s targetAddr: %s err: %v", caller, addr, err))
+		return false
 	}
-	return conn, nil
+	return true
 }
 
-// 每隔一定时间尝试一次dial，直到成功
-// 易造成死循环，谨慎使用
-func mustDial(addr string, interval time.Duration) net.Conn {
-	for {
-		conn, err := net.Dial("tcp", addr)
-		if err != nil {
-			time.Sleep(interval)
-		} else {
-			return conn
+/* 与 sendMsg 相同，用于启动阶段，对端可能尚未开始监听 */
+func sendMsgPersistent(caller string, addr string, envelope *core.Msg) bool {
+	err := peers.SendPersistent(addr, packEnvelope(envelope, addr))
+	if err != nil {
+		log.Warn(fmt.Sprintf("Send Error. caller: %s targetAddr: %s err: %v", caller, addr, err))
+		return false
+	}
+	return true
+}
+
+/* 通过短连接发送消息，发送后关闭连接 */
+func sendMsgOnce(caller string, addr string, envelope *core.Msg) bool {
+	err := peers.SendOnce(addr, packEnvelope(envelope, addr))
+	if err != nil {
+		log.Warn(fmt.Sprintf("Send Error. caller: %s targetAddr: %s err: %v", caller, addr, err))
+		return false
+	}
+	return true
+}
+
+/** 多目标消息的目标过滤函数，返回 false 的地址不发送；为nil时发往全部目标
+ * FaultyMessageHub 对多目标消息逐个目标注入故障时使用
+ */
+type targetFilter func(addr string) bool
+
+func (keep targetFilter) allows(addr string) bool {
+	return keep == nil || keep(addr)
+}
+
+func (keep targetFilter) filter(addrs []string) []string {
+	if keep == nil {
+		return addrs
+	}
+	kept := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if keep(addr) {
+			kept = append(kept, addr)
 		}
 	}
+	return kept
 }
 
-func packMsg(msgType string, data []byte) []byte {
-	msg := &core.Msg{
+/* 未签名的信封，发送给每个接收方时分别签名 */
+func packMsg(msgType string, data []byte) *core.Msg {
+	return &core.Msg{
 		MsgType: msgType,
 		Data:    data,
 	}
+}
+
+/** 以 to 为接收方对信封的副本签名并序列化，加上长度前缀
+ * to 为多个接收方时以逗号分隔，envelope 本身不变，可以再发给其他接收方
+ */
+func packEnvelope(envelope *core.Msg, to string) []byte {
+	msg := *envelope
+	msg.To = to
+	if msgSigner != nil {
+		msgSigner.seal(&msg)
+	}
 
 	var buf bytes.Buffer
 	msgEnc := gob.NewEncoder(&buf)
-	err := msgEnc.Encode(msg)
+	err := msgEnc.Encode(&msg)
 	if err != nil {
 		log.Error("gobEncodeErr", "err", err, "msg", msg)
 	}
@@ -71,70 +103,25 @@ func packMsg(msgType string, data []byte) []byte {
 	return networkBuf
 }
 
-func comGetHeightFromShard(shardID uint32, msg interface{}) *big.Int {
+func comGetHeightFromShard(addr string, msg interface{}) (*big.Int, error) {
 	data := msg.(*core.ComGetHeight)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(data)
-	if err != nil {
-		log.Error("gobEncodeErr", "err", err, "data", data)
-	}
-
-	// 序列化后的消息
-	msg_bytes := packMsg("ComGetHeight", buf.Bytes())
 
 	// 从分片的leader节点处获取
-	addr := cfg.NodeTable[shardID][0]
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = dial(addr)
-		if err != nil {
-			log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-				"comGetHeightFromShard", shardID, -1, 0, addr))
-		}
-		conns2Node.Add(addr, conn)
-	}
-	_, err = conn.Write(msg_bytes)
-	if err != nil {
-		log.Error("WriteError", "err", err)
-	}
 	log.Info("Msg Sent: ComGetHeight", "data", "empty data")
-
-	// 等待回复
-
-	// 首先读取消息长度的四个字节
-	lengthBuf := make([]byte, 4)
-	_, err = io.ReadFull(conn, lengthBuf)
-	if err != nil {
-		log.Error("ReadLengthError", "err", err)
-	}
-	// 解析这四个字节为int32来获取消息长度
-	msgLength := int(binary.BigEndian.Uint32(lengthBuf))
-
-	// 根据消息长度分配缓冲区
-	msgBuf := make([]byte, msgLength)
-	_, err = io.ReadFull(conn, msgBuf)
-	if err != nil {
-		log.Error("ReadMsgError", "err", err)
-	}
-
 	height := new(big.Int)
-	decodeBuf := bytes.NewReader(msgBuf)
-	decoder := gob.NewDecoder(decodeBuf)
-	err = decoder.Decode(height)
-	if err != nil {
-		log.Error("Failed to decode height using gob", "err", err)
+	if _, err := rpcCall(addr, ComGetHeight, data, height); err != nil {
+		return nil, err
 	}
 
 	log.Info("Msg Response Received: ComGetHeight", "height", height)
 
-	return height
+	return height, nil
 }
 
 /* 分片向一个中心化节点发送创世区块信标和初始账户地址
 该消息只进行一次，不需通过长连接发送
 */
-func shardSendGenesis(msg interface{}) {
+func shardSendGenesis(addr string, msg interface{}) {
 	data := msg.(*core.ShardSendGenesis)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -144,25 +131,16 @@ func shardSendGenesis(msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg("ShardSendGenesis", buf.Bytes())
-
-	// 连接到目标地址
-	conn, err := net.Dial("tcp", data.Target_nodeAddr)
-	if err != nil {
-		log.Error("DialError", "err", err)
-	}
-	defer conn.Close()
+	envelope := packMsg("ShardSendGenesis", buf.Bytes())
 
-	// 写入消息
-	_, err = conn.Write(msg_bytes)
-	if err != nil {
-		log.Error("WriteError", "err", err)
+	if !sendMsgOnce("shardSendGenesis", addr, envelope) {
+		return
 	}
 
 	log.Info("Msg Sent: ShardSendGenesis", "data", data)
 }
 
-func clientInjectTx2Com(comID uint32, msg interface{}) {
+func clientInjectTx2Com(comID uint32, addr string, msg interface{}) {
 	data := msg.([]*core.Transaction)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -172,27 +150,19 @@ func clientInjectTx2Com(comID uint32, msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg("ClientSendTx", buf.Bytes())
+	envelope := packMsg("ClientSendTx", buf.Bytes())
 
 	// 发送给委员会的leader即可
-	addr := cfg.ComNodeTable[comID][0]
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = dial(addr)
-		if err != nil {
-			log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-				"clientInjectTx2Com", -1, comID, 0, addr))
-		}
-		conns2Node.Add(addr, conn)
+	if !sendMsg("clientInjectTx2Com", addr, envelope) {
+		// 这批交易不会被执行，客户端按超时处理
+		log.Warn("Msg Not Sent: ClientSendTx", "targetComID", comID, "targetAddr", addr, "tx count", len(data))
+		return
 	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
 
 	log.Info("Msg Sent: ClientSendTx", "targetComID", comID, "targetAddr", addr, "tx count", len(data))
 }
 
-func clientSetInjectDone2Nodes(cid uint32) {
+func clientSetInjectDone2Nodes(cid uint32, addrs []string) {
 	data := &core.ClientSetInjectDone{Cid: cid}
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -202,107 +172,34 @@ func clientSetInjectDone2Nodes(cid uint32) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg("ClientSetInjectDone", buf.Bytes())
+	envelope := packMsg("ClientSetInjectDone", buf.Bytes())
 
 	// 向所有节点发送交易注入完成信息
-	var i, j uint32
-	for i = 0; i < uint32(shardNum); i++ {
-		for j = 0; j < uint32(comAllNodeNum); j++ {
-			addr := cfg.NodeTable[i][j]
-			conn, ok := conns2Node.Get(addr)
-			if !ok {
-				conn, err = dial(addr)
-				if err != nil {
-					log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-						"clientSetInjectDone2Nodes", i, -1, j, addr))
-				}
-				conns2Node.Add(addr, conn)
-			}
-			_, err := conn.Write(msg_bytes)
-			// if err != nil {
-			// 	panic(err)
-			// }
-			// 尝试重新建立连接后再发送一次，若依然失败则panic
-			if err != nil {
-				log.Debug(fmt.Sprint("write tcp error: ", err))
-				conn, err = dial(addr)
-				if err != nil {
-					log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-						"clientSetInjectDone2Nodes", i, -1, j, addr))
-				}
-				conns2Node.Add(addr, conn)
-				_, err := conn.Write(msg_bytes)
-				if err != nil {
-					panic(err)
-				}
-			}
-
-			conn.Close()
-			log.Info("Msg Sent: ClientSetInjectDone", "clientID", cid, "shardID", i, "nodeID", j)
+	for _, addr := range addrs {
+		// 节点可能暂时不可达，在启动等待时间内重试
+		if !sendMsgOnce("clientSetInjectDone2Nodes", addr, envelope) && !sendMsgPersistent("clientSetInjectDone2Nodes", addr, envelope) {
+			continue
 		}
+		log.Info("Msg Sent: ClientSetInjectDone", "clientID", cid, "targetAddr", addr)
 	}
 }
 
-func comGetStateFromShard(shardID uint32, msg interface{}) {
+func comGetStateFromShard(addr string, msg interface{}) (*core.ShardSendState, error) {
 	data := msg.(*core.ComGetState)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(data)
-	if err != nil {
-		log.Error("gobEncodeErr", "err", err, "data", data)
-	}
-
-	// 序列化后的消息
-	msg_bytes := packMsg("ComGetState", buf.Bytes())
 
 	// 从分片的leader节点获取
-	addr := cfg.NodeTable[shardID][0]
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = dial(addr)
-		if err != nil {
-			log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-				"comGetStateFromShard", shardID, -1, 0, addr))
-		}
-		conns2Node.Add(addr, conn)
-	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
-
 	log.Info("Msg Sent: ComGetState", "addr count", len(data.AddrList))
-}
-
-func shardSendStateToCom(comID uint32, msg interface{}) {
-	data := msg.(*core.ShardSendState)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(data)
-	if err != nil {
-		log.Error("gobEncodeErr", "err", err, "data", data)
+	state := new(core.ShardSendState)
+	if _, err := rpcCall(addr, ComGetState, data, state); err != nil {
+		return nil, err
 	}
 
-	// 序列化后的消息
-	msg_bytes := packMsg("ShardSendState", buf.Bytes())
-	// 只发送给委员会的leader节点
-	addr := cfg.ComNodeTable[comID][0]
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = dial(addr)
-		if err != nil {
-			log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-				"shardSendStateToCom", -1, comID, 0, addr))
-		}
-		conns2Node.Add(addr, conn)
-	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
+	log.Info("Msg Response Received: ShardSendState", "addr count", len(state.AccountData))
 
-	log.Info("Msg Sent: ShardSendState", "addr count", len(data.AccountData))
+	return state, nil
 }
 
-func comSendBlock2Shard(shardID uint32, msg interface{}) {
+func comSendBlock2Shard(shardID uint32, addr string, msg interface{}) {
 	data := msg.(*core.ComSendBlock)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -312,27 +209,17 @@ func comSendBlock2Shard(shardID uint32, msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg("ComSendBlock", buf.Bytes())
+	envelope := packMsg("ComSendBlock", buf.Bytes())
 
 	// 只发送给分片的leader节点
-	addr := cfg.NodeTable[shardID][0]
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = dial(addr)
-		if err != nil {
-			log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-				"comSendBlock2Shard", shardID, -1, 0, addr))
-		}
-		conns2Node.Add(addr, conn)
+	if !sendMsg("comSendBlock2Shard", addr, envelope) {
+		return
 	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
 
 	log.Info("Msg Sent: ComSendBlock", "toShardID", shardID, "tx count", len(data.Block.Transactions))
 }
 
-func comSendReply2Client(clientID uint32, msg interface{}) {
+func comSendReply2Client(clientID uint32, addr string, msg interface{}) {
 	data := msg.([]*result.TXReceipt)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -342,21 +229,11 @@ func comSendReply2Client(clientID uint32, msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg("ComSendTxReceipt", buf.Bytes())
-
-	addr := cfg.ClientTable[clientID]
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = dial(addr)
-		if err != nil {
-			log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-				"comSendReply2Client", -1, -1, -1, addr))
-		}
-		conns2Node.Add(addr, conn)
+	envelope := packMsg("ComSendTxReceipt", buf.Bytes())
+
+	if !sendMsg("comSendReply2Client", addr, envelope) {
+		return
 	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
 
 	log.Info("Msg Sent: ComSendTxReceipt", "toClientID", clientID, "tx count", len(data))
 }
@@ -369,6 +246,11 @@ func comAddTb2TBChain(nodeID uint32, msg interface{}) {
 	tbChain_ref.AddTimeBeacon(data, nodeID)
 }
 
+func comAddTbRoot2TBChain(nodeID uint32, msg interface{}) {
+	data := msg.(*core.SignedTBRoot)
+	tbChain_ref.AddTimeBeaconRoot(data, nodeID)
+}
+
 func getEthLatestBlock(callback func(...interface{})) {
 	hash, height := tbChain_ref.GetEthChainLatestBlockHash()
 	callback(hash, height)
@@ -388,6 +270,14 @@ func tbChainPushBlock2Client(msg interface{}) {
 	client_ref.AddTBs(data)
 }
 
+func tbChainRetractTB2Client(msg interface{}) {
+	if client_ref == nil {
+		return
+	}
+	data := msg.(*beaconChain.ConfirmedTB)
+	client_ref.RetractTB(data)
+}
+
 func tbChainPushBlock2Com(msg interface{}) {
 	if committee_ref == nil {
 		return
@@ -397,7 +287,7 @@ func tbChainPushBlock2Com(msg interface{}) {
 	shard_ref.AddTBs(data)
 }
 
-func comLeaderInitMultiSign(comID uint32, msg interface{}) {
+func comLeaderInitMultiSign(comID uint32, addrs []string, msg interface{}) {
 	data := msg.(*core.ComLeaderInitMultiSign)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -407,38 +297,14 @@ func comLeaderInitMultiSign(comID uint32, msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg(LeaderInitMultiSign, buf.Bytes())
+	envelope := packMsg(LeaderInitMultiSign, buf.Bytes())
 
 	// 向委员会中的所有共识节点发送（包括自己）
-	var i uint32
-	for i = 0; i < uint32(shardSize); i++ {
-		addr := cfg.ComNodeTable[comID][i]
-		if addr == "" {
-			if i == 3 {
-				// pbft最低允许只有3个节点
-				continue
-			} else {
-				log.Error("address is empty.")
-			}
-		}
-		conn, ok := conns2Node.Get(addr)
-		if !ok {
-			conn, err = dial(addr)
-			if err != nil {
-				log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-					"comLeaderInitMultiSign", -1, comID, i, addr))
-			}
-			conns2Node.Add(addr, conn)
-		}
-		_, err := conn.Write(msg_bytes)
-		if err != nil {
-			log.Debug(fmt.Sprintf("write err: %v", err))
-		}
-	}
+	relayer.broadcast("comLeaderInitMultiSign", addrs, envelope)
 	log.Info("Msg Sent: comLeaderInitMultiSign", "comID", comID)
 }
 
-func sendMultiSignReply(comID uint32, msg interface{}) {
+func sendMultiSignReply(comID uint32, addr string, msg interface{}) {
 	data := msg.(*core.MultiSignReply)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -448,23 +314,11 @@ func sendMultiSignReply(comID uint32, msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg(MultiSignReply, buf.Bytes())
+	envelope := packMsg(MultiSignReply, buf.Bytes())
 
 	// 向委员会的leader节点发送
-
-	addr := cfg.ComNodeTable[comID][0]
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = dial(addr)
-		if err != nil {
-			log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-				"sendMultiSignReply", -1, comID, 0, addr))
-		}
-		conns2Node.Add(addr, conn)
-	}
-	_, err = conn.Write(msg_bytes)
-	if err != nil {
-		panic(err)
+	if !sendMsg("sendMultiSignReply", addr, envelope) {
+		return
 	}
 
 	log.Info("Msg Sent: multiSignReply", "comID", comID)
@@ -474,7 +328,7 @@ func sendMultiSignReply(comID uint32, msg interface{}) {
 ////  booter  ////
 //////////////////////////////////////////////////
 
-func booterSendContract(msg interface{}) {
+func booterSendContract(targets []string, msg interface{}) {
 	data := msg.(*core.BooterSendContract)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -484,56 +338,30 @@ func booterSendContract(msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg("BooterSendContract", buf.Bytes())
-
-	// 向所有节点发送合约地址等信息
-	var i, j uint32
-	for i = 0; i < uint32(shardNum); i++ {
-		for j = 0; j < uint32(comAllNodeNum); j++ {
-			addr := cfg.NodeTable[i][j]
-			conn, ok := conns2Node.Get(addr)
-			if !ok {
-				conn, err = dial(addr)
-				if err != nil {
-					log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-						"booterSendContract", i, -1, j, addr))
-				}
-			}
-			_, err := conn.Write(msg_bytes)
-			if err != nil {
-				panic(err)
-			}
-			conn.Close()
-		}
-
-	}
+	envelope := packMsg("BooterSendContract", buf.Bytes())
 
-	// 向客户端发送合约地址等信息
-	for i = 0; i < uint32(clientNum); i++ {
-		addr := cfg.ClientTable[i]
-		conn, ok := conns2Node.Get(addr)
-		if !ok {
-			conn, err = dial(addr)
-			if err != nil {
-				log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-					"booterSendContract", -1, -1, -1, addr))
-			}
+	// 向所有节点和客户端发送合约地址等信息
+	failed := make([]string, 0)
+	for _, addr := range targets {
+		if !sendMsgOnce("booterSendContract", addr, envelope) {
+			failed = append(failed, addr)
 		}
-		_, err := conn.Write(msg_bytes)
-		if err != nil {
-			panic(err)
+	}
+	// 没有收到合约地址的进程不会开始运行，对端可能尚未开始监听，在启动等待时间内重试
+	for _, addr := range failed {
+		if !sendMsgPersistent("booterSendContract", addr, envelope) {
+			log.Warn("Msg Not Sent: BooterSendContract", "targetAddr", addr)
 		}
-		conn.Close()
 	}
 
-	log.Info("Msg Sent: BooterSendContract", "data", data)
+	log.Info("Msg Sent: BooterSendContract", "data", data, "targets", len(targets), "retried", len(failed))
 
 }
 
 /////////////////////
 ///// pbft //////////
 /////////////////////
-func sendPbftMsg(comID uint32, msg interface{}, msgType string) {
+func sendPbftMsg(comID uint32, addrs []string, msg interface{}, msgType string) {
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
 	var err error
@@ -557,8 +385,8 @@ func sendPbftMsg(comID uint32, msg interface{}, msgType string) {
 	case CSendOldrequest:
 		data := msg.(*core.SendOldMessage)
 		err = enc.Encode(data)
-		msg_bytes := packMsg(msgType, buf.Bytes())
-		sendOldRequests(data, msg_bytes)
+		envelope := packMsg(msgType, buf.Bytes())
+		sendOldRequests(data, addrs[0], envelope)
 		return
 	default:
 		log.Error("unknown pbft msg type", "type", msgType)
@@ -569,69 +397,28 @@ func sendPbftMsg(comID uint32, msg interface{}, msgType string) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg(msgType, buf.Bytes())
-
-	var i uint32
-	nodeAddr := node_ref.NodeInfo.NodeAddr
-	for i = 0; i < uint32(shardSize); i++ {
-		if i > 0 && (msgType == CReply || msgType == CRequestOldrequest) { // reply、CRequestOldrequest 只需发给leader
-			return
-		}
-
-		addr := cfg.ComNodeTable[comID][i]
-		if addr == nodeAddr {
-			continue // 不用发给自己
-		}
-		if addr == "" {
-			if i == 3 {
-				// pbft最低允许只有3个节点
-				continue
-			} else {
-				log.Error("address is empty.")
-			}
-		}
-		conn, ok := conns2Node.Get(addr)
-		if !ok {
-			conn, err = dial(addr)
-			if err != nil {
-				log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-					msgType, -1, comID, i, addr))
-			}
-			conns2Node.Add(addr, conn)
-		}
-		writer := bufio.NewWriter(conn)
-		writer.Write(msg_bytes)
-		writer.Flush()
+	envelope := packMsg(msgType, buf.Bytes())
 
+	// 不用发给自己，reply、CRequestOldrequest 只需发给leader
+	for _, addr := range addrs {
 		if msgType == CPrePrepare {
-			log.Info(fmt.Sprintf("Msg Sent: %s ComID: %v, to nodeID: %v seqID: %d", msgType, comID, i, msg.(*core.PrePrepare).SeqID))
+			log.Info(fmt.Sprintf("Msg Sent: %s ComID: %v, to addr: %s seqID: %d", msgType, comID, addr, msg.(*core.PrePrepare).SeqID))
 		} else {
-			log.Info(fmt.Sprintf("Msg Sent: %s ComID: %v, to nodeID: %v", msgType, comID, i))
+			log.Info(fmt.Sprintf("Msg Sent: %s ComID: %v, to addr: %s", msgType, comID, addr))
 		}
 	}
+	relayer.broadcast(msgType, addrs, envelope)
 }
 
-func sendOldRequests(data *core.SendOldMessage, msgBytes []byte) {
-	addr := cfg.ComNodeTable[data.ReceiverInfo.ComID][data.ReceiverInfo.NodeID]
-	var err error
-
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = dial(addr)
-		if err != nil {
-			log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-				"sendOldRequests", -1, data.ReceiverInfo.ComID, data.ReceiverInfo.NodeID, addr))
-		}
-		conns2Node.Add(addr, conn)
+func sendOldRequests(data *core.SendOldMessage, addr string, envelope *core.Msg) {
+	if !sendMsg("sendOldRequests", addr, envelope) {
+		return
 	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msgBytes)
-	writer.Flush()
 
 	log.Info(fmt.Sprintf("Msg Sent: %s ComID: %v, to nodeID: %v", CSendOldrequest, data.ReceiverInfo.ComID, data.ReceiverInfo.NodeID))
 }
 
-func sendNodeInfo(comID uint32, msg interface{}) {
+func sendNodeInfo(comID uint32, addr string, msg interface{}) {
 	data := msg.(*core.NodeSendInfo)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -641,17 +428,11 @@ func sendNodeInfo(comID uint32, msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg(NodeSendInfo, buf.Bytes())
+	envelope := packMsg(NodeSendInfo, buf.Bytes())
 
-	addr := cfg.ComNodeTable[comID][0]
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn = mustDial(addr, time.Second)
-		conns2Node.Add(addr, conn)
+	if !sendMsgPersistent(NodeSendInfo, addr, envelope) {
+		return
 	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
 
 	log.Info("Msg Sent: NodeSendInfo", "ComID", comID, "to nodeID", 0)
 }
@@ -659,7 +440,7 @@ func sendNodeInfo(comID uint32, msg interface{}) {
 type SendReconfigMsgs struct {
 }
 
-func leaderInitReconfig(comID uint32, msg interface{}) {
+func leaderInitReconfig(comID uint32, addrs []string, msg interface{}) {
 	data := msg.(*core.InitReconfig)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -669,30 +450,17 @@ func leaderInitReconfig(comID uint32, msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg(LeaderInitReconfig, buf.Bytes())
+	envelope := packMsg(LeaderInitReconfig, buf.Bytes())
 
-	var i uint32
 	// 向包括共识节点在内的所有委员会内节点发送该消息
-	for i = 0; i < data.ComNodeNum; i++ {
-		addr := cfg.ComNodeTable[comID][i]
-		conn, ok := conns2Node.Get(addr)
-		if !ok {
-			conn, err = dial(addr)
-			if err != nil {
-				log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-					"leaderInitReconfig", -1, comID, i, addr))
-			}
-			conns2Node.Add(addr, conn)
-		}
-		writer := bufio.NewWriter(conn)
-		writer.Write(msg_bytes)
-		writer.Flush()
-		log.Info(fmt.Sprintf("Msg Sent: %s ComID: %d nodeID: %d", LeaderInitReconfig, comID, i))
+	for _, addr := range addrs {
+		log.Info(fmt.Sprintf("Msg Sent: %s ComID: %d to_addr: %s", LeaderInitReconfig, comID, addr))
 	}
+	relayer.broadcast("leaderInitReconfig", addrs, envelope)
 
 }
 
-func sendReconfigResult2Leader(comID uint32, msg interface{}) {
+func sendReconfigResult2Leader(comID uint32, addr string, msg interface{}) {
 	data := msg.(*core.ReconfigResult)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -702,26 +470,16 @@ func sendReconfigResult2Leader(comID uint32, msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg(SendReconfigResult2ComLeader, buf.Bytes())
-
-	addr := cfg.ComNodeTable[comID][0]
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = dial(addr)
-		if err != nil {
-			log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-				"sendReconfigResult2Leader", -1, comID, 0, addr))
-		}
-		conns2Node.Add(addr, conn)
+	envelope := packMsg(SendReconfigResult2ComLeader, buf.Bytes())
+
+	if !sendMsg("sendReconfigResult2Leader", addr, envelope) {
+		return
 	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
 
 	log.Info(fmt.Sprintf("Msg Sent: %s ComID: %d", SendReconfigResult2ComLeader, comID))
 }
 
-func sendReconfigResults2AllLeaders(comID uint32, msg interface{}) {
+func sendReconfigResults2AllLeaders(comID uint32, addrs []string, msg interface{}) {
 	data := msg.(*core.ComReconfigResults)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -731,34 +489,18 @@ func sendReconfigResults2AllLeaders(comID uint32, msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg(SendReconfigResults2AllComLeaders, buf.Bytes())
+	envelope := packMsg(SendReconfigResults2AllComLeaders, buf.Bytes())
 
-	// 先拷贝待发送地址，否则leader接收到该消息后可能更新地址表
-	// 导致某些地址缺失或错误
-	target_addrs := make(map[uint32]string)
-	for comID, list := range cfg.ComNodeTable {
-		target_addrs[comID] = list[0]
-	}
-	var i uint32
-	for i = 0; i < uint32(shardNum); i++ {
-		addr := target_addrs[i]
-		conn, ok := conns2Node.Get(addr)
-		if !ok {
-			conn, err = dial(addr)
-			if err != nil {
-				log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-					"sendReconfigResults2AllLeaders", -1, i, 0, addr))
-			}
-			conns2Node.Add(addr, conn)
+	// 待发送地址在路由时已拷贝，leader接收到该消息后更新地址表不影响发送
+	for _, addr := range addrs {
+		if !sendMsg("sendReconfigResults2AllLeaders", addr, envelope) {
+			continue
 		}
-		writer := bufio.NewWriter(conn)
-		writer.Write(msg_bytes)
-		writer.Flush()
-		log.Info(fmt.Sprintf("Msg Sent: %s from_ComID: %d to_ComID: %d to_addr: %s", SendReconfigResults2AllComLeaders, comID, i, addr))
+		log.Info(fmt.Sprintf("Msg Sent: %s from_ComID: %d to_addr: %s", SendReconfigResults2AllComLeaders, comID, addr))
 	}
 }
 
-func sendReconfigResults2ComNodes(comID uint32, msg interface{}) {
+func sendReconfigResults2ComNodes(comID uint32, addrs []string, msg interface{}) {
 	data := msg.(map[uint32]*core.ComReconfigResults)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -768,27 +510,14 @@ func sendReconfigResults2ComNodes(comID uint32, msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg(SendReconfigResults2ComNodes, buf.Bytes())
-
-	var i uint32
-	// 先拷贝待发送地址，否则leader接收到该消息后可能更新地址表
-	// 导致某些地址缺失或错误
-	target_addrs := cfg.ComNodeTable[comID]
-	for i = 0; i < data[comID].ComNodeNum; i++ {
-		addr := target_addrs[i]
-		conn, ok := conns2Node.Get(addr)
-		if !ok {
-			conn, err = dial(addr)
-			if err != nil {
-				log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-					"sendReconfigResults2ComNodes", -1, comID, i, addr))
-			}
-			conns2Node.Add(addr, conn)
+	envelope := packMsg(SendReconfigResults2ComNodes, buf.Bytes())
+
+	// 待发送地址在路由时已拷贝，leader接收到该消息后更新地址表不影响发送
+	for _, addr := range addrs {
+		if !sendMsg("sendReconfigResults2ComNodes", addr, envelope) {
+			continue
 		}
-		writer := bufio.NewWriter(conn)
-		writer.Write(msg_bytes)
-		writer.Flush()
-		log.Info(fmt.Sprintf("Msg Sent: %s ComID: %d to_nodeID: %d, to_addr: %s", SendReconfigResults2ComNodes, comID, i, addr))
+		log.Info(fmt.Sprintf("Msg Sent: %s ComID: %d to_addr: %s", SendReconfigResults2ComNodes, comID, addr))
 	}
 }
 
@@ -797,7 +526,7 @@ func comSendNewAddrs(nodeID uint32, msg interface{}) {
 	tbChain_ref.SetAddrs(data.Addrs, data.Vrfs, data.SeedHeight, data.ComID, nodeID)
 }
 
-func sendNewNodeTable2Client(msg interface{}) {
+func sendNewNodeTable2Client(addrs []string, msg interface{}) {
 	data := msg.(map[uint32]map[uint32]string)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -807,146 +536,64 @@ func sendNewNodeTable2Client(msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg(SendNewNodeTable2Client, buf.Bytes())
-
-	var i uint32
-	for i = 0; i < uint32(clientNum); i++ {
-		addr := cfg.ClientTable[i]
-		conn, ok := conns2Node.Get(addr)
-		if !ok {
-			conn, err = dial(addr)
-			if err != nil {
-				log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-					"sendNewNodeTable2Client", -1, -1, -1, addr))
-			}
-			conns2Node.Add(addr, conn)
+	envelope := packMsg(SendNewNodeTable2Client, buf.Bytes())
+
+	for _, addr := range addrs {
+		if !sendMsg("sendNewNodeTable2Client", addr, envelope) {
+			continue
 		}
-		writer := bufio.NewWriter(conn)
-		writer.Write(msg_bytes)
-		writer.Flush()
-		log.Info(fmt.Sprintf("Msg Sent: %s to_clientID: %d", SendNewNodeTable2Client, i))
+		log.Info(fmt.Sprintf("Msg Sent: %s to_addr: %s", SendNewNodeTable2Client, addr))
 	}
 
 }
 
-func sendGetPoolTx(comID uint32, msg interface{}, callback func(...interface{})) {
+func sendGetPoolTx(addr string, msg interface{}) (*core.PoolTx, core.TransferSize, error) {
 	data := msg.(*core.GetPoolTx)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(data)
-	if err != nil {
-		log.Error("gobEncodeErr", "err", err, "data", data)
-	}
-
-	// 序列化后的消息
-	msg_bytes := packMsg(GetPoolTx, buf.Bytes())
 
-	// 从分片的leader节点处获取
-	addr := data.ServerAddr
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = dial(addr)
-		if err != nil {
-			log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-				"sendNewNodeTable2Client", -1, -1, -1, addr))
-		}
-		conns2Node.Add(addr, conn)
-	}
-	_, err = conn.Write(msg_bytes)
-	if err != nil {
-		log.Error("WriteError", "err", err)
-	}
+	// 从旧委员会的leader节点处获取
 	log.Info(fmt.Sprintf("Msg Sent: %s data: %v", GetPoolTx, "empty data"))
-
-	// 等待回复
-
-	// 首先读取消息长度的四个字节
-	lengthBuf := make([]byte, 4)
-	_, err = io.ReadFull(conn, lengthBuf)
-	if err != nil {
-		log.Error("ReadLengthError", "err", err)
-	}
-	// 解析这四个字节为int32来获取消息长度
-	msgLength := int(binary.BigEndian.Uint32(lengthBuf))
-
-	// 根据消息长度分配缓冲区
-	msgBuf := make([]byte, msgLength)
-	_, err = io.ReadFull(conn, msgBuf)
-	if err != nil {
-		log.Error("ReadMsgError", "err", err)
-	}
-
 	poolTx := new(core.PoolTx)
-	decodeBuf := bytes.NewReader(msgBuf)
-	decoder := gob.NewDecoder(decodeBuf)
-	err = decoder.Decode(poolTx)
+	size, err := rpcCall(addr, GetPoolTx, data, poolTx)
 	if err != nil {
-		log.Error("Failed to decode", "err", err)
+		return nil, size, err
 	}
 
 	log.Info(fmt.Sprintf("Msg Response Received: %s pendingLen: %d pendingRollbackLen: %d", GetPoolTx, len(poolTx.Pending), len(poolTx.PendingRollback)))
 
-	callback(poolTx)
+	return poolTx, size, nil
 }
 
-func sendGetSyncData(comID uint32, msg interface{}, callback func(...interface{})) {
+func sendGetSyncData(addr string, msg interface{}) (*core.SyncData, core.TransferSize, error) {
 	data := msg.(*core.GetSyncData)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(data)
-	if err != nil {
-		log.Error("gobEncodeErr", "err", err, "data", data)
-	}
-
-	// 序列化后的消息
-	msg_bytes := packMsg(GetSyncData, buf.Bytes())
 
 	// 从分片的leader节点处获取
-	addr := data.ServerAddr
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = dial(addr)
-		if err != nil {
-			log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-				"sendNewNodeTable2Client", -1, -1, -1, addr))
-		}
-		conns2Node.Add(addr, conn)
-	}
-	_, err = conn.Write(msg_bytes)
+	log.Info(fmt.Sprintf("Msg Sent: %s syncMode: %v", GetSyncData, data.SyncType))
+	syncData := new(core.SyncData)
+	size, err := rpcCall(addr, GetSyncData, data, syncData)
 	if err != nil {
-		log.Error("WriteError", "err", err)
+		return nil, size, err
 	}
-	log.Info(fmt.Sprintf("Msg Sent: %s syncMode: %v", GetSyncData, data.SyncType))
 
-	// 等待回复
+	log.Info(fmt.Sprintf("Msg Response Received: %s syncMode: %s raw(bytes): %d wire(bytes): %d", GetSyncData, data.SyncType, size.Raw, size.Wire))
 
-	// 首先读取消息长度的四个字节
-	lengthBuf := make([]byte, 4)
-	_, err = io.ReadFull(conn, lengthBuf)
-	if err != nil {
-		log.Error("ReadLengthError", "err", err)
-	}
-	// 解析这四个字节为int32来获取消息长度
-	msgLength := int(binary.BigEndian.Uint32(lengthBuf))
+	return syncData, size, nil
+}
 
-	// 根据消息长度分配缓冲区
-	msgBuf := make([]byte, msgLength)
-	_, err = io.ReadFull(conn, msgBuf)
-	if err != nil {
-		log.Error("ReadMsgError", "err", err)
+/* 从分片leader节点的信标链视图中获取已确认的信标 */
+func getTB(shardID uint32, addr string, msg interface{}) (*beaconChain.ConfirmedTB, error) {
+	data := &core.GetTB{
+		ShardID: shardID,
+		Height:  msg.(uint64),
 	}
 
-	syncData := new(core.SyncData)
-	decodeBuf := bytes.NewReader(msgBuf)
-	decoder := gob.NewDecoder(decodeBuf)
-	err = decoder.Decode(syncData)
-	if err != nil {
-		log.Error("Failed to decode", "err", err)
+	tb := new(beaconChain.ConfirmedTB)
+	if _, err := rpcCall(addr, GetTB, data, tb); err != nil {
+		return nil, err
 	}
 
-	log.Info(fmt.Sprintf("Msg Response Received: %s syncMode: %s", GetSyncData, data.SyncType))
+	log.Info(fmt.Sprintf("Msg Response Received: %s shardID: %d height: %d", GetTB, shardID, data.Height))
 
-	callback(syncData)
+	return tb, nil
 }
 
 // 清理多余的长连接
@@ -963,17 +610,11 @@ func clearConnection(msg interface{}) {
 			to_preserved[cfg.ComNodeTable[uint32(i)][0]] = struct{}{}
 		}
 	}
-	before_cnt := len(conns2Node.connections)
-	for addr, conn := range conns2Node.connections {
-		if _, ok := to_preserved[addr]; !ok {
-			conn.Close()
-			conns2Node.Remove(addr)
-		}
-	}
-	log.Debug(fmt.Sprintf("remove unused tcp connections. before count: %d after count: %d", before_cnt, len(conns2Node.connections)))
+	before_cnt, after_cnt := peers.CloseExcept(to_preserved)
+	log.Debug(fmt.Sprintf("remove unused tcp connections. before count: %d after count: %d", before_cnt, after_cnt))
 }
 
-func reportError(clientID uint32, msg interface{}) {
+func reportError(clientID uint32, addr string, msg interface{}) {
 	data := msg.(*core.ErrReport)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -983,26 +624,16 @@ func reportError(clientID uint32, msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg(ReportError, buf.Bytes())
-
-	addr := cfg.ClientTable[clientID]
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = dial(addr)
-		if err != nil {
-			log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-				reportError, -1, -1, -1, addr))
-		}
-		conns2Node.Add(addr, conn)
+	envelope := packMsg(ReportError, buf.Bytes())
+
+	if !sendMsg(ReportError, addr, envelope) {
+		return
 	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
 
 	log.Info("Msg Sent: reportError", "toClientID", clientID, "err", data.Err)
 }
 
-func reportAny(clientID uint32, msg interface{}) {
+func reportAny(clientID uint32, addr string, msg interface{}) {
 	data := msg.(string)
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -1012,74 +643,86 @@ func reportAny(clientID uint32, msg interface{}) {
 	}
 
 	// 序列化后的消息
-	msg_bytes := packMsg(ReportAny, buf.Bytes())
-
-	addr := cfg.ClientTable[clientID]
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = dial(addr)
-		if err != nil {
-			log.Error(fmt.Sprintf("Dial Error. caller: %s targetShardID: %d targetComID: %d targetNodeID: %d targetAddr: %s",
-				ReportAny, -1, -1, -1, addr))
-		}
-		conns2Node.Add(addr, conn)
+	envelope := packMsg(ReportAny, buf.Bytes())
+
+	if !sendMsg(ReportAny, addr, envelope) {
+		return
 	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
 
 	log.Info("Msg Sent: reportAny", "toClientID", clientID, "dataStr", data)
 }
 
 /* 用于分片、委员会、客户端、信标链传送消息 */
 func (hub *GoodMessageHub) Send(msgType uint32, id uint32, msg interface{}, callback func(res ...interface{})) {
+	hub.send(msgType, id, msg, callback, nil)
+}
+
+/** 与 Send 相同，但多目标消息只发往 keep 返回 true 的地址
+ * 树形或 gossip 广播在剩余的目标之间进行，被过滤的节点也不会经其他节点转发收到
+ */
+func (hub *GoodMessageHub) SendToTargets(msgType uint32, id uint32, msg interface{}, keep func(addr string) bool) {
+	hub.send(msgType, id, msg, nil, keep)
+}
+
+/* 消息经网络发往的所有地址，与 Send 使用同一路由规则 */
+func (hub *GoodMessageHub) Targets(msgType uint32, id uint32, msg interface{}) []string {
+	return goodRouting().targets(msgType, id, msg)
+}
+
+func (hub *GoodMessageHub) send(msgType uint32, id uint32, msg interface{}, callback func(res ...interface{}), keep targetFilter) {
+	// 单目标消息的地址为 addrs[0]，多目标消息只发往 keep 保留的地址
+	addrs := hub.Targets(msgType, id, msg)
 	switch msgType {
 	case core.MsgTypeComGetHeightFromShard:
-		height := comGetHeightFromShard(id, msg)
-		callback(height)
+		height, err := comGetHeightFromShard(addrs[0], msg)
+		callback(height, err)
 
 	case core.MsgTypeShardSendGenesis:
-		shardSendGenesis(msg)
+		shardSendGenesis(addrs[0], msg)
 	case core.MsgTypeBooterSendContract:
-		booterSendContract(msg)
+		booterSendContract(keep.filter(addrs), msg)
 
 	case core.MsgTypeComGetStateFromShard:
-		comGetStateFromShard(id, msg)
-	case core.MsgTypeShardSendStateToCom:
-		go shardSendStateToCom(id, msg)
+		state, err := comGetStateFromShard(addrs[0], msg)
+		callback(state, err)
 
 	case core.MsgTypeClientInjectTX2Committee:
-		go clientInjectTx2Com(id, msg)
+		go clientInjectTx2Com(id, addrs[0], msg)
 	case core.MsgTypeSetInjectDone2Nodes:
-		clientSetInjectDone2Nodes(id)
+		clientSetInjectDone2Nodes(id, keep.filter(addrs))
 
 	case core.MsgTypeSendBlock2Shard:
-		go comSendBlock2Shard(id, msg)
+		go comSendBlock2Shard(id, addrs[0], msg)
 
 	case core.MsgTypeCommitteeReply2Client:
-		go comSendReply2Client(id, msg)
+		go comSendReply2Client(id, addrs[0], msg)
 
 	case core.MsgTypeLeaderInitMultiSign:
-		comLeaderInitMultiSign(id, msg)
+		comLeaderInitMultiSign(id, keep.filter(addrs), msg)
 	case core.MsgTypeSendMultiSignReply:
-		sendMultiSignReply(id, msg)
+		sendMultiSignReply(id, addrs[0], msg)
 
 	case core.MsgTypeLeaderInitReconfig:
-		leaderInitReconfig(id, msg)
+		leaderInitReconfig(id, keep.filter(addrs), msg)
 	case core.MsgTypeSendReconfigResult2ComLeader:
-		sendReconfigResult2Leader(id, msg)
+		sendReconfigResult2Leader(id, addrs[0], msg)
 	case core.MsgTypeSendReconfigResults2AllComLeaders:
-		sendReconfigResults2AllLeaders(id, msg)
+		sendReconfigResults2AllLeaders(id, keep.filter(addrs), msg)
 	case core.MsgTypeSendReconfigResults2ComNodes:
-		sendReconfigResults2ComNodes(id, msg)
+		sendReconfigResults2ComNodes(id, keep.filter(addrs), msg)
 	case core.MsgTypeGetPoolTx:
-		sendGetPoolTx(id, msg, callback)
+		poolTx, size, err := sendGetPoolTx(addrs[0], msg)
+		callback(poolTx, err, size)
 	case core.MsgTypeGetSyncData:
-		sendGetSyncData(id, msg, callback)
+		syncData, size, err := sendGetSyncData(addrs[0], msg)
+		callback(syncData, err, size)
+	case core.MsgTypeGetTB:
+		tb, err := getTB(id, addrs[0], msg)
+		callback(tb, err)
 	case core.MsgTypeComSendNewAddrs:
 		comSendNewAddrs(id, msg)
 	case core.MsgTypeSendNewNodeTable2Client:
-		sendNewNodeTable2Client(msg)
+		sendNewNodeTable2Client(keep.filter(addrs), msg)
 
 	////////////////////
 	// 通过beaconChain模块中的ethclient与ethChain交互
@@ -1091,36 +734,40 @@ func (hub *GoodMessageHub) Send(msgType uint32, id uint32, msg interface{}, call
 
 	case core.MsgTypeComAddTb2TBChain:
 		comAddTb2TBChain(id, msg)
+	case core.MsgTypeComAddTbRoot2TBChain:
+		comAddTbRoot2TBChain(id, msg)
 	case core.MsgTypeTBChainPushTB2Client:
 		tbChainPushBlock2Client(msg)
 	case core.MsgTypeTBChainPushTB2Coms:
 		tbChainPushBlock2Com(msg)
+	case core.MsgTypeTBChainRetractTB2Client:
+		tbChainRetractTB2Client(msg)
 
 	////////////////////
 	///// pbft  ////////
 	////////////////////
 	case core.MsgTypePbftPrePrepare:
-		sendPbftMsg(id, msg, CPrePrepare)
+		sendPbftMsg(id, keep.filter(addrs), msg, CPrePrepare)
 	case core.MsgTypePbftPrepare:
-		sendPbftMsg(id, msg, CPrepare)
+		sendPbftMsg(id, keep.filter(addrs), msg, CPrepare)
 	case core.MsgTypePbftCommit:
-		sendPbftMsg(id, msg, CCommit)
+		sendPbftMsg(id, keep.filter(addrs), msg, CCommit)
 	case core.MsgTypePbftReply:
-		sendPbftMsg(id, msg, CReply)
+		sendPbftMsg(id, keep.filter(addrs), msg, CReply)
 	case core.MsgTypePbftRequestOldMessage:
-		sendPbftMsg(id, msg, CRequestOldrequest)
+		sendPbftMsg(id, keep.filter(addrs), msg, CRequestOldrequest)
 	case core.MsgTypePbftSendOldMessage:
-		sendPbftMsg(id, msg, CSendOldrequest)
+		sendPbftMsg(id, addrs, msg, CSendOldrequest)
 
 	case core.MsgTypeNodeSendInfo2Leader:
-		sendNodeInfo(id, msg)
+		sendNodeInfo(id, addrs[0], msg)
 
 	case core.MsgTypeClearConnection:
 		clearConnection(msg)
 	case core.MsgTypeReportError:
-		reportError(id, msg)
+		reportError(id, addrs[0], msg)
 	case core.MsgTypeReportAny:
-		reportAny(id, msg)
+		reportAny(id, addrs[0], msg)
 	}
 
 }
@@ -0,0 +1,198 @@
+package messageHub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"go-w3chain/node"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	// 对端在该时间内未完成tls握手则关闭连接
+	handshakeTimeout = 10 * time.Second
+	// 节点身份对证书公钥签名时使用的前缀，避免签名被挪作他用
+	tlsIdentityPrefix = "lesschain-tls-identity:"
+)
+
+// 证书中存放节点身份签名的扩展
+var tlsIdentityOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 53594, 1, 1}
+
+var (
+	errNoPeerCert          = errors.New("peer did not present a certificate")
+	errNoTLSIdentity       = errors.New("peer certificate has no identity signature")
+	errTLSIdentityMismatch = errors.New("envelope signer does not match the tls identity of the connection")
+	errTLSPeerMismatch     = errors.New("tls identity of the dialed peer does not match its expected account")
+)
+
+/** 基于 tls1.3 的加密传输
+ * 每个进程启动时生成一个临时的 P-256 证书，并用节点的 secp256k1 账户对证书公钥签名，签名写入证书扩展。
+ * 握手时双方都出示证书，对端从签名中恢复出账户地址作为连接的身份，不依赖CA。
+ * 拨号方还要求该身份是身份表中被拨地址应使用的账户，防止中间人用其他账户冒充。
+ * tls.Conn 实现了 net.Conn，长度前缀加 gob 的消息格式不变
+ */
+type tlsTransport struct {
+	identity     common.Address
+	serverConfig *tls.Config
+	clientConfig *tls.Config
+	// 网络地址应使用的账户
+	expected func(addr string) (common.Address, bool)
+}
+
+func newTLSTransport(account *node.W3Account) (*tlsTransport, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	identitySig, err := asn1.Marshal(account.SignHash(tlsIdentityHash(spki)))
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: account.GetAccountAddress().Hex()},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		ExtraExtensions: []pkix.Extension{{Id: tlsIdentityOID, Value: identitySig}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	return &tlsTransport{
+		identity: *account.GetAccountAddress(),
+		serverConfig: &tls.Config{
+			MinVersion:            tls.VersionTLS13,
+			Certificates:          []tls.Certificate{cert},
+			ClientAuth:            tls.RequireAnyClientCert,
+			VerifyPeerCertificate: verifyPeerIdentity,
+		},
+		clientConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS13,
+			Certificates: []tls.Certificate{cert},
+			// 证书是自签名的，由 VerifyPeerCertificate 检查其中的身份签名
+			// 拨号时再按被拨地址检查身份，见 dial
+			InsecureSkipVerify:    true,
+			VerifyPeerCertificate: verifyPeerIdentity,
+		},
+		expected: expectedAccount,
+	}, nil
+}
+
+func tlsIdentityHash(spki []byte) []byte {
+	return crypto.Keccak256([]byte(tlsIdentityPrefix), spki)
+}
+
+/* 从证书的身份签名中恢复账户地址 */
+func certIdentity(cert *x509.Certificate) (common.Address, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(tlsIdentityOID) {
+			continue
+		}
+		var sig []byte
+		if _, err := asn1.Unmarshal(ext.Value, &sig); err != nil {
+			return common.Address{}, fmt.Errorf("%w: %v", errNoTLSIdentity, err)
+		}
+		pubKey, err := crypto.SigToPub(tlsIdentityHash(cert.RawSubjectPublicKeyInfo), sig)
+		if err != nil {
+			return common.Address{}, fmt.Errorf("invalid tls identity signature: %v", err)
+		}
+		return crypto.PubkeyToAddress(*pubKey), nil
+	}
+	return common.Address{}, errNoTLSIdentity
+}
+
+/* 对端证书中的身份 */
+func peerIdentity(rawCerts [][]byte) (common.Address, error) {
+	if len(rawCerts) == 0 {
+		return common.Address{}, errNoPeerCert
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return common.Address{}, err
+	}
+	return certIdentity(cert)
+}
+
+/* 监听端接受任何带有合法身份签名的证书，连入方的地址未知，由信封检查消息的签名者与连接身份一致 */
+func verifyPeerIdentity(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	_, err := peerIdentity(rawCerts)
+	return err
+}
+
+/* 拨号时对端的身份必须是 addr 应使用的账户 */
+func (t *tlsTransport) verifyDialedIdentity(addr string, rawCerts [][]byte) error {
+	identity, err := peerIdentity(rawCerts)
+	if err != nil {
+		return err
+	}
+	expected, ok := t.expected(addr)
+	if !ok {
+		return fmt.Errorf("%w: %s", errNoExpectedAccount, addr)
+	}
+	if identity != expected {
+		return fmt.Errorf("%w: %s presented %s, expected %s", errTLSPeerMismatch, addr, identity.Hex(), expected.Hex())
+	}
+	return nil
+}
+
+func (t *tlsTransport) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	config := t.clientConfig.Clone()
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return t.verifyDialedIdentity(addr, rawCerts)
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
+
+func (t *tlsTransport) listen(ln net.Listener) net.Listener {
+	return tls.NewListener(ln, t.serverConfig)
+}
+
+/** 对tls连接完成握手，返回对端证书中的身份
+ * 明文连接返回 nil，不做检查
+ */
+func handshakeIdentity(conn net.Conn) (*common.Address, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errNoPeerCert
+	}
+	identity, err := certIdentity(certs[0])
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
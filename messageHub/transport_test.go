@@ -0,0 +1,131 @@
+package messageHub
+
+import (
+	"crypto/tls"
+	"errors"
+	"go-w3chain/log"
+	"go-w3chain/node"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestTLSTransport(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testTransport.log"))
+	serverAccount, clientAccount := node.NewW3Account(""), node.NewW3Account("")
+	server, err := newTLSTransport(serverAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newTLSTransport(clientAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]common.Address)
+	client.expected = func(addr string) (common.Address, bool) {
+		account, ok := expected[addr]
+		return account, ok
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = server.listen(ln)
+	defer ln.Close()
+	addr := ln.Addr().String()
+	expected[addr] = *serverAccount.GetAccountAddress()
+
+	type accepted struct {
+		identity *common.Address
+		msgType  string
+		err      error
+	}
+	acceptCh := make(chan accepted, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				identity, err := handshakeIdentity(conn)
+				if err != nil {
+					acceptCh <- accepted{err: err}
+					return
+				}
+				packed, err := readFrame(conn)
+				if err != nil {
+					acceptCh <- accepted{identity: identity, err: err}
+					return
+				}
+				acceptCh <- accepted{identity: identity, msgType: unpackMsg(packed).MsgType}
+			}(conn)
+		}
+	}()
+
+	// 双方都能从证书中得到对端的账户地址，消息格式不变
+	pm := NewPeerManager()
+	defer pm.Close()
+	pm.SetTLS(client)
+	if err := pm.Send(addr, packEnvelope(packMsg(ReportAny, nil), addr)); err != nil {
+		t.Fatalf("send over tls fail: %v", err)
+	}
+	got := <-acceptCh
+	if got.err != nil || got.msgType != ReportAny || *got.identity != *clientAccount.GetAccountAddress() {
+		t.Fatalf("unexpected server side result: %+v", got)
+	}
+	conn, err := client.dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := handshakeIdentity(conn)
+	conn.Close()
+	if err != nil || *identity != *serverAccount.GetAccountAddress() {
+		t.Fatalf("unexpected server identity %v, err: %v", identity, err)
+	}
+	<-acceptCh
+
+	// 被拨地址的身份与身份表不符或未知时，拨号方拒绝连接
+	expected[addr] = *clientAccount.GetAccountAddress()
+	if conn, err := client.dial(addr, time.Second); err == nil || !errors.Is(err, errTLSPeerMismatch) {
+		if conn != nil {
+			conn.Close()
+		}
+		t.Fatalf("impersonated peer accepted, err: %v", err)
+	}
+	<-acceptCh
+	delete(expected, addr)
+	if conn, err := client.dial(addr, time.Second); err == nil || !errors.Is(err, errNoExpectedAccount) {
+		if conn != nil {
+			conn.Close()
+		}
+		t.Fatalf("peer without expected account accepted, err: %v", err)
+	}
+	<-acceptCh
+
+	// 不出示证书的对端被拒绝
+	noCert, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})
+	if err == nil {
+		noCert.Write([]byte{0, 0, 0, 0})
+		noCert.Close()
+	}
+	if got := <-acceptCh; got.err == nil {
+		t.Fatalf("peer without certificate accepted")
+	}
+
+	// 明文连接无法与tls监听端通信
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Write(packEnvelope(packMsg(ReportAny, nil), addr))
+	plain.Close()
+	if got := <-acceptCh; got.err == nil {
+		t.Fatalf("plaintext peer accepted")
+	}
+}
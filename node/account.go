@@ -70,14 +70,16 @@ func VerifySignature(msgHash []byte, sig []byte, expected_addr common.Address) b
 	// 恢复公钥
 	pubKeyBytes, err := crypto.Ecrecover(msgHash, sig)
 	if err != nil {
-		log.Error("ecrecover fail", "err", err)
+		log.Warn("ecrecover fail", "err", err)
 		// fmt.Printf("ecrecover err: %v\n", err)
+		return false
 	}
 
 	pubkey, err := crypto.UnmarshalPubkey(pubKeyBytes)
 	if err != nil {
-		log.Error("UnmarshalPubkey fail", "err", err)
+		log.Warn("UnmarshalPubkey fail", "err", err)
 		// fmt.Printf("UnmarshalPubkey err: %v\n", err)
+		return false
 	}
 
 	recovered_addr := crypto.PubkeyToAddress(*pubkey)
@@ -1,7 +1,10 @@
 package node
 
 import (
+	"go-w3chain/cfg"
 	"go-w3chain/core"
+	"go-w3chain/log"
+	"path/filepath"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -39,3 +42,90 @@ func TestVRF(t *testing.T) {
 		t.Error("verify vrf fail.")
 	}
 }
+
+/* 保存的私钥重启后仍被使用；身份表优先使用配置中的账户 */
+func TestLoadW3Account(t *testing.T) {
+	dir := t.TempDir()
+	first, err := LoadW3Account(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadW3Account(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *first.GetAccountAddress() != *second.GetAccountAddress() {
+		t.Fatal("account changed after reload")
+	}
+
+	oldDir, oldTable := IdentityDir, cfg.AccountTable
+	IdentityDir = t.TempDir()
+	defer func() { IdentityDir, cfg.AccountTable = oldDir, oldTable }()
+	if _, ok := ExpectedAccount("S0N1"); ok {
+		t.Fatal("unexpected account for S0N1")
+	}
+	if err := PublishAccount("S0N1", *first.GetAccountAddress()); err != nil {
+		t.Fatal(err)
+	}
+	if account, ok := ExpectedAccount("S0N1"); !ok || account != *first.GetAccountAddress() {
+		t.Fatalf("published account not found: %v", account)
+	}
+	configured := NewW3Account("")
+	cfg.AccountTable = map[string]string{"S0N1": configured.GetAccountAddress().Hex()}
+	if account, _ := ExpectedAccount("S0N1"); account != *configured.GetAccountAddress() {
+		t.Fatalf("configured account not preferred: %v", account)
+	}
+}
+
+func TestRegistryClusterToken(t *testing.T) {
+	log.SetLogInfo(log.Lvl(4), filepath.Join(t.TempDir(), "testRegistry.log"))
+	oldDir, oldTable := IdentityDir, cfg.AccountTable
+	IdentityDir, cfg.AccountTable = t.TempDir(), nil
+	defer func() { IdentityDir, cfg.AccountTable = oldDir, oldTable }()
+	const token = "secret"
+	booter, client := NewW3Account(""), NewW3Account("")
+	r := newRegistry(0, 0, 1, booter, token)
+
+	// 没有口令 hmac 的注册被拒绝，带有时第一个注册的账户与角色绑定
+	req := &core.RegisterPeer{Role: core.RegisterRoleClient, Addr: "10.0.0.9:19000", Account: *client.GetAccountAddress()}
+	req.Sig = client.SignHash(req.SigHash())
+	if err := r.register(req); err == nil {
+		t.Fatal("registration without cluster token accepted")
+	}
+	req.Mac = ClusterMAC(token, req.SigHash())
+	if err := r.register(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// 地址表带有挑战、booter 签名和口令 hmac
+	nonce := []byte("nonce")
+	topology, err := r.topology(nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyTopology(topology, nonce, token); err != nil {
+		t.Fatalf("topology from booter rejected: %v", err)
+	}
+	if err := VerifyTopology(topology, []byte("other"), token); err == nil {
+		t.Fatal("replayed topology accepted")
+	}
+	if err := VerifyTopology(topology, nonce, "wrong"); err == nil {
+		t.Fatal("topology with wrong cluster token accepted")
+	}
+	// 没有口令时需知道 booter 的账户
+	if err := VerifyTopology(topology, nonce, ""); err != errUnknownBooter {
+		t.Fatalf("topology from unknown booter accepted, err: %v", err)
+	}
+	cfg.AccountTable = map[string]string{BooterSlot: client.GetAccountAddress().Hex()}
+	if err := VerifyTopology(topology, nonce, token); err == nil {
+		t.Fatal("topology signed by another account accepted")
+	}
+	cfg.AccountTable = map[string]string{BooterSlot: booter.GetAccountAddress().Hex()}
+	if err := VerifyTopology(topology, nonce, ""); err != nil {
+		t.Fatalf("topology from known booter rejected: %v", err)
+	}
+	topology.ClientTable[0] = "10.0.0.8:19000"
+	if err := VerifyTopology(topology, nonce, ""); err == nil {
+		t.Fatal("modified topology accepted")
+	}
+}
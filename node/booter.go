@@ -1,6 +1,7 @@
 package node
 
 import (
+	"errors"
 	"fmt"
 	"go-w3chain/beaconChain"
 	"go-w3chain/cfg"
@@ -19,6 +20,8 @@ type Booter struct {
 	tbchain     *beaconChain.BeaconChain
 	messageHub  core.MessageHub
 	genesisLock sync.Mutex
+	contract    *core.BooterSendContract // 已发送的合约地址，部署前为nil，由 genesisLock 保护
+	registry    *registry                // 为nil时各进程使用 cfg 中固定的地址表
 }
 
 func NewBooter() *Booter {
@@ -37,6 +40,33 @@ func NewBooter() *Booter {
 	}
 }
 
+/** 让 booter 作为注册中心，收集 shardNum*comAllNodeNum 个节点和 clientNum 个客户端的地址
+ * account 为 booter 的账户，用于对下发的地址表签名；token 为集群口令，非空时注册和地址表都需带有该口令的 hmac
+ */
+func (booter *Booter) EnableRegistry(shardNum, comAllNodeNum, clientNum int, account *W3Account, token string) {
+	booter.registry = newRegistry(shardNum, comAllNodeNum, clientNum, account, token)
+}
+
+func (booter *Booter) RegistryEnabled() bool {
+	return booter.registry != nil
+}
+
+/* 登记节点或客户端的监听地址，节点的注册信息需由其账户签名 */
+func (booter *Booter) HandleRegister(req *core.RegisterPeer) error {
+	if booter.registry == nil {
+		return errors.New("booter registry not enabled")
+	}
+	return booter.registry.register(req)
+}
+
+/* 所有节点和客户端都注册后返回完整的地址表，用 booter 的账户对地址表和查询者的挑战 nonce 签名 */
+func (booter *Booter) HandleGetTopology(nonce []byte) (*core.Topology, error) {
+	if booter.registry == nil {
+		return nil, errors.New("booter registry not enabled")
+	}
+	return booter.registry.topology(nonce)
+}
+
 func (booter *Booter) SetTBchain(tbchain *beaconChain.BeaconChain) {
 	booter.tbchain = tbchain
 }
@@ -49,14 +79,25 @@ func (booter *Booter) GetAddr() string {
 	return fmt.Sprintf("%s:%d", booter.addrConfig.Host, booter.addrConfig.Port)
 }
 
-/* booter接收各个分片的创世区块信标和初始账户列表
-收集齐后部署信标链上的合约，并返回退出booter监听线程的信号 */
-func (booter *Booter) HandleShardSendGenesis(data *core.ShardSendGenesis) (exit bool) {
+/** booter接收各个分片的创世区块信标和初始账户列表，收集齐后部署信标链上的合约并发送合约地址
+ * 之后 booter 继续监听，向重启的节点和客户端提供合约地址，重启的节点再次发送的创世信标被忽略
+ */
+func (booter *Booter) HandleShardSendGenesis(data *core.ShardSendGenesis) {
 	booter.genesisLock.Lock()
 	defer booter.genesisLock.Unlock()
-	exit = false
-	// 调用tbchain的方法
+	if booter.contract != nil {
+		log.Warn("genesis received after the contract was sent, ignored", "shardID", data.Gtb.ShardID)
+		return
+	}
+	// 记录分片的初始地址，信标链合约据此验证信标的签名者
 	booter.tbchain.SetAddrs(data.Addrs, nil, 0, data.Gtb.ShardID, 0)
+	if booter.tbchain.IsSimulationChain() {
+		// 模拟信标链的合约在进程内，收集齐创世信标后发送空的合约地址，通知各节点和客户端开始运行
+		if booter.tbchain.AddSimulationChainGenesisTB(data.Gtb) {
+			booter.sendContract(&core.BooterSendContract{})
+		}
+		return
+	}
 	contractTB := &eth_chain.ContractTB{
 		ShardID:    data.Gtb.ShardID,
 		Height:     data.Gtb.Height,
@@ -66,11 +107,24 @@ func (booter *Booter) HandleShardSendGenesis(data *core.ShardSendGenesis) (exit
 	}
 	contractAddr, _ := booter.tbchain.AddEthChainGenesisTB(contractTB)
 	if (contractAddr != common.Address{}) {
-		exit = true
-		msg := &core.BooterSendContract{
+		booter.sendContract(&core.BooterSendContract{
 			Addr: contractAddr,
-		}
-		booter.messageHub.Send(core.MsgTypeBooterSendContract, 0, msg, nil)
+		})
+	}
+}
+
+/* 调用者需持有 genesisLock */
+func (booter *Booter) sendContract(msg *core.BooterSendContract) {
+	booter.contract = msg
+	booter.messageHub.Send(core.MsgTypeBooterSendContract, 0, msg, nil)
+}
+
+/* 已发送的合约地址，重启的节点和客户端据此恢复信标链视图 */
+func (booter *Booter) HandleGetContract() (*core.BooterSendContract, error) {
+	booter.genesisLock.Lock()
+	defer booter.genesisLock.Unlock()
+	if booter.contract == nil {
+		return nil, errors.New("contract not deployed yet")
 	}
-	return
+	return booter.contract, nil
 }
@@ -0,0 +1,167 @@
+package node
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"go-w3chain/cfg"
+	"go-w3chain/core"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	// 数据目录 keystore 下保存私钥的文件
+	nodeKeyFile = "nodekey"
+	// booter 在身份表中的名字
+	BooterSlot = "B"
+)
+
+/** 公开身份表所在的目录，每个角色启动时把自己的账户地址写入其中名为角色名的文件
+ * 同一台机器或共享数据目录的其他进程据此确定该角色应使用的账户；为空时为数据目录下的 accounts
+ */
+var IdentityDir string
+
+func identityDir() string {
+	if IdentityDir != "" {
+		return IdentityDir
+	}
+	return filepath.Join(cfg.DefaultDataDir(), "accounts")
+}
+
+/* 节点在身份表中的名字，与节点数据目录名相同 */
+func NodeSlot(shardID, nodeID uint32) string {
+	return fmt.Sprintf("S%dN%d", shardID, nodeID)
+}
+
+/* 客户端在身份表中的名字 */
+func ClientSlot(clientID uint32) string {
+	return fmt.Sprintf("C%d", clientID)
+}
+
+/* 角色 slot 在默认数据目录下的目录，其中保存该角色的私钥；booter 使用 booter 目录 */
+func SlotDir(slot string) string {
+	if slot == BooterSlot {
+		return filepath.Join(cfg.DefaultDataDir(), "booter")
+	}
+	return filepath.Join(cfg.DefaultDataDir(), slot)
+}
+
+/** 读取 dataDir/keystore 中保存的私钥，不存在时创建并保存
+ * 进程重启后账户不变，其他进程预先绑定的账户仍然有效
+ */
+func LoadW3Account(dataDir string) (*W3Account, error) {
+	keyDir := filepath.Join(dataDir, KeyStoreDir)
+	keyFile := filepath.Join(keyDir, nodeKeyFile)
+	privateKey, err := crypto.LoadECDSA(keyFile)
+	if os.IsNotExist(err) {
+		privateKey = newPrivateKey()
+		if err := os.MkdirAll(keyDir, 0700); err != nil {
+			return nil, err
+		}
+		err = crypto.SaveECDSA(keyFile, privateKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load node key %s: %v", keyFile, err)
+	}
+	w3Account := &W3Account{
+		privateKey: privateKey,
+		pubKey:     &privateKey.PublicKey,
+		keyDir:     keyDir,
+	}
+	w3Account.accountAddr = crypto.PubkeyToAddress(privateKey.PublicKey)
+	return w3Account, nil
+}
+
+/* 把角色 slot 的账户地址写入公开身份表 */
+func PublishAccount(slot string, account common.Address) error {
+	dir := identityDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// 先写临时文件再改名，其他进程不会读到写了一半的地址
+	tmp := filepath.Join(dir, "."+slot+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(account.Hex()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, slot))
+}
+
+/** 角色 slot 应使用的账户
+ * 优先使用地址配置文件中 Accounts 给出的账户，其次是公开身份表中的账户，都没有时返回 false
+ */
+func ExpectedAccount(slot string) (common.Address, bool) {
+	if hex, ok := cfg.AccountTable[slot]; ok {
+		return common.HexToAddress(hex), true
+	}
+	data, err := ioutil.ReadFile(filepath.Join(identityDir(), slot))
+	if err != nil {
+		return common.Address{}, false
+	}
+	hex := strings.TrimSpace(string(data))
+	if !common.IsHexAddress(hex) {
+		return common.Address{}, false
+	}
+	return common.HexToAddress(hex), true
+}
+
+/* 网络地址 addr 在地址表中对应的角色名 */
+func SlotOfAddr(addr string) (string, bool) {
+	if addr == cfg.BooterAddr {
+		return BooterSlot, true
+	}
+	for shardID, list := range cfg.NodeTable {
+		for nodeID, a := range list {
+			if a == addr {
+				return NodeSlot(shardID, nodeID), true
+			}
+		}
+	}
+	for clientID, a := range cfg.ClientTable {
+		if a == addr {
+			return ClientSlot(clientID), true
+		}
+	}
+	return "", false
+}
+
+/* 用集群口令 token 对签名内容 hash 计算的 hmac，booter 和注册者据此确认对方与自己属于同一集群 */
+func ClusterMAC(token string, hash []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(hash)
+	return mac.Sum(nil)
+}
+
+var errUnknownBooter = errors.New("booter account unknown, add B to Accounts of the topology file or set ClusterToken")
+
+/** 验证 booter 返回的地址表：签名有效、挑战为本次查询的 nonce，
+ * 且签名者是身份表中 booter 的账户，或配置了 ClusterToken 时 hmac 正确；两者都无法确认时拒绝
+ */
+func VerifyTopology(t *core.Topology, nonce []byte, token string) error {
+	if !bytes.Equal(t.Nonce, nonce) {
+		return errors.New("topology does not answer this request")
+	}
+	hash := t.SigHash()
+	if len(t.Sig) == 0 || !VerifySignature(hash, t.Sig, t.Booter) {
+		return errors.New("invalid topology signature")
+	}
+	expected, known := ExpectedAccount(BooterSlot)
+	if known && t.Booter != expected {
+		return fmt.Errorf("topology signed by %s, expected booter %s", t.Booter.Hex(), expected.Hex())
+	}
+	if token != "" {
+		if !hmac.Equal(t.Mac, ClusterMAC(token, hash)) {
+			return errors.New("invalid topology cluster token")
+		}
+	} else if !known {
+		return errUnknownBooter
+	}
+	return nil
+}
@@ -51,6 +51,9 @@ type Node struct {
 	reconfigResult      *core.ReconfigResult                // 本节点的重组结果
 	reconfigResults     []*core.ReconfigResult              // 本委员会所有节点的重组结果
 	com2ReconfigResults map[uint32]*core.ComReconfigResults // 所有委员会的节点的重组结果
+
+	reconfigStateLock sync.Mutex
+	reconfigState     ReconfigState // 重组进度，由管理接口读取
 }
 
 func NewNode(parentdataDir string, shardNum, shardID, comID, nodeID, shardSize, comAllNodeNum int, reconfigMode string) *Node {
@@ -66,9 +69,15 @@ func NewNode(parentdataDir string, shardNum, shardID, comID, nodeID, shardSize,
 		NodeInfo:      nodeInfo,
 		comAllNodeNum: comAllNodeNum,
 		reconfigMode:  reconfigMode,
+		reconfigState: ReconfigState{Mode: reconfigMode, Phase: ReconfigPhaseIdle},
 	}
 
-	node.w3Account = NewW3Account(node.DataDir)
+	// 账户私钥保存在节点数据目录中，重启后账户不变
+	w3Account, err := LoadW3Account(node.DataDir)
+	if err != nil {
+		log.Error("load node account fail", "nodeID", nodeID, "err", err)
+	}
+	node.w3Account = w3Account
 	printAccounts(node.w3Account)
 
 	db, err := node.OpenDatabase("chaindata", 0, 0, "", false)
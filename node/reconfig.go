@@ -16,6 +16,39 @@ import (
 type HandleReconfigMsgs struct {
 }
 
+/* 节点所处的重组阶段 */
+const (
+	ReconfigPhaseIdle = "idle" // 未在重组
+	ReconfigPhaseVrf  = "vrf"  // 已发送vrf结果，等待所有委员会的结果
+	ReconfigPhaseSync = "sync" // 已加入新委员会，正在同步交易池和状态
+)
+
+/* 节点的重组进度 */
+type ReconfigState struct {
+	Mode       string
+	Phase      string
+	Rounds     int    // 已完成的重组轮数
+	SeedHeight uint64 // 最近一轮重组的种子高度
+}
+
+func (n *Node) setReconfigPhase(phase string, seedHeight uint64) {
+	n.reconfigStateLock.Lock()
+	defer n.reconfigStateLock.Unlock()
+	if phase == ReconfigPhaseIdle && n.reconfigState.Phase != ReconfigPhaseIdle {
+		n.reconfigState.Rounds++
+	}
+	n.reconfigState.Phase = phase
+	if seedHeight > 0 {
+		n.reconfigState.SeedHeight = seedHeight
+	}
+}
+
+func (n *Node) GetReconfigState() ReconfigState {
+	n.reconfigStateLock.Lock()
+	defer n.reconfigStateLock.Unlock()
+	return n.reconfigState
+}
+
 // leader节点调用
 func (n *Node) AddReconfigResult(res *core.ReconfigResult) {
 	if n.NodeInfo.NodeID != 0 {
@@ -72,6 +105,7 @@ func (n *Node) InitReconfig(data *core.InitReconfig) {
 
 func (n *Node) HandleLeaderInitReconfig(data *core.InitReconfig) {
 	n.com.UpdateTbChainHeight(data.SeedHeight)
+	n.setReconfigPhase(ReconfigPhaseVrf, data.SeedHeight)
 
 	acc := n.GetAccount()
 	vrfValue := acc.GenerateVRFOutput(data.Seed[:]).RandomValue
@@ -186,6 +220,7 @@ func (n *Node) updateNodeInfo(newNodeInfo *core.NodeInfo) {
 }
 
 func (n *Node) EndReconfig(newCom2Results map[uint32][]*core.ReconfigResult, oldComLeaderAddr string) {
+	n.setReconfigPhase(ReconfigPhaseSync, 0)
 	// 更新委员会节点数量
 	n.comAllNodeNum = len(newCom2Results[n.NodeInfo.ComID])
 	log.Debug(fmt.Sprintf("after reconfiguration, com %d has %d nodes in total.", n.NodeInfo.ComID, n.comAllNodeNum))
@@ -223,6 +258,8 @@ func (n *Node) EndReconfig(newCom2Results map[uint32][]*core.ReconfigResult, old
 	syncStartTime := time.Now()
 	// 同步交易池
 	var sizeofPoolTx int
+	// 同步过程中回复在网络上传输的字节数，压缩前后分别统计
+	var transfer core.TransferSize
 	// if utils.IsComLeader(n.NodeInfo.NodeID) {
 	if true {
 		var poolTx *core.PoolTx
@@ -233,6 +270,12 @@ func (n *Node) EndReconfig(newCom2Results map[uint32][]*core.ReconfigResult, old
 			getPoolTxsCh := make(chan struct{}, 1)
 			callback := func(res ...interface{}) {
 				poolTx = res[0].(*core.PoolTx)
+				if err := core.RPCErr(res); err != nil || poolTx == nil {
+					// 旧leader无响应时以空交易池继续，避免重组卡住
+					log.Warn("get pool tx from old committee leader failed", "addr", oldComLeaderAddr, "err", err)
+					poolTx = &core.PoolTx{}
+				}
+				transfer.Add(core.RPCTransferSize(res))
 				n.com.SetPoolTx(poolTx)
 
 				getPoolTxsCh <- struct{}{}
@@ -254,13 +297,13 @@ func (n *Node) EndReconfig(newCom2Results map[uint32][]*core.ReconfigResult, old
 		// 根据不同同步方式，选择需要额外同步的内容
 		switch n.reconfigMode {
 		case "lesssync": // 存储共识分离，只需同步交易池
-			n.lessSync(sizeofPoolTx, syncStartTime)
+			n.lessSync(sizeofPoolTx, transfer, syncStartTime)
 		case "fullsync":
-			n.fullsync(sizeofPoolTx, syncStartTime)
+			n.fullsync(sizeofPoolTx, transfer, syncStartTime)
 		case "fastsync":
-			n.fastsync(sizeofPoolTx, syncStartTime)
+			n.fastsync(sizeofPoolTx, transfer, syncStartTime)
 		case "tMPTsync":
-			n.tMPTsync(sizeofPoolTx, syncStartTime)
+			n.tMPTsync(sizeofPoolTx, transfer, syncStartTime)
 		default:
 			log.Error("unknown reconfig mode", "mode", n.reconfigMode)
 		}
@@ -282,20 +325,22 @@ func (n *Node) EndReconfig(newCom2Results map[uint32][]*core.ReconfigResult, old
 		n.messageHub.Send(core.MsgTypeReportAny, 0, reportMsg, nil)
 	}
 
+	n.setReconfigPhase(ReconfigPhaseIdle, 0)
+
 	// 删除无用的长连接，释放系统资源，防止某些端口被强制关闭
 	// n.messageHub.Send(core.MsgTypeClearConnection, 0, n.NodeInfo, nil)
 
 	// todo
 }
 
-func (n *Node) lessSync(sizeofPoolTx int, syncStartTime time.Time) {
+func (n *Node) lessSync(sizeofPoolTx int, transfer core.TransferSize, syncStartTime time.Time) {
 	elapsed := time.Since(syncStartTime)
-	reportMsg := fmt.Sprintf("shardID: %d msgType: %s sizeof states(bytes): %d sizeof blocks(bytes): %d sizeof poolTx(bytes): %d sync time: %d",
-		n.NodeInfo.ComID, "lesssync", 0, 0, sizeofPoolTx, elapsed.Milliseconds())
+	reportMsg := fmt.Sprintf("shardID: %d msgType: %s sizeof states(bytes): %d sizeof blocks(bytes): %d sizeof poolTx(bytes): %d sync time: %d sync raw(bytes): %d sync wire(bytes): %d",
+		n.NodeInfo.ComID, "lesssync", 0, 0, sizeofPoolTx, elapsed.Milliseconds(), transfer.Raw, transfer.Wire)
 	n.messageHub.Send(core.MsgTypeReportAny, 0, reportMsg, nil)
 }
 
-func (n *Node) tMPTsync(sizeofPoolTx int, syncStartTime time.Time) {
+func (n *Node) tMPTsync(sizeofPoolTx int, transfer core.TransferSize, syncStartTime time.Time) {
 	shardLeader := cfg.NodeTable[n.NodeInfo.ComID][0]
 	request := &core.GetSyncData{
 		ServerAddr: shardLeader,
@@ -310,6 +355,11 @@ func (n *Node) tMPTsync(sizeofPoolTx int, syncStartTime time.Time) {
 		getSyncDataCh := make(chan struct{}, 1)
 		callback := func(res ...interface{}) {
 			data = res[0].(*core.SyncData)
+			if err := core.RPCErr(res); err != nil || data == nil {
+				log.Warn("get sync data from shard leader failed", "mode", "tMPTsync", "addr", shardLeader, "err", err)
+				data = &core.SyncData{}
+			}
+			transfer.Add(core.RPCTransferSize(res))
 			log.Debug("tMPTsync data received", "len(states)", len(data.States), "len(blocks)", len(data.Blocks))
 			getSyncDataCh <- struct{}{}
 		}
@@ -319,12 +369,12 @@ func (n *Node) tMPTsync(sizeofPoolTx int, syncStartTime time.Time) {
 	}
 
 	elapsed := time.Since(syncStartTime)
-	reportMsg := fmt.Sprintf("shardID: %d msgType: %s sizeof states(bytes): %d sizeof blocks(bytes): %d sizeof poolTx(bytes): %d sync time: %d",
-		n.NodeInfo.ComID, "tMPTsync", len(utils.EncodeAny(data.States)), len(utils.EncodeAny(data.Blocks)), sizeofPoolTx, elapsed.Milliseconds())
+	reportMsg := fmt.Sprintf("shardID: %d msgType: %s sizeof states(bytes): %d sizeof blocks(bytes): %d sizeof poolTx(bytes): %d sync time: %d sync raw(bytes): %d sync wire(bytes): %d",
+		n.NodeInfo.ComID, "tMPTsync", len(utils.EncodeAny(data.States)), len(utils.EncodeAny(data.Blocks)), sizeofPoolTx, elapsed.Milliseconds(), transfer.Raw, transfer.Wire)
 	n.messageHub.Send(core.MsgTypeReportAny, 0, reportMsg, nil)
 }
 
-func (n *Node) fullsync(sizeofPoolTx int, syncStartTime time.Time) {
+func (n *Node) fullsync(sizeofPoolTx int, transfer core.TransferSize, syncStartTime time.Time) {
 	shardLeader := cfg.NodeTable[n.NodeInfo.ComID][0]
 	request := &core.GetSyncData{
 		ServerAddr: shardLeader,
@@ -339,6 +389,11 @@ func (n *Node) fullsync(sizeofPoolTx int, syncStartTime time.Time) {
 		getSyncDataCh := make(chan struct{}, 1)
 		callback := func(res ...interface{}) {
 			data = res[0].(*core.SyncData)
+			if err := core.RPCErr(res); err != nil || data == nil {
+				log.Warn("get sync data from shard leader failed", "mode", "fullsync", "addr", shardLeader, "err", err)
+				data = &core.SyncData{}
+			}
+			transfer.Add(core.RPCTransferSize(res))
 			log.Debug("fullsync data received", "len(states)", len(data.States), "len(blocks)", len(data.Blocks))
 			getSyncDataCh <- struct{}{}
 		}
@@ -348,12 +403,12 @@ func (n *Node) fullsync(sizeofPoolTx int, syncStartTime time.Time) {
 	}
 
 	elapsed := time.Since(syncStartTime)
-	reportMsg := fmt.Sprintf("shardID: %d msgType: %s sizeof states(bytes): %d sizeof blocks(bytes): %d sizeof poolTx(bytes): %d sync time: %d",
-		n.NodeInfo.ComID, "fullsync", len(utils.EncodeAny(data.States)), len(utils.EncodeAny(data.Blocks)), sizeofPoolTx, elapsed.Milliseconds())
+	reportMsg := fmt.Sprintf("shardID: %d msgType: %s sizeof states(bytes): %d sizeof blocks(bytes): %d sizeof poolTx(bytes): %d sync time: %d sync raw(bytes): %d sync wire(bytes): %d",
+		n.NodeInfo.ComID, "fullsync", len(utils.EncodeAny(data.States)), len(utils.EncodeAny(data.Blocks)), sizeofPoolTx, elapsed.Milliseconds(), transfer.Raw, transfer.Wire)
 	n.messageHub.Send(core.MsgTypeReportAny, 0, reportMsg, nil)
 }
 
-func (n *Node) fastsync(sizeofPoolTx int, syncStartTime time.Time) {
+func (n *Node) fastsync(sizeofPoolTx int, transfer core.TransferSize, syncStartTime time.Time) {
 	shardLeader := cfg.NodeTable[n.NodeInfo.ComID][0]
 	request := &core.GetSyncData{
 		ServerAddr: shardLeader,
@@ -368,6 +423,11 @@ func (n *Node) fastsync(sizeofPoolTx int, syncStartTime time.Time) {
 		getSyncDataCh := make(chan struct{}, 1)
 		callback := func(res ...interface{}) {
 			data = res[0].(*core.SyncData)
+			if err := core.RPCErr(res); err != nil || data == nil {
+				log.Warn("get sync data from shard leader failed", "mode", "fastsync", "addr", shardLeader, "err", err)
+				data = &core.SyncData{}
+			}
+			transfer.Add(core.RPCTransferSize(res))
 			log.Debug("fastsync data received", "len(states)", len(data.States), "len(blocks)", len(data.Blocks))
 			getSyncDataCh <- struct{}{}
 		}
@@ -377,7 +437,7 @@ func (n *Node) fastsync(sizeofPoolTx int, syncStartTime time.Time) {
 	}
 
 	elapsed := time.Since(syncStartTime)
-	reportMsg := fmt.Sprintf("shardID: %d msgType: %s sizeof states(bytes): %d sizeof blocks(bytes): %d sizeof poolTx(bytes): %d sync time: %d",
-		n.NodeInfo.ComID, "fastsync", len(utils.EncodeAny(data.States)), len(utils.EncodeAny(data.Blocks)), sizeofPoolTx, elapsed.Milliseconds())
+	reportMsg := fmt.Sprintf("shardID: %d msgType: %s sizeof states(bytes): %d sizeof blocks(bytes): %d sizeof poolTx(bytes): %d sync time: %d sync raw(bytes): %d sync wire(bytes): %d",
+		n.NodeInfo.ComID, "fastsync", len(utils.EncodeAny(data.States)), len(utils.EncodeAny(data.Blocks)), sizeofPoolTx, elapsed.Milliseconds(), transfer.Raw, transfer.Wire)
 	n.messageHub.Send(core.MsgTypeReportAny, 0, reportMsg, nil)
 }
@@ -0,0 +1,187 @@
+package node
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"go-w3chain/cfg"
+	"go-w3chain/core"
+	"go-w3chain/log"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var ErrTopologyIncomplete = errors.New("topology incomplete")
+
+/** booter 上的注册表，记录各节点和客户端启动时上报的监听地址
+ * 身份表中有该角色应使用的账户时（见 ExpectedAccount），只接受该账户签名的注册；
+ * 没有时该角色第一个签名有效的注册者的账户与其绑定（首次使用即信任），之后只接受同一账户的注册。
+ * 配置了集群口令时注册还需带有该口令的 hmac。
+ * 所有节点和客户端注册完成后地址表固定，之后不再接受改变地址表的注册
+ */
+type registry struct {
+	lock          sync.Mutex
+	shardNum      int
+	comAllNodeNum int
+	clientNum     int
+
+	nodes    map[uint32]map[uint32]string
+	clients  map[uint32]string
+	accounts map[string]common.Address // 网络地址 -> 注册者的账户
+	owners   map[string]string         // 网络地址 -> 注册者，防止两个注册者使用同一地址
+	bound    map[string]common.Address // 角色名 -> 首次注册时绑定的账户
+
+	account *W3Account // booter 的账户，对下发的地址表签名
+	token   string
+}
+
+func newRegistry(shardNum, comAllNodeNum, clientNum int, account *W3Account, token string) *registry {
+	r := &registry{
+		shardNum:      shardNum,
+		comAllNodeNum: comAllNodeNum,
+		clientNum:     clientNum,
+		nodes:         make(map[uint32]map[uint32]string),
+		clients:       make(map[uint32]string),
+		accounts:      make(map[string]common.Address),
+		owners:        make(map[string]string),
+		bound:         make(map[string]common.Address),
+		account:       account,
+		token:         token,
+	}
+	for i := 0; i < shardNum; i++ {
+		r.nodes[uint32(i)] = make(map[uint32]string)
+	}
+	return r
+}
+
+func (r *registry) registered() int {
+	n := len(r.clients)
+	for _, list := range r.nodes {
+		n += len(list)
+	}
+	return n
+}
+
+func (r *registry) complete() bool {
+	return r.registered() == r.shardNum*r.comAllNodeNum+r.clientNum
+}
+
+func (r *registry) register(req *core.RegisterPeer) error {
+	var owner string
+	switch req.Role {
+	case core.RegisterRoleNode:
+		if int(req.ShardID) >= r.shardNum || int(req.NodeID) >= r.comAllNodeNum {
+			return fmt.Errorf("node S%dN%d out of range, shardNum: %d comAllNodeNum: %d", req.ShardID, req.NodeID, r.shardNum, r.comAllNodeNum)
+		}
+		owner = NodeSlot(req.ShardID, req.NodeID)
+	case core.RegisterRoleClient:
+		if int(req.ClientID) >= r.clientNum {
+			return fmt.Errorf("client %d out of range, clientNum: %d", req.ClientID, r.clientNum)
+		}
+		owner = ClientSlot(req.ClientID)
+	default:
+		return fmt.Errorf("unknown register role %s", req.Role)
+	}
+	if len(req.Sig) == 0 || !VerifySignature(req.SigHash(), req.Sig, req.Account) {
+		return fmt.Errorf("invalid register signature of %s", owner)
+	}
+	if r.token != "" && !hmac.Equal(req.Mac, ClusterMAC(r.token, req.SigHash())) {
+		return fmt.Errorf("invalid cluster token of %s", owner)
+	}
+	if req.Addr == "" || req.Addr == cfg.BooterAddr {
+		return fmt.Errorf("invalid listen address %q of %s", req.Addr, owner)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	expected, ok := ExpectedAccount(owner)
+	if !ok {
+		expected, ok = r.bound[owner]
+	}
+	if ok && req.Account != expected {
+		return fmt.Errorf("account %s can not register as %s, expected %s", req.Account.Hex(), owner, expected.Hex())
+	}
+	if o, ok := r.owners[req.Addr]; ok && o != owner {
+		return fmt.Errorf("address %s already registered by %s", req.Addr, o)
+	}
+	var old string
+	if req.Role == core.RegisterRoleNode {
+		old = r.nodes[req.ShardID][req.NodeID]
+	} else {
+		old = r.clients[req.ClientID]
+	}
+	if r.complete() {
+		// 地址表已经下发，只接受相同的重复注册
+		if old != req.Addr || r.accounts[old] != req.Account {
+			return fmt.Errorf("topology already complete, %s can not change its registration", owner)
+		}
+		return nil
+	}
+	if !ok {
+		log.Warn("booter registry bind account on first use", "slot", owner, "account", req.Account.Hex())
+	}
+	r.bound[owner] = req.Account
+	// 进程在地址表完成之前重启时，以新的注册为准
+	if old != "" {
+		delete(r.owners, old)
+		delete(r.accounts, old)
+	}
+	r.owners[req.Addr] = owner
+	r.accounts[req.Addr] = req.Account
+	if req.Role == core.RegisterRoleNode {
+		r.nodes[req.ShardID][req.NodeID] = req.Addr
+	} else {
+		r.clients[req.ClientID] = req.Addr
+	}
+	log.Info("booter registry", "registered", owner, "addr", req.Addr, "progress", fmt.Sprintf("%d/%d", r.registered(), r.shardNum*r.comAllNodeNum+r.clientNum))
+	return nil
+}
+
+/* 已注册和需要注册的节点与客户端数量，未开启注册时均为0 */
+func (booter *Booter) RegistryProgress() (registered, total int) {
+	r := booter.registry
+	if r == nil {
+		return 0, 0
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.registered(), r.shardNum*r.comAllNodeNum + r.clientNum
+}
+
+/* 所有节点和客户端都注册后返回签名的地址表，否则返回 ErrTopologyIncomplete */
+func (r *registry) topology(nonce []byte) (*core.Topology, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.complete() {
+		return nil, fmt.Errorf("%w: %d/%d registered", ErrTopologyIncomplete, r.registered(), r.shardNum*r.comAllNodeNum+r.clientNum)
+	}
+	t := &core.Topology{
+		NodeTable:   make(map[uint32]map[uint32]string),
+		ClientTable: make(map[uint32]string),
+		Accounts:    make(map[string]common.Address),
+		GethAddr:    cfg.GethIPAddr,
+	}
+	for shardID, list := range r.nodes {
+		t.NodeTable[shardID] = make(map[uint32]string)
+		for nodeID, addr := range list {
+			t.NodeTable[shardID][nodeID] = addr
+		}
+	}
+	for cid, addr := range r.clients {
+		t.ClientTable[cid] = addr
+	}
+	for addr, account := range r.accounts {
+		t.Accounts[addr] = account
+	}
+	t.Nonce = nonce
+	if r.account != nil {
+		t.Booter = *r.account.GetAccountAddress()
+		hash := t.SigHash()
+		t.Sig = r.account.SignHash(hash)
+		if r.token != "" {
+			t.Mac = ClusterMAC(r.token, hash)
+		}
+	}
+	return t, nil
+}
@@ -2,6 +2,7 @@ package pbft
 
 import (
 	"go-w3chain/core"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/rlp"
@@ -9,7 +10,7 @@ import (
 
 func (p *PbftConsensusNode) SetSequenceID(id uint64) {
 	p.sequenceLock.Lock()
-	p.sequenceID = id
+	atomic.StoreUint64(&p.sequenceID, id)
 	p.sequenceLock.Unlock()
 }
 
@@ -63,7 +64,7 @@ func (p *PbftConsensusNode) HandlePrePrepare(ppmsg *core.PrePrepare) {
 	// 方便起见，直接同步至新的sequenceID
 	// 这是不安全的，仅能用于实验调试
 	if debug {
-		p.sequenceID = ppmsg.SeqID
+		atomic.StoreUint64(&p.sequenceID, ppmsg.SeqID)
 	}
 
 	flag := false
@@ -189,7 +190,7 @@ func (p *PbftConsensusNode) HandleCommit(cmsg *core.Commit) {
 		p.reply(cmsg.SeqID, cmsg.Digest)
 		if p.NodeInfo.NodeID != p.view {
 			p.pl.Plog.Printf("C%dN%d: this round of pbft %d is end \n", p.NodeInfo.ComID, p.NodeInfo.NodeID, p.sequenceID)
-			p.sequenceID += 1
+			atomic.AddUint64(&p.sequenceID, 1)
 		}
 		// }
 
@@ -223,7 +224,7 @@ func (p *PbftConsensusNode) HandleReply(rmsg *core.Reply) {
 		p.gotEnoughReply[rmsg.MessageID] = true
 
 		p.pl.Plog.Printf("C%dN%d: this round of pbft %d is end \n", p.NodeInfo.ComID, p.NodeInfo.NodeID, p.sequenceID)
-		p.sequenceID += 1
+		atomic.AddUint64(&p.sequenceID, 1)
 		p.OneConsensusDone <- struct{}{}
 
 		p.pl.Plog.Printf("C%dN%d get sequenceLock unlocked...\n", p.NodeInfo.ComID, p.NodeInfo.NodeID)
@@ -286,7 +287,7 @@ func (p *PbftConsensusNode) HandleSendOldSeq(som *core.SendOldMessage) {
 		p.reply(uint64(idx)+beginSeq, getDigest(r))
 		p.pl.Plog.Printf("this round of pbft %d is end \n", uint64(idx)+beginSeq)
 	}
-	p.sequenceID = som.SeqEndHeight + 1
+	atomic.StoreUint64(&p.sequenceID, som.SeqEndHeight+1)
 	if rDigest, ok1 := p.height2Digest[p.sequenceID]; ok1 {
 		if r, ok2 := p.requestPool[rDigest]; ok2 {
 			ppmsg := &core.PrePrepare{
@@ -6,6 +6,7 @@ import (
 	"go-w3chain/core"
 	"go-w3chain/pbft/pbft_log"
 	"sync"
+	"sync/atomic"
 )
 
 type PbftConsensusNode struct {
@@ -16,7 +17,7 @@ type PbftConsensusNode struct {
 	view           uint32 // denote the view of this pbft, the main node can be inferred from this variant
 
 	// the control message and message checking utils in pbft
-	sequenceID        uint64                             // the message sequence id of the pbft
+	sequenceID        uint64                             // the message sequence id of the pbft, written atomically so that status reads need no lock
 	requestPool       map[string]*core.PbftRequest       // RequestHash to Request
 	cntPrepareConfirm map[string]map[*core.NodeInfo]bool // count the prepare confirm message, [messageHash][Node]bool
 	cntCommitConfirm  map[string]map[*core.NodeInfo]bool // count the commit confirm message, [messageHash][Node]bool
@@ -103,3 +104,13 @@ func (p *PbftConsensusNode) SetMessageHub(hub core.MessageHub) {
 func (p *PbftConsensusNode) GetNodes_num() uint32 {
 	return p.node_nums
 }
+
+/* 当前序号，仅用于查看状态；leader 在整轮共识期间持有 sequenceLock，因此所有修改都是原子操作，这里原子读取 */
+func (p *PbftConsensusNode) GetSequenceID() uint64 {
+	return atomic.LoadUint64(&p.sequenceID)
+}
+
+/* view 只在创建时设置，之后不再修改 */
+func (p *PbftConsensusNode) GetView() uint32 {
+	return p.view
+}
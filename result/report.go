@@ -0,0 +1,175 @@
+package result
+
+import (
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/** 节点发给客户端的重组报告，格式见 node/reconfig.go，如
+ * "shardID: 1 msgType: lesssync sizeof states(bytes): 0 ... sync time: 12 sync raw(bytes): 100 sync wire(bytes): 80"
+ */
+var (
+	reportFieldRe = regexp.MustCompile(`([A-Za-z][A-Za-z ()]*): (\S+)`)
+	reportLock    sync.Mutex
+	reports       []map[string]string
+)
+
+/* 重组报告的统计 */
+type ReconfigSummary struct {
+	Rounds           int     // 完成重组的委员会次数，每个委员会每轮重组计一次
+	Syncs            int     // 节点同步状态的次数
+	AvgSyncTimeMs    float64 // 平均同步时间
+	AvgSyncWireBytes float64 // 平均每次同步在网络上传输的字节数
+}
+
+/* 记录一条报告，客户端收到 MsgTypeReportAny 时调用 */
+func AddReport(msg string) {
+	fields := make(map[string]string)
+	for _, m := range reportFieldRe.FindAllStringSubmatch(msg, -1) {
+		fields[m[1]] = m[2]
+	}
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	reports = append(reports, fields)
+}
+
+func GetReconfigSummary() ReconfigSummary {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	var s ReconfigSummary
+	var syncTime, syncWire float64
+	for _, fields := range reports {
+		switch fields["msgType"] {
+		case "endReconfig":
+			s.Rounds++
+		case "lesssync", "fastsync", "fullsync", "tMPTsync":
+			s.Syncs++
+			t, _ := strconv.ParseFloat(fields["sync time"], 64)
+			w, _ := strconv.ParseFloat(fields["sync wire(bytes)"], 64)
+			syncTime += t
+			syncWire += w
+		}
+	}
+	if s.Syncs > 0 {
+		s.AvgSyncTimeMs = syncTime / float64(s.Syncs)
+		s.AvgSyncWireBytes = syncWire / float64(s.Syncs)
+	}
+	return s
+}
+
+/* 一类交易或一个分片的信标链开销 */
+type GasStat struct {
+	Txs          int     // 交易数，一笔批量交易在它提交了信标的每个分片各计一次
+	TBs          int     // 提交的信标数，即上链的分片区块数
+	GasUsed      uint64  // 批量交易的 gas 按信标数分摊到各分片
+	FeeGwei      float64 // gasUsed * 实际 gas 价格
+	AvgLatencyMs float64 // 从发送交易到被打包的平均时延
+	Failed       int     // 执行失败（revert）的交易数，其 gas 也计入开销
+}
+
+/* 信标链交互开销的统计，节点在交易被打包后发送 msgType 为 gas 的报告，格式见 beaconChain/cost.go */
+type GasSummary struct {
+	Total   GasStat
+	ByType  map[string]*GasStat `json:",omitempty"`
+	ByShard map[uint32]*GasStat `json:",omitempty"`
+	// 全部开销（含部署和调整地址）除以上链的分片区块数、已完成的交易数
+	GasPerShardBlock float64
+	FeePerShardBlock float64 // gwei
+	GasPerTx         float64
+	FeePerTx         float64 // gwei
+}
+
+func (s *GasStat) add(gas uint64, feeGwei float64, latencyMs float64, tbs int, failed bool) {
+	// 先还原总时延再加入本笔交易
+	total := s.AvgLatencyMs * float64(s.Txs)
+	s.Txs++
+	s.TBs += tbs
+	s.GasUsed += gas
+	s.FeeGwei += feeGwei
+	s.AvgLatencyMs = (total + latencyMs) / float64(s.Txs)
+	if failed {
+		s.Failed++
+	}
+}
+
+/* 解析 "0=3,1=5" 形式的每分片信标数，"-" 表示没有提交信标 */
+func parseShardTBs(v string) map[uint32]int {
+	m := make(map[uint32]int)
+	if v == "" || v == "-" {
+		return m
+	}
+	for _, kv := range strings.Split(v, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		s, err1 := strconv.ParseUint(parts[0], 10, 32)
+		n, err2 := strconv.Atoi(parts[1])
+		if err1 == nil && err2 == nil {
+			m[uint32(s)] += n
+		}
+	}
+	return m
+}
+
+/* 汇总收到的开销报告，没有报告时（模拟信标链）各项为0 */
+func GetGasSummary() GasSummary {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	s := GasSummary{ByType: make(map[string]*GasStat), ByShard: make(map[uint32]*GasStat)}
+	for _, fields := range reports {
+		if fields["msgType"] != "gas" {
+			continue
+		}
+		gas, _ := strconv.ParseUint(fields["gas used"], 10, 64)
+		price, ok := new(big.Float).SetString(fields["gas price(wei)"])
+		if !ok {
+			price = new(big.Float)
+		}
+		fee, _ := new(big.Float).Quo(new(big.Float).Mul(price, new(big.Float).SetUint64(gas)), big.NewFloat(1e9)).Float64()
+		latency, _ := strconv.ParseFloat(fields["latency"], 64)
+		failed := fields["status"] == "0"
+		shardTBs := parseShardTBs(fields["shard tbs"])
+		tbs := 0
+		for _, n := range shardTBs {
+			tbs += n
+		}
+
+		s.Total.add(gas, fee, latency, tbs, failed)
+		txType := fields["txType"]
+		if s.ByType[txType] == nil {
+			s.ByType[txType] = &GasStat{}
+		}
+		s.ByType[txType].add(gas, fee, latency, tbs, failed)
+
+		if len(shardTBs) == 0 {
+			// 调整地址的交易归属于发送它的委员会，部署交易的 shardID 为 -1，不归属于任何分片
+			shardID, err := strconv.ParseUint(fields["shardID"], 10, 32)
+			if err == nil {
+				shardTBs[uint32(shardID)] = 0
+			}
+		}
+		for shardID, n := range shardTBs {
+			share := 1.0
+			if tbs > 0 {
+				share = float64(n) / float64(tbs)
+			}
+			if s.ByShard[shardID] == nil {
+				s.ByShard[shardID] = &GasStat{}
+			}
+			s.ByShard[shardID].add(uint64(float64(gas)*share), fee*share, latency, n, failed)
+		}
+	}
+	if s.Total.TBs > 0 {
+		s.GasPerShardBlock = float64(s.Total.GasUsed) / float64(s.Total.TBs)
+		s.FeePerShardBlock = s.Total.FeeGwei / float64(s.Total.TBs)
+	}
+	if res.allComplished > 0 {
+		s.GasPerTx = float64(s.Total.GasUsed) / float64(res.allComplished)
+		s.FeePerTx = s.Total.FeeGwei / float64(res.allComplished)
+	}
+	return s
+}
@@ -217,8 +217,11 @@ func GetThroughtPutAndLatencyV2() (float64, float64, float64, []int) {
 
 	averageLatency := float64(sum) / float64(res.allComplished)
 	log.Info("average latency: " + fmt.Sprint(averageLatency))
-	log.Info("max latency: "+fmt.Sprint(max_latency), "txid", max_latency_id, "txStatus", getStatusListStr(res.AllTXStatus[max_latency_id]))
-	log.Info("min latency: "+fmt.Sprint(min_latency), "txid", min_latency_id, "txStatus", getStatusListStr(res.AllTXStatus[min_latency_id]))
+	// 提前中断时可能没有执行完成的交易
+	if max_latency_id >= 0 {
+		log.Info("max latency: "+fmt.Sprint(max_latency), "txid", max_latency_id, "txStatus", getStatusListStr(res.AllTXStatus[max_latency_id]))
+		log.Info("min latency: "+fmt.Sprint(min_latency), "txid", min_latency_id, "txStatus", getStatusListStr(res.AllTXStatus[min_latency_id]))
+	}
 
 	log.Info("output workload: " + fmt.Sprint(res.WorkLoad) + " (TXs)")
 	keys := make([]int, 0, len(res.workload4shard))
@@ -28,7 +28,7 @@ func getHash(val []byte) []byte {
 	return hasher.Sum(nil)
 }
 
-func (s *Shard) HandleComGetState(request *core.ComGetState) {
+func (s *Shard) HandleComGetState(request *core.ComGetState) *core.ShardSendState {
 	stateDB := s.blockchain.GetStateDB()
 	// 先看看stateDB中有没有对应账户的节点，没有则先创建节点并更新trie
 	for _, address := range request.AddrList {
@@ -42,7 +42,7 @@ func (s *Shard) HandleComGetState(request *core.ComGetState) {
 	trie, err := trie.NewSecure(root, database)
 	if err != nil {
 		log.Error("trie.NewSecure error", "err", err, "trieRoot", root)
-		return
+		return nil
 	}
 
 	accountsData := make(map[common.Address][]byte)
@@ -84,7 +84,7 @@ func (s *Shard) HandleComGetState(request *core.ComGetState) {
 		Height:         s.blockchain.CurrentBlock().Number(),
 	}
 
-	s.messageHub.Send(core.MsgTypeShardSendStateToCom, request.From_comID, response, nil)
+	return response
 }
 
 func (s *Shard) HandleComGetHeight(request *core.ComGetHeight) *big.Int {
@@ -96,6 +96,11 @@ func (s *Shard) HandleComGetHeight(request *core.ComGetHeight) *big.Int {
 若两者相等，说明委员会由merkle proof rebuild得到的树根是正确的
 */
 func (s *Shard) HandleComSendBlock(data *core.ComSendBlock) {
+	if !s.beginBlock() {
+		log.Warn("shard closed, drop block", "height", data.Block.Header.Number)
+		return
+	}
+	defer s.inflight.Done()
 	block := data.Block
 	s.AddBlock(block)
 
@@ -8,6 +8,7 @@ import (
 	"go-w3chain/log"
 	"go-w3chain/node"
 	"math/big"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -35,6 +36,10 @@ type Shard struct {
 
 	// 同步模式是fastsync时，同步的区块数量
 	fastsyncBlockNum int
+
+	closeLock sync.Mutex
+	closed    bool
+	inflight  sync.WaitGroup // 正在执行的区块，关闭时等待其完成
 }
 
 func (s *Shard) AddInitialAddr(addr common.Address, nodeID uint32) {
@@ -113,8 +118,27 @@ func (s *Shard) Start() {
 	s.addGenesisTB()
 }
 
+/* 停止接收新区块，等待正在执行的区块写入数据库，之后节点才能关闭数据库 */
 func (s *Shard) Close() {
-	// todo: fill it
+	s.closeLock.Lock()
+	s.closed = true
+	s.closeLock.Unlock()
+	s.inflight.Wait()
+	if err := s.blockchain.Flush(); err != nil {
+		log.Warn("flush blockchain fail", "shardID", s.GetShardID(), "err", err)
+	}
+	log.Debug("shard closed", "shardID", s.GetShardID(), "height", s.GetChainHeight())
+}
+
+/* 开始执行一个区块，分片已关闭时返回 false */
+func (s *Shard) beginBlock() bool {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
 }
 
 /**
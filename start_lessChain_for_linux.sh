@@ -4,13 +4,6 @@
 SCRIPT_DIR="$( cd "$( dirname "$0" )" && pwd )"
 GETH_DIR="$SCRIPT_DIR/eth_chain/geth-chain-data"
 
-# 从配置文件中读取值
-CONFIG_FILE="$SCRIPT_DIR/cfg/debug.json"
-SHARD_NUM=$(jq .ShardNum $CONFIG_FILE)
-SHARD_ALL_NODE_NUM=$(jq .ComAllNodeNum $CONFIG_FILE)
-MACHINE_NUM=$(jq .MachineNum $CONFIG_FILE)
-SHARD_START_INDEX=$(jq .ShardStartIndex $CONFIG_FILE)
-ROLE=$(jq -r .Role $CONFIG_FILE)
 # 如果系统上的go版本大于等于1.17，则直接使用，否则安装go1.21
 ## 检查系统是否安装 Go 以及 Go 版本是否大于等于 1.17
 if ! go version &> /dev/null || [[ "$(go version | awk '{print $3}')" < "go1.17" ]]; then
@@ -40,6 +33,22 @@ fi
 echo "Go 版本：$(go version)"
 GO=go
 
+# 编译后从生效的配置中读取值：配置文件可以用 CONFIG_FILE 指定，
+# 各字段可以用 LESSCHAIN_<字段名> 环境变量覆写，如 LESSCHAIN_SHARDSTARTINDEX=1 ./start_lessChain_for_linux.sh，
+# 这些环境变量同样传给下面启动的各进程。
+# 下面的 -r/-S/-s/-n 只覆写对应的字段，没有给出的参数（如 booter 和 client 的 -s/-n）使用配置文件中的值，
+# 不再是命令行参数的默认值
+CONFIG_FILE="${CONFIG_FILE:-$SCRIPT_DIR/cfg/debug.json}"
+$GO build -o ./lessChain || exit 1
+read_cfg() {
+    ./lessChain config -c "$CONFIG_FILE" "$1" || exit 1
+}
+SHARD_NUM=$(read_cfg ShardNum)
+SHARD_ALL_NODE_NUM=$(read_cfg ComAllNodeNum)
+MACHINE_NUM=$(read_cfg MachineNum)
+SHARD_START_INDEX=$(read_cfg ShardStartIndex)
+ROLE=$(read_cfg Role)
+
 if [ "$ROLE" != "node" ]
 then
     # 启动geth、booteer和client
@@ -56,26 +65,25 @@ then
 
     # 启动其他终端并运行相应的命令
     echo "Starting booter..."
-    screen -d -m bash -c "$GO build -o ./lessChain && ./lessChain -r booter -S $SHARD_NUM; tail -f /dev/null"
+    screen -d -m bash -c "./lessChain -c $CONFIG_FILE -r booter -S $SHARD_NUM; tail -f /dev/null"
     sleep 5
 
     echo "Starting client..."
-    screen -d -m bash -c "./lessChain -r client -S $SHARD_NUM; tail -f /dev/null"
+    screen -d -m bash -c "./lessChain -c $CONFIG_FILE -r client -S $SHARD_NUM; tail -f /dev/null"
     sleep 1
 else
-    $GO build -o ./lessChain
     sleep 5
     # 启动分片节点
     for ((j=0;j<$((SHARD_NUM / MACHINE_NUM));j++));
     do
         shardIndex=$((SHARD_START_INDEX + MACHINE_NUM * j))
         echo "Starting node S$shardIndex N0..."
-        screen -d -m bash -c "./lessChain -r node -S $SHARD_NUM -s $shardIndex -n 0; tail -f /dev/null"
+        screen -d -m bash -c "./lessChain -c $CONFIG_FILE -r node -S $SHARD_NUM -s $shardIndex -n 0; tail -f /dev/null"
         sleep 2
         for ((i=1;i<$SHARD_ALL_NODE_NUM;i++));
         do
             echo "Starting node S$shardIndex N$i..."
-            screen -d -m bash -c "./lessChain -r node -S $SHARD_NUM -s $shardIndex -n $i; tail -f /dev/null"
+            screen -d -m bash -c "./lessChain -c $CONFIG_FILE -r node -S $SHARD_NUM -s $shardIndex -n $i; tail -f /dev/null"
             sleep 0.2
         done
     done
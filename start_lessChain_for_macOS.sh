@@ -16,6 +16,8 @@ get_window_position() {
 }
 
 # 使用循环启动终端并设置每个窗口的位置
+# 各进程使用 cfg/debug.json，下面的 -r/-S/-s/-n 只覆写对应的字段，其余参数（包括每个分片的节点数 ComAllNodeNum）
+# 取自配置文件，不再使用命令行参数的默认值；SHARD_ALL_NODE_NUM 需与配置中的 ComAllNodeNum 一致
 counter=0
 SHARD_NUM=2
 SHARD_ALL_NODE_NUM=8
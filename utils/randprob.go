@@ -16,6 +16,10 @@ func SetSeed1() {
 	rand.Seed(1)
 }
 
+func SetSeed(seed int64) {
+	rand.Seed(seed)
+}
+
 func SetTimeNowSeed() {
 	rand.Seed(time.Now().UnixNano())
 }